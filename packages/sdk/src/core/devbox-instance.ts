@@ -531,11 +531,11 @@ export class DevboxInstance {
    * Download multiple files with format options
    * @param paths Array of file paths to download
    * @param options Download options including format
-   * @returns Buffer containing downloaded files (tar.gz, tar, or multipart format)
+   * @returns Buffer containing downloaded files (tar.gz, tar, zip, or multipart format)
    */
   async downloadFiles(
     paths: string[],
-    options?: { format?: 'tar.gz' | 'tar' | 'multipart' | 'direct' }
+    options?: { format?: 'tar.gz' | 'tar' | 'zip' | 'multipart' | 'direct' }
   ): Promise<Buffer> {
     if (!paths || paths.length === 0) {
       throw new Error('At least one file path is required')
@@ -558,6 +558,9 @@ export class DevboxInstance {
           case 'tar':
             headers.Accept = 'application/x-tar'
             break
+          case 'zip':
+            headers.Accept = 'application/zip'
+            break
           case 'multipart':
             headers.Accept = 'multipart/mixed'
             break
@@ -281,7 +281,7 @@ export type RenameFileResponse = Record<string, never>
 // File download options
 export interface DownloadFileOptions {
   paths: string[]
-  format?: 'tar.gz' | 'tar' | 'multipart' | 'direct'
+  format?: 'tar.gz' | 'tar' | 'zip' | 'multipart' | 'direct'
 }
 
 // File search options (by filename)
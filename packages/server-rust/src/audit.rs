@@ -0,0 +1,260 @@
+//! Command execution audit log.
+//!
+//! When `AUDIT_LOG` is configured every command execution (async, sync,
+//! streaming, scripts, session exec and WebSocket session input) is appended
+//! to the file as one JSON object per line. Environment values whose names look like secrets are
+//! redacted before they are written.
+
+use crate::middleware::logging::TraceId;
+use crate::state::AppState;
+use axum::extract::{ConnectInfo, FromRequestParts};
+use axum::http::{request::Parts, HeaderMap};
+use serde::Serialize;
+use std::collections::HashMap;
+use std::convert::Infallible;
+use std::net::SocketAddr;
+use std::path::Path;
+use std::sync::Arc;
+use tokio::io::AsyncWriteExt;
+use tokio::sync::Mutex;
+
+const REDACTED: &str = "[REDACTED]";
+
+/// Substrings that mark an environment variable name as secret
+const SECRET_ENV_MARKERS: &[&str] = &[
+    "SECRET",
+    "TOKEN",
+    "PASSWORD",
+    "PASSWD",
+    "KEY",
+    "CREDENTIAL",
+    "AUTH",
+];
+
+/// Request metadata recorded alongside each audited command.
+#[derive(Debug, Clone, Default)]
+pub struct AuditContext {
+    pub client_ip: Option<String>,
+    pub trace_id: Option<String>,
+}
+
+/// Client address: taken from `X-Forwarded-For` or `X-Real-IP` only behind a
+/// trusted proxy (`TRUST_FORWARDED_FOR`), since any caller can set them.
+fn client_ip(
+    headers: &HeaderMap,
+    peer: Option<SocketAddr>,
+    trust_forwarded_for: bool,
+) -> Option<String> {
+    let header = |name: &str| {
+        headers
+            .get(name)
+            .and_then(|v| v.to_str().ok())
+            .map(str::trim)
+            .filter(|v| !v.is_empty())
+    };
+
+    let forwarded = trust_forwarded_for
+        .then(|| {
+            header("x-forwarded-for")
+                .and_then(|v| v.split(',').next())
+                .map(|v| v.trim().to_string())
+                .or_else(|| header("x-real-ip").map(str::to_string))
+        })
+        .flatten();
+    forwarded.or_else(|| peer.map(|addr| addr.ip().to_string()))
+}
+
+impl FromRequestParts<Arc<AppState>> for AuditContext {
+    type Rejection = Infallible;
+
+    async fn from_request_parts(
+        parts: &mut Parts,
+        state: &Arc<AppState>,
+    ) -> Result<Self, Self::Rejection> {
+        let peer = parts
+            .extensions
+            .get::<ConnectInfo<SocketAddr>>()
+            .map(|ConnectInfo(addr)| *addr);
+        let client_ip = client_ip(&parts.headers, peer, state.config.trust_forwarded_for);
+
+        let trace_id = TraceId::from_request_parts(parts, state)
+            .await
+            .ok()
+            .map(|id| id.0);
+
+        Ok(AuditContext {
+            client_ip,
+            trace_id,
+        })
+    }
+}
+
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+pub struct AuditEntry<'a> {
+    pub timestamp: String,
+    pub kind: &'a str,
+    pub command: &'a str,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub args: Option<&'a [String]>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub cwd: Option<&'a str>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub env: Option<HashMap<&'a str, &'a str>>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub session_id: Option<&'a str>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub client_ip: Option<&'a str>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub trace_id: Option<&'a str>,
+}
+
+impl<'a> AuditEntry<'a> {
+    pub fn new(kind: &'a str, command: &'a str, ctx: &'a AuditContext) -> Self {
+        let secs = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)
+            .unwrap_or_default()
+            .as_secs();
+        AuditEntry {
+            timestamp: crate::utils::common::format_time(secs),
+            kind,
+            command,
+            args: None,
+            cwd: None,
+            env: None,
+            session_id: None,
+            client_ip: ctx.client_ip.as_deref(),
+            trace_id: ctx.trace_id.as_deref(),
+        }
+    }
+
+    pub fn args(mut self, args: Option<&'a Vec<String>>) -> Self {
+        self.args = args.map(|a| a.as_slice());
+        self
+    }
+
+    pub fn cwd(mut self, cwd: Option<&'a String>) -> Self {
+        self.cwd = cwd.map(|c| c.as_str());
+        self
+    }
+
+    pub fn env(mut self, env: Option<&'a HashMap<String, String>>) -> Self {
+        self.env = env.map(redact_env);
+        self
+    }
+
+    pub fn session_id(mut self, id: &'a str) -> Self {
+        self.session_id = Some(id);
+        self
+    }
+}
+
+/// Append-only JSON lines audit log; a no-op when no path is configured.
+pub struct AuditLog {
+    file: Option<Mutex<tokio::fs::File>>,
+}
+
+impl AuditLog {
+    pub fn open(path: Option<&Path>) -> Self {
+        let file = path.and_then(|p| {
+            match std::fs::OpenOptions::new()
+                .create(true)
+                .append(true)
+                .open(p)
+            {
+                Ok(f) => Some(Mutex::new(tokio::fs::File::from_std(f))),
+                Err(e) => {
+                    println!("Warning: failed to open audit log {:?}: {}", p, e);
+                    None
+                }
+            }
+        });
+        AuditLog { file }
+    }
+
+    pub async fn record(&self, entry: AuditEntry<'_>) {
+        let Some(file) = &self.file else {
+            return;
+        };
+        let mut line = match serde_json::to_string(&entry) {
+            Ok(l) => l,
+            Err(e) => {
+                println!("Failed to serialize audit entry: {}", e);
+                return;
+            }
+        };
+        line.push('\n');
+
+        let mut file = file.lock().await;
+        if let Err(e) = file.write_all(line.as_bytes()).await {
+            println!("Failed to write audit entry: {}", e);
+            return;
+        }
+        if let Err(e) = file.flush().await {
+            println!("Failed to flush audit log: {}", e);
+        }
+    }
+}
+
+fn is_secret_env_key(key: &str) -> bool {
+    let upper = key.to_ascii_uppercase();
+    SECRET_ENV_MARKERS.iter().any(|m| upper.contains(m))
+}
+
+fn redact_env(env: &HashMap<String, String>) -> HashMap<&str, &str> {
+    env.iter()
+        .map(|(k, v)| {
+            let value = if is_secret_env_key(k) {
+                REDACTED
+            } else {
+                v.as_str()
+            };
+            (k.as_str(), value)
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_redact_env() {
+        let mut env = HashMap::new();
+        env.insert("PATH".to_string(), "/usr/bin".to_string());
+        env.insert("GITHUB_TOKEN".to_string(), "ghp_xxx".to_string());
+        env.insert("db_password".to_string(), "hunter2".to_string());
+        env.insert("AWS_SECRET_ACCESS_KEY".to_string(), "abc".to_string());
+
+        let redacted = redact_env(&env);
+        assert_eq!(redacted["PATH"], "/usr/bin");
+        assert_eq!(redacted["GITHUB_TOKEN"], REDACTED);
+        assert_eq!(redacted["db_password"], REDACTED);
+        assert_eq!(redacted["AWS_SECRET_ACCESS_KEY"], REDACTED);
+    }
+
+    #[test]
+    fn test_client_ip() {
+        let mut headers = HeaderMap::new();
+        headers.insert("x-forwarded-for", "203.0.113.7, 10.0.0.1".parse().unwrap());
+        let peer = Some(SocketAddr::from(([10, 0, 0, 1], 4000)));
+
+        // Forged headers are ignored unless the proxy is trusted
+        assert_eq!(
+            client_ip(&headers, peer, false).as_deref(),
+            Some("10.0.0.1")
+        );
+        assert_eq!(
+            client_ip(&headers, peer, true).as_deref(),
+            Some("203.0.113.7")
+        );
+
+        let mut headers = HeaderMap::new();
+        headers.insert("x-real-ip", "203.0.113.8".parse().unwrap());
+        assert_eq!(
+            client_ip(&headers, peer, true).as_deref(),
+            Some("203.0.113.8")
+        );
+        assert_eq!(client_ip(&HeaderMap::new(), None, true), None);
+    }
+}
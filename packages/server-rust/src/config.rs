@@ -16,6 +16,117 @@ pub struct Config {
 
     /// Maximum concurrent file reads for search and replace operations
     pub max_concurrent_reads: usize,
+
+    /// Shell used for sessions that do not request one explicitly
+    pub default_shell: String,
+
+    /// Directory for temporary upload files (defaults to the destination directory)
+    pub temp_dir: Option<PathBuf>,
+
+    /// Reject all mutating requests (read-only preview mode)
+    pub read_only: bool,
+
+    /// Deleted paths are moved here instead of being removed (permanent deletes when unset)
+    pub trash_dir: Option<PathBuf>,
+
+    /// File receiving the command execution audit log (disabled when unset)
+    pub audit_log: Option<PathBuf>,
+
+    /// PATH given to spawned processes instead of the server's own PATH
+    pub default_exec_path: Option<String>,
+
+    /// Maximum directory depth for recursive walks (archives, search, chmod)
+    pub max_traversal_depth: usize,
+
+    /// Wrap successful JSON responses in the status/message envelope
+    pub response_envelope: bool,
+
+    /// Share one result between identical concurrent stat/hash requests
+    pub coalesce_reads: bool,
+
+    /// Maximum number of files accepted by a single batch upload
+    pub max_batch_files: usize,
+
+    /// Maximum combined size in bytes of a single batch upload
+    pub max_batch_size: u64,
+
+    /// Maximum number of batch upload files moved into place concurrently
+    pub max_upload_concurrency: usize,
+
+    /// Max request body size in bytes, except for file uploads
+    pub max_body_size: u64,
+
+    /// Max file size in bytes returned inline by JSON/base64 reads
+    pub max_read_size: u64,
+
+    /// PEM certificate chain served over TLS (plain HTTP when unset)
+    pub tls_cert_file: Option<PathBuf>,
+
+    /// PEM private key for `tls_cert_file`
+    pub tls_key_file: Option<PathBuf>,
+
+    /// PEM CA bundle; when set, clients must present a certificate signed by it
+    pub client_ca_file: Option<PathBuf>,
+
+    /// Hardlink uploads with identical content to one stored blob
+    pub dedup: bool,
+
+    /// Blob store for `dedup`; must be outside the workspace but on its
+    /// filesystem (defaults to `.devbox-dedup` next to the workspace)
+    pub dedup_dir: Option<PathBuf>,
+
+    /// Path prefixes that file operations may read but not modify
+    pub read_only_paths: Vec<PathBuf>,
+
+    /// Glob patterns of workspace-relative paths no file operation may access
+    pub denied_paths: Vec<String>,
+
+    /// Number of output lines kept per process
+    pub max_log_lines: usize,
+
+    /// Longest process output line in bytes; longer lines are truncated
+    pub max_log_line_bytes: usize,
+
+    /// Most stdout or stderr bytes `exec-sync` and `run-script` keep per stream
+    pub max_output_bytes: usize,
+
+    /// Kill `exec-sync` and `run-script` commands whose output exceeds `max_output_bytes`
+    /// instead of discarding the rest until they finish
+    pub kill_on_output_limit: bool,
+
+    /// Requests per second allowed per client (unlimited when unset)
+    pub rate_limit: Option<f64>,
+
+    /// Requests a client may make in a burst above `rate_limit`
+    pub rate_limit_burst: u32,
+
+    /// Identify clients by the first `X-Forwarded-For` address (behind a proxy)
+    pub trust_forwarded_for: bool,
+
+    /// Browser origins allowed to call the API (`*` for any; CORS off when empty)
+    pub cors_allowed_origins: Vec<String>,
+
+    /// Methods announced to browsers in CORS preflight responses
+    pub cors_allowed_methods: Vec<String>,
+
+    /// Origins allowed to open WebSocket connections (`*` for any)
+    pub ws_allowed_origins: Vec<String>,
+
+    /// Close WebSocket clients whose send queue is full instead of dropping
+    /// their oldest log messages
+    pub ws_disconnect_slow_clients: bool,
+
+    /// Seconds a session may go unused before it is terminated (never when unset)
+    pub session_idle_timeout: Option<u64>,
+
+    /// Bytes the workspace may occupy; writes that would exceed it are rejected
+    pub workspace_quota: Option<u64>,
+
+    /// Seconds in-flight requests get to finish after a shutdown signal
+    pub shutdown_timeout: u64,
+
+    /// Seconds an SSE stream may stay silent before a keep-alive comment is sent
+    pub sse_keepalive_interval: u64,
 }
 
 impl Config {
@@ -37,6 +148,129 @@ impl Config {
             .and_then(|s| s.parse().ok())
             .unwrap_or(4);
 
+        let mut default_shell =
+            std::env::var("DEFAULT_SHELL").unwrap_or_else(|_| "/bin/bash".to_string());
+
+        let mut temp_dir = std::env::var("TEMP_DIR").ok().map(PathBuf::from);
+
+        let mut read_only = std::env::var("READ_ONLY")
+            .map(|v| v == "true" || v == "1")
+            .unwrap_or(false);
+
+        let mut trash_dir = std::env::var("TRASH_DIR").ok().map(PathBuf::from);
+
+        let mut audit_log = std::env::var("AUDIT_LOG").ok().map(PathBuf::from);
+
+        let mut default_exec_path = std::env::var("DEFAULT_EXEC_PATH").ok();
+
+        let mut max_traversal_depth = std::env::var("MAX_TRAVERSAL_DEPTH")
+            .ok()
+            .and_then(|s| s.parse().ok())
+            .unwrap_or(64);
+
+        let mut response_envelope = std::env::var("RESPONSE_ENVELOPE")
+            .map(|v| v != "false" && v != "0")
+            .unwrap_or(true);
+
+        let mut coalesce_reads = std::env::var("COALESCE_READS")
+            .map(|v| v != "false" && v != "0")
+            .unwrap_or(true);
+
+        let mut max_batch_files = std::env::var("MAX_BATCH_FILES")
+            .ok()
+            .and_then(|s| s.parse().ok())
+            .unwrap_or(1000);
+
+        let mut max_batch_size = std::env::var("MAX_BATCH_SIZE")
+            .ok()
+            .and_then(|s| s.parse().ok())
+            .unwrap_or(1024 * 1024 * 1024); // 1GB
+
+        let mut max_upload_concurrency = std::env::var("MAX_UPLOAD_CONCURRENCY")
+            .ok()
+            .and_then(|s| s.parse().ok())
+            .unwrap_or(4);
+
+        let mut max_body_size = std::env::var("MAX_BODY_SIZE")
+            .ok()
+            .and_then(|s| s.parse().ok())
+            .unwrap_or(2 * 1024 * 1024); // 2MB
+
+        let mut max_read_size = std::env::var("MAX_READ_SIZE")
+            .ok()
+            .and_then(|s| s.parse().ok())
+            .unwrap_or(10 * 1024 * 1024); // 10MB
+
+        let mut tls_cert_file = std::env::var("TLS_CERT_FILE").ok().map(PathBuf::from);
+        let mut tls_key_file = std::env::var("TLS_KEY_FILE").ok().map(PathBuf::from);
+        let mut client_ca_file = std::env::var("CLIENT_CA_FILE").ok().map(PathBuf::from);
+
+        let mut dedup = std::env::var("DEDUP")
+            .map(|v| v == "true" || v == "1")
+            .unwrap_or(false);
+        let mut dedup_dir = std::env::var("DEDUP_DIR").ok().map(PathBuf::from);
+
+        let mut read_only_paths = std::env::var("READ_ONLY_PATHS").unwrap_or_default();
+        let mut denied_paths = std::env::var("DENIED_PATHS").unwrap_or_default();
+
+        let mut max_log_lines = std::env::var("MAX_LOG_LINES")
+            .ok()
+            .and_then(|s| s.parse().ok())
+            .unwrap_or(10000);
+
+        let mut max_log_line_bytes = std::env::var("MAX_LOG_LINE_BYTES")
+            .ok()
+            .and_then(|s| s.parse().ok())
+            .unwrap_or(1024 * 1024); // 1MB
+
+        let mut max_output_bytes = std::env::var("MAX_OUTPUT_BYTES")
+            .ok()
+            .and_then(|s| s.parse().ok())
+            .unwrap_or(16 * 1024 * 1024); // 16MB
+        let mut kill_on_output_limit = std::env::var("KILL_ON_OUTPUT_LIMIT")
+            .map(|v| v == "true" || v == "1")
+            .unwrap_or(false);
+
+        let mut rate_limit: Option<f64> = std::env::var("RATE_LIMIT")
+            .ok()
+            .and_then(|s| s.parse().ok());
+        let mut rate_limit_burst: Option<u32> = std::env::var("RATE_LIMIT_BURST")
+            .ok()
+            .and_then(|s| s.parse().ok());
+        let mut trust_forwarded_for = std::env::var("TRUST_FORWARDED_FOR")
+            .map(|v| v == "true" || v == "1")
+            .unwrap_or(false);
+
+        let mut cors_allowed_origins = std::env::var("CORS_ALLOWED_ORIGINS").unwrap_or_default();
+        let mut cors_allowed_methods = std::env::var("CORS_ALLOWED_METHODS")
+            .unwrap_or_else(|_| "GET,POST,PUT,PATCH,DELETE,OPTIONS".to_string());
+
+        let mut ws_allowed_origins =
+            std::env::var("WS_ALLOWED_ORIGINS").unwrap_or_else(|_| "*".to_string());
+        let mut ws_disconnect_slow_clients = std::env::var("WS_DISCONNECT_SLOW_CLIENTS")
+            .map(|v| v == "true" || v == "1")
+            .unwrap_or(false);
+
+        let mut session_idle_timeout = std::env::var("SESSION_IDLE_TIMEOUT")
+            .ok()
+            .and_then(|s| s.parse().ok());
+
+        let mut workspace_quota = std::env::var("WORKSPACE_QUOTA")
+            .ok()
+            .and_then(|s| s.parse().ok());
+
+        let mut shutdown_timeout = std::env::var("SHUTDOWN_TIMEOUT")
+            .ok()
+            .and_then(|s| s.parse().ok())
+            .unwrap_or(30);
+
+        // Zero would flood the stream with comments
+        let mut sse_keepalive_interval = std::env::var("SSE_KEEPALIVE_INTERVAL")
+            .ok()
+            .and_then(|s| s.parse().ok())
+            .filter(|&secs| secs > 0)
+            .unwrap_or(15);
+
         // Check command line args for overrides (simple implementation)
         for arg in std::env::args() {
             if arg.starts_with("--addr=") {
@@ -53,9 +287,154 @@ impl Config {
                 if let Ok(reads) = arg.trim_start_matches("--max-concurrent-reads=").parse::<usize>() {
                     max_concurrent_reads = reads;
                 }
+            } else if arg.starts_with("--default-shell=") {
+                default_shell = arg.trim_start_matches("--default-shell=").to_string();
+            } else if arg.starts_with("--temp-dir=") {
+                temp_dir = Some(PathBuf::from(arg.trim_start_matches("--temp-dir=")));
+            } else if arg == "--read-only" {
+                read_only = true;
+            } else if arg.starts_with("--trash-dir=") {
+                trash_dir = Some(PathBuf::from(arg.trim_start_matches("--trash-dir=")));
+            } else if arg.starts_with("--audit-log=") {
+                audit_log = Some(PathBuf::from(arg.trim_start_matches("--audit-log=")));
+            } else if arg.starts_with("--default-exec-path=") {
+                default_exec_path =
+                    Some(arg.trim_start_matches("--default-exec-path=").to_string());
+            } else if arg.starts_with("--max-traversal-depth=") {
+                if let Ok(depth) = arg.trim_start_matches("--max-traversal-depth=").parse() {
+                    max_traversal_depth = depth;
+                }
+            } else if arg.starts_with("--response-envelope=") {
+                let value = arg.trim_start_matches("--response-envelope=");
+                response_envelope = value != "false" && value != "0";
+            } else if arg.starts_with("--coalesce-reads=") {
+                let value = arg.trim_start_matches("--coalesce-reads=");
+                coalesce_reads = value != "false" && value != "0";
+            } else if arg.starts_with("--max-batch-files=") {
+                if let Ok(files) = arg.trim_start_matches("--max-batch-files=").parse() {
+                    max_batch_files = files;
+                }
+            } else if arg.starts_with("--max-batch-size=") {
+                if let Ok(size) = arg.trim_start_matches("--max-batch-size=").parse() {
+                    max_batch_size = size;
+                }
+            } else if arg.starts_with("--max-upload-concurrency=") {
+                if let Ok(n) = arg.trim_start_matches("--max-upload-concurrency=").parse() {
+                    max_upload_concurrency = n;
+                }
+            } else if arg.starts_with("--max-body-size=") {
+                if let Ok(size) = arg.trim_start_matches("--max-body-size=").parse() {
+                    max_body_size = size;
+                }
+            } else if arg.starts_with("--max-read-size=") {
+                if let Ok(size) = arg.trim_start_matches("--max-read-size=").parse() {
+                    max_read_size = size;
+                }
+            } else if arg.starts_with("--tls-cert-file=") {
+                tls_cert_file = Some(PathBuf::from(arg.trim_start_matches("--tls-cert-file=")));
+            } else if arg.starts_with("--tls-key-file=") {
+                tls_key_file = Some(PathBuf::from(arg.trim_start_matches("--tls-key-file=")));
+            } else if arg.starts_with("--client-ca-file=") {
+                client_ca_file = Some(PathBuf::from(arg.trim_start_matches("--client-ca-file=")));
+            } else if arg == "--dedup" {
+                dedup = true;
+            } else if arg.starts_with("--dedup-dir=") {
+                dedup_dir = Some(PathBuf::from(arg.trim_start_matches("--dedup-dir=")));
+            } else if arg.starts_with("--read-only-paths=") {
+                read_only_paths = arg.trim_start_matches("--read-only-paths=").to_string();
+            } else if arg.starts_with("--denied-paths=") {
+                denied_paths = arg.trim_start_matches("--denied-paths=").to_string();
+            } else if arg.starts_with("--max-log-lines=") {
+                if let Ok(n) = arg.trim_start_matches("--max-log-lines=").parse() {
+                    max_log_lines = n;
+                }
+            } else if arg.starts_with("--max-log-line-bytes=") {
+                if let Ok(size) = arg.trim_start_matches("--max-log-line-bytes=").parse() {
+                    max_log_line_bytes = size;
+                }
+            } else if arg.starts_with("--max-output-bytes=") {
+                if let Ok(size) = arg.trim_start_matches("--max-output-bytes=").parse() {
+                    max_output_bytes = size;
+                }
+            } else if arg == "--kill-on-output-limit" {
+                kill_on_output_limit = true;
+            } else if arg.starts_with("--rate-limit=") {
+                if let Ok(n) = arg.trim_start_matches("--rate-limit=").parse() {
+                    rate_limit = Some(n);
+                }
+            } else if arg.starts_with("--rate-limit-burst=") {
+                if let Ok(n) = arg.trim_start_matches("--rate-limit-burst=").parse() {
+                    rate_limit_burst = Some(n);
+                }
+            } else if arg == "--trust-forwarded-for" {
+                trust_forwarded_for = true;
+            } else if arg.starts_with("--cors-allowed-origins=") {
+                cors_allowed_origins = arg
+                    .trim_start_matches("--cors-allowed-origins=")
+                    .to_string();
+            } else if arg.starts_with("--cors-allowed-methods=") {
+                cors_allowed_methods = arg
+                    .trim_start_matches("--cors-allowed-methods=")
+                    .to_string();
+            } else if arg.starts_with("--ws-allowed-origins=") {
+                ws_allowed_origins = arg.trim_start_matches("--ws-allowed-origins=").to_string();
+            } else if arg == "--ws-disconnect-slow-clients" {
+                ws_disconnect_slow_clients = true;
+            } else if arg.starts_with("--session-idle-timeout=") {
+                if let Ok(secs) = arg.trim_start_matches("--session-idle-timeout=").parse() {
+                    session_idle_timeout = Some(secs);
+                }
+            } else if arg.starts_with("--workspace-quota=") {
+                if let Ok(bytes) = arg.trim_start_matches("--workspace-quota=").parse() {
+                    workspace_quota = Some(bytes);
+                }
+            } else if arg.starts_with("--shutdown-timeout=") {
+                if let Ok(secs) = arg.trim_start_matches("--shutdown-timeout=").parse() {
+                    shutdown_timeout = secs;
+                }
+            } else if arg.starts_with("--sse-keepalive-interval=") {
+                match arg.trim_start_matches("--sse-keepalive-interval=").parse() {
+                    Ok(secs) if secs > 0 => sse_keepalive_interval = secs,
+                    _ => {}
+                }
             }
         }
 
+        // Relative entries are resolved against the workspace
+        let read_only_paths = read_only_paths
+            .split(',')
+            .map(str::trim)
+            .filter(|p| !p.is_empty())
+            .map(|p| crate::utils::path::normalize_path(&workspace_path.join(p)))
+            .collect();
+
+        let denied_paths = denied_paths
+            .split(',')
+            .map(str::trim)
+            .filter(|p| !p.is_empty())
+            .map(str::to_string)
+            .collect();
+
+        let cors_allowed_origins = cors_allowed_origins
+            .split(',')
+            .map(str::trim)
+            .filter(|o| !o.is_empty())
+            .map(str::to_string)
+            .collect();
+
+        let cors_allowed_methods = cors_allowed_methods
+            .split(',')
+            .map(|m| m.trim().to_ascii_uppercase())
+            .filter(|m| !m.is_empty())
+            .collect();
+
+        let ws_allowed_origins = ws_allowed_origins
+            .split(',')
+            .map(str::trim)
+            .filter(|o| !o.is_empty())
+            .map(str::to_string)
+            .collect();
+
         if let Some(ref t) = token {
             let masked = if t.len() > 6 {
                 format!("{}******{}", &t[..3], &t[t.len() - 3..])
@@ -63,6 +442,9 @@ impl Config {
                 "******".to_string()
             };
             println!("Token loaded from environment/args: {}", masked);
+        } else if client_ca_file.is_some() {
+            // Client certificates replace the bearer token when no token is configured
+            println!("No token provided. Authenticating clients by certificate only");
         } else {
             let random_token = crate::utils::common::generate_id();
             println!(
@@ -72,12 +454,60 @@ impl Config {
             token = Some(random_token);
         }
 
+        if !std::path::Path::new(&default_shell).exists() {
+            println!(
+                "Warning: default shell {} does not exist, session creation without an explicit shell will fail",
+                default_shell
+            );
+        }
+
         Config {
             addr,
             workspace_path,
             max_file_size,
             token,
             max_concurrent_reads,
+            default_shell,
+            temp_dir,
+            read_only,
+            trash_dir,
+            audit_log,
+            default_exec_path,
+            max_traversal_depth,
+            response_envelope,
+            coalesce_reads,
+            max_batch_files,
+            max_batch_size,
+            max_upload_concurrency,
+            max_body_size,
+            max_read_size,
+            tls_cert_file,
+            tls_key_file,
+            client_ca_file,
+            dedup,
+            dedup_dir,
+            read_only_paths,
+            denied_paths,
+            max_log_lines,
+            max_log_line_bytes,
+            max_output_bytes,
+            kill_on_output_limit,
+            // A non-positive rate disables limiting; the burst defaults to one
+            // second's worth of requests
+            rate_limit: rate_limit.filter(|&n| n > 0.0),
+            rate_limit_burst: rate_limit_burst
+                .unwrap_or_else(|| rate_limit.unwrap_or(1.0).ceil() as u32)
+                .max(1),
+            trust_forwarded_for,
+            cors_allowed_origins,
+            cors_allowed_methods,
+            ws_allowed_origins,
+            ws_disconnect_slow_clients,
+            // 0 disables the timeout, e.g. to override the environment
+            session_idle_timeout: session_idle_timeout.filter(|&secs| secs > 0),
+            workspace_quota: workspace_quota.filter(|&bytes| bytes > 0),
+            shutdown_timeout,
+            sse_keepalive_interval,
         }
     }
 }
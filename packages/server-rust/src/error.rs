@@ -8,7 +8,7 @@ use serde_json::json;
 use std::fmt;
 
 #[allow(dead_code)]
-#[derive(Debug)]
+#[derive(Debug, Clone)]
 pub enum AppError {
     InternalServerError(String),
     BadRequest(String),
@@ -18,10 +18,57 @@ pub enum AppError {
     Conflict(String),
     Validation(String),
     OperationError(String, serde_json::Value),
+    /// Route exists but not for this method; sent with HTTP 405
+    MethodNotAllowed(String),
+    /// Rate limit exceeded; sent with HTTP 429 and `Retry-After` (seconds)
+    TooManyRequests(String, u64),
+}
+
+/// Error details attached to error responses so middleware can re-render them
+/// (e.g. as plain text) without parsing the JSON body.
+#[derive(Debug, Clone)]
+pub struct ErrorDetails {
+    pub status: Status,
+    pub message: String,
+    pub data: serde_json::Value,
 }
 
 impl std::error::Error for AppError {}
 
+impl AppError {
+    /// Internal status code reported for this error
+    pub fn status(&self) -> Status {
+        match self {
+            AppError::InternalServerError(_) => Status::InternalError,
+            AppError::BadRequest(_) => Status::InvalidRequest,
+            AppError::NotFound(_) => Status::NotFound,
+            AppError::Unauthorized(_) => Status::Unauthorized,
+            AppError::Forbidden(_) => Status::Forbidden,
+            AppError::Conflict(_) => Status::Conflict,
+            AppError::Validation(_) => Status::ValidationError,
+            AppError::OperationError(_, _) => Status::OperationError,
+            AppError::MethodNotAllowed(_) => Status::MethodNotAllowed,
+            AppError::TooManyRequests(_, _) => Status::TooManyRequests,
+        }
+    }
+
+    /// Error message without the kind prefix added by `Display`
+    pub fn message(&self) -> &str {
+        match self {
+            AppError::InternalServerError(msg)
+            | AppError::BadRequest(msg)
+            | AppError::NotFound(msg)
+            | AppError::Unauthorized(msg)
+            | AppError::Forbidden(msg)
+            | AppError::Conflict(msg)
+            | AppError::Validation(msg)
+            | AppError::OperationError(msg, _)
+            | AppError::MethodNotAllowed(msg)
+            | AppError::TooManyRequests(msg, _) => msg,
+        }
+    }
+}
+
 impl fmt::Display for AppError {
     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
         match self {
@@ -33,12 +80,18 @@ impl fmt::Display for AppError {
             AppError::Conflict(msg) => write!(f, "Conflict: {}", msg),
             AppError::Validation(msg) => write!(f, "Validation Error: {}", msg),
             AppError::OperationError(msg, _) => write!(f, "Operation Error: {}", msg),
+            AppError::MethodNotAllowed(msg) => write!(f, "Method Not Allowed: {}", msg),
+            AppError::TooManyRequests(msg, _) => write!(f, "Too Many Requests: {}", msg),
         }
     }
 }
 
 impl IntoResponse for AppError {
     fn into_response(self) -> Response {
+        let retry_after = match &self {
+            AppError::TooManyRequests(_, secs) => Some(*secs),
+            _ => None,
+        };
         let (status, message, data) = match self {
             AppError::InternalServerError(msg) => (Status::InternalError, msg, json!({})),
             AppError::BadRequest(msg) => (Status::InvalidRequest, msg, json!({})),
@@ -48,16 +101,33 @@ impl IntoResponse for AppError {
             AppError::Conflict(msg) => (Status::Conflict, msg, json!({})),
             AppError::Validation(msg) => (Status::ValidationError, msg, json!({})),
             AppError::OperationError(msg, data) => (Status::OperationError, msg, data),
+            AppError::MethodNotAllowed(msg) => (Status::MethodNotAllowed, msg, json!({})),
+            AppError::TooManyRequests(msg, _) => (Status::TooManyRequests, msg, json!({})),
         };
 
+        let details = ErrorDetails {
+            status,
+            message: message.clone(),
+            data: data.clone(),
+        };
         let body = Json(ApiResponse::error(status, message, data));
 
         let http_status = match status {
             Status::Panic => StatusCode::INTERNAL_SERVER_ERROR,
+            // Proxies and HTTP clients back off on 429 without reading the body
+            Status::MethodNotAllowed => StatusCode::METHOD_NOT_ALLOWED,
+            Status::TooManyRequests => StatusCode::TOO_MANY_REQUESTS,
             _ => StatusCode::OK,
         };
 
-        (http_status, body).into_response()
+        let mut response = (http_status, body).into_response();
+        if let Some(secs) = retry_after {
+            response
+                .headers_mut()
+                .insert(axum::http::header::RETRY_AFTER, secs.into());
+        }
+        response.extensions_mut().insert(details);
+        response
     }
 }
 
@@ -1,22 +1,29 @@
 use crate::error::AppError;
-use crate::response::ApiResponse;
-use crate::state::AppState;
-use crate::utils::path::{ensure_directory, validate_path};
+use crate::response::{ApiResponse, NDJSON_CONTENT_TYPE};
+use crate::state::{upload::ProgressReporter, AppState};
+use crate::utils::atomic::{AtomicFile, StagedFile};
+use crate::utils::dedup::deduplicate;
+use crate::utils::path::{
+    absolute_path, depth_exceeded_message, ensure_directory, ensure_writable,
+    workspace_relative_path, DeniedPaths,
+};
 use axum::{
     body::Body,
-    extract::{Multipart, State},
-    http::header,
+    extract::{Multipart, Query, State},
+    http::{header, HeaderMap},
     response::{IntoResponse, Response},
     Json,
 };
 use flate2::write::GzEncoder;
 use flate2::Compression;
 use futures::StreamExt;
+use schemars::JsonSchema;
 use serde::{Deserialize, Serialize};
 use std::io::Write;
+use std::path::{Path, PathBuf};
 use std::sync::Arc;
-use tokio::fs;
 use tokio::io::AsyncWriteExt;
+use tokio::sync::Semaphore;
 
 struct ChannelWriter {
     tx: tokio::sync::mpsc::Sender<Result<Vec<u8>, std::io::Error>>,
@@ -40,72 +47,290 @@ impl std::io::Write for ChannelWriter {
     }
 }
 
-#[derive(Deserialize)]
+type DownloadSender = tokio::sync::mpsc::Sender<Result<Vec<u8>, std::io::Error>>;
+
+/// Once the client goes away the response body is dropped and every write into
+/// the channel fails with a broken pipe.
+fn is_client_disconnect(err: &std::io::Error) -> bool {
+    matches!(
+        err.kind(),
+        std::io::ErrorKind::BrokenPipe
+            | std::io::ErrorKind::ConnectionReset
+            | std::io::ErrorKind::ConnectionAborted
+    )
+}
+
+/// Log a failed archive write and forward real IO errors to the response stream.
+/// Callers abort the remaining archive work after reporting. The error ends the
+/// response body without its final chunk, so clients see a failed transfer
+/// rather than a short archive; the end-of-archive blocks the tar and gzip
+/// writers still emit when dropped are queued behind it and never sent.
+fn report_download_error(tx: &DownloadSender, context: &str, err: std::io::Error) {
+    if is_client_disconnect(&err) {
+        println!(
+            "Download aborted, client disconnected while trying to {}",
+            context
+        );
+        return;
+    }
+    println!("Download failed to {}: {}", context, err);
+    let _ = tx.blocking_send(Err(std::io::Error::new(
+        err.kind(),
+        format!("Failed to {}: {}", context, err),
+    )));
+}
+
+#[derive(Deserialize, JsonSchema)]
 pub struct DownloadFilesRequest {
     paths: Vec<String>,
     #[serde(default)]
     format: Option<String>,
 }
 
-pub async fn batch_download(
-    State(state): State<Arc<AppState>>,
-    Json(req): Json<DownloadFilesRequest>,
-) -> Result<Response, AppError> {
-    if req.paths.is_empty() {
+/// Archive formats a download can be streamed as. Both walk the tree through
+/// `append_dir_limited`, so their contents are identical.
+trait ArchiveWriter {
+    fn add_dir(&mut self, name: &Path, src: &Path) -> std::io::Result<()>;
+    /// Add `src` under `name`, following symlinks
+    fn add_file(&mut self, name: &Path, src: &Path) -> std::io::Result<()>;
+}
+
+impl<W: Write> ArchiveWriter for tar::Builder<W> {
+    fn add_dir(&mut self, name: &Path, src: &Path) -> std::io::Result<()> {
+        self.append_dir(name, src)
+    }
+
+    fn add_file(&mut self, name: &Path, src: &Path) -> std::io::Result<()> {
+        self.append_path_with_name(src, name)
+    }
+}
+
+type ZipStream<W> = zip::ZipWriter<zip::write::StreamWriter<W>>;
+
+/// Zip entry names always use `/`, with a trailing one for directories
+fn zip_entry_name(name: &Path) -> String {
+    name.components()
+        .map(|c| c.as_os_str().to_string_lossy())
+        .collect::<Vec<_>>()
+        .join("/")
+}
+
+fn zip_options(metadata: &std::fs::Metadata) -> zip::write::SimpleFileOptions {
+    use std::os::unix::fs::PermissionsExt;
+    zip::write::SimpleFileOptions::default()
+        .compression_method(zip::CompressionMethod::Deflated)
+        .unix_permissions(metadata.permissions().mode() & 0o7777)
+        .large_file(metadata.len() >= u32::MAX as u64)
+}
+
+impl<W: Write> ArchiveWriter for ZipStream<W> {
+    fn add_dir(&mut self, name: &Path, src: &Path) -> std::io::Result<()> {
+        let metadata = std::fs::metadata(src)?;
+        self.add_directory(zip_entry_name(name), zip_options(&metadata))?;
+        Ok(())
+    }
+
+    fn add_file(&mut self, name: &Path, src: &Path) -> std::io::Result<()> {
+        let metadata = std::fs::metadata(src)?;
+        if metadata.is_dir() {
+            // Like tar, a symlinked directory becomes an empty directory entry
+            return self.add_dir(name, src);
+        }
+        let mut file = std::fs::File::open(src)?;
+        self.start_file(zip_entry_name(name), zip_options(&metadata))?;
+        std::io::copy(&mut file, self)?;
+        Ok(())
+    }
+}
+
+/// Like `tar::Builder::append_dir_all`, but refuses to descend more than
+/// `max_depth` levels, does not follow symlinked directories and leaves out
+/// denied paths.
+fn append_dir_limited<A: ArchiveWriter>(
+    archive: &mut A,
+    name: &Path,
+    dir: &Path,
+    max_depth: usize,
+    denied: &DeniedPaths,
+) -> std::io::Result<()> {
+    let mut stack = vec![(dir.to_path_buf(), name.to_path_buf(), 0)];
+    while let Some((src, dest, depth)) = stack.pop() {
+        if depth > max_depth {
+            return Err(std::io::Error::other(depth_exceeded_message(
+                max_depth, &src,
+            )));
+        }
+        archive
+            .add_dir(&dest, &src)
+            .map_err(|e| with_path(&src, e))?;
+        for entry in std::fs::read_dir(&src).map_err(|e| with_path(&src, e))? {
+            let entry = entry.map_err(|e| with_path(&src, e))?;
+            if denied.is_denied(&entry.path()) {
+                continue;
+            }
+            let entry_dest = dest.join(entry.file_name());
+            if entry.file_type()?.is_dir() {
+                stack.push((entry.path(), entry_dest, depth + 1));
+            } else {
+                archive
+                    .add_file(&entry_dest, &entry.path())
+                    .map_err(|e| with_path(&entry.path(), e))?;
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Prefix an IO error with the path it happened on, keeping its kind.
+fn with_path(path: &Path, err: std::io::Error) -> std::io::Error {
+    std::io::Error::new(err.kind(), format!("{}: {}", path.display(), err))
+}
+
+/// Walks everything a download will contain and checks that each directory
+/// can be listed and each file opened, within the traversal depth limit.
+/// Once the archive starts streaming its status can no longer change, so
+/// catching these up front turns most failures into a proper error response.
+fn preflight_download(
+    paths: Vec<PathBuf>,
+    max_depth: usize,
+    denied: &DeniedPaths,
+) -> Result<(), AppError> {
+    let unreadable = |path: &Path, err: std::io::Error| {
+        let message = format!("Cannot read {}: {}", path.display(), err);
+        match err.kind() {
+            std::io::ErrorKind::PermissionDenied => AppError::Forbidden(message),
+            std::io::ErrorKind::NotFound => AppError::NotFound(message),
+            _ => AppError::BadRequest(message),
+        }
+    };
+
+    // Mirrors the archive walk: top-level symlinks are followed, nested ones
+    // are not descended into
+    let mut stack: Vec<(PathBuf, usize)> = paths.into_iter().map(|p| (p, 0)).collect();
+    while let Some((path, depth)) = stack.pop() {
+        let is_dir = if depth == 0 {
+            path.is_dir()
+        } else {
+            std::fs::symlink_metadata(&path)
+                .map_err(|e| unreadable(&path, e))?
+                .is_dir()
+        };
+        if is_dir {
+            if depth > max_depth {
+                return Err(AppError::Validation(depth_exceeded_message(
+                    max_depth, &path,
+                )));
+            }
+            for entry in std::fs::read_dir(&path).map_err(|e| unreadable(&path, e))? {
+                let entry = entry.map_err(|e| unreadable(&path, e))?;
+                if !denied.is_denied(&entry.path()) {
+                    stack.push((entry.path(), depth + 1));
+                }
+            }
+        } else {
+            std::fs::File::open(&path).map_err(|e| unreadable(&path, e))?;
+        }
+    }
+    Ok(())
+}
+
+/// The requested archive format, or one picked from the `Accept` header when
+/// the request does not name it. Defaults to `tar.gz`.
+fn download_format(requested: Option<&str>, headers: &HeaderMap) -> String {
+    if let Some(format) = requested {
+        return format.to_string();
+    }
+    let accept = headers
+        .get(header::ACCEPT)
+        .and_then(|v| v.to_str().ok())
+        .unwrap_or("");
+    let format = accept
+        .split(',')
+        .map(|t| t.split(';').next().unwrap_or("").trim())
+        .find_map(|mime| match mime {
+            "application/zip" => Some("zip"),
+            "application/x-tar" => Some("tar"),
+            "multipart/mixed" => Some("multipart"),
+            "application/gzip" => Some("tar.gz"),
+            _ => None,
+        });
+    format.unwrap_or("tar.gz").to_string()
+}
+
+/// Name a requested path gets in a download archive: relative to the
+/// workspace, or just its file name when it lies outside.
+fn archive_name<'a>(workspace_path: &Path, path: &'a Path) -> &'a Path {
+    match path.strip_prefix(workspace_path) {
+        Ok(p) => p,
+        Err(_) => Path::new(path.file_name().unwrap_or(path.as_os_str())),
+    }
+}
+
+/// Resolves the requested download paths, failing on the first missing one.
+fn validate_download_paths(state: &AppState, paths: &[String]) -> Result<Vec<PathBuf>, AppError> {
+    if paths.is_empty() {
         return Err(AppError::BadRequest("No paths provided".to_string()));
     }
 
     let mut valid_paths = Vec::new();
-    for path in &req.paths {
-        let valid_path = validate_path(&state.config.workspace_path, path)?;
+    for path in paths {
+        let valid_path = state.resolve_path(path)?;
         if !valid_path.exists() {
             return Err(AppError::NotFound(format!("File not found: {}", path)));
         }
         valid_paths.push(valid_path);
     }
+    Ok(valid_paths)
+}
+
+pub async fn batch_download(
+    State(state): State<Arc<AppState>>,
+    headers: HeaderMap,
+    Json(req): Json<DownloadFilesRequest>,
+) -> Result<Response, AppError> {
+    let valid_paths = validate_download_paths(&state, &req.paths)?;
 
-    let format = req.format.as_deref().unwrap_or("tar.gz");
+    let format = download_format(req.format.as_deref(), &headers);
     let workspace_path = state.config.workspace_path.clone();
+    let max_depth = state.config.max_traversal_depth;
+    let denied = state.denied_paths.clone();
+
+    let preflight_paths = valid_paths.clone();
+    let preflight_denied = denied.clone();
+    tokio::task::spawn_blocking(move || {
+        preflight_download(preflight_paths, max_depth, &preflight_denied)
+    })
+    .await
+    .map_err(|e| AppError::InternalServerError(e.to_string()))??;
 
-    match format {
+    match format.as_str() {
         "tar" => {
             let (tx, rx) = tokio::sync::mpsc::channel::<Result<Vec<u8>, std::io::Error>>(10);
             let valid_paths = valid_paths.clone();
+            let denied = denied.clone();
             let tx_err = tx.clone();
 
             tokio::task::spawn_blocking(move || {
                 let writer = ChannelWriter { tx };
                 let mut tar = tar::Builder::new(writer);
                 for path in valid_paths {
-                    let rel_path = match path.strip_prefix(&workspace_path) {
-                        Ok(p) => p,
-                        Err(_) => {
-                            std::path::Path::new(path.file_name().unwrap_or(path.as_os_str()))
-                        }
-                    };
+                    let rel_path = archive_name(&workspace_path, &path);
                     if path.is_dir() {
-                        if let Err(e) = tar.append_dir_all(rel_path, &path) {
-                            let _ = tx_err.blocking_send(Err(std::io::Error::new(
-                                std::io::ErrorKind::Other,
-                                format!("Failed to append dir: {}", e),
-                            )));
+                        if let Err(e) =
+                            append_dir_limited(&mut tar, rel_path, &path, max_depth, &denied)
+                        {
+                            report_download_error(&tx_err, "append dir", e);
                             return;
                         }
                     } else {
                         if let Err(e) = tar.append_path_with_name(&path, rel_path) {
-                            let _ = tx_err.blocking_send(Err(std::io::Error::new(
-                                std::io::ErrorKind::Other,
-                                format!("Failed to append file: {}", e),
-                            )));
+                            report_download_error(&tx_err, "append file", with_path(&path, e));
                             return;
                         }
                     }
                 }
                 if let Err(e) = tar.finish() {
-                    let _ = tx_err.blocking_send(Err(std::io::Error::new(
-                        std::io::ErrorKind::Other,
-                        format!("Failed to finish tar: {}", e),
-                    )));
+                    report_download_error(&tx_err, "finish tar", e);
                 }
             });
 
@@ -121,22 +346,71 @@ pub async fn batch_download(
             ];
             Ok((headers, body).into_response())
         }
+        "zip" => {
+            let (tx, rx) = tokio::sync::mpsc::channel::<Result<Vec<u8>, std::io::Error>>(10);
+            let valid_paths = valid_paths.clone();
+            let denied = denied.clone();
+            let tx_err = tx.clone();
+
+            tokio::task::spawn_blocking(move || {
+                let writer = ChannelWriter { tx };
+                let mut zip = zip::ZipWriter::new_stream(writer);
+                for path in valid_paths {
+                    let rel_path = archive_name(&workspace_path, &path);
+                    if path.is_dir() {
+                        if let Err(e) =
+                            append_dir_limited(&mut zip, rel_path, &path, max_depth, &denied)
+                        {
+                            report_download_error(&tx_err, "append dir", e);
+                            return;
+                        }
+                    } else if let Err(e) = zip.add_file(rel_path, &path) {
+                        report_download_error(&tx_err, "append file", with_path(&path, e));
+                        return;
+                    }
+                }
+                if let Err(e) = zip.finish() {
+                    report_download_error(&tx_err, "finish zip", e.into());
+                }
+            });
+
+            let stream = tokio_stream::wrappers::ReceiverStream::new(rx);
+            let body = Body::from_stream(stream);
+
+            let headers = [
+                (header::CONTENT_TYPE, "application/zip".to_string()),
+                (
+                    header::CONTENT_DISPOSITION,
+                    "attachment; filename=\"download.zip\"".to_string(),
+                ),
+            ];
+            Ok((headers, body).into_response())
+        }
         "multipart" | "mixed" => {
             let boundary = crate::utils::common::generate_id();
             let boundary_clone = boundary.clone();
             let (tx, rx) = tokio::sync::mpsc::channel::<Result<Vec<u8>, std::io::Error>>(10);
             let valid_paths = valid_paths.clone();
+            let denied = denied.clone();
             let tx_err = tx.clone();
 
             tokio::task::spawn_blocking(move || {
                 let mut writer = ChannelWriter { tx };
-                let mut stack = valid_paths.clone();
+                let mut stack: Vec<(PathBuf, usize)> =
+                    valid_paths.iter().map(|p| (p.clone(), 0)).collect();
 
-                while let Some(path) = stack.pop() {
+                while let Some((path, depth)) = stack.pop() {
                     if path.is_dir() {
+                        if depth > max_depth {
+                            let message = depth_exceeded_message(max_depth, &path);
+                            report_download_error(&tx_err, "walk", std::io::Error::other(message));
+                            return;
+                        }
                         if let Ok(entries) = std::fs::read_dir(&path) {
                             for entry in entries.flatten() {
-                                stack.push(entry.path());
+                                if !denied.is_denied(&entry.path()) {
+                                    stack.push((entry.path(), depth + 1));
+                                }
                             }
                         }
                     } else {
@@ -147,25 +421,29 @@ pub async fn batch_download(
                             path.to_string_lossy(),
                             mime
                         );
-                        if writer.write_all(header.as_bytes()).is_err() {
+                        if let Err(e) = writer.write_all(header.as_bytes()) {
+                            report_download_error(&tx_err, "write part header", e);
                             return;
                         }
 
                         if let Ok(mut file) = std::fs::File::open(&path) {
-                            if std::io::copy(&mut file, &mut writer).is_err() {
-                                let _ = tx_err.blocking_send(Err(std::io::Error::new(
-                                    std::io::ErrorKind::Other,
-                                    "Failed to read file",
-                                )));
+                            let copied = std::io::copy(&mut file, &mut writer);
+                            // Release the handle before anything else happens on this thread
+                            drop(file);
+                            if let Err(e) = copied {
+                                report_download_error(&tx_err, "copy file", e);
                                 return;
                             }
                         }
-                        if writer.write_all(b"\r\n").is_err() {
+                        if let Err(e) = writer.write_all(b"\r\n") {
+                            report_download_error(&tx_err, "write part trailer", e);
                             return;
                         }
                     }
                 }
-                let _ = writer.write_all(format!("--{}--\r\n", boundary_clone).as_bytes());
+                if let Err(e) = writer.write_all(format!("--{}--\r\n", boundary_clone).as_bytes()) {
+                    report_download_error(&tx_err, "write closing boundary", e);
+                }
             });
 
             let stream = tokio_stream::wrappers::ReceiverStream::new(rx);
@@ -187,6 +465,7 @@ pub async fn batch_download(
             // tar.gz
             let (tx, rx) = tokio::sync::mpsc::channel::<Result<Vec<u8>, std::io::Error>>(10);
             let valid_paths = valid_paths.clone();
+            let denied = denied.clone();
             let tx_err = tx.clone();
 
             tokio::task::spawn_blocking(move || {
@@ -195,43 +474,28 @@ pub async fn batch_download(
                 {
                     let mut tar = tar::Builder::new(&mut enc);
                     for path in valid_paths {
-                        let rel_path = match path.strip_prefix(&workspace_path) {
-                            Ok(p) => p,
-                            Err(_) => {
-                                std::path::Path::new(path.file_name().unwrap_or(path.as_os_str()))
-                            }
-                        };
+                        let rel_path = archive_name(&workspace_path, &path);
                         if path.is_dir() {
-                            if let Err(e) = tar.append_dir_all(rel_path, &path) {
-                                let _ = tx_err.blocking_send(Err(std::io::Error::new(
-                                    std::io::ErrorKind::Other,
-                                    format!("Failed to append dir: {}", e),
-                                )));
+                            if let Err(e) =
+                                append_dir_limited(&mut tar, rel_path, &path, max_depth, &denied)
+                            {
+                                report_download_error(&tx_err, "append dir", e);
                                 return;
                             }
                         } else {
                             if let Err(e) = tar.append_path_with_name(&path, rel_path) {
-                                let _ = tx_err.blocking_send(Err(std::io::Error::new(
-                                    std::io::ErrorKind::Other,
-                                    format!("Failed to append file: {}", e),
-                                )));
+                                report_download_error(&tx_err, "append file", with_path(&path, e));
                                 return;
                             }
                         }
                     }
                     if let Err(e) = tar.finish() {
-                        let _ = tx_err.blocking_send(Err(std::io::Error::new(
-                            std::io::ErrorKind::Other,
-                            format!("Failed to finish tar: {}", e),
-                        )));
+                        report_download_error(&tx_err, "finish tar", e);
                         return;
                     }
                 }
                 if let Err(e) = enc.finish() {
-                    let _ = tx_err.blocking_send(Err(std::io::Error::new(
-                        std::io::ErrorKind::Other,
-                        format!("Failed to finish gzip: {}", e),
-                    )));
+                    report_download_error(&tx_err, "finish gzip", e);
                 }
             });
 
@@ -250,15 +514,233 @@ pub async fn batch_download(
     }
 }
 
+/// Size of a tar header block; entries are padded to a multiple of it
+const TAR_BLOCK_SIZE: u64 = 512;
+
+/// Rough gzip ratio used to estimate `tar.gz` downloads without compressing
+const ESTIMATED_GZIP_RATIO: f64 = 0.5;
+
+/// Zip local header, data descriptor and central directory record of one
+/// entry, not counting the name that appears in both headers
+const ZIP_ENTRY_OVERHEAD: u64 = 30 + 16 + 46;
+
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+pub struct DownloadEstimateResponse {
+    file_count: u64,
+    total_bytes: u64,
+    /// Approximate size of the response body in the requested format
+    estimated_compressed_bytes: u64,
+}
+
+/// Validates a batch download request and reports its size without streaming
+/// any content, so clients can confirm large transfers and size progress bars.
+pub async fn batch_download_estimate(
+    State(state): State<Arc<AppState>>,
+    headers: HeaderMap,
+    Json(req): Json<DownloadFilesRequest>,
+) -> Result<Json<ApiResponse<DownloadEstimateResponse>>, AppError> {
+    let valid_paths = validate_download_paths(&state, &req.paths)?;
+    let format = download_format(req.format.as_deref(), &headers);
+    let max_depth = state.config.max_traversal_depth;
+    let denied = state.denied_paths.clone();
+
+    let estimate = tokio::task::spawn_blocking(move || {
+        let mut file_count = 0u64;
+        let mut total_bytes = 0u64;
+        let mut archive_bytes = 0u64;
+
+        let mut stack: Vec<(PathBuf, usize)> = valid_paths.into_iter().map(|p| (p, 0)).collect();
+        while let Some((path, depth)) = stack.pop() {
+            if path.is_dir() {
+                if depth > max_depth {
+                    return Err(AppError::Validation(depth_exceeded_message(
+                        max_depth, &path,
+                    )));
+                }
+                archive_bytes += match format.as_str() {
+                    "zip" => ZIP_ENTRY_OVERHEAD + 2 * path.as_os_str().len() as u64,
+                    _ => TAR_BLOCK_SIZE,
+                };
+                for entry in std::fs::read_dir(&path)? {
+                    let entry_path = entry?.path();
+                    if !denied.is_denied(&entry_path) {
+                        stack.push((entry_path, depth + 1));
+                    }
+                }
+            } else {
+                let size = std::fs::metadata(&path)?.len();
+                file_count += 1;
+                total_bytes += size;
+                archive_bytes += match format.as_str() {
+                    // Part header with the path, plus the trailing CRLF
+                    "multipart" | "mixed" => 128 + path.as_os_str().len() as u64 + size,
+                    "zip" => {
+                        ZIP_ENTRY_OVERHEAD
+                            + 2 * path.as_os_str().len() as u64
+                            + (size as f64 * ESTIMATED_GZIP_RATIO) as u64
+                    }
+                    _ => TAR_BLOCK_SIZE + size.div_ceil(TAR_BLOCK_SIZE) * TAR_BLOCK_SIZE,
+                };
+            }
+        }
+
+        let estimated_compressed_bytes = match format.as_str() {
+            "tar" => archive_bytes + 2 * TAR_BLOCK_SIZE,
+            "multipart" | "mixed" => archive_bytes,
+            // Entries are deflated individually; the end of central directory is 22 bytes
+            "zip" => archive_bytes + 22,
+            _ => ((archive_bytes + 2 * TAR_BLOCK_SIZE) as f64 * ESTIMATED_GZIP_RATIO) as u64,
+        };
+
+        Ok(DownloadEstimateResponse {
+            file_count,
+            total_bytes,
+            estimated_compressed_bytes,
+        })
+    })
+    .await
+    .map_err(|e| AppError::InternalServerError(e.to_string()))??;
+
+    Ok(Json(ApiResponse::success(estimate)))
+}
+
+#[derive(Deserialize, JsonSchema)]
+pub struct DownloadManifestParams {
+    /// Comma-separated paths, as given to a batch download
+    paths: String,
+}
+
+#[derive(Serialize)]
+pub struct ManifestEntry {
+    /// Name of the file in a `tar`, `tar.gz` or `zip` download
+    path: String,
+    size: u64,
+    /// Octal permission bits, e.g. "0644"
+    mode: String,
+    modified: Option<String>,
+}
+
+impl ManifestEntry {
+    fn new(name: &Path, metadata: &std::fs::Metadata) -> Self {
+        use std::os::unix::fs::PermissionsExt;
+        ManifestEntry {
+            path: name.to_string_lossy().to_string(),
+            size: metadata.len(),
+            mode: format!("0{:o}", metadata.permissions().mode() & 0o777),
+            modified: metadata.modified().ok().map(|t| {
+                let duration = t.duration_since(std::time::UNIX_EPOCH).unwrap_or_default();
+                crate::utils::common::format_time(duration.as_secs())
+            }),
+        }
+    }
+}
+
+/// Pass every file a download of `paths` would contain to `emit`, walking the
+/// trees the way `append_dir_limited` does: nested symlinks to files are
+/// reported with their target's metadata, symlinked directories hold no files.
+fn walk_manifest(
+    paths: Vec<PathBuf>,
+    workspace_path: &Path,
+    max_depth: usize,
+    denied: &DeniedPaths,
+    mut emit: impl FnMut(ManifestEntry) -> std::io::Result<()>,
+) -> std::io::Result<()> {
+    for path in paths {
+        let name = archive_name(workspace_path, &path).to_path_buf();
+        if !path.is_dir() {
+            emit(ManifestEntry::new(&name, &std::fs::metadata(&path)?))?;
+            continue;
+        }
+
+        let mut stack = vec![(path, name, 0)];
+        while let Some((src, dest, depth)) = stack.pop() {
+            if depth > max_depth {
+                return Err(std::io::Error::other(depth_exceeded_message(
+                    max_depth, &src,
+                )));
+            }
+            for entry in std::fs::read_dir(&src).map_err(|e| with_path(&src, e))? {
+                let entry = entry.map_err(|e| with_path(&src, e))?;
+                let entry_path = entry.path();
+                if denied.is_denied(&entry_path) {
+                    continue;
+                }
+                let entry_dest = dest.join(entry.file_name());
+                if entry.file_type()?.is_dir() {
+                    stack.push((entry_path, entry_dest, depth + 1));
+                    continue;
+                }
+                let metadata =
+                    std::fs::metadata(&entry_path).map_err(|e| with_path(&entry_path, e))?;
+                if !metadata.is_dir() {
+                    emit(ManifestEntry::new(&entry_dest, &metadata))?;
+                }
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Lists the files a batch download of `paths` would contain as
+/// newline-delimited JSON, without reading their contents. Unreadable paths
+/// are reported as errors before the listing starts.
+pub async fn batch_download_manifest(
+    State(state): State<Arc<AppState>>,
+    Query(params): Query<DownloadManifestParams>,
+) -> Result<Response, AppError> {
+    let paths: Vec<String> = params
+        .paths
+        .split(',')
+        .map(str::trim)
+        .filter(|p| !p.is_empty())
+        .map(str::to_string)
+        .collect();
+    let valid_paths = validate_download_paths(&state, &paths)?;
+    let workspace_path = state.config.workspace_path.clone();
+    let max_depth = state.config.max_traversal_depth;
+    let denied = state.denied_paths.clone();
+
+    let preflight_paths = valid_paths.clone();
+    let preflight_denied = denied.clone();
+    tokio::task::spawn_blocking(move || {
+        preflight_download(preflight_paths, max_depth, &preflight_denied)
+    })
+    .await
+    .map_err(|e| AppError::InternalServerError(e.to_string()))??;
+
+    let (tx, rx) = tokio::sync::mpsc::channel::<Result<Vec<u8>, std::io::Error>>(10);
+    let tx_err = tx.clone();
+    tokio::task::spawn_blocking(move || {
+        let mut writer = ChannelWriter { tx };
+        let result = walk_manifest(valid_paths, &workspace_path, max_depth, &denied, |entry| {
+            let mut line = serde_json::to_vec(&entry)?;
+            line.push(b'\n');
+            writer.write_all(&line)
+        });
+        if let Err(e) = result {
+            report_download_error(&tx_err, "list files", e);
+        }
+    });
+
+    let body = Body::from_stream(tokio_stream::wrappers::ReceiverStream::new(rx));
+    Ok(([(header::CONTENT_TYPE, NDJSON_CONTENT_TYPE)], body).into_response())
+}
+
 #[derive(Serialize)]
 #[serde(rename_all = "camelCase")]
 pub struct BatchUploadResult {
+    /// Absolute destination path, or the client-supplied name if it could not be resolved
     path: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    relative_path: Option<String>,
     success: bool,
     #[serde(skip_serializing_if = "Option::is_none")]
     error: Option<String>,
     #[serde(skip_serializing_if = "Option::is_none")]
     size: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    deduplicated: Option<bool>,
 }
 
 #[derive(Serialize)]
@@ -269,6 +751,66 @@ pub struct BatchUploadResponse {
     success_count: usize,
 }
 
+impl BatchUploadResult {
+    fn failed(path: String, relative_path: Option<String>, error: String) -> Self {
+        BatchUploadResult {
+            path,
+            relative_path,
+            success: false,
+            error: Some(error),
+            size: None,
+            deduplicated: None,
+        }
+    }
+}
+
+/// A batch upload entry, in request order, as the form is read
+enum ReceivedUpload {
+    Done(BatchUploadResult),
+    /// Received in full, not yet moved into place
+    Staged {
+        filename: String,
+        staged: StagedFile,
+        target_path: PathBuf,
+        resolved: String,
+        relative: Option<String>,
+        size: u64,
+    },
+}
+
+/// A batch upload entry, in request order, whose result may still be pending
+enum PendingUpload {
+    Done(BatchUploadResult),
+    Finalizing {
+        filename: String,
+        handle: tokio::task::JoinHandle<BatchUploadResult>,
+    },
+}
+
+/// Await every entry in request order, reporting completions.
+async fn collect_uploads(
+    pending: Vec<PendingUpload>,
+    progress: &mut Option<ProgressReporter>,
+) -> Vec<BatchUploadResult> {
+    let mut results = Vec::with_capacity(pending.len());
+    for entry in pending {
+        let result = match entry {
+            PendingUpload::Done(result) => result,
+            PendingUpload::Finalizing { filename, handle } => {
+                let result = handle.await.unwrap_or_else(|e| {
+                    BatchUploadResult::failed(filename.clone(), None, e.to_string())
+                });
+                if let (true, Some(p)) = (result.success, progress.as_mut()) {
+                    p.complete(&filename, result.size.unwrap_or(0));
+                }
+                result
+            }
+        };
+        results.push(result);
+    }
+    results
+}
+
 /// Mimics the Go server's behavior of manually parsing Content-Disposition
 /// to extract a filename, allowing for paths in the filename field.
 fn extract_full_filename(field: &axum::extract::multipart::Field) -> String {
@@ -298,50 +840,96 @@ fn extract_full_filename(field: &axum::extract::multipart::Field) -> String {
 
 pub async fn batch_upload(
     State(state): State<Arc<AppState>>,
+    headers: HeaderMap,
     mut multipart: Multipart,
 ) -> Result<Json<ApiResponse<BatchUploadResponse>>, AppError> {
-    let mut results = Vec::new();
-    let mut success_count = 0;
+    let max_files = state.config.max_batch_files;
+    let max_total_size = state.config.max_batch_size;
+
+    // Reject oversized bodies up front when the client announces the length
+    let content_length = headers
+        .get(header::CONTENT_LENGTH)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.parse::<u64>().ok());
+    if let Some(length) = content_length {
+        if length > max_total_size {
+            return Err(AppError::BadRequest(format!(
+                "Batch upload too large: {} bytes exceeds the limit of {} bytes",
+                length, max_total_size
+            )));
+        }
+    }
+
+    let mut pending = Vec::new();
     let mut total_files = 0;
+    let mut total_size = 0u64;
+    // Bytes of files accepted so far, counted against the workspace quota
+    let mut accepted_size = 0u64;
+    let mut reservation = state.reserve_quota(0).await?;
+    let mut progress: Option<ProgressReporter> = None;
 
+    // Files are only staged while the form is read: the count and size limits
+    // are not known to hold until all of it has arrived, and failing them
+    // drops the staged files, so a rejected batch writes no files.
     while let Some(field) = multipart
         .next_field()
         .await
         .map_err(|e| AppError::BadRequest(e.to_string()))?
     {
         let name = field.name().unwrap_or("").to_string();
-        if name == "files" || name == "file" {
+        if name == "uploadId" {
+            let upload_id = field
+                .text()
+                .await
+                .map_err(|e| AppError::BadRequest(e.to_string()))?;
+            progress = Some(ProgressReporter::new(&state.uploads, upload_id).await);
+        } else if name == "files" || name == "file" {
             total_files += 1;
+            if total_files > max_files {
+                return Err(AppError::BadRequest(format!(
+                    "Too many files in batch upload: the limit is {}; no files were written",
+                    max_files
+                )));
+            }
             let filename = extract_full_filename(&field);
 
-            let target_path_res = validate_path(&state.config.workspace_path, &filename);
+            let target_path_res = state.resolve_path(&filename);
 
             match target_path_res {
                 Ok(target_path) => {
+                    let resolved = absolute_path(&target_path).to_string_lossy().to_string();
+                    let relative =
+                        workspace_relative_path(&state.config.workspace_path, &target_path);
+                    let failure = |error: String| {
+                        ReceivedUpload::Done(BatchUploadResult::failed(
+                            resolved.clone(),
+                            relative.clone(),
+                            error,
+                        ))
+                    };
+
+                    if let Err(e) = ensure_writable(&state.config.read_only_paths, &target_path) {
+                        pending.push(failure(e.to_string()));
+                        continue;
+                    }
+
                     if let Some(parent) = target_path.parent() {
                         if let Err(e) = ensure_directory(parent).await {
-                            results.push(BatchUploadResult {
-                                path: filename,
-                                success: false,
-                                error: Some(e.to_string()),
-                                size: None,
-                            });
+                            pending.push(failure(e.to_string()));
                             continue;
                         }
                     }
 
-                    let mut file = match fs::File::create(&target_path).await {
-                        Ok(f) => f,
-                        Err(e) => {
-                            results.push(BatchUploadResult {
-                                path: filename,
-                                success: false,
-                                error: Some(e.to_string()),
-                                size: None,
-                            });
-                            continue;
-                        }
-                    };
+                    let mut atomic =
+                        match AtomicFile::create(state.config.temp_dir.as_deref(), &target_path)
+                            .await
+                        {
+                            Ok(f) => f,
+                            Err(e) => {
+                                pending.push(failure(e.to_string()));
+                                continue;
+                            }
+                        };
 
                     let mut size = 0;
                     let mut stream = field;
@@ -350,37 +938,35 @@ pub async fn batch_upload(
                         match chunk {
                             Ok(data) => {
                                 size += data.len() as u64;
+                                total_size += data.len() as u64;
+                                if total_size > max_total_size {
+                                    return Err(AppError::BadRequest(format!(
+                                        "Batch upload too large: exceeds the limit of {} bytes; no files were written",
+                                        max_total_size
+                                    )));
+                                }
                                 if size > state.config.max_file_size {
-                                    drop(file);
-                                    fs::remove_file(&target_path).await.ok();
-                                    results.push(BatchUploadResult {
-                                        path: filename.clone(),
-                                        success: false,
-                                        error: Some("File too large".to_string()),
-                                        size: None,
-                                    });
+                                    pending.push(failure("File too large".to_string()));
+                                    failed = true;
+                                    break;
+                                }
+                                if let Err(e) = reservation.ensure(accepted_size + size).await {
+                                    pending.push(failure(e.to_string()));
                                     failed = true;
                                     break;
                                 }
 
-                                if let Err(e) = file.write_all(&data).await {
-                                    results.push(BatchUploadResult {
-                                        path: filename.clone(),
-                                        success: false,
-                                        error: Some(e.to_string()),
-                                        size: None,
-                                    });
+                                if let Err(e) = atomic.file.write_all(&data).await {
+                                    pending.push(failure(e.to_string()));
                                     failed = true;
                                     break;
                                 }
+                                if let Some(p) = progress.as_mut() {
+                                    p.update(&filename, size, None);
+                                }
                             }
                             Err(e) => {
-                                results.push(BatchUploadResult {
-                                    path: filename.clone(),
-                                    success: false,
-                                    error: Some(e.to_string()),
-                                    size: None,
-                                });
+                                pending.push(failure(e.to_string()));
                                 failed = true;
                                 break;
                             }
@@ -388,30 +974,187 @@ pub async fn batch_upload(
                     }
 
                     if !failed {
-                        success_count += 1;
-                        results.push(BatchUploadResult {
-                            path: target_path.to_string_lossy().to_string(),
-                            success: true,
-                            error: None,
-                            size: Some(size),
-                        });
+                        match atomic.close().await {
+                            Ok(staged) => {
+                                accepted_size += size;
+                                pending.push(ReceivedUpload::Staged {
+                                    filename,
+                                    staged,
+                                    target_path,
+                                    resolved,
+                                    relative,
+                                    size,
+                                });
+                            }
+                            Err(e) => pending.push(failure(e.to_string())),
+                        }
                     }
                 }
                 Err(e) => {
-                    results.push(BatchUploadResult {
-                        path: filename,
-                        success: false,
-                        error: Some(e.to_string()),
-                        size: None,
-                    });
+                    pending.push(ReceivedUpload::Done(BatchUploadResult::failed(
+                        filename,
+                        None,
+                        e.to_string(),
+                    )));
                 }
             }
         }
     }
 
+    // The whole batch is within the limits: move the staged files into place.
+    // Committing and deduplicating run concurrently; results keep request order.
+    let finalizers = Arc::new(Semaphore::new(state.config.max_upload_concurrency.max(1)));
+    let pending = pending
+        .into_iter()
+        .map(|entry| match entry {
+            ReceivedUpload::Done(result) => PendingUpload::Done(result),
+            ReceivedUpload::Staged {
+                filename,
+                staged,
+                target_path,
+                resolved,
+                relative,
+                size,
+            } => {
+                let finalizers = finalizers.clone();
+                let dedup = state.dedup.clone();
+                let handle = tokio::spawn(async move {
+                    let _permit = finalizers.acquire_owned().await;
+                    if let Err(e) = staged.commit().await {
+                        return BatchUploadResult::failed(resolved, relative, e.to_string());
+                    }
+                    let deduplicated = deduplicate(dedup.as_deref(), &target_path).await;
+                    BatchUploadResult {
+                        path: resolved,
+                        relative_path: relative,
+                        success: true,
+                        error: None,
+                        size: Some(size),
+                        deduplicated,
+                    }
+                });
+                PendingUpload::Finalizing { filename, handle }
+            }
+        })
+        .collect();
+
+    let results = collect_uploads(pending, &mut progress).await;
+    let success_count = results.iter().filter(|r| r.success).count();
+    let written = results
+        .iter()
+        .filter(|r| r.success)
+        .filter_map(|r| r.size)
+        .sum();
+    reservation.commit(written).await;
+
     Ok(Json(ApiResponse::success(BatchUploadResponse {
         results,
         total_files,
         success_count,
     })))
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_walk_manifest() {
+        let dir = std::env::temp_dir().join(format!("manifest-test-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("src/deep")).unwrap();
+        std::fs::write(dir.join("src/a.txt"), b"hello").unwrap();
+        std::fs::write(dir.join("src/deep/b.txt"), b"hi").unwrap();
+        std::fs::write(dir.join("src/secret"), b"x").unwrap();
+        std::os::unix::fs::symlink(dir.join("src/deep"), dir.join("src/linked")).unwrap();
+        let denied = DeniedPaths::new(&dir, vec!["src/secret".to_string()]);
+
+        let mut entries = Vec::new();
+        walk_manifest(vec![dir.join("src")], &dir, 10, &denied, |entry| {
+            entries.push((entry.path, entry.size));
+            Ok(())
+        })
+        .unwrap();
+        entries.sort();
+        assert_eq!(
+            entries,
+            vec![
+                ("src/a.txt".to_string(), 5),
+                ("src/deep/b.txt".to_string(), 2)
+            ]
+        );
+
+        assert!(walk_manifest(vec![dir.join("src")], &dir, 0, &denied, |_| Ok(())).is_err());
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_zip_download_matches_tar() {
+        use std::io::Read;
+
+        let dir = std::env::temp_dir().join(format!("zip-download-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("src/deep")).unwrap();
+        std::fs::write(dir.join("src/a.txt"), b"hello").unwrap();
+        std::fs::write(dir.join("src/deep/b.txt"), b"hi").unwrap();
+        std::fs::write(dir.join("src/secret"), b"x").unwrap();
+        std::fs::write(dir.join("top.txt"), b"top").unwrap();
+        let mut config = crate::config::Config::load();
+        config.workspace_path = dir.clone();
+        config.denied_paths = vec!["src/secret".to_string()];
+        let state = Arc::new(AppState::new(config));
+
+        let mut accept = HeaderMap::new();
+        accept.insert(header::ACCEPT, "application/zip".parse().unwrap());
+        assert_eq!(download_format(None, &accept), "zip");
+
+        let download = |format: &str| {
+            let req = serde_json::from_value::<DownloadFilesRequest>(serde_json::json!({
+                "paths": ["src", "top.txt"],
+                "format": format,
+            }))
+            .unwrap();
+            let state = state.clone();
+            async move {
+                let response = batch_download(State(state), HeaderMap::new(), Json(req))
+                    .await
+                    .unwrap();
+                axum::body::to_bytes(response.into_body(), usize::MAX)
+                    .await
+                    .unwrap()
+                    .to_vec()
+            }
+        };
+
+        let mut zip = zip::ZipArchive::new(std::io::Cursor::new(download("zip").await)).unwrap();
+        let mut zip_names: Vec<String> = zip
+            .file_names()
+            .map(|name| name.trim_end_matches('/').to_string())
+            .collect();
+        zip_names.sort();
+        let mut content = String::new();
+        zip.by_name("src/deep/b.txt")
+            .unwrap()
+            .read_to_string(&mut content)
+            .unwrap();
+        assert_eq!(content, "hi");
+
+        let tar_bytes = download("tar").await;
+        let mut tar = tar::Archive::new(tar_bytes.as_slice());
+        let mut tar_names: Vec<String> = tar
+            .entries()
+            .unwrap()
+            .map(|entry| {
+                let path = entry.unwrap().path().unwrap().to_string_lossy().to_string();
+                path.trim_end_matches('/').to_string()
+            })
+            .collect();
+        tar_names.sort();
+
+        assert_eq!(
+            zip_names,
+            ["src", "src/a.txt", "src/deep", "src/deep/b.txt", "top.txt"]
+        );
+        assert_eq!(zip_names, tar_names);
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -0,0 +1,141 @@
+use super::types::{FileHash, FileInfo};
+use crate::error::AppError;
+use crate::response::ApiResponse;
+use crate::state::AppState;
+use crate::utils::common::{digest_file, HashAlgorithm};
+use axum::{
+    extract::{Query, State},
+    Json,
+};
+use schemars::JsonSchema;
+use serde::Deserialize;
+use std::path::PathBuf;
+use std::sync::Arc;
+use tokio::fs;
+
+#[derive(Deserialize, JsonSchema)]
+pub struct FileInfoParams {
+    path: String,
+}
+
+#[derive(Deserialize, JsonSchema)]
+pub struct HashFileParams {
+    path: String,
+    /// sha256 (default), sha1, md5 or crc32
+    algo: Option<String>,
+}
+
+/// Metadata for a single file or directory. Identical concurrent requests
+/// share one `stat` call when read coalescing is enabled.
+pub async fn stat_file(
+    State(state): State<Arc<AppState>>,
+    Query(params): Query<FileInfoParams>,
+) -> Result<Json<ApiResponse<FileInfo>>, AppError> {
+    let valid_path = state.resolve_path(&params.path)?;
+
+    let info = if state.config.coalesce_reads {
+        let key = valid_path.to_string_lossy().to_string();
+        state
+            .file_reads
+            .stat
+            .run(&key, move || stat_path(valid_path))
+            .await?
+    } else {
+        stat_path(valid_path).await?
+    };
+
+    Ok(Json(ApiResponse::success(info)))
+}
+
+/// Checksum of a file, streamed through the requested algorithm. Identical
+/// concurrent requests share one read of the file when read coalescing is
+/// enabled.
+pub async fn hash_file(
+    State(state): State<Arc<AppState>>,
+    Query(params): Query<HashFileParams>,
+) -> Result<Json<ApiResponse<FileHash>>, AppError> {
+    let valid_path = state.resolve_path(&params.path)?;
+    let algorithm = match params.algo.as_deref() {
+        None => HashAlgorithm::Sha256,
+        Some(name) => HashAlgorithm::parse(name).ok_or_else(|| {
+            AppError::BadRequest(format!(
+                "Unsupported algo: {} (expected sha256, sha1, md5 or crc32)",
+                name
+            ))
+        })?,
+    };
+
+    let hash = if state.config.coalesce_reads {
+        let key = format!("{}:{}", algorithm.name(), valid_path.to_string_lossy());
+        state
+            .file_reads
+            .hash
+            .run(&key, move || hash_path(valid_path, algorithm))
+            .await?
+    } else {
+        hash_path(valid_path, algorithm).await?
+    };
+
+    Ok(Json(ApiResponse::success(hash)))
+}
+
+async fn stat_path(path: PathBuf) -> Result<FileInfo, AppError> {
+    let not_accessible = |e: std::io::Error| match e.kind() {
+        std::io::ErrorKind::PermissionDenied => {
+            AppError::Forbidden(format!("Permission denied: {}", path.display()))
+        }
+        _ => AppError::NotFound(format!("File not found: {}", path.display())),
+    };
+
+    let link_metadata = fs::symlink_metadata(&path).await.map_err(not_accessible)?;
+    let is_symlink = link_metadata.file_type().is_symlink();
+    let symlink_target = if is_symlink {
+        Some(
+            fs::read_link(&path)
+                .await
+                .map_err(not_accessible)?
+                .to_string_lossy()
+                .to_string(),
+        )
+    } else {
+        None
+    };
+    // Report what the link points to; a dangling link falls back to the link itself
+    let metadata = if is_symlink {
+        fs::metadata(&path).await.unwrap_or(link_metadata)
+    } else {
+        link_metadata
+    };
+
+    let name = path
+        .file_name()
+        .unwrap_or_default()
+        .to_string_lossy()
+        .to_string();
+
+    Ok(FileInfo {
+        is_symlink: Some(is_symlink),
+        symlink_target,
+        ..FileInfo::from_metadata(name, &path, &metadata, true)
+    })
+}
+
+async fn hash_path(path: PathBuf, algorithm: HashAlgorithm) -> Result<FileHash, AppError> {
+    let metadata = fs::metadata(&path)
+        .await
+        .map_err(|_| AppError::NotFound(format!("File not found: {}", path.display())))?;
+    if metadata.is_dir() {
+        return Err(AppError::BadRequest(
+            "Path is a directory, not a file".to_string(),
+        ));
+    }
+
+    let digest = digest_file(&path, algorithm).await?;
+    Ok(FileHash {
+        path: path.to_string_lossy().to_string(),
+        size: metadata.len(),
+        algorithm: algorithm.name().to_string(),
+        sha256: (algorithm == HashAlgorithm::Sha256).then(|| digest.clone()),
+        digest,
+    })
+}
@@ -1,40 +1,107 @@
+use super::perm::{chmod_path, parse_mode};
+use super::trash::move_to_trash;
 use super::types::{FileOperationResponse, WriteFileResponse};
 use crate::error::AppError;
-use crate::response::ApiResponse;
-use crate::state::AppState;
-use crate::utils::path::{ensure_directory, validate_path};
+use crate::middleware::logging::TraceId;
+use crate::response::{if_none_match, not_modified_since, ApiResponse};
+use crate::state::{upload::ProgressReporter, AppState};
+use crate::utils::atomic::AtomicFile;
+use crate::utils::common::{format_http_date, parse_time};
+use crate::utils::dedup::deduplicate;
+use crate::utils::mime::preview_mime_type;
+use crate::utils::path::{
+    absolute_path, depth_exceeded_message, ensure_directory, ensure_writable, DeniedPaths,
+};
+use crate::utils::quota::QuotaReservation;
+use crate::utils::range::{parse_range_header, range_from_offset, ByteRange};
 use axum::{
     body::Body,
     extract::{Multipart, Query, State},
-    http::header,
+    http::{header, HeaderMap, StatusCode},
     response::{IntoResponse, Response},
     Json,
 };
 use futures::StreamExt;
-use serde::Deserialize;
-use std::path::PathBuf;
+use schemars::JsonSchema;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
 use std::sync::Arc;
 use tokio::fs;
-use tokio::io::AsyncWriteExt;
+use tokio::io::{AsyncReadExt, AsyncSeekExt, AsyncWriteExt};
 use tokio_util::io::ReaderStream;
 
-#[derive(Deserialize)]
+#[derive(Deserialize, JsonSchema)]
 pub struct DeleteFileRequest {
     path: String,
     #[serde(default)]
     recursive: bool,
+    /// Report what would be deleted without removing anything
+    #[serde(default, rename = "dryRun")]
+    dry_run: bool,
+}
+
+#[derive(Serialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct DeleteFileResponse {
+    success: bool,
+    /// Id to restore the path with, when it was moved to the trash
+    #[serde(skip_serializing_if = "Option::is_none")]
+    trash_id: Option<String>,
+}
+
+/// What a delete would remove, returned instead of deleting on a dry run
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct DeletePreview {
+    dry_run: bool,
+    /// The path itself followed by everything below it
+    paths: Vec<String>,
+    total_count: u64,
+    /// Apparent size of the files, in bytes
+    total_size: u64,
 }
 
 pub async fn delete_file(
     State(state): State<Arc<AppState>>,
     Json(req): Json<DeleteFileRequest>,
-) -> Result<Json<ApiResponse<FileOperationResponse>>, AppError> {
-    let valid_path = validate_path(&state.config.workspace_path, &req.path)?;
+) -> Result<Response, AppError> {
+    let valid_path = state.resolve_path(&req.path)?;
+    ensure_writable(&state.config.read_only_paths, &valid_path)?;
 
     if !valid_path.exists() {
         return Err(AppError::NotFound("File not found".to_string()));
     }
 
+    if req.dry_run {
+        let preview = deletion_preview(&valid_path, req.recursive).await?;
+        return Ok(Json(ApiResponse::success(preview)).into_response());
+    }
+
+    // With a trash configured the path is moved there; items already in the
+    // trash are deleted for good
+    if let Some(trash_dir) = state.config.trash_dir.as_deref() {
+        let trash_dir = absolute_path(trash_dir);
+        let target = absolute_path(&valid_path);
+        if !target.starts_with(&trash_dir) {
+            if trash_dir.starts_with(&target) {
+                return Err(AppError::BadRequest(format!(
+                    "{} contains the trash directory",
+                    valid_path.display()
+                )));
+            }
+            if valid_path.is_dir() && !req.recursive {
+                ensure_empty_dir(&valid_path).await?;
+            }
+            let id =
+                move_to_trash(&trash_dir, &valid_path, state.config.max_traversal_depth).await?;
+            return Ok(Json(ApiResponse::success(DeleteFileResponse {
+                success: true,
+                trash_id: Some(id),
+            }))
+            .into_response());
+        }
+    }
+
     if valid_path.is_dir() {
         if req.recursive {
             fs::remove_dir_all(valid_path).await?;
@@ -45,23 +112,245 @@ pub async fn delete_file(
         fs::remove_file(valid_path).await?;
     }
 
-    Ok(Json(ApiResponse::success(FileOperationResponse {
+    // Reclaim blobs whose last workspace copy was just deleted
+    if let Some(store) = state.dedup.clone() {
+        tokio::spawn(async move { store.sweep().await });
+    }
+
+    Ok(Json(ApiResponse::success(DeleteFileResponse {
         success: true,
-    })))
+        trash_id: None,
+    }))
+    .into_response())
+}
+
+async fn ensure_empty_dir(path: &Path) -> Result<(), AppError> {
+    if fs::read_dir(path).await?.next_entry().await?.is_some() {
+        return Err(AppError::BadRequest(format!(
+            "Directory not empty: {} (set recursive to delete it)",
+            path.display()
+        )));
+    }
+    Ok(())
+}
+
+/// List the paths a delete of `root` would remove. Like `remove_dir_all`,
+/// the walk does not follow symlinks; a non-recursive delete of a directory
+/// that is not empty fails the same way the real delete would.
+async fn deletion_preview(root: &Path, recursive: bool) -> Result<DeletePreview, AppError> {
+    let mut preview = DeletePreview {
+        dry_run: true,
+        paths: Vec::new(),
+        total_count: 0,
+        total_size: 0,
+    };
+    let mut stack = vec![root.to_path_buf()];
+
+    while let Some(path) = stack.pop() {
+        let metadata = fs::symlink_metadata(&path).await?;
+        if metadata.is_dir() {
+            if !recursive {
+                ensure_empty_dir(&path).await?;
+            }
+            let mut entries = fs::read_dir(&path).await?;
+            let mut children = Vec::new();
+            while let Some(entry) = entries.next_entry().await? {
+                children.push(entry.path());
+            }
+            // Reversed so entries come off the stack in name order
+            children.sort_unstable_by(|a, b| b.cmp(a));
+            stack.extend(children);
+        } else if metadata.is_file() {
+            preview.total_size += metadata.len();
+        }
+        preview.paths.push(path.to_string_lossy().to_string());
+        preview.total_count += 1;
+    }
+
+    Ok(preview)
 }
 
-#[derive(Deserialize)]
+#[derive(Deserialize, JsonSchema)]
 pub struct WriteFileRequest {
     path: String,
     content: String,
     encoding: Option<String>,
+    /// Verify the written bytes against this hex SHA-256 before replacing the file
+    #[serde(rename = "expectedSha256")]
+    expected_sha256: Option<String>,
+    /// Append to the existing file instead of replacing it
+    #[serde(default)]
+    append: bool,
+    /// Octal mode applied after writing, e.g. "0755"
+    permissions: Option<String>,
+    /// RFC 3339 modification time applied after writing
+    #[serde(rename = "modTime")]
+    mod_time: Option<String>,
+}
+
+/// Permissions and modification time requested for a written file
+struct FileAttributes {
+    mode: Option<u32>,
+    mod_time: Option<std::time::SystemTime>,
+}
+
+impl FileAttributes {
+    /// Validates the raw values up front so a bad one fails before any write.
+    fn parse(permissions: Option<&str>, mod_time: Option<&str>) -> Result<Self, AppError> {
+        let mode = permissions
+            .map(|p| {
+                parse_mode(p).map_err(|_| {
+                    AppError::Validation(format!(
+                        "Invalid permissions {:?} (expected octal like 0644)",
+                        p
+                    ))
+                })
+            })
+            .transpose()?;
+        let mod_time = mod_time
+            .map(|t| {
+                parse_time(t).ok_or_else(|| {
+                    AppError::Validation(format!(
+                        "Invalid modTime {:?} (expected RFC 3339 like 2024-01-01T12:00:00Z)",
+                        t
+                    ))
+                })
+            })
+            .transpose()?;
+        Ok(FileAttributes { mode, mod_time })
+    }
+
+    fn is_empty(&self) -> bool {
+        self.mode.is_none() && self.mod_time.is_none()
+    }
+
+    async fn apply(&self, path: &Path) -> Result<(), AppError> {
+        // The timestamp goes first since the new mode may make the file read-only
+        if let Some(mod_time) = self.mod_time {
+            let file = std::fs::File::options().write(true).open(path)?;
+            file.set_modified(mod_time)?;
+        }
+        if let Some(mode) = self.mode {
+            chmod_path(path, mode).await?;
+        }
+        Ok(())
+    }
+}
+
+/// Destination of a write: a temp file atomically swapped into place, or the
+/// existing file opened for appending.
+enum WriteTarget {
+    Replace(AtomicFile),
+    Append { file: fs::File, existing: u64 },
+}
+
+impl WriteTarget {
+    async fn open(
+        state: &AppState,
+        path: &Path,
+        append: bool,
+        verify: bool,
+    ) -> Result<Self, AppError> {
+        if !append {
+            return Ok(WriteTarget::Replace(
+                AtomicFile::create(state.config.temp_dir.as_deref(), path).await?,
+            ));
+        }
+        // Appended bytes go straight into the file, so there is nothing to
+        // verify before they become visible.
+        if verify {
+            return Err(AppError::BadRequest(
+                "expectedSha256 cannot be combined with append".to_string(),
+            ));
+        }
+        if let Some(store) = &state.dedup {
+            if path.exists() {
+                store.detach(path).await?;
+            }
+        }
+        let file = fs::OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(path)
+            .await?;
+        let existing = file.metadata().await?.len();
+        Ok(WriteTarget::Append { file, existing })
+    }
+
+    fn file(&mut self) -> &mut fs::File {
+        match self {
+            WriteTarget::Replace(atomic) => &mut atomic.file,
+            WriteTarget::Append { file, .. } => file,
+        }
+    }
+
+    /// Undo an uncommitted write: a replacement is discarded along with its
+    /// temp file, appended bytes are truncated away.
+    async fn abort(self) {
+        if let WriteTarget::Append { file, existing } = self {
+            let _ = file.set_len(existing).await;
+        }
+    }
+
+    /// Reject the write once the resulting file would exceed the size limit.
+    fn check_size(&self, written: u64, max_file_size: u64) -> Result<(), AppError> {
+        let existing = match self {
+            WriteTarget::Replace(_) => 0,
+            WriteTarget::Append { existing, .. } => *existing,
+        };
+        if existing + written > max_file_size {
+            return Err(AppError::BadRequest("File too large".to_string()));
+        }
+        Ok(())
+    }
+
+    /// Verify and commit a replacement, or flush appended data, then apply
+    /// the requested attributes. Returns the dedup outcome, which only applies
+    /// to replaced files without custom attributes (links share their inode).
+    async fn finish(
+        self,
+        state: &AppState,
+        path: &Path,
+        expected_sha256: Option<&str>,
+        attributes: &FileAttributes,
+    ) -> Result<Option<bool>, AppError> {
+        match self {
+            WriteTarget::Replace(mut atomic) => {
+                if let Some(expected) = expected_sha256 {
+                    atomic.verify_sha256(expected).await?;
+                }
+                atomic.commit().await?;
+                if attributes.is_empty() {
+                    return Ok(deduplicate(state.dedup.as_deref(), path).await);
+                }
+                attributes.apply(path).await?;
+                Ok(None)
+            }
+            WriteTarget::Append { mut file, existing } => {
+                // Only reachable when a multipart checksum arrived after the
+                // data; undo the append rather than ignore it
+                if expected_sha256.is_some() {
+                    file.set_len(existing).await?;
+                    return Err(AppError::BadRequest(
+                        "expectedSha256 cannot be combined with append".to_string(),
+                    ));
+                }
+                file.flush().await?;
+                attributes.apply(path).await?;
+                Ok(None)
+            }
+        }
+    }
 }
 
 pub async fn write_file_json(
     State(state): State<Arc<AppState>>,
+    trace: TraceId,
     Json(req): Json<WriteFileRequest>,
 ) -> Result<Json<ApiResponse<WriteFileResponse>>, AppError> {
-    let valid_path = validate_path(&state.config.workspace_path, &req.path)?;
+    let valid_path = state.resolve_path(&req.path)?;
+    ensure_writable(&state.config.read_only_paths, &valid_path)?;
+    let attributes = FileAttributes::parse(req.permissions.as_deref(), req.mod_time.as_deref())?;
 
     let content_bytes = if let Some(enc) = req.encoding {
         if enc == "base64" {
@@ -79,27 +368,162 @@ pub async fn write_file_json(
     if content_bytes.len() as u64 > state.config.max_file_size {
         return Err(AppError::BadRequest("File too large".to_string()));
     }
+    let size = content_bytes.len() as u64;
+    let reservation = state.reserve_quota(size).await?;
 
     if let Some(parent) = valid_path.parent() {
         ensure_directory(parent).await?;
     }
 
-    fs::write(&valid_path, content_bytes).await?;
+    let mut target = WriteTarget::open(
+        &state,
+        &valid_path,
+        req.append,
+        req.expected_sha256.is_some(),
+    )
+    .await?;
+    target.check_size(size, state.config.max_file_size)?;
+    target.file().write_all(&content_bytes).await?;
+    let deduplicated = target
+        .finish(
+            &state,
+            &valid_path,
+            req.expected_sha256.as_deref(),
+            &attributes,
+        )
+        .await?;
+    reservation.commit(size).await;
+    trace.log(format_args!(
+        "Wrote {} bytes to {}",
+        size,
+        valid_path.display()
+    ));
 
     Ok(Json(ApiResponse::success(WriteFileResponse {
-        path: valid_path.to_string_lossy().to_string(),
-        size: fs::metadata(&valid_path).await?.len(),
+        deduplicated,
+        ..WriteFileResponse::new(&state.config.workspace_path, &valid_path, size)
     })))
 }
 
+#[derive(Deserialize, JsonSchema)]
+pub struct PatchFileRequest {
+    path: String,
+    offset: u64,
+    data: String,
+    encoding: Option<String>,
+}
+
+/// Overwrite bytes of an existing file in place starting at `offset`,
+/// extending the file when the write runs past its end.
+pub async fn patch_file(
+    State(state): State<Arc<AppState>>,
+    Json(req): Json<PatchFileRequest>,
+) -> Result<Json<ApiResponse<WriteFileResponse>>, AppError> {
+    let valid_path = state.resolve_path(&req.path)?;
+    ensure_writable(&state.config.read_only_paths, &valid_path)?;
+
+    let data = if req.encoding.as_deref() == Some("base64") {
+        use base64::{engine::general_purpose, Engine as _};
+        general_purpose::STANDARD
+            .decode(&req.data)
+            .map_err(|e| AppError::BadRequest(format!("Invalid base64: {}", e)))?
+    } else {
+        req.data.into_bytes()
+    };
+
+    let metadata = fs::metadata(&valid_path)
+        .await
+        .map_err(|_| AppError::NotFound("File not found".to_string()))?;
+    if !metadata.is_file() {
+        return Err(AppError::BadRequest("Path is not a file".to_string()));
+    }
+
+    let end = req
+        .offset
+        .checked_add(data.len() as u64)
+        .ok_or_else(|| AppError::BadRequest("Offset out of range".to_string()))?;
+    if end > metadata.len() && end > state.config.max_file_size {
+        return Err(AppError::BadRequest("File too large".to_string()));
+    }
+
+    if let Some(store) = &state.dedup {
+        store.detach(&valid_path).await?;
+    }
+
+    let mut file = fs::OpenOptions::new().write(true).open(&valid_path).await?;
+    file.seek(std::io::SeekFrom::Start(req.offset)).await?;
+    file.write_all(&data).await?;
+    file.flush().await?;
+
+    let size = fs::metadata(&valid_path).await?.len();
+    Ok(Json(ApiResponse::success(WriteFileResponse::new(
+        &state.config.workspace_path,
+        &valid_path,
+        size,
+    ))))
+}
+
+/// A multipart file that has been received but not committed yet, so that
+/// options sent after it (`expectedSha256`, `permissions`, `modTime`) still
+/// apply.
+struct PendingFile {
+    target: WriteTarget,
+    reservation: QuotaReservation,
+    path: PathBuf,
+    path_str: String,
+    size: u64,
+}
+
+impl PendingFile {
+    async fn finish(
+        self,
+        state: &AppState,
+        trace: &TraceId,
+        expected_sha256: Option<&str>,
+        permissions: Option<&str>,
+        mod_time: Option<&str>,
+        progress: Option<&mut ProgressReporter>,
+    ) -> Result<(PathBuf, u64, Option<bool>), AppError> {
+        let attributes = match FileAttributes::parse(permissions, mod_time) {
+            Ok(attributes) => attributes,
+            Err(e) => {
+                self.target.abort().await;
+                return Err(e);
+            }
+        };
+        let deduplicated = self
+            .target
+            .finish(state, &self.path, expected_sha256, &attributes)
+            .await?;
+        self.reservation.commit(self.size).await;
+        trace.log(format_args!(
+            "Wrote {} bytes to {}",
+            self.size,
+            self.path.display()
+        ));
+        if let Some(p) = progress {
+            p.complete(&self.path_str, self.size);
+        }
+        Ok((self.path, self.size, deduplicated))
+    }
+}
+
 pub async fn write_file_multipart(
     State(state): State<Arc<AppState>>,
+    trace: TraceId,
     mut multipart: Multipart,
 ) -> Result<Json<ApiResponse<WriteFileResponse>>, AppError> {
     let mut target_path = None;
     let mut file_saved = false;
     let mut saved_size = 0;
+    let mut deduplicated = None;
     let mut saved_path = PathBuf::new();
+    let mut progress: Option<ProgressReporter> = None;
+    let mut expected_sha256: Option<String> = None;
+    let mut append = false;
+    let mut permissions: Option<String> = None;
+    let mut mod_time: Option<String> = None;
+    let mut pending: Option<PendingFile> = None;
 
     while let Some(field) = multipart
         .next_field()
@@ -108,42 +532,115 @@ pub async fn write_file_multipart(
     {
         let name = field.name().unwrap_or("").to_string();
 
+        // Where and how a file is written is decided when it arrives
+        if (name == "path" || name == "append") && file_saved {
+            if let Some(file) = pending.take() {
+                file.target.abort().await;
+            }
+            return Err(AppError::BadRequest(format!(
+                "The {} field must come before the file",
+                name
+            )));
+        }
+
         if name == "path" {
             let val = field
                 .text()
                 .await
                 .map_err(|e| AppError::BadRequest(e.to_string()))?;
             target_path = Some(val);
+        } else if name == "uploadId" {
+            let upload_id = field
+                .text()
+                .await
+                .map_err(|e| AppError::BadRequest(e.to_string()))?;
+            progress = Some(ProgressReporter::new(&state.uploads, upload_id).await);
+        } else if name == "expectedSha256" {
+            let val = field
+                .text()
+                .await
+                .map_err(|e| AppError::BadRequest(e.to_string()))?;
+            expected_sha256 = Some(val);
+        } else if name == "append" {
+            let val = field
+                .text()
+                .await
+                .map_err(|e| AppError::BadRequest(e.to_string()))?;
+            append = val == "true" || val == "1";
+        } else if name == "permissions" || name == "modTime" {
+            let val = field
+                .text()
+                .await
+                .map_err(|e| AppError::BadRequest(e.to_string()))?;
+            if name == "permissions" {
+                permissions = Some(val);
+            } else {
+                mod_time = Some(val);
+            }
         } else if name == "file" || name == "files" {
+            if let Some(file) = pending.take() {
+                (saved_path, saved_size, deduplicated) = file
+                    .finish(
+                        &state,
+                        &trace,
+                        expected_sha256.as_deref(),
+                        permissions.as_deref(),
+                        mod_time.as_deref(),
+                        progress.as_mut(),
+                    )
+                    .await?;
+            }
             let filename = field.file_name().unwrap_or("unknown").to_string();
             let path_str = target_path.clone().unwrap_or_else(|| filename.clone());
-            let valid_path = validate_path(&state.config.workspace_path, &path_str)?;
+            let valid_path = state.resolve_path(&path_str)?;
+            ensure_writable(&state.config.read_only_paths, &valid_path)?;
 
             if let Some(parent) = valid_path.parent() {
                 ensure_directory(parent).await?;
             }
 
-            let mut file = fs::File::create(&valid_path).await?;
+            let mut reservation = state.reserve_quota(0).await?;
+            let mut target =
+                WriteTarget::open(&state, &valid_path, append, expected_sha256.is_some()).await?;
             let mut size = 0;
 
             let mut stream = field;
             while let Some(chunk) = stream.next().await {
                 let chunk = chunk.map_err(|e| AppError::InternalServerError(e.to_string()))?;
                 size += chunk.len() as u64;
-                if size > state.config.max_file_size {
-                    drop(file);
-                    fs::remove_file(&valid_path).await.ok();
-                    return Err(AppError::BadRequest("File too large".to_string()));
+                target.check_size(size, state.config.max_file_size)?;
+                reservation.ensure(size).await?;
+                target.file().write_all(&chunk).await?;
+                if let Some(p) = progress.as_mut() {
+                    p.update(&path_str, size, None);
                 }
-                file.write_all(&chunk).await?;
             }
 
+            // Committed once the form ends or the next file starts
+            pending = Some(PendingFile {
+                target,
+                reservation,
+                path: valid_path,
+                path_str,
+                size,
+            });
             file_saved = true;
-            saved_size = size;
-            saved_path = valid_path;
         }
     }
 
+    if let Some(file) = pending.take() {
+        (saved_path, saved_size, deduplicated) = file
+            .finish(
+                &state,
+                &trace,
+                expected_sha256.as_deref(),
+                permissions.as_deref(),
+                mod_time.as_deref(),
+                progress.as_mut(),
+            )
+            .await?;
+    }
+
     if !file_saved {
         return Err(AppError::BadRequest(
             "No file found in multipart form".to_string(),
@@ -151,56 +648,151 @@ pub async fn write_file_multipart(
     }
 
     Ok(Json(ApiResponse::success(WriteFileResponse {
-        path: saved_path.to_string_lossy().to_string(),
-        size: saved_size,
+        deduplicated,
+        ..WriteFileResponse::new(&state.config.workspace_path, &saved_path, saved_size)
     })))
 }
 
 pub async fn write_file_binary(
     State(state): State<Arc<AppState>>,
+    trace: TraceId,
     Query(params): Query<std::collections::HashMap<String, String>>,
     body: Body,
 ) -> Result<Json<ApiResponse<WriteFileResponse>>, AppError> {
     let path_str = params
         .get("path")
         .ok_or_else(|| AppError::BadRequest("Path parameter required".to_string()))?;
-    let valid_path = validate_path(&state.config.workspace_path, path_str)?;
+    let valid_path = state.resolve_path(path_str)?;
+    ensure_writable(&state.config.read_only_paths, &valid_path)?;
+    let attributes = FileAttributes::parse(
+        params.get("permissions").map(String::as_str),
+        params.get("modTime").map(String::as_str),
+    )?;
 
     if let Some(parent) = valid_path.parent() {
         ensure_directory(parent).await?;
     }
 
-    let mut file = fs::File::create(&valid_path).await?;
+    let total_bytes = axum::body::HttpBody::size_hint(&body).exact();
+    let mut progress = match params.get("uploadId") {
+        Some(id) => Some(ProgressReporter::new(&state.uploads, id.clone()).await),
+        None => None,
+    };
+
+    let append = params
+        .get("append")
+        .is_some_and(|v| v == "true" || v == "1");
+    let expected_sha256 = params.get("expectedSha256").map(String::as_str);
+    let mut reservation = state.reserve_quota(0).await?;
+    let mut target =
+        WriteTarget::open(&state, &valid_path, append, expected_sha256.is_some()).await?;
+    // Fail before appending anything when the announced length is already too much
+    if let Some(total) = total_bytes {
+        target.check_size(total, state.config.max_file_size)?;
+        reservation.ensure(total).await?;
+    }
     let mut size = 0;
 
     let mut stream = body.into_data_stream();
     while let Some(chunk) = stream.next().await {
         let chunk = chunk.map_err(|e| AppError::InternalServerError(e.to_string()))?;
         size += chunk.len() as u64;
-        if size > state.config.max_file_size {
-            drop(file);
-            fs::remove_file(&valid_path).await.ok();
-            return Err(AppError::BadRequest("File too large".to_string()));
+        target.check_size(size, state.config.max_file_size)?;
+        reservation.ensure(size).await?;
+        target.file().write_all(&chunk).await?;
+        if let Some(p) = progress.as_mut() {
+            p.update(path_str, size, total_bytes);
         }
-        file.write_all(&chunk).await?;
+    }
+    let deduplicated = target
+        .finish(&state, &valid_path, expected_sha256, &attributes)
+        .await?;
+    reservation.commit(size).await;
+    trace.log(format_args!(
+        "Wrote {} bytes to {}",
+        size,
+        valid_path.display()
+    ));
+    if let Some(p) = progress.as_mut() {
+        p.complete(path_str, size);
     }
 
     Ok(Json(ApiResponse::success(WriteFileResponse {
-        path: valid_path.to_string_lossy().to_string(),
-        size,
+        deduplicated,
+        ..WriteFileResponse::new(&state.config.workspace_path, &valid_path, size)
     })))
 }
 
-#[derive(Deserialize)]
+#[derive(Deserialize, JsonSchema)]
 pub struct ReadFileParams {
     path: String,
+    /// Return the content inline as JSON ("utf8" or "base64") instead of streaming it
+    encoding: Option<String>,
+    /// "attachment" (default) or "inline" to let browsers preview the file
+    disposition: Option<String>,
+    /// Read only part of the file, as an alternative to the `Range` header
+    offset: Option<u64>,
+    length: Option<u64>,
+}
+
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+pub struct ReadFileResponse {
+    path: String,
+    content: String,
+    encoding: String,
+    size: u64,
+    /// Start of the returned content for partial reads
+    #[serde(skip_serializing_if = "Option::is_none")]
+    offset: Option<u64>,
+}
+
+/// Byte range requested through `offset`/`length` or the `Range` header, if any.
+fn requested_range(
+    params: &ReadFileParams,
+    headers: &HeaderMap,
+    size: u64,
+) -> Result<Option<ByteRange>, AppError> {
+    let range_header = headers
+        .get(header::RANGE)
+        .map(|v| {
+            v.to_str()
+                .map_err(|_| AppError::Validation("Invalid Range header".to_string()))
+        })
+        .transpose()?;
+
+    let by_offset = params.offset.is_some() || params.length.is_some();
+    let range = match (by_offset, range_header) {
+        (true, Some(_)) => {
+            return Err(AppError::Validation(
+                "Use either the Range header or offset/length, not both".to_string(),
+            ))
+        }
+        (true, None) => range_from_offset(params.offset, params.length, size),
+        (false, Some(value)) => parse_range_header(value, size),
+        (false, None) => return Ok(None),
+    };
+    range.map(Some).map_err(AppError::Validation)
+}
+
+/// Weak validator of a file's content, derived from its size and
+/// modification time
+fn file_etag(metadata: &std::fs::Metadata) -> String {
+    let mtime = metadata
+        .modified()
+        .ok()
+        .and_then(|t| t.duration_since(std::time::UNIX_EPOCH).ok())
+        .map(|d| d.as_nanos())
+        .unwrap_or(0);
+    format!("W/\"{:x}-{:x}\"", metadata.len(), mtime)
 }
 
 pub async fn read_file(
     State(state): State<Arc<AppState>>,
     Query(params): Query<ReadFileParams>,
+    headers: HeaderMap,
 ) -> Result<Response, AppError> {
-    let valid_path = validate_path(&state.config.workspace_path, &params.path)?;
+    let valid_path = state.resolve_path(&params.path)?;
 
     if !valid_path.exists() {
         return Err(AppError::NotFound("File not found".to_string()));
@@ -212,32 +804,164 @@ pub async fn read_file(
         ));
     }
 
-    let file = fs::File::open(&valid_path).await?;
+    let mut file = fs::File::open(&valid_path).await?;
     let metadata = file.metadata().await?;
     let size = metadata.len();
+
+    let etag = file_etag(&metadata);
+    let modified = metadata.modified().ok();
+    let mut validators = HeaderMap::new();
+    if let Ok(value) = etag.parse() {
+        validators.insert(header::ETAG, value);
+    }
+    if let Some(secs) = modified
+        .and_then(|t| t.duration_since(std::time::UNIX_EPOCH).ok())
+        .map(|d| d.as_secs())
+    {
+        if let Ok(value) = format_http_date(secs).parse() {
+            validators.insert(header::LAST_MODIFIED, value);
+        }
+    }
+    // If-Modified-Since only counts when the client sent no ETag to compare
+    let unchanged = if headers.contains_key(header::IF_NONE_MATCH) {
+        if_none_match(&headers, &etag)
+    } else {
+        modified.is_some_and(|t| not_modified_since(&headers, t))
+    };
+    if unchanged {
+        return Ok((StatusCode::NOT_MODIFIED, validators).into_response());
+    }
+
+    let range = requested_range(&params, &headers, size)?;
+
+    if let Some(encoding) = params.encoding.as_deref() {
+        return read_file_inline(&state, &valid_path, size, range, encoding)
+            .await
+            .map(|r| (validators, r).into_response());
+    }
+
     let filename = valid_path
         .file_name()
         .unwrap_or_default()
         .to_string_lossy()
         .to_string();
-    let mime_type = "application/octet-stream".to_string();
+    let inline = match params.disposition.as_deref() {
+        None | Some("attachment") => false,
+        Some("inline") => true,
+        Some(other) => {
+            return Err(AppError::BadRequest(format!(
+                "Unsupported disposition: {} (expected attachment or inline)",
+                other
+            )))
+        }
+    };
+    let mime_type = if inline {
+        preview_mime_type(&valid_path).unwrap_or("application/octet-stream")
+    } else {
+        "application/octet-stream"
+    };
+
+    let length = match range {
+        Some(range) => {
+            file.seek(std::io::SeekFrom::Start(range.start)).await?;
+            range.length()
+        }
+        None => size,
+    };
 
-    let stream = ReaderStream::new(file);
+    // A disconnecting client simply drops the body (and with it the file handle);
+    // read errors are logged since hyper only sees them as an aborted stream.
+    let log_path = valid_path.clone();
+    let stream = ReaderStream::new(file.take(length)).inspect(move |chunk| {
+        if let Err(e) = chunk {
+            println!("Download of {:?} failed: {}", log_path, e);
+        }
+    });
     let body = Body::from_stream(stream);
 
     let headers = [
-        (header::CONTENT_TYPE, mime_type),
-        (header::CONTENT_LENGTH, size.to_string()),
+        (header::CONTENT_TYPE, mime_type.to_string()),
+        (header::CONTENT_LENGTH, length.to_string()),
         (
             header::CONTENT_DISPOSITION,
-            format!("attachment; filename=\"{}\"", filename),
+            format!(
+                "{}; filename=\"{}\"",
+                if inline { "inline" } else { "attachment" },
+                filename
+            ),
         ),
+        (header::X_CONTENT_TYPE_OPTIONS, "nosniff".to_string()),
+        (header::ACCEPT_RANGES, "bytes".to_string()),
     ];
 
-    Ok((headers, body).into_response())
+    match range {
+        Some(range) => Ok((
+            StatusCode::PARTIAL_CONTENT,
+            [(header::CONTENT_RANGE, range.content_range(size))],
+            headers,
+            validators,
+            body,
+        )
+            .into_response()),
+        None => Ok((headers, validators, body).into_response()),
+    }
 }
 
-#[derive(Deserialize)]
+/// Read a file (or the requested range of it) into a JSON response, bounded by
+/// `max_read_size` since the content is materialized in memory (and grows by a
+/// third as base64).
+async fn read_file_inline(
+    state: &AppState,
+    path: &std::path::Path,
+    size: u64,
+    range: Option<ByteRange>,
+    encoding: &str,
+) -> Result<Json<ApiResponse<ReadFileResponse>>, AppError> {
+    if encoding != "utf8" && encoding != "base64" {
+        return Err(AppError::BadRequest(format!(
+            "Unsupported encoding: {} (expected utf8 or base64)",
+            encoding
+        )));
+    }
+
+    let length = range.map_or(size, |r| r.length());
+    let limit = state.config.max_read_size;
+    if length > limit {
+        return Err(AppError::BadRequest(format!(
+            "File is too large to read inline ({} bytes, limit {} bytes); use /api/v1/files/download to stream it",
+            length, limit
+        )));
+    }
+
+    let bytes = match range {
+        Some(range) => {
+            let mut file = fs::File::open(path).await?;
+            file.seek(std::io::SeekFrom::Start(range.start)).await?;
+            let mut bytes = Vec::with_capacity(length as usize);
+            file.take(length).read_to_end(&mut bytes).await?;
+            bytes
+        }
+        None => fs::read(path).await?,
+    };
+    let content = if encoding == "base64" {
+        use base64::{engine::general_purpose, Engine as _};
+        general_purpose::STANDARD.encode(&bytes)
+    } else {
+        String::from_utf8(bytes).map_err(|_| {
+            AppError::BadRequest("File is not valid UTF-8; use encoding=base64".to_string())
+        })?
+    };
+
+    Ok(Json(ApiResponse::success(ReadFileResponse {
+        path: path.to_string_lossy().to_string(),
+        content,
+        encoding: encoding.to_string(),
+        size,
+        offset: range.map(|r| r.start),
+    })))
+}
+
+#[derive(Deserialize, JsonSchema)]
 pub struct MoveFileRequest {
     source: String,
     destination: String,
@@ -249,12 +973,21 @@ pub async fn move_file(
     State(state): State<Arc<AppState>>,
     Json(req): Json<MoveFileRequest>,
 ) -> Result<Json<ApiResponse<FileOperationResponse>>, AppError> {
-    let source_path = validate_path(&state.config.workspace_path, &req.source)?;
-    let dest_path = validate_path(&state.config.workspace_path, &req.destination)?;
+    let source_path = state.resolve_path(&req.source)?;
+    let dest_path = state.resolve_path(&req.destination)?;
+    ensure_writable(&state.config.read_only_paths, &source_path)?;
+    ensure_writable(&state.config.read_only_paths, &dest_path)?;
 
     if !source_path.exists() {
         return Err(AppError::NotFound("Source file not found".to_string()));
     }
+    check_denied_tree(
+        &state.denied_paths,
+        &source_path,
+        &dest_path,
+        state.config.max_traversal_depth,
+    )
+    .await?;
 
     if dest_path.exists() {
         if !req.overwrite {
@@ -278,7 +1011,404 @@ pub async fn move_file(
     })))
 }
 
-#[derive(Deserialize)]
+#[derive(Deserialize, JsonSchema)]
+pub struct BatchMoveItem {
+    source: String,
+    destination: String,
+}
+
+#[derive(Deserialize, JsonSchema)]
+pub struct BatchMoveRequest {
+    moves: Vec<BatchMoveItem>,
+}
+
+#[derive(Serialize, Clone, Copy, Debug, PartialEq, JsonSchema)]
+#[serde(rename_all = "snake_case")]
+pub enum MoveStatus {
+    Moved,
+    /// Rejected by validation; nothing was moved
+    Invalid,
+    /// Valid, but not attempted because another move was invalid or failed
+    Skipped,
+    Failed,
+    /// Moved, then moved back after a later move failed
+    RolledBack,
+    /// Moved, and could not be moved back after a later move failed
+    RollbackFailed,
+}
+
+#[derive(Serialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct BatchMoveResult {
+    source: String,
+    destination: String,
+    status: MoveStatus,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    error: Option<String>,
+}
+
+#[derive(Serialize, JsonSchema)]
+pub struct BatchMoveResponse {
+    /// Whether every move was done
+    success: bool,
+    results: Vec<BatchMoveResult>,
+}
+
+/// Move several paths as one operation. Every move is validated before any
+/// is made; if one then fails, the moves already done are reversed, so the
+/// workspace ends up either fully moved or as it was (apart from parent
+/// directories created for destinations). Destinations must not exist.
+pub async fn batch_move(
+    State(state): State<Arc<AppState>>,
+    Json(req): Json<BatchMoveRequest>,
+) -> Result<Json<ApiResponse<BatchMoveResponse>>, AppError> {
+    if req.moves.is_empty() {
+        return Err(AppError::BadRequest("No moves given".to_string()));
+    }
+    if req.moves.len() > state.config.max_batch_files {
+        return Err(AppError::BadRequest(format!(
+            "Too many moves: {} (limit {})",
+            req.moves.len(),
+            state.config.max_batch_files
+        )));
+    }
+
+    let mut planned = Vec::with_capacity(req.moves.len());
+    for item in &req.moves {
+        planned.push(
+            check_move(&state, item)
+                .await
+                .map_err(|e| e.message().to_string()),
+        );
+    }
+    let conflicts = move_conflicts(&planned);
+    for (plan, conflict) in planned.iter_mut().zip(conflicts) {
+        if let Some(conflict) = conflict {
+            *plan = Err(conflict);
+        }
+    }
+
+    let mut results: Vec<BatchMoveResult> = req
+        .moves
+        .iter()
+        .zip(&planned)
+        .map(|(item, plan)| BatchMoveResult {
+            source: item.source.clone(),
+            destination: item.destination.clone(),
+            status: if plan.is_ok() {
+                MoveStatus::Skipped
+            } else {
+                MoveStatus::Invalid
+            },
+            error: plan.as_ref().err().cloned(),
+        })
+        .collect();
+    // Nothing is moved unless every move is valid
+    let moves: Vec<(PathBuf, PathBuf)> = planned.into_iter().flatten().collect();
+    if moves.len() < results.len() {
+        return Ok(Json(ApiResponse::success(BatchMoveResponse {
+            success: false,
+            results,
+        })));
+    }
+
+    let outcome = apply_moves(&moves).await;
+    for (result, (status, error)) in results.iter_mut().zip(outcome) {
+        result.status = status;
+        result.error = error;
+    }
+    let success = results.iter().all(|r| r.status == MoveStatus::Moved);
+
+    Ok(Json(ApiResponse::success(BatchMoveResponse {
+        success,
+        results,
+    })))
+}
+
+/// Resolve and validate one move on its own.
+async fn check_move(
+    state: &AppState,
+    item: &BatchMoveItem,
+) -> Result<(PathBuf, PathBuf), AppError> {
+    let source = state.resolve_path(&item.source)?;
+    let dest = state.resolve_path(&item.destination)?;
+    ensure_writable(&state.config.read_only_paths, &source)?;
+    ensure_writable(&state.config.read_only_paths, &dest)?;
+
+    if fs::symlink_metadata(&source).await.is_err() {
+        return Err(AppError::NotFound("Source file not found".to_string()));
+    }
+    if fs::symlink_metadata(&dest).await.is_ok() {
+        return Err(AppError::Conflict("Destination already exists".to_string()));
+    }
+    if dest.starts_with(&source) {
+        return Err(AppError::BadRequest(
+            "Cannot move a directory into itself".to_string(),
+        ));
+    }
+    check_denied_tree(
+        &state.denied_paths,
+        &source,
+        &dest,
+        state.config.max_traversal_depth,
+    )
+    .await?;
+    Ok((source, dest))
+}
+
+/// Forbid moving or copying the tree at `source` to `dest` when a path in it
+/// is denied, or would be once at `dest`: a denied file must not be carried
+/// out from under its pattern, nor planted beneath one.
+async fn check_denied_tree(
+    denied: &DeniedPaths,
+    source: &Path,
+    dest: &Path,
+    max_depth: usize,
+) -> Result<(), AppError> {
+    if denied.is_empty() || !fs::symlink_metadata(source).await?.is_dir() {
+        return Ok(());
+    }
+
+    let mut stack = vec![(source.to_path_buf(), dest.to_path_buf(), 0)];
+    while let Some((from, to, depth)) = stack.pop() {
+        if depth > max_depth {
+            return Err(AppError::BadRequest(depth_exceeded_message(
+                max_depth, &from,
+            )));
+        }
+        let mut entries = fs::read_dir(&from).await?;
+        while let Some(entry) = entries.next_entry().await? {
+            let target = to.join(entry.file_name());
+            denied.check(&entry.path())?;
+            denied.check(&target)?;
+            if entry.file_type().await?.is_dir() {
+                stack.push((entry.path(), target, depth + 1));
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Reasons moves that are valid on their own cannot be made together: a
+/// destination used twice, or a path that an earlier move takes away or a
+/// later one fills.
+fn move_conflicts<E>(planned: &[Result<(PathBuf, PathBuf), E>]) -> Vec<Option<String>> {
+    let mut conflicts = vec![None; planned.len()];
+    for (i, plan) in planned.iter().enumerate() {
+        let Ok((source, dest)) = plan else {
+            continue;
+        };
+        for (j, other) in planned.iter().enumerate() {
+            let Ok((other_source, other_dest)) = other else {
+                continue;
+            };
+            if i == j {
+                continue;
+            }
+            let reason = if dest == other_dest {
+                "Same destination as"
+            } else if source.starts_with(other_source) || other_source.starts_with(source) {
+                "Source overlaps the source of"
+            } else if dest.starts_with(other_source) || other_dest.starts_with(source) {
+                "Depends on a path changed by"
+            } else {
+                continue;
+            };
+            // 1-based like the positions clients see
+            conflicts[i] = Some(format!("{} move {}", reason, j + 1));
+            break;
+        }
+    }
+    conflicts
+}
+
+/// Rename each pair in order. After the first failure the remaining moves
+/// are skipped and the completed ones are renamed back, newest first.
+async fn apply_moves(moves: &[(PathBuf, PathBuf)]) -> Vec<(MoveStatus, Option<String>)> {
+    let mut outcome = vec![(MoveStatus::Skipped, None); moves.len()];
+    for (i, (source, dest)) in moves.iter().enumerate() {
+        let moved = async {
+            if let Some(parent) = dest.parent() {
+                ensure_directory(parent).await?;
+            }
+            fs::rename(source, dest).await.map_err(AppError::from)
+        }
+        .await;
+        if let Err(e) = moved {
+            outcome[i] = (MoveStatus::Failed, Some(e.message().to_string()));
+            for (j, (source, dest)) in moves[..i].iter().enumerate().rev() {
+                outcome[j] = match fs::rename(dest, source).await {
+                    Ok(()) => (MoveStatus::RolledBack, None),
+                    Err(e) => (MoveStatus::RollbackFailed, Some(e.to_string())),
+                };
+            }
+            return outcome;
+        }
+        outcome[i] = (MoveStatus::Moved, None);
+    }
+    outcome
+}
+
+#[derive(Deserialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct CopyFileRequest {
+    source: String,
+    destination: String,
+    #[serde(default)]
+    overwrite: bool,
+    /// Required to copy a directory tree
+    #[serde(default)]
+    recursive: bool,
+}
+
+#[derive(Serialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct CopyFileResponse {
+    source: String,
+    destination: String,
+    bytes_copied: u64,
+    timestamp: String,
+}
+
+/// Copy a file, or a directory tree with `recursive`, preserving permissions.
+/// Symlinks inside a copied tree are recreated rather than followed.
+pub async fn copy_file(
+    State(state): State<Arc<AppState>>,
+    Json(req): Json<CopyFileRequest>,
+) -> Result<Json<ApiResponse<CopyFileResponse>>, AppError> {
+    let source_path = state.resolve_path(&req.source)?;
+    let dest_path = state.resolve_path(&req.destination)?;
+    ensure_writable(&state.config.read_only_paths, &dest_path)?;
+
+    let source_meta = fs::metadata(&source_path)
+        .await
+        .map_err(|_| AppError::NotFound("Source file not found".to_string()))?;
+    if source_meta.is_dir() {
+        if !req.recursive {
+            return Err(AppError::BadRequest(
+                "Source is a directory; set recursive to copy it".to_string(),
+            ));
+        }
+        if dest_path.starts_with(&source_path) {
+            return Err(AppError::BadRequest(
+                "Cannot copy a directory into itself".to_string(),
+            ));
+        }
+        check_denied_tree(
+            &state.denied_paths,
+            &source_path,
+            &dest_path,
+            state.config.max_traversal_depth,
+        )
+        .await?;
+    }
+
+    if dest_path.exists() {
+        if !req.overwrite {
+            return Err(AppError::Conflict("Destination already exists".to_string()));
+        }
+        if source_path == dest_path {
+            return Err(AppError::BadRequest(
+                "Source and destination are the same".to_string(),
+            ));
+        }
+        // Removing the destination would take the source with it
+        if source_path.starts_with(&dest_path) {
+            return Err(AppError::BadRequest(
+                "Cannot overwrite a directory containing the source".to_string(),
+            ));
+        }
+        if dest_path.is_dir() {
+            fs::remove_dir_all(&dest_path).await?;
+        } else {
+            fs::remove_file(&dest_path).await?;
+        }
+    }
+
+    if let Some(parent) = dest_path.parent() {
+        ensure_directory(parent).await?;
+    }
+
+    let bytes_copied = if source_meta.is_dir() {
+        let copied = copy_tree(
+            &source_path,
+            &dest_path,
+            state.config.max_traversal_depth,
+            Some(&state.denied_paths),
+        )
+        .await;
+        // Don't leave half a tree behind
+        if copied.is_err() {
+            let _ = fs::remove_dir_all(&dest_path).await;
+        }
+        copied?
+    } else {
+        fs::copy(&source_path, &dest_path).await?
+    };
+
+    Ok(Json(ApiResponse::success(CopyFileResponse {
+        source: source_path.to_string_lossy().to_string(),
+        destination: dest_path.to_string_lossy().to_string(),
+        bytes_copied,
+        timestamp: crate::utils::common::format_time(
+            std::time::SystemTime::now()
+                .duration_since(std::time::UNIX_EPOCH)
+                .expect("Time went backwards")
+                .as_secs(),
+        ),
+    })))
+}
+
+/// Copy the directory `source` to `dest` (which must not exist yet), returning
+/// the number of file bytes copied. With `denied`, every entry is checked at
+/// both ends before it is copied.
+pub(super) async fn copy_tree(
+    source: &Path,
+    dest: &Path,
+    max_depth: usize,
+    denied: Option<&DeniedPaths>,
+) -> Result<u64, AppError> {
+    let mut bytes_copied = 0;
+    let mut stack = vec![(source.to_path_buf(), dest.to_path_buf(), 0)];
+    let mut created = Vec::new();
+
+    while let Some((from, to, depth)) = stack.pop() {
+        if depth > max_depth {
+            return Err(AppError::BadRequest(depth_exceeded_message(
+                max_depth, &from,
+            )));
+        }
+
+        fs::create_dir(&to).await?;
+        let mut entries = fs::read_dir(&from).await?;
+        while let Some(entry) = entries.next_entry().await? {
+            let target = to.join(entry.file_name());
+            if let Some(denied) = denied {
+                denied.check(&entry.path())?;
+                denied.check(&target)?;
+            }
+            let file_type = entry.file_type().await?;
+            if file_type.is_dir() {
+                stack.push((entry.path(), target, depth + 1));
+            } else if file_type.is_symlink() {
+                let link = fs::read_link(entry.path()).await?;
+                fs::symlink(link, &target).await?;
+            } else {
+                bytes_copied += fs::copy(entry.path(), &target).await?;
+            }
+        }
+        created.push((to, fs::metadata(&from).await?.permissions()));
+    }
+
+    // Applied last so read-only source directories can still be filled
+    for (dir, permissions) in created.into_iter().rev() {
+        fs::set_permissions(&dir, permissions).await?;
+    }
+
+    Ok(bytes_copied)
+}
+
+#[derive(Deserialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct RenameFileRequest {
     old_path: String,
@@ -289,8 +1419,10 @@ pub async fn rename_file(
     State(state): State<Arc<AppState>>,
     Json(req): Json<RenameFileRequest>,
 ) -> Result<Json<ApiResponse<FileOperationResponse>>, AppError> {
-    let old_path = validate_path(&state.config.workspace_path, &req.old_path)?;
-    let new_path = validate_path(&state.config.workspace_path, &req.new_path)?;
+    let old_path = state.resolve_path(&req.old_path)?;
+    let new_path = state.resolve_path(&req.new_path)?;
+    ensure_writable(&state.config.read_only_paths, &old_path)?;
+    ensure_writable(&state.config.read_only_paths, &new_path)?;
 
     if !old_path.exists() {
         return Err(AppError::NotFound("Old path not found".to_string()));
@@ -310,3 +1442,244 @@ pub async fn rename_file(
         success: true,
     })))
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_deletion_preview() {
+        let dir = std::env::temp_dir().join(format!("delete-preview-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("sub/empty")).unwrap();
+        std::fs::write(dir.join("a.txt"), b"hello").unwrap();
+        std::fs::write(dir.join("sub/b.txt"), b"hi").unwrap();
+        std::os::unix::fs::symlink(dir.join("sub"), dir.join("link")).unwrap();
+
+        let preview = deletion_preview(&dir, true).await.unwrap();
+        let relative: Vec<_> = preview
+            .paths
+            .iter()
+            .map(|p| Path::new(p).strip_prefix(&dir).unwrap().to_path_buf())
+            .collect();
+        // The symlink is listed but not followed
+        assert_eq!(
+            relative,
+            ["", "a.txt", "link", "sub", "sub/b.txt", "sub/empty"]
+                .map(PathBuf::from)
+                .to_vec()
+        );
+        assert_eq!(preview.total_count, 6);
+        assert_eq!(preview.total_size, 7);
+        assert!(dir.join("sub/b.txt").exists());
+
+        assert!(deletion_preview(&dir, false).await.is_err());
+        let empty = deletion_preview(&dir.join("sub/empty"), false)
+            .await
+            .unwrap();
+        assert_eq!(empty.total_count, 1);
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn test_move_conflicts() {
+        let plan = |source: &str, dest: &str| -> Result<(PathBuf, PathBuf), ()> {
+            Ok((PathBuf::from(source), PathBuf::from(dest)))
+        };
+        let conflicts = move_conflicts(&[
+            plan("/w/a", "/w/x"),
+            plan("/w/b", "/w/x"),
+            plan("/w/c", "/w/a/c"),
+            Err(()),
+            plan("/w/d", "/w/e"),
+        ]);
+        assert_eq!(conflicts[0].as_deref(), Some("Same destination as move 2"));
+        assert_eq!(conflicts[1].as_deref(), Some("Same destination as move 1"));
+        assert_eq!(
+            conflicts[2].as_deref(),
+            Some("Depends on a path changed by move 1")
+        );
+        assert_eq!(conflicts[3], None);
+        assert_eq!(conflicts[4], None);
+    }
+
+    #[tokio::test]
+    async fn test_apply_moves_rolls_back() {
+        let dir = std::env::temp_dir().join(format!("batch-move-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("new")).unwrap();
+        std::fs::write(dir.join("a"), b"a").unwrap();
+        std::fs::write(dir.join("b"), b"b").unwrap();
+        std::fs::write(dir.join("blocker"), b"").unwrap();
+
+        // The second destination's parent is a file, so that rename fails
+        let outcome = apply_moves(&[
+            (dir.join("a"), dir.join("new/a")),
+            (dir.join("b"), dir.join("blocker/b")),
+        ])
+        .await;
+        assert_eq!(outcome[0], (MoveStatus::RolledBack, None));
+        assert_eq!(outcome[1].0, MoveStatus::Failed);
+        assert!(dir.join("a").exists());
+        assert!(dir.join("b").exists());
+        assert!(!dir.join("new/a").exists());
+
+        let outcome = apply_moves(&[(dir.join("a"), dir.join("new/a"))]).await;
+        assert_eq!(outcome[0], (MoveStatus::Moved, None));
+        assert!(dir.join("new/a").exists());
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_copy_file() {
+        use std::os::unix::fs::PermissionsExt;
+
+        let dir = std::env::temp_dir().join(format!("copy-file-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("tree/sub")).unwrap();
+        std::fs::write(dir.join("run.sh"), b"#!/bin/sh\n").unwrap();
+        std::fs::set_permissions(dir.join("run.sh"), std::fs::Permissions::from_mode(0o750))
+            .unwrap();
+        std::fs::write(dir.join("tree/sub/data"), b"data").unwrap();
+        std::os::unix::fs::symlink("sub/data", dir.join("tree/link")).unwrap();
+        let mut config = crate::config::Config::load();
+        config.workspace_path = dir.clone();
+        let state = Arc::new(AppState::new(config));
+
+        let copy = |source: &str, destination: &str, overwrite: bool, recursive: bool| {
+            let req = serde_json::from_value::<CopyFileRequest>(serde_json::json!({
+                "source": source,
+                "destination": destination,
+                "overwrite": overwrite,
+                "recursive": recursive,
+            }))
+            .unwrap();
+            copy_file(State(state.clone()), Json(req))
+        };
+
+        // Contents and permissions are copied
+        let resp = copy("run.sh", "bin/run.sh", false, false).await.unwrap();
+        assert_eq!(resp.data.bytes_copied, 10);
+        assert_eq!(
+            std::fs::read(dir.join("bin/run.sh")).unwrap(),
+            b"#!/bin/sh\n"
+        );
+        let mode = std::fs::metadata(dir.join("bin/run.sh"))
+            .unwrap()
+            .permissions()
+            .mode();
+        assert_eq!(mode & 0o777, 0o750);
+
+        // Existing destinations need overwrite, directories need recursive
+        let err = copy("run.sh", "bin/run.sh", false, false)
+            .await
+            .err()
+            .unwrap();
+        assert!(matches!(err, AppError::Conflict(_)));
+        copy("run.sh", "bin/run.sh", true, false).await.unwrap();
+        let err = copy("tree", "tree2", false, false).await.err().unwrap();
+        assert!(matches!(err, AppError::BadRequest(_)));
+
+        // Trees are copied whole, with symlinks recreated rather than followed
+        let resp = copy("tree", "tree2", false, true).await.unwrap();
+        assert_eq!(resp.data.bytes_copied, 4);
+        assert_eq!(std::fs::read(dir.join("tree2/sub/data")).unwrap(), b"data");
+        assert_eq!(
+            std::fs::read_link(dir.join("tree2/link")).unwrap(),
+            std::path::PathBuf::from("sub/data")
+        );
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_copy_over_ancestor_of_source() {
+        let dir = std::env::temp_dir().join(format!("copy-ancestor-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("a/b")).unwrap();
+        std::fs::write(dir.join("a/b/file"), b"keep").unwrap();
+        let mut config = crate::config::Config::load();
+        config.workspace_path = dir.clone();
+        let state = Arc::new(AppState::new(config));
+
+        let req = serde_json::from_value(serde_json::json!({
+            "source": "a/b",
+            "destination": "a",
+            "overwrite": true,
+            "recursive": true,
+        }))
+        .unwrap();
+        let err = copy_file(State(state), Json(req)).await.err().unwrap();
+        assert!(matches!(err, AppError::BadRequest(_)));
+        assert_eq!(std::fs::read(dir.join("a/b/file")).unwrap(), b"keep");
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_denied_children_stay_put() {
+        let dir = std::env::temp_dir().join(format!("copy-denied-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("config")).unwrap();
+        std::fs::create_dir_all(dir.join("plain")).unwrap();
+        std::fs::write(dir.join("config/app.key"), b"secret").unwrap();
+        std::fs::write(dir.join("plain/app.key"), b"public").unwrap();
+        let mut config = crate::config::Config::load();
+        config.workspace_path = dir.clone();
+        config.denied_paths = vec!["config/*.key".to_string()];
+        let state = Arc::new(AppState::new(config));
+
+        let copy = |source: &str, destination: &str| {
+            serde_json::from_value::<CopyFileRequest>(serde_json::json!({
+                "source": source,
+                "destination": destination,
+                "recursive": true,
+            }))
+            .unwrap()
+        };
+        let moving = |source: &str, destination: &str| {
+            serde_json::from_value::<MoveFileRequest>(serde_json::json!({
+                "source": source,
+                "destination": destination,
+            }))
+            .unwrap()
+        };
+
+        // Carrying a denied file out from under its pattern
+        let err = copy_file(State(state.clone()), Json(copy("config", "cfg2")))
+            .await
+            .err()
+            .unwrap();
+        assert!(matches!(err, AppError::Forbidden(_)));
+        assert!(!dir.join("cfg2").exists());
+        let err = move_file(State(state.clone()), Json(moving("config", "cfg2")))
+            .await
+            .err()
+            .unwrap();
+        assert!(matches!(err, AppError::Forbidden(_)));
+        assert!(dir.join("config/app.key").exists());
+        let item = BatchMoveItem {
+            source: "config".to_string(),
+            destination: "cfg3".to_string(),
+        };
+        assert!(matches!(
+            check_move(&state, &item).await,
+            Err(AppError::Forbidden(_))
+        ));
+
+        // Planting a file beneath a denied pattern
+        std::fs::remove_file(dir.join("config/app.key")).unwrap();
+        std::fs::remove_dir(dir.join("config")).unwrap();
+        let err = copy_file(State(state.clone()), Json(copy("plain", "config")))
+            .await
+            .err()
+            .unwrap();
+        assert!(matches!(err, AppError::Forbidden(_)));
+        assert!(!dir.join("config").exists());
+
+        // Trees without denied paths still copy
+        copy_file(State(state), Json(copy("plain", "other")))
+            .await
+            .unwrap();
+        assert_eq!(std::fs::read(dir.join("other/app.key")).unwrap(), b"public");
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -1,17 +1,21 @@
 use super::types::FileInfo;
 use crate::error::AppError;
-use crate::response::ApiResponse;
+use crate::response::{if_none_match, ApiResponse};
 use crate::state::AppState;
-use crate::utils::path::validate_path;
 use axum::{
     extract::{Query, State},
+    http::{header, HeaderMap, StatusCode},
+    response::{IntoResponse, Response},
     Json,
 };
+use schemars::JsonSchema;
 use serde::{Deserialize, Serialize};
+use std::hash::{Hash, Hasher};
+use std::path::PathBuf;
 use std::sync::Arc;
 use tokio::fs;
 
-#[derive(Deserialize)]
+#[derive(Deserialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct ListFilesParams {
     path: Option<String>,
@@ -21,6 +25,15 @@ pub struct ListFilesParams {
     limit: usize,
     #[serde(default)]
     offset: usize,
+    /// Include inode, link count and device id (Unix only)
+    #[serde(default)]
+    detailed: bool,
+    /// Walk subdirectories too; names become paths relative to `path`
+    #[serde(default)]
+    recursive: bool,
+    /// Deepest level listed in recursive mode (1 = direct children only),
+    /// capped by the configured maximum traversal depth
+    max_depth: Option<usize>,
 }
 
 fn default_limit() -> usize {
@@ -33,46 +46,104 @@ pub struct ListFilesResponse {
     files: Vec<FileInfo>,
 }
 
+/// Lists a directory. The response carries an `ETag` derived from every
+/// entry's name, size, mode and modification time (plus the query options), so
+/// polling clients can send `If-None-Match` and get `304 Not Modified`.
+///
+/// With `recursive` the whole tree (down to `maxDepth`) is flattened into one
+/// list sorted by relative path, and `limit`/`offset` page through it.
+/// Symlinks are listed but never followed.
 pub async fn list_files(
     State(state): State<Arc<AppState>>,
+    headers: HeaderMap,
     Query(params): Query<ListFilesParams>,
-) -> Result<Json<ApiResponse<ListFilesResponse>>, AppError> {
+) -> Result<Response, AppError> {
     let path_str = params.path.as_deref().unwrap_or(".");
-    let valid_path = validate_path(&state.config.workspace_path, path_str)?;
+    let valid_path = state.resolve_path(path_str)?;
+
+    let max_depth = if params.recursive {
+        let limit = state.config.max_traversal_depth;
+        match params.max_depth {
+            Some(0) => {
+                return Err(AppError::Validation(
+                    "maxDepth must be at least 1".to_string(),
+                ))
+            }
+            Some(depth) => depth.min(limit),
+            None => limit,
+        }
+    } else {
+        1
+    };
 
-    let mut entries = fs::read_dir(&valid_path).await?;
     let mut files = Vec::new();
+    let mut fingerprints = Vec::new();
+    let mut dirs = vec![(valid_path.clone(), PathBuf::new(), 1)];
 
-    while let Some(entry) = entries.next_entry().await? {
-        let name = entry.file_name().to_string_lossy().to_string();
-        if !params.show_hidden && name.starts_with('.') {
-            continue;
+    while let Some((dir, prefix, depth)) = dirs.pop() {
+        let mut entries = match fs::read_dir(&dir).await {
+            Ok(entries) => entries,
+            // Unreadable subdirectories are skipped; the requested one must be readable
+            Err(_) if depth > 1 => continue,
+            Err(e) => return Err(e.into()),
+        };
+
+        while let Some(entry) = entries.next_entry().await? {
+            let file_name = entry.file_name().to_string_lossy().to_string();
+            if !params.show_hidden && file_name.starts_with('.') {
+                continue;
+            }
+            if state.denied_paths.is_denied(&entry.path()) {
+                continue;
+            }
+
+            // DirEntry::metadata does not traverse symlinks, so linked
+            // directories are never descended into
+            let metadata = entry.metadata().await?;
+            let relative = prefix.join(&file_name);
+            let name = relative.to_string_lossy().to_string();
+            if metadata.is_dir() && depth < max_depth {
+                dirs.push((entry.path(), relative, depth + 1));
+            }
+
+            fingerprints.push((
+                name.clone(),
+                metadata.len(),
+                metadata.modified().ok(),
+                metadata.is_dir(),
+                std::os::unix::fs::PermissionsExt::mode(&metadata.permissions()),
+            ));
+            files.push(FileInfo::from_metadata(
+                name,
+                &entry.path(),
+                &metadata,
+                params.detailed,
+            ));
         }
+    }
 
-        let metadata = entry.metadata().await?;
-        let is_dir = metadata.is_dir();
-        let size = metadata.len();
+    // Walk order depends on the traversal, so give paging a stable order
+    if params.recursive {
+        files.sort_by(|a, b| a.name.cmp(&b.name));
+    }
 
-        #[cfg(unix)]
-        let permissions = {
-            use std::os::unix::fs::PermissionsExt;
-            Some(format!("0{:o}", metadata.permissions().mode() & 0o777))
-        };
-        #[cfg(not(unix))]
-        let permissions = None;
-        let modified = metadata.modified().ok().map(|t| {
-            let duration = t.duration_since(std::time::UNIX_EPOCH).unwrap_or_default();
-            crate::utils::common::format_time(duration.as_secs())
-        });
+    // Directory iteration order is unspecified, so hash a sorted view
+    fingerprints.sort();
+    let mut hasher = std::collections::hash_map::DefaultHasher::new();
+    fingerprints.hash(&mut hasher);
+    (
+        params.show_hidden,
+        params.limit,
+        params.offset,
+        params.detailed,
+        params.recursive,
+        max_depth,
+    )
+        .hash(&mut hasher);
+    let etag = format!("\"{:016x}\"", hasher.finish());
 
-        files.push(FileInfo {
-            name,
-            path: entry.path().to_string_lossy().to_string(),
-            size,
-            is_dir,
-            permissions,
-            modified,
-        });
+    if if_none_match(&headers, &etag) {
+        return Ok((StatusCode::NOT_MODIFIED, [(header::ETAG, etag)]).into_response());
     }
 
     let total = files.len();
@@ -83,7 +154,11 @@ pub async fn list_files(
         Vec::new()
     };
 
-    Ok(Json(ApiResponse::success(ListFilesResponse {
-        files: paged_files,
-    })))
+    Ok((
+        [(header::ETAG, etag)],
+        Json(ApiResponse::success(ListFilesResponse {
+            files: paged_files,
+        })),
+    )
+        .into_response())
 }
@@ -1,15 +1,23 @@
 pub mod batch;
+pub mod info;
 pub mod io;
 pub mod list;
 pub mod perm;
 pub mod search;
+pub mod stale;
+pub mod trash;
 pub mod types;
+pub mod usage;
 
-pub use batch::{batch_download, batch_upload};
+pub use batch::{batch_download, batch_download_estimate, batch_download_manifest, batch_upload};
+pub use info::{hash_file, stat_file};
 pub use io::{
-    delete_file, move_file, read_file, rename_file, write_file_binary, write_file_json,
-    write_file_multipart, WriteFileRequest,
+    batch_move, copy_file, delete_file, move_file, patch_file, read_file, rename_file,
+    write_file_binary, write_file_json, write_file_multipart, WriteFileRequest,
 };
 pub use list::list_files;
 pub use perm::change_permissions;
-pub use search::{find_in_files, replace_in_files, search_files};
+pub use search::{find_in_files, grep_files, replace_in_files, search_files};
+pub use stale::{delete_stale_files, find_stale_files};
+pub use trash::{list_trash, restore_from_trash};
+pub use usage::get_disk_usage;
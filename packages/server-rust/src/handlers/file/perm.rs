@@ -1,8 +1,10 @@
 use crate::error::AppError;
 use crate::response::ApiResponse;
 use crate::state::AppState;
-use crate::utils::path::validate_path;
+use crate::utils::dedup::{detach, DedupStore};
+use crate::utils::path::{depth_exceeded_message, ensure_writable};
 use axum::{extract::State, Json};
+use schemars::JsonSchema;
 use serde::Deserialize;
 use std::path::{Path, PathBuf};
 use std::sync::Arc;
@@ -10,7 +12,7 @@ use tokio::fs;
 
 use super::types::FileOperationResponse;
 
-#[derive(Deserialize)]
+#[derive(Deserialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct ChmodRequest {
     path: String,
@@ -22,7 +24,7 @@ pub struct ChmodRequest {
 }
 
 #[cfg(unix)]
-fn parse_mode(mode_str: &str) -> Result<u32, AppError> {
+pub(super) fn parse_mode(mode_str: &str) -> Result<u32, AppError> {
     let s = mode_str.trim();
     if s.is_empty() {
         return Err(AppError::BadRequest("Mode cannot be empty".to_string()));
@@ -34,7 +36,7 @@ fn parse_mode(mode_str: &str) -> Result<u32, AppError> {
 }
 
 #[cfg(unix)]
-async fn chmod_path(path: &Path, mode: u32) -> Result<(), AppError> {
+pub(super) async fn chmod_path(path: &Path, mode: u32) -> Result<(), AppError> {
     use std::os::unix::fs::PermissionsExt;
     let perms = std::fs::Permissions::from_mode(mode & 0o777);
     fs::set_permissions(path, perms).await?;
@@ -42,11 +44,16 @@ async fn chmod_path(path: &Path, mode: u32) -> Result<(), AppError> {
 }
 
 #[cfg(unix)]
-async fn chmod_recursive(root: &Path, mode: u32) -> Result<(), AppError> {
-    let mut stack: Vec<PathBuf> = vec![root.to_path_buf()];
-    while let Some(p) = stack.pop() {
-        // Set permission for current path
-        let _ = chmod_path(&p, mode).await;
+async fn chmod_recursive(root: &Path, mode: u32, max_depth: usize, dedup: Option<&DedupStore>) -> Result<(), AppError> {
+    let mut stack: Vec<(PathBuf, usize)> = vec![(root.to_path_buf(), 0)];
+    while let Some((p, depth)) = stack.pop() {
+        if depth > max_depth {
+            return Err(AppError::BadRequest(depth_exceeded_message(max_depth, &p)));
+        }
+        // Set permission for current path; a deduplicated file shares its inode
+        if detach(dedup, &p).await.is_ok() {
+            let _ = chmod_path(&p, mode).await;
+        }
 
         // If directory, push children
         if let Ok(meta) = fs::metadata(&p).await {
@@ -56,7 +63,7 @@ async fn chmod_recursive(root: &Path, mode: u32) -> Result<(), AppError> {
                     Err(_) => continue,
                 };
                 while let Ok(Some(entry)) = rd.next_entry().await {
-                    stack.push(entry.path());
+                    stack.push((entry.path(), depth + 1));
                 }
             }
         }
@@ -121,16 +128,21 @@ async fn chown_path(path: &Path, owner: Option<&str>) -> Result<(), AppError> {
 }
 
 #[cfg(unix)]
-async fn chown_recursive(root: &Path, owner: Option<&str>) -> Result<(), AppError> {
+async fn chown_recursive(root: &Path, owner: Option<&str>, max_depth: usize, dedup: Option<&DedupStore>) -> Result<(), AppError> {
     if owner.is_none() { return Ok(()); }
-    let mut stack: Vec<PathBuf> = vec![root.to_path_buf()];
-    while let Some(p) = stack.pop() {
-        let _ = chown_path(&p, owner).await;
+    let mut stack: Vec<(PathBuf, usize)> = vec![(root.to_path_buf(), 0)];
+    while let Some((p, depth)) = stack.pop() {
+        if depth > max_depth {
+            return Err(AppError::BadRequest(depth_exceeded_message(max_depth, &p)));
+        }
+        if detach(dedup, &p).await.is_ok() {
+            let _ = chown_path(&p, owner).await;
+        }
         if let Ok(meta) = fs::metadata(&p).await {
             if meta.is_dir() {
                 let mut rd = match fs::read_dir(&p).await { Ok(rd) => rd, Err(_) => continue };
                 while let Ok(Some(entry)) = rd.next_entry().await {
-                    stack.push(entry.path());
+                    stack.push((entry.path(), depth + 1));
                 }
             }
         }
@@ -142,7 +154,8 @@ pub async fn change_permissions(
     State(state): State<Arc<AppState>>,
     Json(req): Json<ChmodRequest>,
 ) -> Result<Json<ApiResponse<FileOperationResponse>>, AppError> {
-    let target = validate_path(&state.config.workspace_path, &req.path)?;
+    let target = state.resolve_path(&req.path)?;
+    ensure_writable(&state.config.read_only_paths, &target)?;
 
     if !target.exists() {
         return Err(AppError::NotFound("Path not found".to_string()));
@@ -150,10 +163,14 @@ pub async fn change_permissions(
 
     let mode = parse_mode(&req.mode)?;
 
+    let dedup = state.dedup.as_deref();
     if req.recursive {
-        chmod_recursive(&target, mode).await?;
-        chown_recursive(&target, req.owner.as_deref()).await?;
+        let max_depth = state.config.max_traversal_depth;
+        chmod_recursive(&target, mode, max_depth, dedup).await?;
+        chown_recursive(&target, req.owner.as_deref(), max_depth, dedup).await?;
     } else {
+        // Mode and owner belong to the inode, which a deduplicated file shares
+        detach(dedup, &target).await?;
         chmod_path(&target, mode).await?;
         chown_path(&target, req.owner.as_deref()).await?;
     }
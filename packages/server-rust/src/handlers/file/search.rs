@@ -1,11 +1,13 @@
 use crate::error::AppError;
 use crate::response::ApiResponse;
 use crate::state::AppState;
-use crate::utils::path::validate_path;
+use crate::utils::dedup::{detach, DedupStore};
+use crate::utils::path::{depth_exceeded_message, ensure_writable, glob_match, DeniedPaths};
 use axum::{extract::Json, extract::State};
 use futures::stream::{self, FuturesUnordered, StreamExt};
+use schemars::JsonSchema;
 use serde::{Deserialize, Serialize};
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
 use std::sync::Arc;
 use tokio::fs;
 use tokio::io::{AsyncBufReadExt, AsyncReadExt, BufReader};
@@ -20,6 +22,18 @@ const BINARY_CHECK_SIZE: usize = 256;
 /// Threshold for small files: use full read + in-memory search instead of streaming
 const SMALL_FILE_THRESHOLD: u64 = 32 * 1024; // 32 KB
 
+/// Line matches returned by grep when `maxResults` is not given
+const DEFAULT_GREP_RESULTS: usize = 100;
+
+/// Upper bound on `maxResults`
+const MAX_GREP_RESULTS: usize = 1000;
+
+/// Upper bound on `contextLines`
+const MAX_GREP_CONTEXT: usize = 10;
+
+/// File bytes a single grep reads at most before it stops
+const MAX_GREP_SCAN_BYTES: u64 = 256 * 1024 * 1024; // 256 MB
+
 /// Default ignored directories for search
 const IGNORED_DIRS: &[&str] = &[
     "node_modules",
@@ -51,14 +65,14 @@ const IGNORED_DIRS: &[&str] = &[
 
 // --- Search Types (filename search) ---
 
-#[derive(Deserialize)]
+#[derive(Deserialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct SearchRequest {
     dir: String,
     pattern: String,
 }
 
-#[derive(Serialize)]
+#[derive(Serialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct SearchResponse {
     files: Vec<String>,
@@ -66,19 +80,68 @@ pub struct SearchResponse {
 
 // --- Find Types (content search) ---
 
-#[derive(Deserialize)]
+#[derive(Deserialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct FindRequest {
     dir: String,
     keyword: String,
 }
 
-#[derive(Serialize)]
+#[derive(Serialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct FindResponse {
     files: Vec<String>,
 }
 
+// --- Grep Types (line search) ---
+
+#[derive(Deserialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct GrepRequest {
+    /// Directory to search, the workspace by default
+    #[serde(default)]
+    dir: String,
+    query: String,
+    /// Glob the file path (relative to `dir`) must match; without `/` it
+    /// is matched against the file name
+    path_glob: Option<String>,
+    #[serde(default)]
+    regex: bool,
+    max_results: Option<usize>,
+    /// Lines of context returned around each match
+    #[serde(default)]
+    context_lines: usize,
+}
+
+#[derive(Serialize, Debug, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct GrepMatch {
+    path: String,
+    line_number: usize,
+    line: String,
+    before: Vec<String>,
+    after: Vec<String>,
+}
+
+#[derive(Serialize, Debug, Default, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct GrepResponse {
+    matches: Vec<GrepMatch>,
+    files_scanned: u64,
+    bytes_scanned: u64,
+    /// The result or scan limit was hit before the whole tree was searched
+    truncated: bool,
+}
+
+/// Limits of one grep
+struct GrepLimits {
+    max_results: usize,
+    context_lines: usize,
+    max_file_size: u64,
+    max_scan_bytes: u64,
+    max_depth: usize,
+}
+
 // --- Replace Types ---
 
 /// Replace request structure
@@ -88,7 +151,7 @@ pub struct FindResponse {
 /// - Both `from` and `to` strings are transmitted as UTF-8 via HTTP/JSON
 /// - Files with other encodings (GBK, UTF-16, Latin1, etc.) will be skipped
 /// - Binary files are automatically detected and skipped
-#[derive(Deserialize)]
+#[derive(Deserialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct ReplaceRequest {
     files: Vec<String>,
@@ -96,7 +159,7 @@ pub struct ReplaceRequest {
     to: String,
 }
 
-#[derive(Serialize)]
+#[derive(Serialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct ReplaceResult {
     file: String,
@@ -106,7 +169,7 @@ pub struct ReplaceResult {
     error: Option<String>,
 }
 
-#[derive(Serialize)]
+#[derive(Serialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct ReplaceResponse {
     results: Vec<ReplaceResult>,
@@ -124,8 +187,7 @@ pub async fn search_files(
         return Err(AppError::BadRequest("Pattern cannot be empty".to_string()));
     }
 
-    // P0: Normalize workspace base (allow relative workspace path) and dir input
-    let workspace_base = state.config.workspace_path.clone();
+    // P0: Normalize dir input
     let dir_trimmed = req.dir.trim();
     let dir_str = if dir_trimmed.is_empty() {
         "."
@@ -133,8 +195,8 @@ pub async fn search_files(
         dir_trimmed
     };
 
-    // P0: Path validation - use validate_path like other file operations
-    let root_path = validate_path(&workspace_base, dir_str)?;
+    // P0: Path validation - resolve like other file operations
+    let root_path = state.resolve_path(dir_str)?;
 
     // Check if directory exists (async)
     let metadata = fs::metadata(&root_path)
@@ -148,7 +210,13 @@ pub async fn search_files(
         )));
     }
 
-    let files = perform_filename_search(root_path, &req.pattern).await?;
+    let files = perform_filename_search(
+        root_path,
+        &req.pattern,
+        state.config.max_traversal_depth,
+        &state.denied_paths,
+    )
+    .await?;
 
     let response = SearchResponse { files };
 
@@ -165,8 +233,7 @@ pub async fn find_in_files(
         return Err(AppError::BadRequest("Keyword cannot be empty".to_string()));
     }
 
-    // P0: Normalize workspace base (allow relative workspace path) and dir input
-    let workspace_base = state.config.workspace_path.clone();
+    // P0: Normalize dir input
     let dir_trimmed = req.dir.trim();
     let dir_str = if dir_trimmed.is_empty() {
         "."
@@ -174,8 +241,8 @@ pub async fn find_in_files(
         dir_trimmed
     };
 
-    // P0: Path validation - use validate_path like other file operations
-    let root_path = validate_path(&workspace_base, dir_str)?;
+    // P0: Path validation - resolve like other file operations
+    let root_path = state.resolve_path(dir_str)?;
 
     // Check if directory exists (async)
     let metadata = fs::metadata(&root_path)
@@ -194,6 +261,8 @@ pub async fn find_in_files(
         &req.keyword,
         state.config.max_concurrent_reads,
         state.config.max_file_size,
+        state.config.max_traversal_depth,
+        &state.denied_paths,
     )
     .await?;
 
@@ -202,6 +271,75 @@ pub async fn find_in_files(
     Ok(Json(ApiResponse::success(response)))
 }
 
+/// Find matching lines, with context, in the text files below a directory.
+/// Ignored and hidden directories, symlinks, binary files and denied paths
+/// are skipped; the walk is in name order and stops at the result or scan
+/// limit.
+pub async fn grep_files(
+    State(state): State<Arc<AppState>>,
+    Json(req): Json<GrepRequest>,
+) -> Result<Json<ApiResponse<GrepResponse>>, AppError> {
+    if req.query.is_empty() {
+        return Err(AppError::BadRequest("Query cannot be empty".to_string()));
+    }
+    let re = if req.regex {
+        Some(
+            regex::Regex::new(&req.query)
+                .map_err(|e| AppError::BadRequest(format!("Invalid regex: {}", e)))?,
+        )
+    } else {
+        None
+    };
+
+    let dir_trimmed = req.dir.trim();
+    let dir_str = if dir_trimmed.is_empty() {
+        "."
+    } else {
+        dir_trimmed
+    };
+    let root_path = state.resolve_path(dir_str)?;
+    let metadata = fs::metadata(&root_path)
+        .await
+        .map_err(|_| AppError::NotFound(format!("Directory not found: {}", root_path.display())))?;
+    if !metadata.is_dir() {
+        return Err(AppError::BadRequest(format!(
+            "Path is not a directory: {}",
+            root_path.display()
+        )));
+    }
+
+    let limits = GrepLimits {
+        max_results: req
+            .max_results
+            .unwrap_or(DEFAULT_GREP_RESULTS)
+            .clamp(1, MAX_GREP_RESULTS),
+        context_lines: req.context_lines.min(MAX_GREP_CONTEXT),
+        max_file_size: state.config.max_file_size,
+        max_scan_bytes: MAX_GREP_SCAN_BYTES,
+        max_depth: state.config.max_traversal_depth,
+    };
+    let denied = state.denied_paths.clone();
+    let query = req.query;
+    let path_glob = req.path_glob;
+    let response = tokio::task::spawn_blocking(move || {
+        let is_match = |line: &str| match &re {
+            Some(re) => re.is_match(line),
+            None => line.contains(&query),
+        };
+        perform_grep(
+            &root_path,
+            is_match,
+            path_glob.as_deref(),
+            &limits,
+            |path| denied.is_denied(path),
+        )
+    })
+    .await
+    .map_err(|e| AppError::InternalServerError(e.to_string()))??;
+
+    Ok(Json(ApiResponse::success(response)))
+}
+
 pub async fn replace_in_files(
     State(state): State<Arc<AppState>>,
     Json(req): Json<ReplaceRequest>,
@@ -216,7 +354,8 @@ pub async fn replace_in_files(
     // P0: Validate all file paths before processing
     let mut validated_paths = Vec::with_capacity(req.files.len());
     for file_path_str in &req.files {
-        let valid_path = validate_path(&state.config.workspace_path, file_path_str)?;
+        let valid_path = state.resolve_path(file_path_str)?;
+        ensure_writable(&state.config.read_only_paths, &valid_path)?;
         validated_paths.push((file_path_str.clone(), valid_path));
     }
 
@@ -224,17 +363,17 @@ pub async fn replace_in_files(
     let from = req.from.clone();
     let to = req.to.clone();
     let max_file_size = state.config.max_file_size;
-
-    let replace_futs =
-        validated_paths
-            .into_iter()
-            .map(|(original_path, valid_path)| {
-                let from = from.clone();
-                let to = to.clone();
-                async move {
-                    perform_replace(valid_path, &original_path, &from, &to, max_file_size).await
-                }
-            });
+    let dedup = state.dedup.as_deref();
+
+    let replace_futs = validated_paths
+        .into_iter()
+        .map(|(original_path, valid_path)| {
+            let from = from.clone();
+            let to = to.clone();
+            async move {
+                perform_replace(valid_path, &original_path, &from, &to, max_file_size, dedup).await
+            }
+        });
 
     let mut stream = stream::iter(replace_futs).buffer_unordered(state.config.max_concurrent_reads);
     let mut results = Vec::new();
@@ -264,13 +403,22 @@ fn should_ignore_dir(name: &str) -> bool {
 async fn perform_filename_search(
     root: PathBuf,
     pattern: &str,
+    max_depth: usize,
+    denied: &DeniedPaths,
 ) -> Result<Vec<String>, AppError> {
     let mut matched_files: Vec<String> = Vec::new();
-    let mut dirs = vec![root];
+    let mut dirs = vec![(root, 0)];
     let pattern_lower = pattern.to_lowercase();
 
     // Iterative DFS to avoid stack overflow
-    while let Some(current_dir) = dirs.pop() {
+    while let Some((current_dir, depth)) = dirs.pop() {
+        if depth > max_depth {
+            return Err(AppError::BadRequest(depth_exceeded_message(
+                max_depth,
+                &current_dir,
+            )));
+        }
+
         let mut entries = match fs::read_dir(&current_dir).await {
             Ok(e) => e,
             Err(_) => continue, // Skip unreadable dirs
@@ -278,6 +426,9 @@ async fn perform_filename_search(
 
         while let Ok(Some(entry)) = entries.next_entry().await {
             let path = entry.path();
+            if denied.is_denied(&path) {
+                continue;
+            }
 
             // Get file name for filtering
             let file_name = match path.file_name().and_then(|n| n.to_str()) {
@@ -301,7 +452,7 @@ async fn perform_filename_search(
                 if should_ignore_dir(file_name) {
                     continue;
                 }
-                dirs.push(path);
+                dirs.push((path, depth + 1));
             } else if file_type.is_file() {
                 // Match filename (case-insensitive)
                 if file_name.to_lowercase().contains(&pattern_lower) {
@@ -320,14 +471,23 @@ async fn perform_content_search(
     keyword: &str,
     max_concurrent: usize,
     max_file_size: u64,
+    max_depth: usize,
+    denied: &DeniedPaths,
 ) -> Result<Vec<String>, AppError> {
     let mut matched_files: Vec<String> = Vec::new();
-    let mut dirs = vec![root];
+    let mut dirs = vec![(root, 0)];
     let keyword_owned = keyword.to_string();
     let mut futs: FuturesUnordered<_> = FuturesUnordered::new();
 
     // Iterative DFS to avoid stack overflow
-    while let Some(current_dir) = dirs.pop() {
+    while let Some((current_dir, depth)) = dirs.pop() {
+        if depth > max_depth {
+            return Err(AppError::BadRequest(depth_exceeded_message(
+                max_depth,
+                &current_dir,
+            )));
+        }
+
         let mut entries = match fs::read_dir(&current_dir).await {
             Ok(e) => e,
             Err(_) => continue, // Skip unreadable dirs
@@ -338,6 +498,9 @@ async fn perform_content_search(
 
         while let Ok(Some(entry)) = entries.next_entry().await {
             let path = entry.path();
+            if denied.is_denied(&path) {
+                continue;
+            }
 
             // Get file name for filtering
             let file_name = match path.file_name().and_then(|n| n.to_str()) {
@@ -361,7 +524,7 @@ async fn perform_content_search(
                 if should_ignore_dir(file_name) {
                     continue;
                 }
-                dirs.push(path);
+                dirs.push((path, depth + 1));
             } else if file_type.is_file() {
                 files_in_dir.push(path);
             }
@@ -464,12 +627,120 @@ async fn file_contains_keyword_streaming(path: &PathBuf, keyword: &str) -> Optio
     None
 }
 
+/// Walk `root` and collect the lines for which `is_match` holds.
+fn perform_grep(
+    root: &Path,
+    is_match: impl Fn(&str) -> bool,
+    path_glob: Option<&str>,
+    limits: &GrepLimits,
+    skip: impl Fn(&Path) -> bool,
+) -> Result<GrepResponse, AppError> {
+    let mut response = GrepResponse::default();
+    let mut dirs = vec![(root.to_path_buf(), 0)];
+
+    while let Some((current_dir, depth)) = dirs.pop() {
+        if depth > limits.max_depth {
+            return Err(AppError::BadRequest(depth_exceeded_message(
+                limits.max_depth,
+                &current_dir,
+            )));
+        }
+        let Ok(entries) = std::fs::read_dir(&current_dir) else {
+            continue; // Skip unreadable dirs
+        };
+        let mut entries: Vec<_> = entries.flatten().collect();
+        entries.sort_by_key(|entry| entry.file_name());
+
+        let mut subdirs = Vec::new();
+        for entry in entries {
+            let path = entry.path();
+            let Ok(file_type) = entry.file_type() else {
+                continue;
+            };
+            if file_type.is_symlink() || skip(&path) {
+                continue;
+            }
+            let file_name = entry.file_name();
+            let file_name = file_name.to_string_lossy();
+
+            if file_type.is_dir() {
+                if !should_ignore_dir(&file_name) {
+                    subdirs.push((path, depth + 1));
+                }
+                continue;
+            }
+            if !file_type.is_file() {
+                continue;
+            }
+            if let Some(glob) = path_glob {
+                let relative = path.strip_prefix(root).unwrap_or(&path);
+                let target = if glob.contains('/') {
+                    relative.to_string_lossy()
+                } else {
+                    file_name.clone()
+                };
+                if !glob_match(glob, &target) {
+                    continue;
+                }
+            }
+
+            let size = match entry.metadata() {
+                Ok(m) if m.len() > 0 && m.len() <= limits.max_file_size => m.len(),
+                _ => continue,
+            };
+            if response.bytes_scanned + size > limits.max_scan_bytes {
+                response.truncated = true;
+                return Ok(response);
+            }
+            let Ok(bytes) = std::fs::read(&path) else {
+                continue;
+            };
+            response.files_scanned += 1;
+            response.bytes_scanned += bytes.len() as u64;
+            if !is_probably_text(&bytes[..bytes.len().min(BINARY_CHECK_SIZE)]) {
+                continue;
+            }
+            let Ok(content) = std::str::from_utf8(&bytes) else {
+                continue;
+            };
+
+            let lines: Vec<&str> = content.lines().collect();
+            for (i, line) in lines.iter().enumerate() {
+                if !is_match(line) {
+                    continue;
+                }
+                if response.matches.len() >= limits.max_results {
+                    response.truncated = true;
+                    return Ok(response);
+                }
+                let context = |range: &[&str]| -> Vec<String> {
+                    range.iter().map(|l| l.to_string()).collect()
+                };
+                let before = i.saturating_sub(limits.context_lines);
+                let after = (i + 1 + limits.context_lines).min(lines.len());
+                response.matches.push(GrepMatch {
+                    path: path.to_string_lossy().to_string(),
+                    line_number: i + 1,
+                    line: line.to_string(),
+                    before: context(&lines[before..i]),
+                    after: context(&lines[i + 1..after]),
+                });
+            }
+        }
+        // Reversed so subdirectories are searched in name order
+        dirs.extend(subdirs.into_iter().rev());
+    }
+
+    Ok(response)
+}
+
 async fn perform_replace(
     path: PathBuf,
     original_path: &str,
     from: &str,
     to: &str,
     max_file_size: u64,
+    dedup: Option<&DedupStore>,
 ) -> ReplaceResult {
     // P1: Use async metadata check instead of blocking exists()
     let metadata = match fs::metadata(&path).await {
@@ -573,7 +844,12 @@ async fn perform_replace(
     let count = content.matches(from).count();
     if count > 0 {
         let new_content = content.replace(from, to);
-        match fs::write(&path, new_content).await {
+        // fs::write truncates the file in place
+        let written = match detach(dedup, &path).await {
+            Ok(()) => fs::write(&path, new_content).await.map_err(AppError::from),
+            Err(e) => Err(e),
+        };
+        match written {
             Ok(_) => ReplaceResult {
                 file: original_path.to_string(),
                 status: "success".to_string(),
@@ -694,3 +970,53 @@ fn is_valid_utf8_prefix(bytes: &[u8]) -> bool {
     }
     true
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_perform_grep() {
+        let dir = std::env::temp_dir().join(format!("grep-test-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("src")).unwrap();
+        std::fs::create_dir_all(dir.join("node_modules")).unwrap();
+        std::fs::write(dir.join("src/a.rs"), "one\ntodo: two\nthree\nfour\n").unwrap();
+        std::fs::write(dir.join("src/b.txt"), "todo: b\n").unwrap();
+        std::fs::write(dir.join("src/c.bin"), b"todo\0\x01").unwrap();
+        std::fs::write(dir.join("node_modules/d.rs"), "todo: ignored\n").unwrap();
+        let mut limits = GrepLimits {
+            max_results: 10,
+            context_lines: 1,
+            max_file_size: 1024,
+            max_scan_bytes: 1024,
+            max_depth: 8,
+        };
+        let todo = |line: &str| line.starts_with("todo");
+
+        let response = perform_grep(&dir, todo, Some("*.rs"), &limits, |_| false).unwrap();
+        assert_eq!(response.matches.len(), 1);
+        let m = &response.matches[0];
+        assert_eq!(m.line_number, 2);
+        assert_eq!(m.line, "todo: two");
+        assert_eq!(m.before, vec!["one"]);
+        assert_eq!(m.after, vec!["three"]);
+
+        // The binary file is read but not matched
+        let response = perform_grep(&dir, todo, None, &limits, |_| false).unwrap();
+        let paths: Vec<_> = response.matches.iter().map(|m| m.path.as_str()).collect();
+        assert_eq!(paths.len(), 2);
+        assert!(paths[1].ends_with("src/b.txt"));
+        assert_eq!(response.files_scanned, 3);
+        assert!(!response.truncated);
+
+        limits.max_results = 1;
+        let response = perform_grep(&dir, todo, None, &limits, |_| false).unwrap();
+        assert_eq!(response.matches.len(), 1);
+        assert!(response.truncated);
+
+        let response = perform_grep(&dir, todo, None, &limits, |p| p.ends_with("src")).unwrap();
+        assert_eq!(response.files_scanned, 0);
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
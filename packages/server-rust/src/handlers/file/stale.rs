@@ -0,0 +1,302 @@
+use super::trash::move_to_trash;
+use crate::error::AppError;
+use crate::response::ApiResponse;
+use crate::state::AppState;
+use crate::utils::common::{format_time, parse_duration};
+use crate::utils::path::{absolute_path, depth_exceeded_message, ensure_writable};
+use axum::{
+    extract::{Query, State},
+    Json,
+};
+use schemars::JsonSchema;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::{SystemTime, UNIX_EPOCH};
+use tokio::fs;
+
+/// Upper bound on entries visited by a single stale-file scan
+const MAX_STALE_SCAN_ENTRIES: usize = 100_000;
+
+/// Directories a scan never enters, wherever they appear
+const SKIPPED_DIRS: &[&str] = &[".git"];
+
+#[derive(Deserialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct StaleFilesParams {
+    path: Option<String>,
+    older_than: String,
+}
+
+#[derive(Serialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct StaleFile {
+    path: String,
+    size: u64,
+    last_used: String,
+    /// Trash folder the file was moved to, when deleted with a trash configured
+    #[serde(skip_serializing_if = "Option::is_none")]
+    trash_id: Option<String>,
+    /// Why the file could not be deleted
+    #[serde(skip_serializing_if = "Option::is_none")]
+    error: Option<String>,
+}
+
+#[derive(Serialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct StaleFilesResponse {
+    files: Vec<StaleFile>,
+    scanned: usize,
+    stale_count: usize,
+    deleted_count: usize,
+    truncated: bool,
+}
+
+/// Result of a stale-file walk: the files found with their paths, how many
+/// entries were visited, and whether the entry limit was hit.
+struct StaleScan {
+    files: Vec<(PathBuf, StaleFile)>,
+    scanned: usize,
+    truncated: bool,
+}
+
+/// Walk `params.path` and collect the files whose last modification and access
+/// are both older than `params.olderThan`. The whole walk finishes, including
+/// its depth check, before the caller acts on any of the files.
+async fn scan_stale_files(
+    state: &AppState,
+    params: &StaleFilesParams,
+) -> Result<StaleScan, AppError> {
+    let threshold = parse_duration(&params.older_than).ok_or_else(|| {
+        AppError::BadRequest(format!("Invalid olderThan duration: {}", params.older_than))
+    })?;
+
+    let root = state.resolve_path(params.path.as_deref().unwrap_or("."))?;
+    let metadata = fs::metadata(&root)
+        .await
+        .map_err(|_| AppError::NotFound(format!("Directory not found: {}", root.display())))?;
+    if !metadata.is_dir() {
+        return Err(AppError::BadRequest(format!(
+            "Path is not a directory: {}",
+            root.display()
+        )));
+    }
+
+    let cutoff = SystemTime::now()
+        .checked_sub(threshold)
+        .unwrap_or(UNIX_EPOCH);
+
+    // The trash and the dedup store hold the server's own bookkeeping
+    let internal_dirs: Vec<PathBuf> = state
+        .config
+        .trash_dir
+        .as_deref()
+        .into_iter()
+        .chain(state.dedup.as_deref().map(|store| store.dir()))
+        .map(absolute_path)
+        .collect();
+
+    let mut files = Vec::new();
+    let mut scanned = 0;
+    let mut truncated = false;
+    let max_depth = state.config.max_traversal_depth;
+    let mut dirs = vec![(root, 0)];
+
+    // Iterative DFS, bounded by MAX_STALE_SCAN_ENTRIES
+    'walk: while let Some((current_dir, depth)) = dirs.pop() {
+        if depth > max_depth {
+            return Err(AppError::BadRequest(depth_exceeded_message(
+                max_depth,
+                &current_dir,
+            )));
+        }
+
+        let mut entries = match fs::read_dir(&current_dir).await {
+            Ok(e) => e,
+            Err(_) => continue,
+        };
+
+        while let Ok(Some(entry)) = entries.next_entry().await {
+            if scanned >= MAX_STALE_SCAN_ENTRIES {
+                truncated = true;
+                break 'walk;
+            }
+            scanned += 1;
+            let path = entry.path();
+            if state.denied_paths.is_denied(&path) {
+                continue;
+            }
+            let absolute = absolute_path(&path);
+            if internal_dirs.iter().any(|dir| absolute.starts_with(dir)) {
+                continue;
+            }
+
+            let file_type = match entry.file_type().await {
+                Ok(ft) => ft,
+                Err(_) => continue,
+            };
+            // Skip symbolic links to avoid loops and escapes
+            if file_type.is_symlink() {
+                continue;
+            }
+            if file_type.is_dir() {
+                if !SKIPPED_DIRS.contains(&entry.file_name().to_string_lossy().as_ref()) {
+                    dirs.push((path, depth + 1));
+                }
+                continue;
+            }
+            if !file_type.is_file() {
+                continue;
+            }
+
+            let metadata = match entry.metadata().await {
+                Ok(m) => m,
+                Err(_) => continue,
+            };
+            let last_used = match metadata.modified() {
+                Ok(modified) => match metadata.accessed() {
+                    Ok(accessed) => modified.max(accessed),
+                    Err(_) => modified,
+                },
+                Err(_) => continue,
+            };
+            if last_used >= cutoff {
+                continue;
+            }
+
+            let secs = last_used
+                .duration_since(UNIX_EPOCH)
+                .unwrap_or_default()
+                .as_secs();
+            let file = StaleFile {
+                path: path.to_string_lossy().to_string(),
+                size: metadata.len(),
+                last_used: format_time(secs),
+                trash_id: None,
+                error: None,
+            };
+            files.push((path, file));
+        }
+    }
+
+    Ok(StaleScan {
+        files,
+        scanned,
+        truncated,
+    })
+}
+
+/// Find files whose last modification and access are both older than `olderThan`.
+pub async fn find_stale_files(
+    State(state): State<Arc<AppState>>,
+    Query(params): Query<StaleFilesParams>,
+) -> Result<Json<ApiResponse<StaleFilesResponse>>, AppError> {
+    let scan = scan_stale_files(&state, &params).await?;
+
+    let files: Vec<StaleFile> = scan.files.into_iter().map(|(_, file)| file).collect();
+    let stale_count = files.len();
+    Ok(Json(ApiResponse::success(StaleFilesResponse {
+        files,
+        scanned: scan.scanned,
+        stale_count,
+        deleted_count: 0,
+        truncated: scan.truncated,
+    })))
+}
+
+/// Move one stale file to the trash, returning its trash id, or delete it.
+async fn delete_stale_file(state: &AppState, path: &Path) -> Result<Option<String>, AppError> {
+    // Checked per file: READ_ONLY_PATHS may cover only part of the scanned tree
+    ensure_writable(&state.config.read_only_paths, path)?;
+    match state.config.trash_dir.as_deref() {
+        Some(trash_dir) => move_to_trash(trash_dir, path, state.config.max_traversal_depth)
+            .await
+            .map(Some),
+        None => {
+            fs::remove_file(path).await?;
+            Ok(None)
+        }
+    }
+}
+
+/// Delete the files `find_stale_files` would report. Like `/files/delete`,
+/// files go to the trash when one is configured.
+pub async fn delete_stale_files(
+    State(state): State<Arc<AppState>>,
+    Json(params): Json<StaleFilesParams>,
+) -> Result<Json<ApiResponse<StaleFilesResponse>>, AppError> {
+    let scan = scan_stale_files(&state, &params).await?;
+
+    let mut files = Vec::with_capacity(scan.files.len());
+    let mut deleted_count = 0;
+    for (path, mut file) in scan.files {
+        match delete_stale_file(&state, &path).await {
+            Ok(trash_id) => {
+                deleted_count += 1;
+                file.trash_id = trash_id;
+            }
+            Err(e) => file.error = Some(e.to_string()),
+        }
+        files.push(file);
+    }
+
+    // Reclaim blobs whose last workspace copy was just deleted
+    if deleted_count > 0 {
+        if let Some(store) = state.dedup.clone() {
+            tokio::spawn(async move { store.sweep().await });
+        }
+    }
+
+    let stale_count = files.len();
+    Ok(Json(ApiResponse::success(StaleFilesResponse {
+        files,
+        scanned: scan.scanned,
+        stale_count,
+        deleted_count,
+        truncated: scan.truncated,
+    })))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[tokio::test]
+    async fn test_stale_files() {
+        let dir = std::env::temp_dir().join(format!("stale-test-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("src")).unwrap();
+        std::fs::create_dir_all(dir.join(".git/objects")).unwrap();
+        std::fs::write(dir.join("src/old.txt"), b"old").unwrap();
+        std::fs::create_dir_all(dir.join("vendor")).unwrap();
+        std::fs::write(dir.join("vendor/lib.txt"), b"lib").unwrap();
+        std::fs::write(dir.join(".git/objects/pack"), b"git").unwrap();
+
+        let mut config = crate::config::Config::load();
+        config.workspace_path = dir.clone();
+        config.trash_dir = None;
+        config.read_only_paths = vec![dir.join("vendor")];
+        let state = Arc::new(AppState::new(config));
+        let params = || serde_json::from_value(json!({ "olderThan": "0s" })).unwrap();
+
+        // Listing never deletes
+        let Json(listed) = find_stale_files(State(state.clone()), Query(params()))
+            .await
+            .unwrap();
+        assert_eq!(listed.data.stale_count, 2);
+        assert!(dir.join("src/old.txt").exists());
+
+        let Json(deleted) = delete_stale_files(State(state), Json(params()))
+            .await
+            .unwrap();
+        assert_eq!(deleted.data.deleted_count, 1);
+        assert!(!dir.join("src/old.txt").exists());
+        // Read-only files are reported but kept
+        assert!(dir.join("vendor/lib.txt").exists());
+        assert!(deleted.data.files.iter().any(|f| f.error.is_some()));
+        // .git is never scanned
+        assert!(dir.join(".git/objects/pack").exists());
+
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+}
@@ -0,0 +1,308 @@
+//! Soft delete. With a trash directory configured, deleted paths are moved
+//! into a timestamped folder of it instead of being removed:
+//!
+//! ```text
+//! <trash>/2024-01-01T120000Z-x3k9a2/info.json      original path and time
+//! <trash>/2024-01-01T120000Z-x3k9a2/item/<name>    the deleted file or directory
+//! ```
+//!
+//! The folder name is the item id used to restore it. The deleted path lives
+//! in its own subdirectory so no file name can collide with the metadata.
+
+use super::io::copy_tree;
+use crate::error::AppError;
+use crate::response::ApiResponse;
+use crate::state::AppState;
+use crate::utils::common::{format_time, generate_nanoid};
+use crate::utils::path::{ensure_directory, ensure_writable};
+use axum::{extract::State, Json};
+use schemars::JsonSchema;
+use serde::{Deserialize, Serialize};
+use std::path::{Component, Path, PathBuf};
+use std::sync::Arc;
+use tokio::fs;
+
+/// Metadata file kept next to each trashed item
+const TRASH_INFO: &str = "info.json";
+
+/// Subdirectory holding the trashed item itself
+const TRASH_ITEM: &str = "item";
+
+#[derive(Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct TrashInfo {
+    original_path: String,
+    deleted_at: String,
+}
+
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+pub struct TrashItem {
+    id: String,
+    original_path: String,
+    deleted_at: String,
+    is_dir: bool,
+}
+
+#[derive(Serialize)]
+pub struct TrashListResponse {
+    items: Vec<TrashItem>,
+}
+
+/// Move `path` into a new folder of `trash_dir` and return the folder name.
+pub(super) async fn move_to_trash(
+    trash_dir: &Path,
+    path: &Path,
+    max_depth: usize,
+) -> Result<String, AppError> {
+    let now = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_secs();
+    let deleted_at = format_time(now);
+    let id = format!("{}-{}", deleted_at.replace(':', ""), generate_nanoid(6));
+    let name = path
+        .file_name()
+        .ok_or_else(|| AppError::BadRequest(format!("Cannot delete {}", path.display())))?;
+
+    let folder = trash_dir.join(&id);
+    ensure_directory(&folder.join(TRASH_ITEM)).await?;
+    let info = TrashInfo {
+        original_path: path.to_string_lossy().to_string(),
+        deleted_at,
+    };
+    fs::write(folder.join(TRASH_INFO), serde_json::to_vec(&info)?).await?;
+
+    if let Err(e) = move_path(path, &folder.join(TRASH_ITEM).join(name), max_depth).await {
+        let _ = fs::remove_dir_all(&folder).await;
+        return Err(e);
+    }
+    Ok(id)
+}
+
+/// Rename, falling back to copy and delete when `to` is on another filesystem.
+async fn move_path(from: &Path, to: &Path, max_depth: usize) -> Result<(), AppError> {
+    match fs::rename(from, to).await {
+        Ok(()) => return Ok(()),
+        Err(e) if e.raw_os_error() == Some(nix::errno::Errno::EXDEV as i32) => {}
+        Err(e) => return Err(e.into()),
+    }
+
+    let metadata = fs::symlink_metadata(from).await?;
+    let copied = if metadata.is_symlink() {
+        match fs::read_link(from).await {
+            Ok(link) => fs::symlink(link, to).await.map_err(AppError::from),
+            Err(e) => Err(e.into()),
+        }
+    } else if metadata.is_dir() {
+        // Items leave the workspace and come back to the same path, so no
+        // denied path becomes reachable under another name
+        copy_tree(from, to, max_depth, None).await.map(|_| ())
+    } else {
+        fs::copy(from, to).await.map(|_| ()).map_err(AppError::from)
+    };
+    if let Err(e) = copied {
+        let _ = remove_path(to).await;
+        return Err(e);
+    }
+    remove_path(from).await
+}
+
+async fn remove_path(path: &Path) -> Result<(), AppError> {
+    if fs::symlink_metadata(path).await?.is_dir() {
+        fs::remove_dir_all(path).await?;
+    } else {
+        fs::remove_file(path).await?;
+    }
+    Ok(())
+}
+
+fn trash_dir(state: &AppState) -> Result<&Path, AppError> {
+    state
+        .config
+        .trash_dir
+        .as_deref()
+        .ok_or_else(|| AppError::BadRequest("Trash is not enabled (set TRASH_DIR)".to_string()))
+}
+
+/// The folder of a trashed item, rejecting ids that are not a plain name.
+fn item_folder(trash_dir: &Path, id: &str) -> Result<PathBuf, AppError> {
+    let mut components = Path::new(id).components();
+    match (components.next(), components.next()) {
+        (Some(Component::Normal(_)), None) => Ok(trash_dir.join(id)),
+        _ => Err(AppError::BadRequest(format!("Invalid trash id: {}", id))),
+    }
+}
+
+/// The trashed file or directory in `folder`
+async fn item_path(folder: &Path) -> Result<Option<PathBuf>, AppError> {
+    let mut entries = fs::read_dir(folder.join(TRASH_ITEM)).await?;
+    Ok(entries.next_entry().await?.map(|entry| entry.path()))
+}
+
+async fn read_info(folder: &Path) -> Option<TrashInfo> {
+    let data = fs::read(folder.join(TRASH_INFO)).await.ok()?;
+    serde_json::from_slice(&data).ok()
+}
+
+/// Trashed items, most recently deleted first. Folders that do not look like
+/// trash items are skipped.
+pub async fn list_trash(
+    State(state): State<Arc<AppState>>,
+) -> Result<Json<ApiResponse<TrashListResponse>>, AppError> {
+    let trash_dir = trash_dir(&state)?;
+    let mut items = Vec::new();
+
+    let mut entries = match fs::read_dir(trash_dir).await {
+        Ok(entries) => entries,
+        // Nothing has been deleted yet
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => {
+            return Ok(Json(ApiResponse::success(TrashListResponse { items })))
+        }
+        Err(e) => return Err(e.into()),
+    };
+    while let Some(entry) = entries.next_entry().await? {
+        let folder = entry.path();
+        let Some(info) = read_info(&folder).await else {
+            continue;
+        };
+        let Ok(Some(path)) = item_path(&folder).await else {
+            continue;
+        };
+        let is_dir = fs::symlink_metadata(&path)
+            .await
+            .map(|m| m.is_dir())
+            .unwrap_or(false);
+        items.push(TrashItem {
+            id: entry.file_name().to_string_lossy().to_string(),
+            original_path: info.original_path,
+            deleted_at: info.deleted_at,
+            is_dir,
+        });
+    }
+    items.sort_by(|a, b| b.id.cmp(&a.id));
+
+    Ok(Json(ApiResponse::success(TrashListResponse { items })))
+}
+
+#[derive(Deserialize, JsonSchema)]
+pub struct RestoreRequest {
+    id: String,
+    /// Replace whatever now exists at the original path
+    #[serde(default)]
+    overwrite: bool,
+}
+
+#[derive(Serialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct RestoreResponse {
+    id: String,
+    path: String,
+}
+
+/// Move a trashed item back to where it was deleted from.
+pub async fn restore_from_trash(
+    State(state): State<Arc<AppState>>,
+    Json(req): Json<RestoreRequest>,
+) -> Result<Json<ApiResponse<RestoreResponse>>, AppError> {
+    let folder = item_folder(trash_dir(&state)?, &req.id)?;
+    let not_found = || AppError::NotFound(format!("Trash item not found: {}", req.id));
+    let info = read_info(&folder).await.ok_or_else(not_found)?;
+    let source = item_path(&folder)
+        .await
+        .map_err(|_| not_found())?
+        .ok_or_else(not_found)?;
+
+    let dest = state.resolve_path(&info.original_path)?;
+    ensure_writable(&state.config.read_only_paths, &dest)?;
+    if fs::symlink_metadata(&dest).await.is_ok() {
+        if !req.overwrite {
+            return Err(AppError::Conflict(format!(
+                "{} already exists",
+                dest.display()
+            )));
+        }
+        remove_path(&dest).await?;
+    }
+    if let Some(parent) = dest.parent() {
+        ensure_directory(parent).await?;
+    }
+
+    move_path(&source, &dest, state.config.max_traversal_depth).await?;
+    fs::remove_dir_all(&folder).await?;
+
+    Ok(Json(ApiResponse::success(RestoreResponse {
+        id: req.id,
+        path: dest.to_string_lossy().to_string(),
+    })))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_move_to_trash() {
+        let dir = std::env::temp_dir().join(format!("trash-test-{}", std::process::id()));
+        let trash = dir.join("trash");
+        std::fs::create_dir_all(dir.join("project/src")).unwrap();
+        std::fs::write(dir.join("project/src/main.rs"), b"fn main() {}").unwrap();
+
+        let id = move_to_trash(&trash, &dir.join("project/src"), 64)
+            .await
+            .unwrap();
+        assert!(!dir.join("project/src").exists());
+
+        let folder = item_folder(&trash, &id).unwrap();
+        let info = read_info(&folder).await.unwrap();
+        assert_eq!(
+            info.original_path,
+            dir.join("project/src").to_string_lossy()
+        );
+        let path = item_path(&folder).await.unwrap().unwrap();
+        assert_eq!(path, folder.join(TRASH_ITEM).join("src"));
+        assert!(path.join("main.rs").exists());
+
+        assert!(item_folder(&trash, "../project").is_err());
+        assert!(item_folder(&trash, "a/b").is_err());
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_restore_file_named_like_metadata() {
+        let dir = std::env::temp_dir().join(format!("trash-info-test-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("project")).unwrap();
+        std::fs::write(dir.join("project/info.json"), b"{\"user\": true}").unwrap();
+
+        let mut config = crate::config::Config::load();
+        config.workspace_path = dir.join("project");
+        config.trash_dir = Some(dir.join("trash"));
+        let state = Arc::new(AppState::new(config));
+
+        let id = move_to_trash(&dir.join("trash"), &dir.join("project/info.json"), 64)
+            .await
+            .unwrap();
+        assert!(!dir.join("project/info.json").exists());
+
+        let listed = list_trash(State(state.clone())).await.unwrap();
+        assert_eq!(listed.data.items.len(), 1);
+        assert_eq!(listed.data.items[0].id, id);
+
+        restore_from_trash(
+            State(state),
+            Json(RestoreRequest {
+                id,
+                overwrite: false,
+            }),
+        )
+        .await
+        .unwrap();
+        assert_eq!(
+            std::fs::read(dir.join("project/info.json")).unwrap(),
+            b"{\"user\": true}"
+        );
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -1,4 +1,8 @@
+use crate::utils::mime::mime_type;
+use crate::utils::path::{absolute_path, workspace_relative_path};
+use schemars::JsonSchema;
 use serde::Serialize;
+use std::path::Path;
 
 #[derive(Serialize, Clone)]
 #[serde(rename_all = "camelCase")]
@@ -7,19 +11,118 @@ pub struct FileInfo {
     pub path: String,
     pub size: u64,
     pub is_dir: bool,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub mime_type: Option<String>,
     pub permissions: Option<String>,
     pub modified: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub inode: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub nlink: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub device: Option<u64>,
+    /// Set by stat, which reports the link itself rather than its target
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub is_symlink: Option<bool>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub symlink_target: Option<String>,
 }
 
-#[derive(Serialize)]
+impl FileInfo {
+    /// `detailed` adds inode, link count and device id (Unix only).
+    pub fn from_metadata(
+        name: String,
+        path: &Path,
+        metadata: &std::fs::Metadata,
+        detailed: bool,
+    ) -> Self {
+        #[cfg(unix)]
+        let permissions = {
+            use std::os::unix::fs::PermissionsExt;
+            Some(format!("0{:o}", metadata.permissions().mode() & 0o777))
+        };
+        #[cfg(not(unix))]
+        let permissions = None;
+        let modified = metadata.modified().ok().map(|t| {
+            let duration = t.duration_since(std::time::UNIX_EPOCH).unwrap_or_default();
+            crate::utils::common::format_time(duration.as_secs())
+        });
+
+        #[cfg(unix)]
+        let (inode, nlink, device) = if detailed {
+            use std::os::unix::fs::MetadataExt;
+            (
+                Some(metadata.ino()),
+                Some(metadata.nlink()),
+                Some(metadata.dev()),
+            )
+        } else {
+            (None, None, None)
+        };
+        #[cfg(not(unix))]
+        let (inode, nlink, device) = (None, None, None);
+
+        FileInfo {
+            name,
+            path: path.to_string_lossy().to_string(),
+            size: metadata.len(),
+            is_dir: metadata.is_dir(),
+            mime_type: if metadata.is_dir() {
+                None
+            } else {
+                mime_type(path).map(str::to_string)
+            },
+            permissions,
+            modified,
+            inode,
+            nlink,
+            device,
+            is_symlink: None,
+            symlink_target: None,
+        }
+    }
+}
+
+#[derive(Serialize, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct FileHash {
+    pub path: String,
+    pub size: u64,
+    pub algorithm: String,
+    /// Lowercase hex digest
+    pub digest: String,
+    /// Same as `digest` for SHA-256, kept for clients predating `algo`
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub sha256: Option<String>,
+}
+
+#[derive(Serialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct FileOperationResponse {
     pub success: bool,
 }
 
-#[derive(Serialize)]
+#[derive(Serialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct WriteFileResponse {
+    /// Absolute path the server wrote to
     pub path: String,
+    /// Path relative to the workspace, when the file lies inside it
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub relative_path: Option<String>,
     pub size: u64,
+    /// Whether the content was linked to an existing identical blob (dedup mode only)
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub deduplicated: Option<bool>,
+}
+
+impl WriteFileResponse {
+    pub fn new(workspace_path: &Path, path: &Path, size: u64) -> Self {
+        WriteFileResponse {
+            path: absolute_path(path).to_string_lossy().to_string(),
+            relative_path: workspace_relative_path(workspace_path, path),
+            size,
+            deduplicated: None,
+        }
+    }
 }
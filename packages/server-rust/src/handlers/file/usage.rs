@@ -0,0 +1,113 @@
+use crate::error::AppError;
+use crate::response::ApiResponse;
+use crate::state::AppState;
+use crate::utils::path::absolute_path;
+use crate::utils::usage::{disk_usage, USAGE_CACHE_TTL};
+use axum::{
+    extract::{Query, State},
+    Json,
+};
+use schemars::JsonSchema;
+use serde::{Deserialize, Serialize};
+use std::path::PathBuf;
+use std::sync::Arc;
+use std::time::Instant;
+use tokio::fs;
+
+/// Largest files listed when `top` is not given
+const DEFAULT_LARGEST_FILES: usize = 10;
+
+/// Upper bound on `top`
+const MAX_LARGEST_FILES: usize = 100;
+
+#[derive(Deserialize, JsonSchema)]
+pub struct DiskUsageParams {
+    path: Option<String>,
+    /// Number of largest files to list
+    top: Option<usize>,
+}
+
+#[derive(Clone, Serialize)]
+pub struct LargeFile {
+    path: String,
+    size: u64,
+}
+
+#[derive(Clone, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub struct DiskUsageResponse {
+    path: String,
+    total_bytes: u64,
+    file_count: u64,
+    directory_count: u64,
+    largest_files: Vec<LargeFile>,
+}
+
+/// Space used below a directory (the workspace by default), measured in one
+/// walk. The workspace-wide result is cached for a few seconds so frequent
+/// polling does not keep rescanning it. Denied paths are left out.
+pub async fn get_disk_usage(
+    State(state): State<Arc<AppState>>,
+    Query(params): Query<DiskUsageParams>,
+) -> Result<Json<ApiResponse<DiskUsageResponse>>, AppError> {
+    let root = state.resolve_path(params.path.as_deref().unwrap_or("."))?;
+    let top = params
+        .top
+        .unwrap_or(DEFAULT_LARGEST_FILES)
+        .min(MAX_LARGEST_FILES);
+
+    let metadata = fs::metadata(&root)
+        .await
+        .map_err(|_| AppError::NotFound(format!("Directory not found: {}", root.display())))?;
+    if !metadata.is_dir() {
+        return Err(AppError::BadRequest(format!(
+            "Path is not a directory: {}",
+            root.display()
+        )));
+    }
+
+    let mut response = if absolute_path(&root) == absolute_path(&state.config.workspace_path) {
+        let mut cached = state.workspace_usage.lock().await;
+        match &*cached {
+            Some((measured, usage)) if measured.elapsed() < USAGE_CACHE_TTL => usage.clone(),
+            _ => {
+                // Cached with the most files so any `top` can be served from it
+                let usage = measure(&state, root, MAX_LARGEST_FILES).await?;
+                *cached = Some((Instant::now(), usage.clone()));
+                usage
+            }
+        }
+    } else {
+        measure(&state, root, top).await?
+    };
+    response.largest_files.truncate(top);
+
+    Ok(Json(ApiResponse::success(response)))
+}
+
+async fn measure(
+    state: &AppState,
+    root: PathBuf,
+    top: usize,
+) -> Result<DiskUsageResponse, AppError> {
+    let denied = state.denied_paths.clone();
+    tokio::task::spawn_blocking(move || {
+        let usage = disk_usage(&root, top, |path| denied.is_denied(path));
+        DiskUsageResponse {
+            path: root.to_string_lossy().to_string(),
+            total_bytes: usage.bytes,
+            file_count: usage.files,
+            directory_count: usage.directories,
+            largest_files: usage
+                .largest
+                .into_iter()
+                .map(|(size, path)| LargeFile {
+                    path: path.to_string_lossy().to_string(),
+                    size,
+                })
+                .collect(),
+        }
+    })
+    .await
+    .map_err(|e| AppError::InternalServerError(e.to_string()))
+}
@@ -1,8 +1,17 @@
 use crate::response::ApiResponse;
 use crate::state::AppState;
-use axum::{extract::State, Json};
+use crate::utils::atomic::sibling_temp_path;
+use axum::{
+    extract::State,
+    http::{header, StatusCode},
+    response::{IntoResponse, Response},
+    Json,
+};
 use serde::Serialize;
+use std::collections::BTreeMap;
+use std::path::Path;
 use std::sync::Arc;
+use tokio::fs;
 
 #[derive(Serialize)]
 #[serde(rename_all = "camelCase")]
@@ -12,11 +21,44 @@ pub struct HealthCheckResponse {
     version: String,
 }
 
+/// Outcome of one readiness check
+#[derive(Serialize)]
+pub struct CheckResult {
+    status: &'static str,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    error: Option<String>,
+}
+
+impl CheckResult {
+    fn from_result(result: std::io::Result<()>) -> Self {
+        match result {
+            Ok(()) => CheckResult {
+                status: "ok",
+                error: None,
+            },
+            Err(e) => CheckResult {
+                status: "fail",
+                error: Some(e.to_string()),
+            },
+        }
+    }
+
+    fn passed(&self) -> bool {
+        self.error.is_none()
+    }
+}
+
 #[derive(Serialize)]
 #[serde(rename_all = "camelCase")]
 pub struct ReadinessCheckResponse {
     readiness_status: String,
+    /// Whether the workspace is usable (writable unless `READ_ONLY`)
     workspace: bool,
+    checks: BTreeMap<&'static str, CheckResult>,
+    uptime: String,
+    version: String,
+    active_processes: usize,
+    active_sessions: usize,
 }
 
 pub async fn health_check(
@@ -30,18 +72,76 @@ pub async fn health_check(
     }))
 }
 
+/// Prometheus metrics in the text exposition format.
+pub async fn metrics(State(state): State<Arc<AppState>>) -> Response {
+    let body = state.metrics.render(
+        state.running_process_count().await,
+        state.active_session_count().await,
+    );
+    (
+        [(
+            header::CONTENT_TYPE,
+            "text/plain; version=0.0.4; charset=utf-8",
+        )],
+        body,
+    )
+        .into_response()
+}
+
+/// Readiness with the usual HTTP 200, whatever the outcome.
 pub async fn readiness_check(
     State(state): State<Arc<AppState>>,
 ) -> Json<ApiResponse<ReadinessCheckResponse>> {
-    // Check if workspace path is accessible
-    let workspace_accessible = state.config.workspace_path.exists();
+    Json(ApiResponse::success(readiness(&state).await))
+}
+
+/// Readiness for orchestrators (`/readyz`): HTTP 503 while any check fails.
+pub async fn readyz(State(state): State<Arc<AppState>>) -> Response {
+    let readiness = readiness(&state).await;
+    let code = if readiness.workspace {
+        StatusCode::OK
+    } else {
+        StatusCode::SERVICE_UNAVAILABLE
+    };
+    (code, Json(ApiResponse::success(readiness))).into_response()
+}
 
-    Json(ApiResponse::success(ReadinessCheckResponse {
-        readiness_status: if workspace_accessible {
+async fn readiness(state: &AppState) -> ReadinessCheckResponse {
+    // A read-only server only needs to be able to read the workspace
+    let workspace = if state.config.read_only {
+        check_readable(&state.config.workspace_path).await
+    } else {
+        check_writable(&state.config.workspace_path).await
+    };
+    let workspace = CheckResult::from_result(workspace);
+    let ready = workspace.passed();
+
+    ReadinessCheckResponse {
+        readiness_status: if ready {
             "ready".to_string()
         } else {
             "not_ready".to_string()
         },
-        workspace: workspace_accessible,
-    }))
+        workspace: ready,
+        checks: BTreeMap::from([("workspace", workspace)]),
+        uptime: format!("{}s", state.start_time.elapsed().as_secs()),
+        version: env!("CARGO_PKG_VERSION").to_string(),
+        active_processes: state.running_process_count().await,
+        active_sessions: state.active_session_count().await,
+    }
+}
+
+async fn check_readable(dir: &Path) -> std::io::Result<()> {
+    fs::read_dir(dir).await.map(|_| ())
+}
+
+/// Create and remove a hidden file in `dir`.
+async fn check_writable(dir: &Path) -> std::io::Result<()> {
+    let probe = sibling_temp_path(&dir.join(".devbox-ready"));
+    fs::OpenOptions::new()
+        .write(true)
+        .create_new(true)
+        .open(&probe)
+        .await?;
+    fs::remove_file(&probe).await
 }
@@ -1,39 +1,93 @@
+use crate::audit::{AuditContext, AuditEntry};
 use crate::error::AppError;
+use crate::middleware::logging::TraceId;
 use crate::response::ApiResponse;
-use crate::state::{process::ProcessInfo, AppState};
-use crate::utils::path::validate_path;
-use axum::response::sse::{Event, Sse};
+use crate::state::process::{ProcessInfo, ProcessStdin, ProcessStore};
+use crate::state::AppState;
+use crate::utils::env_file::merge_env_file;
+use crate::utils::path::{ensure_directory, ensure_writable, validate_path};
+use crate::utils::pty::attach_pty;
+use axum::response::sse::{Event, KeepAlive, Sse};
 use axum::{
     extract::{Path, Query, State},
     response::{IntoResponse, Response},
     Json,
 };
 use futures::stream::{self, Stream, StreamExt};
+use schemars::JsonSchema;
 use serde::{Deserialize, Serialize};
 use std::convert::Infallible;
 use std::io::ErrorKind;
 use std::os::unix::process::ExitStatusExt;
 use std::process::Stdio;
+use std::sync::atomic::Ordering;
 use std::sync::Arc;
-use tokio::io::{AsyncBufReadExt, BufReader};
+use tokio::io::{AsyncBufReadExt, AsyncWriteExt, BufReader};
 use tokio::process::Command;
 use tokio::time::{timeout, Duration};
 
-#[derive(Deserialize)]
+#[derive(Deserialize, Clone, JsonSchema)]
 pub struct ExecProcessRequest {
     command: String,
     args: Option<Vec<String>>,
     cwd: Option<String>,
+    #[serde(default, rename = "createCwd")]
+    create_cwd: bool,
     env: Option<std::collections::HashMap<String, String>>,
+    /// Workspace dotenv file merged under `env` (explicit values win)
+    #[serde(rename = "envFile")]
+    env_file: Option<String>,
+    #[serde(rename = "pathPrepend")]
+    path_prepend: Option<Vec<String>>,
+    #[serde(rename = "pathAppend")]
+    path_append: Option<Vec<String>>,
+    /// Seconds after which the process is killed and marked failed with
+    /// failureReason `timeout` (default 2 hours)
     timeout: Option<u64>,
+    /// Run under a pseudo-terminal; stdout and stderr are logged together as stdout
+    #[serde(default)]
+    pty: bool,
+    /// Encoding of the process output (e.g. "gbk", "shift_jis", "latin1"),
+    /// transcoded to UTF-8 before it is logged
+    #[serde(rename = "outputEncoding")]
+    output_encoding: Option<String>,
+    /// Workspace file receiving stdout instead of the log buffer (truncated first)
+    #[serde(rename = "stdoutFile")]
+    stdout_file: Option<String>,
+    /// Workspace file receiving stderr instead of the log buffer (truncated first)
+    #[serde(rename = "stderrFile")]
+    stderr_file: Option<String>,
+    /// Keep a stdin pipe open for `/process/{id}/stdin` (implied by `pty`)
+    #[serde(default, rename = "openStdin")]
+    open_stdin: bool,
+    /// Data written to stdin once the process starts. Stdin is closed
+    /// afterwards unless `openStdin` is set.
+    stdin: Option<String>,
+    /// Encoding of `stdin`: "utf8" (default) or "base64"
+    #[serde(rename = "stdinEncoding")]
+    stdin_encoding: Option<String>,
+    /// Scheduling priority from -20 (highest) to 19 (lowest); inherits the
+    /// server's priority when unset. Raising priority needs CAP_SYS_NICE.
+    nice: Option<i32>,
+    /// Address space limit (RLIMIT_AS) in MiB
+    #[serde(rename = "maxMemoryMb")]
+    max_memory_mb: Option<u64>,
+    /// CPU time limit (RLIMIT_CPU) in seconds; the process is killed and
+    /// marked failed with failureReason `cpu_limit` when it is used up
+    #[serde(rename = "maxCpuSeconds")]
+    max_cpu_seconds: Option<u64>,
 }
 
-#[derive(Serialize)]
+#[derive(Serialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct ExecProcessResponse {
     process_id: String,
     pid: Option<u32>,
     process_status: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    stdout_file: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    stderr_file: Option<String>,
 }
 
 #[derive(Serialize)]
@@ -87,42 +141,310 @@ pub struct StreamErrorEvent {
     timestamp: String,
 }
 
+/// Decode the `stdin` of an exec request.
+fn decode_stdin(stdin: Option<&str>, encoding: Option<&str>) -> Result<Option<Vec<u8>>, AppError> {
+    let Some(stdin) = stdin else {
+        return Ok(None);
+    };
+    match encoding.unwrap_or("utf8") {
+        "utf8" | "utf-8" => Ok(Some(stdin.as_bytes().to_vec())),
+        "base64" => {
+            use base64::{engine::general_purpose, Engine as _};
+            general_purpose::STANDARD
+                .decode(stdin)
+                .map(Some)
+                .map_err(|e| AppError::BadRequest(format!("Invalid base64 stdin: {}", e)))
+        }
+        other => Err(AppError::BadRequest(format!(
+            "Unsupported stdin encoding: {} (expected utf8 or base64)",
+            other
+        ))),
+    }
+}
+
+/// Write `data` to the child's stdin in the background, then close it so
+/// commands that read to EOF finish. Running alongside output collection keeps
+/// a child that fills its stdout pipe from blocking the write.
+fn spawn_stdin_writer(child: &mut tokio::process::Child, data: Vec<u8>) {
+    if let Some(mut pipe) = child.stdin.take() {
+        tokio::spawn(async move {
+            // The process may exit without reading everything
+            let _ = pipe.write_all(&data).await;
+        });
+    }
+}
+
+/// Build a command from `command` and `args`. Without explicit args the
+/// command string is split using shell quoting rules.
+fn build_command(command: &str, args: Option<&Vec<String>>) -> Command {
+    if let Some(args) = args {
+        let mut c = Command::new(command);
+        c.args(args);
+        return c;
+    }
+    match shell_words::split(command) {
+        Ok(parts) if !parts.is_empty() => {
+            let mut c = Command::new(&parts[0]);
+            c.args(&parts[1..]);
+            c
+        }
+        _ => Command::new(command),
+    }
+}
+
+/// Compute the PATH for a spawned process. The base is the request's own
+/// `PATH`, then the configured default exec path, then the server's PATH.
+/// Relative entries are resolved against the command's working directory.
+fn exec_path(
+    base: Option<&str>,
+    work_dir: &std::path::Path,
+    prepend: &[String],
+    append: &[String],
+) -> String {
+    let resolve = |entry: &String| {
+        let p = std::path::Path::new(entry);
+        if p.is_absolute() {
+            entry.clone()
+        } else {
+            work_dir.join(p).to_string_lossy().to_string()
+        }
+    };
+
+    let mut parts: Vec<String> = prepend.iter().map(resolve).collect();
+    if let Some(base) = base.filter(|b| !b.is_empty()) {
+        parts.push(base.to_string());
+    }
+    parts.extend(append.iter().map(resolve));
+    parts.join(":")
+}
+
+fn apply_exec_path(
+    cmd: &mut Command,
+    config: &crate::config::Config,
+    work_dir: &std::path::Path,
+    env: Option<&std::collections::HashMap<String, String>>,
+    prepend: Option<&[String]>,
+    append: Option<&[String]>,
+) {
+    let prepend = prepend.unwrap_or_default();
+    let append = append.unwrap_or_default();
+    let request_path = env.and_then(|e| e.get("PATH"));
+    if prepend.is_empty() && append.is_empty() {
+        // Only the configured default needs applying, and the request's PATH wins
+        if request_path.is_none() {
+            if let Some(default) = &config.default_exec_path {
+                cmd.env("PATH", default);
+            }
+        }
+        return;
+    }
+
+    let server_path = std::env::var("PATH").ok();
+    let base = request_path
+        .map(String::as_str)
+        .or(config.default_exec_path.as_deref())
+        .or(server_path.as_deref());
+    cmd.env("PATH", exec_path(base, work_dir, prepend, append));
+}
+
+/// Set the child's scheduling priority before it execs.
+fn apply_nice(cmd: &mut Command, nice: i32) -> Result<(), AppError> {
+    if !(-20..=19).contains(&nice) {
+        return Err(AppError::BadRequest(format!(
+            "nice must be between -20 and 19, got {}",
+            nice
+        )));
+    }
+    // SAFETY: between fork and exec the hook makes a single setpriority
+    // syscall for the calling process (`who` 0) with a copied integer, and
+    // reads errno on failure; nothing is allocated.
+    unsafe {
+        cmd.pre_exec(move || {
+            if nix::libc::setpriority(nix::libc::PRIO_PROCESS, 0, nice) == -1 {
+                return Err(std::io::Error::last_os_error());
+            }
+            Ok(())
+        });
+    }
+    Ok(())
+}
+
+/// Cap the child's memory and CPU time before it execs. The limits are
+/// inherited by everything the process starts.
+fn apply_limits(
+    cmd: &mut Command,
+    max_memory_mb: Option<u64>,
+    max_cpu_seconds: Option<u64>,
+) -> Result<(), AppError> {
+    if max_memory_mb == Some(0) || max_cpu_seconds == Some(0) {
+        return Err(AppError::BadRequest(
+            "maxMemoryMb and maxCpuSeconds must be greater than zero".to_string(),
+        ));
+    }
+    if max_memory_mb.is_none() && max_cpu_seconds.is_none() {
+        return Ok(());
+    }
+    let memory = max_memory_mb.map(|mb| mb.saturating_mul(1024 * 1024));
+    // SIGXCPU at the soft limit, SIGKILL a second later if it is ignored
+    let cpu = max_cpu_seconds.map(|secs| (secs, secs.saturating_add(1)));
+    // SAFETY: runs in the forked child before exec. It only makes setrlimit
+    // calls on the child's own limits, with values computed before the fork;
+    // turning an errno into io::Error neither allocates nor takes locks.
+    unsafe {
+        cmd.pre_exec(move || {
+            use nix::sys::resource::{setrlimit, Resource};
+            if let Some(bytes) = memory {
+                setrlimit(Resource::RLIMIT_AS, bytes, bytes).map_err(std::io::Error::from)?;
+            }
+            if let Some((soft, hard)) = cpu {
+                setrlimit(Resource::RLIMIT_CPU, soft, hard).map_err(std::io::Error::from)?;
+            }
+            Ok(())
+        });
+    }
+    Ok(())
+}
+
 pub async fn exec_process(
     State(state): State<Arc<AppState>>,
+    trace: TraceId,
+    audit: AuditContext,
     Json(req): Json<ExecProcessRequest>,
 ) -> Result<Json<ApiResponse<ExecProcessResponse>>, AppError> {
-    let mut cmd = if let Some(args) = &req.args {
-        let mut c = Command::new(&req.command);
-        c.args(args);
-        c
-    } else {
-        match shell_words::split(&req.command) {
-            Ok(parts) => {
-                if !parts.is_empty() {
-                    let mut c = Command::new(&parts[0]);
-                    c.args(&parts[1..]);
-                    c
-                } else {
-                    Command::new(&req.command)
-                }
-            }
-            Err(_) => Command::new(&req.command),
+    state
+        .audit
+        .record(
+            AuditEntry::new("exec", &req.command, &audit)
+                .args(req.args.as_ref())
+                .cwd(req.cwd.as_ref())
+                .env(req.env.as_ref()),
+        )
+        .await;
+
+    let command = req.command.clone();
+    let response = start_process(&state, req).await?;
+    trace.log(format_args!(
+        "Started process {}: {}",
+        response.process_id, command
+    ));
+    Ok(Json(ApiResponse::success(response)))
+}
+
+/// Start a finished process again with the request it was started with.
+pub async fn restart_process(
+    State(state): State<Arc<AppState>>,
+    Path(id): Path<String>,
+    audit: AuditContext,
+) -> Result<Json<ApiResponse<ExecProcessResponse>>, AppError> {
+    let req = {
+        let processes = state.processes.read().await;
+        let proc = processes
+            .get(&id)
+            .ok_or_else(|| AppError::NotFound("Process not found".to_string()))?;
+        if proc.status == "running" {
+            return Err(AppError::Conflict(format!(
+                "Process {} is still running",
+                id
+            )));
         }
+        proc.request.clone()
+    };
+
+    state
+        .audit
+        .record(
+            AuditEntry::new("restart", &req.command, &audit)
+                .args(req.args.as_ref())
+                .cwd(req.cwd.as_ref())
+                .env(req.env.as_ref()),
+        )
+        .await;
+
+    let response = start_process(&state, req).await?;
+    Ok(Json(ApiResponse::success(response)))
+}
+
+/// Spawn a process in the background and register it in the process store.
+async fn start_process(
+    state: &Arc<AppState>,
+    mut req: ExecProcessRequest,
+) -> Result<ExecProcessResponse, AppError> {
+    let output_encoding = match req.output_encoding.as_deref() {
+        Some(label) => encoding_rs::Encoding::for_label(label.as_bytes()).ok_or_else(|| {
+            AppError::BadRequest(format!("Unsupported output encoding: {}", label))
+        })?,
+        None => encoding_rs::UTF_8,
+    };
+    req.env = merge_env_file(&state, req.env_file.as_deref(), req.env.take()).await?;
+    // Restarts reuse the merged environment instead of reading the file again
+    let spec = ExecProcessRequest {
+        env_file: None,
+        ..req.clone()
     };
 
+    let mut cmd = build_command(&req.command, req.args.as_ref());
+    if let Some(nice) = req.nice {
+        apply_nice(&mut cmd, nice)?;
+    }
+    apply_limits(&mut cmd, req.max_memory_mb, req.max_cpu_seconds)?;
+
+    let mut work_dir = state.config.workspace_path.clone();
     if let Some(cwd) = &req.cwd {
         let valid_cwd = validate_path(&state.config.workspace_path, cwd)?;
-        cmd.current_dir(valid_cwd);
+        if req.create_cwd {
+            ensure_directory(&valid_cwd).await?;
+        }
+        cmd.current_dir(&valid_cwd);
+        work_dir = valid_cwd;
+    }
+
+    if req.pty && (req.stdout_file.is_some() || req.stderr_file.is_some()) {
+        return Err(AppError::BadRequest(
+            "stdoutFile and stderrFile cannot be combined with pty".to_string(),
+        ));
     }
+    let stdin_data = decode_stdin(req.stdin.as_deref(), req.stdin_encoding.as_deref())?;
+    if req.pty && stdin_data.is_some() {
+        return Err(AppError::BadRequest(
+            "stdin cannot be combined with pty".to_string(),
+        ));
+    }
+    let (stdout_file, stdout_stdio) = output_target(state, req.stdout_file.as_deref()).await?;
+    let (stderr_file, stderr_stdio) = output_target(state, req.stderr_file.as_deref()).await?;
+
+    let pty_master = if req.pty {
+        Some(attach_pty(&mut cmd)?)
+    } else {
+        // Own process group, so a timeout stops whole pipelines; the PTY
+        // setup already starts a new session
+        cmd.process_group(0);
+        cmd.stdout(stdout_stdio);
+        cmd.stderr(stderr_stdio);
+        if req.open_stdin || stdin_data.is_some() {
+            cmd.stdin(Stdio::piped());
+        }
+        None
+    };
+    let pty_input = match &pty_master {
+        Some(master) => Some(master.try_clone().await?),
+        None => None,
+    };
 
     if let Some(env) = &req.env {
         cmd.envs(env);
     }
-
-    cmd.stdout(Stdio::piped());
-    cmd.stderr(Stdio::piped());
+    apply_exec_path(
+        &mut cmd,
+        &state.config,
+        &work_dir,
+        req.env.as_ref(),
+        req.path_prepend.as_deref(),
+        req.path_append.as_deref(),
+    );
 
     let child_result = cmd.spawn();
+    // Close our copies of the PTY slave so the master reports EOF on exit
+    drop(cmd);
 
     let mut child = match child_result {
         Ok(c) => c,
@@ -137,52 +459,97 @@ pub async fn exec_process(
     let pid = child.id();
     let process_id = crate::utils::common::generate_id();
 
-    let stdout = child.stdout.take().expect("stdout piped");
-    let stderr = child.stderr.take().expect("stderr piped");
+    let stdout = child.stdout.take();
+    let stderr = child.stderr.take();
+    if let (Some(data), false) = (&stdin_data, req.open_stdin) {
+        spawn_stdin_writer(&mut child, data.clone());
+    }
+    let stdin = match pty_input {
+        Some(master) => Some(ProcessStdin::Pty(master)),
+        None => child.stdin.take().map(ProcessStdin::Pipe),
+    };
 
     let (tx, _rx) = tokio::sync::broadcast::channel(100);
 
-    let process_info = ProcessInfo::new(
+    let mut process_info = ProcessInfo::new(
         process_id.clone(),
         pid,
         req.command.clone(),
         Some(child),
         tx.clone(),
+        spec,
     );
+    process_info.stdin = Arc::new(tokio::sync::Mutex::new(stdin));
+    if let (Some(data), true) = (stdin_data, req.open_stdin) {
+        // Hold the lock until the initial data is written so writes through
+        // `/process/{id}/stdin` follow it
+        let mut guard = process_info.stdin.clone().lock_owned().await;
+        tokio::spawn(async move {
+            if let Some(ProcessStdin::Pipe(pipe)) = guard.as_mut() {
+                let _ = pipe.write_all(&data).await;
+            }
+        });
+    }
 
     {
         let mut processes = state.processes.write().await;
         processes.insert(process_id.clone(), process_info);
     }
 
-    let state_clone = state.clone();
-    let pid_clone = process_id.clone();
-    let tx_clone = tx.clone();
-
-    tokio::spawn(async move {
-        let reader = BufReader::new(stdout);
-        pump_log(reader, pid_clone, state_clone, tx_clone, "[stdout]").await;
-    });
+    if let Some(master) = pty_master {
+        let reader = BufReader::new(master);
+        tokio::spawn(pump_log(
+            reader,
+            process_id.clone(),
+            state.clone(),
+            tx.clone(),
+            "[stdout]",
+            output_encoding,
+        ));
+    }
 
-    let state_clone_err = state.clone();
-    let pid_clone_err = process_id.clone();
-    let tx_clone_err = tx.clone();
+    if let Some(stdout) = stdout {
+        let state_clone = state.clone();
+        let pid_clone = process_id.clone();
+        let tx_clone = tx.clone();
+
+        tokio::spawn(async move {
+            let reader = BufReader::new(stdout);
+            pump_log(
+                reader,
+                pid_clone,
+                state_clone,
+                tx_clone,
+                "[stdout]",
+                output_encoding,
+            )
+            .await;
+        });
+    }
 
-    tokio::spawn(async move {
-        let reader = BufReader::new(stderr);
-        pump_log(
-            reader,
-            pid_clone_err,
-            state_clone_err,
-            tx_clone_err,
-            "[stderr]",
-        )
-        .await;
-    });
+    if let Some(stderr) = stderr {
+        let state_clone_err = state.clone();
+        let pid_clone_err = process_id.clone();
+        let tx_clone_err = tx.clone();
+
+        tokio::spawn(async move {
+            let reader = BufReader::new(stderr);
+            pump_log(
+                reader,
+                pid_clone_err,
+                state_clone_err,
+                tx_clone_err,
+                "[stderr]",
+                output_encoding,
+            )
+            .await;
+        });
+    }
 
     let state_clone_cleanup = state.clone();
     let pid_clone_cleanup = process_id.clone();
     let timeout_val = req.timeout;
+    let cpu_limit = req.max_cpu_seconds;
 
     tokio::spawn(async move {
         // Take the child process out of the state to wait on it
@@ -198,21 +565,48 @@ pub async fn exec_process(
         if let Some(mut child) = child {
             let timeout_duration = Duration::from_secs(timeout_val.unwrap_or(7200)); // Default 2h
 
-            let wait_result = match timeout(timeout_duration, child.wait()).await {
-                Ok(res) => res,
+            let mut timed_out = false;
+            let mut cpu_used = None;
+            let wait_result = match timeout(
+                timeout_duration,
+                wait_measuring_cpu(&mut child, cpu_limit.is_some()),
+            )
+            .await
+            {
+                Ok((used, res)) => {
+                    cpu_used = used;
+                    res
+                }
                 Err(_) => {
-                    let _ = child.start_kill();
+                    timed_out = true;
+                    match child.id() {
+                        Some(pid) => {
+                            let _ = nix::sys::signal::kill(
+                                nix::unistd::Pid::from_raw(-(pid as i32)),
+                                nix::sys::signal::Signal::SIGKILL,
+                            );
+                        }
+                        None => {
+                            let _ = child.start_kill();
+                        }
+                    }
                     child.wait().await
                 }
             };
 
             // Update status
-            {
+            let stdin = {
                 let mut processes = state_clone_cleanup.processes.write().await;
                 if let Some(proc) = processes.get_mut(&pid_clone_cleanup) {
                     match wait_result {
                         Ok(status) => {
-                            if status.success() {
+                            if timed_out {
+                                proc.status = "failed".to_string();
+                                proc.failure_reason = Some(FailureReason::Timeout);
+                            } else if killed_by_cpu_limit(&status, cpu_limit, cpu_used) {
+                                proc.status = "failed".to_string();
+                                proc.failure_reason = Some(FailureReason::CpuLimit);
+                            } else if status.success() {
                                 proc.status = "completed".to_string();
                             } else if status.signal().is_some() {
                                 proc.status = "killed".to_string();
@@ -227,7 +621,15 @@ pub async fn exec_process(
                         }
                     }
                     proc.end_time = Some(std::time::SystemTime::now());
+                    proc.broadcast_event("process_exit");
+                    Some(proc.stdin.clone())
+                } else {
+                    None
                 }
+            };
+            // Release the input pipe (or PTY master clone) of the exited process
+            if let Some(stdin) = stdin {
+                stdin.lock().await.take();
             }
 
             // Cleanup logs and status after 4 hours
@@ -238,16 +640,41 @@ pub async fn exec_process(
         }
     });
 
-    Ok(Json(ApiResponse::success(ExecProcessResponse {
+    Ok(ExecProcessResponse {
         process_id,
         pid,
         process_status: "running".to_string(),
-    })))
+        stdout_file: stdout_file.map(|p| p.to_string_lossy().to_string()),
+        stderr_file: stderr_file.map(|p| p.to_string_lossy().to_string()),
+    })
+}
+
+/// Where a process output stream goes: a freshly truncated workspace file
+/// when `path` is given, otherwise a pipe feeding the log buffer.
+async fn output_target(
+    state: &AppState,
+    path: Option<&str>,
+) -> Result<(Option<std::path::PathBuf>, Stdio), AppError> {
+    let Some(path) = path else {
+        return Ok((None, Stdio::piped()));
+    };
+
+    let valid_path = state.resolve_path(path)?;
+    ensure_writable(&state.config.read_only_paths, &valid_path)?;
+    if let Some(parent) = valid_path.parent() {
+        ensure_directory(parent).await?;
+    }
+    // Truncating a deduplicated file would empty every copy sharing its data
+    crate::utils::dedup::detach(state.dedup.as_deref(), &valid_path).await?;
+    let file = tokio::fs::File::create(&valid_path).await?.into_std().await;
+
+    Ok((Some(valid_path), Stdio::from(file)))
 }
 
 pub async fn list_processes(
     State(state): State<Arc<AppState>>,
-) -> Result<Json<ApiResponse<ListProcessesResponse>>, AppError> {
+    headers: axum::http::HeaderMap,
+) -> Result<Response, AppError> {
     let processes = state.processes.read().await;
     let mut result = Vec::new();
 
@@ -255,9 +682,14 @@ pub async fn list_processes(
         result.push(proc.to_status());
     }
 
+    if crate::response::wants_ndjson(&headers) {
+        return Ok(crate::response::ndjson_response(result));
+    }
+
     Ok(Json(ApiResponse::success(ListProcessesResponse {
         processes: result,
-    })))
+    }))
+    .into_response())
 }
 
 pub async fn get_process_status(
@@ -272,14 +704,239 @@ pub async fn get_process_status(
     Ok(Json(ApiResponse::success(proc.to_status())))
 }
 
+#[derive(Deserialize, JsonSchema)]
+pub struct ProcessPidParams {
+    pid: u32,
+}
+
+/// Find the internal ID of the tracked process with the given OS PID.
+fn find_process_id_by_pid(
+    processes: &std::collections::HashMap<String, ProcessInfo>,
+    pid: u32,
+) -> Result<String, AppError> {
+    processes
+        .iter()
+        .find(|(_, p)| p.pid == Some(pid))
+        .map(|(id, _)| id.clone())
+        .ok_or_else(|| AppError::NotFound(format!("No tracked process with PID {}", pid)))
+}
+
+/// Status lookup by OS PID (`?pid=`) for operators who only know the PID.
+pub async fn get_process_status_by_pid(
+    State(state): State<Arc<AppState>>,
+    Query(params): Query<ProcessPidParams>,
+) -> Result<Json<ApiResponse<crate::state::process::ProcessStatus>>, AppError> {
+    let processes = state.processes.read().await;
+    let id = find_process_id_by_pid(&processes, params.pid)?;
+
+    Ok(Json(ApiResponse::success(processes[&id].to_status())))
+}
+
 pub async fn kill_process(
     State(state): State<Arc<AppState>>,
     Path(id): Path<String>,
     Query(params): Query<std::collections::HashMap<String, String>>,
 ) -> Result<Json<ApiResponse<ProcessOperationResponse>>, AppError> {
+    signal_process(&state, &id, params.get("signal").map(String::as_str)).await?;
+
+    Ok(Json(ApiResponse::success(ProcessOperationResponse {
+        success: true,
+    })))
+}
+
+/// Kill by OS PID (`?pid=`); accepts the same `signal` parameter as `kill_process`.
+pub async fn kill_process_by_pid(
+    State(state): State<Arc<AppState>>,
+    Query(params): Query<std::collections::HashMap<String, String>>,
+) -> Result<Json<ApiResponse<ProcessOperationResponse>>, AppError> {
+    let pid = params
+        .get("pid")
+        .ok_or_else(|| AppError::BadRequest("pid parameter required".to_string()))?
+        .parse::<u32>()
+        .map_err(|_| AppError::BadRequest("Invalid pid".to_string()))?;
+    let id = find_process_id_by_pid(&*state.processes.read().await, pid)?;
+    signal_process(&state, &id, params.get("signal").map(String::as_str)).await?;
+
+    Ok(Json(ApiResponse::success(ProcessOperationResponse {
+        success: true,
+    })))
+}
+
+/// Longest a stdin write may wait for the process to drain its input
+const STDIN_WRITE_TIMEOUT: Duration = Duration::from_secs(30);
+
+#[derive(Deserialize, JsonSchema)]
+pub struct ProcessStdinRequest {
+    #[serde(default)]
+    data: String,
+    /// "base64" for binary input; plain UTF-8 otherwise
+    encoding: Option<String>,
+    /// Send EOF after writing `data`
+    #[serde(default)]
+    close: bool,
+}
+
+#[derive(Serialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct ProcessStdinResponse {
+    bytes_written: usize,
+    closed: bool,
+}
+
+/// Write to the stdin of a process started with `openStdin` or `pty`.
+pub async fn write_process_stdin(
+    State(state): State<Arc<AppState>>,
+    Path(id): Path<String>,
+    Json(req): Json<ProcessStdinRequest>,
+) -> Result<Json<ApiResponse<ProcessStdinResponse>>, AppError> {
+    let data = if req.encoding.as_deref() == Some("base64") {
+        use base64::{engine::general_purpose, Engine as _};
+        general_purpose::STANDARD
+            .decode(&req.data)
+            .map_err(|e| AppError::BadRequest(format!("Invalid base64: {}", e)))?
+    } else {
+        req.data.into_bytes()
+    };
+
+    let stdin = {
+        let processes = state.processes.read().await;
+        let proc = processes
+            .get(&id)
+            .ok_or_else(|| AppError::NotFound("Process not found".to_string()))?;
+        if proc.status != "running" {
+            return Err(AppError::Conflict(format!(
+                "Process is not running (status: {})",
+                proc.status
+            )));
+        }
+        proc.stdin.clone()
+    };
+
+    // Hold only the per-process lock while writing: a process that does not
+    // read its input must not block the process store.
+    let mut guard = stdin.lock().await;
+    let input = guard.as_mut().ok_or_else(|| {
+        AppError::Conflict("Process stdin is not open (start it with openStdin or pty)".to_string())
+    })?;
+
+    let write = async {
+        match input {
+            ProcessStdin::Pipe(pipe) => {
+                pipe.write_all(&data).await?;
+                pipe.flush().await
+            }
+            ProcessStdin::Pty(master) => {
+                master.write_all(&data).await?;
+                if req.close {
+                    // Ctrl-D: end of input for a terminal in canonical mode
+                    master.write_all(&[0x04]).await?;
+                }
+                master.flush().await
+            }
+        }
+    };
+    timeout(STDIN_WRITE_TIMEOUT, write)
+        .await
+        .map_err(|_| {
+            AppError::Conflict("Timed out waiting for the process to read stdin".to_string())
+        })?
+        .map_err(|e| AppError::Conflict(format!("Failed to write to process stdin: {}", e)))?;
+
+    if req.close {
+        // Dropping the pipe closes it, which the process reads as EOF
+        guard.take();
+    }
+
+    Ok(Json(ApiResponse::success(ProcessStdinResponse {
+        bytes_written: data.len(),
+        closed: req.close,
+    })))
+}
+
+/// Signal named by a `signal` parameter: SIGTERM, SIGINT, SIGHUP or SIGKILL
+/// (the default). Other names are rejected rather than guessed, so a typo
+/// does not kill anything.
+pub(crate) fn parse_signal(name: Option<&str>) -> Result<nix::sys::signal::Signal, AppError> {
+    match name.unwrap_or("SIGKILL") {
+        "SIGTERM" => Ok(nix::sys::signal::Signal::SIGTERM),
+        "SIGINT" => Ok(nix::sys::signal::Signal::SIGINT),
+        "SIGHUP" => Ok(nix::sys::signal::Signal::SIGHUP),
+        "SIGKILL" => Ok(nix::sys::signal::Signal::SIGKILL),
+        other => Err(AppError::Validation(format!(
+            "Unknown signal {:?}; expected SIGTERM, SIGINT, SIGHUP or SIGKILL",
+            other
+        ))),
+    }
+}
+
+/// Wait for `child` to exit. With `measure_cpu` the CPU time it used is read
+/// first, while the exited process is still a zombie, since reaping it
+/// removes its `/proc` entry.
+async fn wait_measuring_cpu(
+    child: &mut tokio::process::Child,
+    measure_cpu: bool,
+) -> (Option<f64>, std::io::Result<std::process::ExitStatus>) {
+    let mut cpu_used = None;
+    if let (true, Some(pid)) = (measure_cpu, child.id()) {
+        let pid = nix::unistd::Pid::from_raw(pid as i32);
+        let exited = tokio::task::spawn_blocking(move || {
+            use nix::sys::wait::{waitid, Id, WaitPidFlag};
+            loop {
+                match waitid(Id::Pid(pid), WaitPidFlag::WEXITED | WaitPidFlag::WNOWAIT) {
+                    Err(nix::errno::Errno::EINTR) => continue,
+                    result => return result.is_ok(),
+                }
+            }
+        })
+        .await;
+        if let Ok(true) = exited {
+            cpu_used = cpu_seconds(pid.as_raw() as u32);
+        }
+    }
+    (cpu_used, child.wait().await)
+}
+
+/// User plus system CPU seconds of a process, from `/proc/{pid}/stat`.
+fn cpu_seconds(pid: u32) -> Option<f64> {
+    let stat = std::fs::read_to_string(format!("/proc/{}/stat", pid)).ok()?;
+    // The command name may contain spaces; the fields after it start with
+    // the state (field 3), so utime and stime (14 and 15) are at 11 and 12
+    let mut fields = stat.rsplit_once(')')?.1.split_whitespace().skip(11);
+    let utime: u64 = fields.next()?.parse().ok()?;
+    let stime: u64 = fields.next()?.parse().ok()?;
+    // SAFETY: sysconf only reads a system setting
+    let ticks = unsafe { nix::libc::sysconf(nix::libc::_SC_CLK_TCK) };
+    (ticks > 0).then(|| (utime + stime) as f64 / ticks as f64)
+}
+
+/// Whether a process was stopped by its RLIMIT_CPU: SIGXCPU at the soft limit,
+/// or SIGKILL at the hard limit once it has used at least `limit` seconds
+/// (it ignored SIGXCPU).
+fn killed_by_cpu_limit(
+    status: &std::process::ExitStatus,
+    limit: Option<u64>,
+    cpu_used: Option<f64>,
+) -> bool {
+    let Some(limit) = limit else {
+        return false;
+    };
+    match status.signal() {
+        Some(nix::libc::SIGXCPU) => true,
+        Some(nix::libc::SIGKILL) => cpu_used.is_some_and(|used| used >= limit as f64),
+        _ => false,
+    }
+}
+
+/// Send `signal` (see `parse_signal`) to a tracked process. Shared by the
+/// REST kill endpoints and the websocket.
+pub(crate) async fn signal_process(
+    state: &AppState,
+    id: &str,
+    signal: Option<&str>,
+) -> Result<(), AppError> {
     let mut processes = state.processes.write().await;
     let proc = processes
-        .get_mut(&id)
+        .get_mut(id)
         .ok_or_else(|| AppError::NotFound("Process not found".to_string()))?;
 
     // Check if process is running
@@ -287,16 +944,7 @@ pub async fn kill_process(
         return Err(AppError::Conflict("Process is not running".to_string()));
     }
 
-    let signal_str = params
-        .get("signal")
-        .map(|s| s.as_str())
-        .unwrap_or("SIGKILL");
-    let signal = match signal_str {
-        "SIGTERM" => nix::sys::signal::Signal::SIGTERM,
-        "SIGINT" => nix::sys::signal::Signal::SIGINT,
-        "SIGHUP" => nix::sys::signal::Signal::SIGHUP,
-        _ => nix::sys::signal::Signal::SIGKILL,
-    };
+    let signal = parse_signal(signal)?;
 
     if let Some(pid) = proc.pid {
         nix::sys::signal::kill(nix::unistd::Pid::from_raw(pid as i32), signal).map_err(|e| {
@@ -312,9 +960,73 @@ pub async fn kill_process(
         ));
     }
 
-    Ok(Json(ApiResponse::success(ProcessOperationResponse {
-        success: true,
-    })))
+    Ok(())
+}
+
+/// Time processes get to exit after SIGTERM on shutdown before SIGKILL
+pub const SHUTDOWN_GRACE: Duration = Duration::from_secs(5);
+
+/// How often shutdown checks whether signalled processes have exited
+const SHUTDOWN_POLL_INTERVAL: Duration = Duration::from_millis(50);
+
+/// Stop every running process on server shutdown: SIGTERM first, SIGKILL for
+/// those still running after `grace`, then wait up to `grace` again for their
+/// monitors to record the exit. Returns whether all of them stopped.
+pub async fn shutdown_processes(processes: &ProcessStore, grace: Duration) -> bool {
+    signal_running(processes, nix::sys::signal::Signal::SIGTERM).await;
+    if wait_until_stopped(processes, grace).await {
+        return true;
+    }
+    signal_running(processes, nix::sys::signal::Signal::SIGKILL).await;
+    wait_until_stopped(processes, grace).await
+}
+
+async fn signal_running(processes: &ProcessStore, signal: nix::sys::signal::Signal) {
+    let processes = processes.read().await;
+    for proc in processes.values().filter(|p| p.status == "running") {
+        if let Some(pid) = proc.pid {
+            let _ = nix::sys::signal::kill(nix::unistd::Pid::from_raw(pid as i32), signal);
+        }
+    }
+}
+
+/// Wait until no process is marked running, for at most `limit`.
+async fn wait_until_stopped(processes: &ProcessStore, limit: Duration) -> bool {
+    let deadline = tokio::time::Instant::now() + limit;
+    loop {
+        let running = processes
+            .read()
+            .await
+            .values()
+            .any(|p| p.status == "running");
+        if !running {
+            return true;
+        }
+        if tokio::time::Instant::now() >= deadline {
+            return false;
+        }
+        tokio::time::sleep(SHUTDOWN_POLL_INTERVAL).await;
+    }
+}
+
+/// Keep-alive for SSE streams: a `: keepalive` comment line after every
+/// `SSE_KEEPALIVE_INTERVAL` without events, so proxies do not close a quiet
+/// stream. Clients ignore comment lines.
+fn sse_keep_alive(config: &crate::config::Config) -> KeepAlive {
+    KeepAlive::new()
+        .interval(Duration::from_secs(config.sse_keepalive_interval))
+        .text("keepalive")
+}
+
+/// End an SSE stream once the server starts shutting down, like the WebSocket
+/// loop does, so open streams do not hold up draining.
+fn until_shutdown<S: Stream>(
+    mut shutdown: tokio::sync::watch::Receiver<bool>,
+    stream: S,
+) -> impl Stream<Item = S::Item> {
+    stream.take_until(async move {
+        let _ = shutdown.wait_for(|&stopping| stopping).await;
+    })
 }
 
 pub async fn get_process_logs(
@@ -329,6 +1041,15 @@ pub async fn get_process_logs(
         .ok_or_else(|| AppError::NotFound("Process not found".to_string()))?;
 
     let tail = params.get("tail").and_then(|t| t.parse::<usize>().ok());
+    // Plain-text view of PTY output for consumers that cannot render colors
+    let strip_ansi = params.get("stripAnsi").map(|s| s.as_str()) == Some("true");
+    let render = move |line: String| {
+        if strip_ansi {
+            crate::utils::common::strip_ansi(&line)
+        } else {
+            line
+        }
+    };
 
     let is_sse = headers
         .get(axum::http::header::ACCEPT)
@@ -337,46 +1058,79 @@ pub async fn get_process_logs(
         || params.get("stream").map(|s| s.as_str()) == Some("true");
 
     if is_sse {
-        let rx = proc.log_broadcast.subscribe();
-        let logs = proc.logs.read().await.clone();
+        // SSE data cannot carry carriage returns, which PTY output is full of
+        let render = move |line: String| render(line).replace('\r', "");
+        // Subscribed under the log lock, which writers also hold while
+        // broadcasting, so no line is both replayed and received live
+        let (rx, logs, first) = {
+            let logs = proc.logs.read().await;
+            (
+                proc.log_broadcast.subscribe(),
+                logs.clone(),
+                proc.log_start_sequence.load(Ordering::Relaxed),
+            )
+        };
 
-        let start_index = if let Some(t) = tail {
-            if t < logs.len() {
-                logs.len() - t
-            } else {
-                0
-            }
-        } else {
-            0
+        // Every line keeps its sequence for the life of the process; evicted
+        // lines can no longer be replayed, so older sequences start at `first`
+        let end = first + logs.len() as u64;
+        let start = match params.get("from").map(String::as_str) {
+            Some("beginning") => first,
+            Some("end") => end,
+            Some(sequence) => sequence
+                .parse::<u64>()
+                .map_err(|_| {
+                    AppError::BadRequest(format!(
+                        "Invalid from: {} (expected beginning, end or a sequence number)",
+                        sequence
+                    ))
+                })?
+                .clamp(first, end),
+            None => tail.map_or(first, |t| end.saturating_sub(t as u64).max(first)),
         };
 
         let existing_logs_stream = tokio_stream::iter(
             logs.into_iter()
-                .skip(start_index)
-                .map(|l| Ok::<Event, Infallible>(Event::default().data(l))),
+                .zip(first..)
+                .skip((start - first) as usize)
+                .map(move |(l, i)| {
+                    Ok::<Event, Infallible>(Event::default().id(i.to_string()).data(render(l)))
+                }),
         );
-        let broadcast_stream = tokio_stream::wrappers::BroadcastStream::new(rx).map(|r| match r {
-            Ok(l) => Ok(Event::default().data(l)),
-            Err(_) => Ok(Event::default().event("error").data("stream error")),
+        // Marks the switch from buffered replay to live following
+        let live_marker = stream::once(async move {
+            Ok(Event::default()
+                .event("live")
+                .data(serde_json::json!({ "sequence": end }).to_string()))
         });
+        let broadcast_stream =
+            tokio_stream::wrappers::BroadcastStream::new(rx).scan(end, move |sequence, r| {
+                let event = match r {
+                    Ok(l) => {
+                        let event = Event::default().id(sequence.to_string()).data(render(l));
+                        *sequence += 1;
+                        event
+                    }
+                    Err(tokio_stream::wrappers::errors::BroadcastStreamRecvError::Lagged(n)) => {
+                        *sequence += n;
+                        Event::default().event("error").data("stream error")
+                    }
+                };
+                futures::future::ready(Some(Ok(event)))
+            });
 
-        let stream = existing_logs_stream.chain(broadcast_stream);
+        let stream = existing_logs_stream
+            .chain(live_marker)
+            .chain(broadcast_stream);
 
-        return Ok(Sse::new(stream)
-            .keep_alive(axum::response::sse::KeepAlive::default())
+        return Ok(Sse::new(until_shutdown(state.shutdown.subscribe(), stream))
+            .keep_alive(sse_keep_alive(&state.config))
             .into_response());
     }
 
     let logs = proc.logs.read().await;
-    let result_logs: Vec<String> = if let Some(t) = tail {
-        if t < logs.len() {
-            logs.iter().skip(logs.len() - t).cloned().collect()
-        } else {
-            logs.clone().into()
-        }
-    } else {
-        logs.clone().into()
-    };
+    let skip = tail.map_or(0, |t| logs.len().saturating_sub(t));
+    let result_logs: Vec<String> = logs.iter().skip(skip).cloned().map(render).collect();
 
     let status = proc.to_status();
 
@@ -390,76 +1144,381 @@ pub async fn get_process_logs(
     .into_response())
 }
 
-#[derive(Deserialize)]
-pub struct SyncExecutionRequest {
-    command: String,
-    args: Option<Vec<String>>,
-    cwd: Option<String>,
-    env: Option<std::collections::HashMap<String, String>>,
-    timeout: Option<u64>,
+/// Upper bound for matches returned by a single log search
+const MAX_LOG_SEARCH_RESULTS: usize = 1000;
+
+#[derive(Deserialize, JsonSchema)]
+pub struct LogSearchParams {
+    q: String,
+    #[serde(default)]
+    regex: bool,
+    /// Comma separated list of levels, e.g. "stdout,stderr"
+    level: Option<String>,
+    limit: Option<usize>,
 }
 
-#[derive(serde::Serialize, Clone)]
+#[derive(Serialize)]
 #[serde(rename_all = "camelCase")]
-pub struct SyncExecutionResponse {
-    stdout: String,
-    stderr: String,
-    exit_code: Option<i32>,
-    duration_ms: u128,
-    start_time: String,
-    end_time: String,
+pub struct LogSearchMatch {
+    /// Sequence number of the line, stable across evictions; pass it as
+    /// `from` to the log stream to resume at this line
+    index: u64,
+    level: String,
+    content: String,
 }
 
-pub async fn exec_process_sync(
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+pub struct LogSearchResponse {
+    process_id: String,
+    matches: Vec<LogSearchMatch>,
+    truncated: bool,
+}
+
+pub async fn search_process_logs(
     State(state): State<Arc<AppState>>,
-    Json(req): Json<SyncExecutionRequest>,
-) -> Result<Json<ApiResponse<SyncExecutionResponse>>, AppError> {
-    let start_time = crate::utils::common::format_time(
-        std::time::SystemTime::now()
-            .duration_since(std::time::UNIX_EPOCH)
-            .expect("Time went backwards")
-            .as_secs(),
-    );
-    let start_instant = std::time::Instant::now();
+    Path(id): Path<String>,
+    Query(params): Query<LogSearchParams>,
+) -> Result<Json<ApiResponse<LogSearchResponse>>, AppError> {
+    if params.q.is_empty() {
+        return Err(AppError::BadRequest("Query cannot be empty".to_string()));
+    }
 
-    let mut cmd = if let Some(args) = &req.args {
-        let mut c = Command::new(&req.command);
-        c.args(args);
-        c
+    let re = if params.regex {
+        Some(
+            regex::Regex::new(&params.q)
+                .map_err(|e| AppError::BadRequest(format!("Invalid regex: {}", e)))?,
+        )
     } else {
-        match shell_words::split(&req.command) {
-            Ok(parts) => {
-                if !parts.is_empty() {
-                    let mut c = Command::new(&parts[0]);
-                    c.args(&parts[1..]);
-                    c
-                } else {
-                    Command::new(&req.command)
-                }
-            }
-            Err(_) => Command::new(&req.command),
-        }
+        None
     };
+    let levels: Vec<&str> = params
+        .level
+        .as_deref()
+        .map(|l| {
+            l.split(',')
+                .map(|s| s.trim())
+                .filter(|s| !s.is_empty())
+                .collect()
+        })
+        .unwrap_or_default();
+    let limit = params.limit.unwrap_or(100).clamp(1, MAX_LOG_SEARCH_RESULTS);
+
+    let processes = state.processes.read().await;
+    let proc = processes
+        .get(&id)
+        .ok_or_else(|| AppError::NotFound("Process not found".to_string()))?;
+    let logs = proc.logs.read().await;
+    // Read under the log lock, which evictions hold while bumping it
+    let first = proc.log_start_sequence.load(Ordering::Relaxed);
+
+    let mut matches = Vec::new();
+    let mut truncated = false;
+    for (index, raw) in (first..).zip(logs.iter()) {
+        let (level, content) = crate::handlers::websocket::parse_log_entry(raw);
+        if !levels.is_empty() && !levels.contains(&level.as_str()) {
+            continue;
+        }
+        let is_match = match &re {
+            Some(re) => re.is_match(&content),
+            None => content.contains(&params.q),
+        };
+        if !is_match {
+            continue;
+        }
+        if matches.len() >= limit {
+            truncated = true;
+            break;
+        }
+        matches.push(LogSearchMatch {
+            index,
+            level,
+            content,
+        });
+    }
+
+    Ok(Json(ApiResponse::success(LogSearchResponse {
+        process_id: id,
+        matches,
+        truncated,
+    })))
+}
+
+#[derive(Deserialize, JsonSchema)]
+pub struct MergedLogStreamParams {
+    ids: String,
+    level: Option<String>,
+}
+
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+pub struct MergedLogEvent {
+    process_id: String,
+    level: String,
+    content: String,
+    timestamp: String,
+}
+
+/// Stream live log entries of several processes as one SSE stream, in arrival
+/// order, each tagged with the process it came from.
+pub async fn stream_merged_logs(
+    State(state): State<Arc<AppState>>,
+    Query(params): Query<MergedLogStreamParams>,
+) -> Result<Response, AppError> {
+    let ids: Vec<String> = params
+        .ids
+        .split(',')
+        .map(str::trim)
+        .filter(|id| !id.is_empty())
+        .map(str::to_string)
+        .collect();
+    if ids.is_empty() {
+        return Err(AppError::BadRequest("ids cannot be empty".to_string()));
+    }
+    let levels: Option<Vec<String>> = params.level.as_deref().map(|l| {
+        l.split(',')
+            .map(str::trim)
+            .filter(|l| !l.is_empty())
+            .map(str::to_string)
+            .collect()
+    });
+
+    let mut streams = Vec::with_capacity(ids.len());
+    {
+        let processes = state.processes.read().await;
+        for id in &ids {
+            let proc = processes
+                .get(id)
+                .ok_or_else(|| AppError::NotFound(format!("Process not found: {}", id)))?;
+            let process_id = id.clone();
+            let levels = levels.clone();
+            let stream =
+                tokio_stream::wrappers::BroadcastStream::new(proc.log_broadcast.subscribe())
+                    .filter_map(move |r| {
+                        // Lagged receivers skip the missed entries and keep going
+                        let event = r.ok().and_then(|raw| {
+                            let (level, content) =
+                                crate::handlers::websocket::parse_log_entry(&raw);
+                            if let Some(levels) = &levels {
+                                if !levels.contains(&level) {
+                                    return None;
+                                }
+                            }
+                            let timestamp = crate::utils::common::format_time(
+                                std::time::SystemTime::now()
+                                    .duration_since(std::time::UNIX_EPOCH)
+                                    .unwrap_or_default()
+                                    .as_secs(),
+                            );
+                            let data = serde_json::to_string(&MergedLogEvent {
+                                process_id: process_id.clone(),
+                                level,
+                                content,
+                                timestamp,
+                            })
+                            .ok()?;
+                            Some(Ok::<Event, Infallible>(
+                                Event::default().event("log").data(data),
+                            ))
+                        });
+                        async move { event }
+                    });
+            streams.push(Box::pin(stream));
+        }
+    }
+
+    // Dropping the merged stream on client disconnect drops every receiver
+    let merged = stream::select_all(streams);
+    Ok(Sse::new(until_shutdown(state.shutdown.subscribe(), merged))
+        .keep_alive(sse_keep_alive(&state.config))
+        .into_response())
+}
+
+#[derive(Deserialize, JsonSchema)]
+pub struct SyncExecutionRequest {
+    command: String,
+    args: Option<Vec<String>>,
+    cwd: Option<String>,
+    #[serde(default, rename = "createCwd")]
+    create_cwd: bool,
+    env: Option<std::collections::HashMap<String, String>>,
+    /// Workspace dotenv file merged under `env` (explicit values win)
+    #[serde(rename = "envFile")]
+    env_file: Option<String>,
+    #[serde(rename = "pathPrepend")]
+    path_prepend: Option<Vec<String>>,
+    #[serde(rename = "pathAppend")]
+    path_append: Option<Vec<String>>,
+    timeout: Option<u64>,
+    /// Data written to stdin, which is closed afterwards
+    stdin: Option<String>,
+    /// Encoding of `stdin`: "utf8" (default) or "base64"
+    #[serde(rename = "stdinEncoding")]
+    stdin_encoding: Option<String>,
+    /// Lower per-stream output limit than the server's `MAX_OUTPUT_BYTES`
+    #[serde(rename = "maxOutputBytes")]
+    max_output_bytes: Option<usize>,
+}
+
+#[derive(serde::Serialize, Clone, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct SyncExecutionResponse {
+    stdout: String,
+    stderr: String,
+    exit_code: Option<i32>,
+    duration_ms: u128,
+    start_time: String,
+    end_time: String,
+    /// Why the command did not run to completion, when it did not
+    #[serde(skip_serializing_if = "Option::is_none")]
+    failure_reason: Option<FailureReason>,
+    /// Output went past the limit; the kept part ends in `OUTPUT_TRUNCATED`
+    truncated: bool,
+}
+
+/// Machine-readable cause of a failed synchronous execution
+#[derive(Serialize, Clone, Copy, Debug, PartialEq, JsonSchema)]
+#[serde(rename_all = "snake_case")]
+pub enum FailureReason {
+    CommandNotFound,
+    CwdInvalid,
+    PermissionDenied,
+    Timeout,
+    CpuLimit,
+}
+
+/// Classify a spawn error. The OS reports a missing working directory the
+/// same way as a missing executable, so the directory is checked first.
+fn spawn_failure_reason(err: &std::io::Error, work_dir: &std::path::Path) -> Option<FailureReason> {
+    if !work_dir.is_dir() {
+        return Some(FailureReason::CwdInvalid);
+    }
+    match err.kind() {
+        ErrorKind::NotFound => Some(FailureReason::CommandNotFound),
+        ErrorKind::PermissionDenied => Some(FailureReason::PermissionDenied),
+        _ => None,
+    }
+}
+
+#[derive(Deserialize, JsonSchema)]
+pub struct SyncExecutionParams {
+    stream: Option<String>,
+}
+
+/// Logs commands whose client went away before they finished. Nothing can be
+/// sent back at that point: the server drops the request once it notices the
+/// closed connection, and the child with it (`kill_on_drop`).
+struct DisconnectGuard<'a> {
+    trace: &'a TraceId,
+    command: &'a str,
+    finished: bool,
+}
+
+impl Drop for DisconnectGuard<'_> {
+    fn drop(&mut self) {
+        if !self.finished {
+            self.trace.log(format_args!(
+                "Client disconnected; killed exec-sync command: {}",
+                self.command
+            ));
+        }
+    }
+}
+
+pub async fn exec_process_sync(
+    State(state): State<Arc<AppState>>,
+    Query(params): Query<SyncExecutionParams>,
+    trace: TraceId,
+    audit: AuditContext,
+    Json(mut req): Json<SyncExecutionRequest>,
+) -> Result<Response, AppError> {
+    let chunked = params.stream.as_deref() == Some("chunked");
+
+    state
+        .audit
+        .record(
+            AuditEntry::new("exec-sync", &req.command, &audit)
+                .args(req.args.as_ref())
+                .cwd(req.cwd.as_ref())
+                .env(req.env.as_ref()),
+        )
+        .await;
+
+    let start_time = crate::utils::common::format_time(
+        std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)
+            .expect("Time went backwards")
+            .as_secs(),
+    );
+    let start_instant = std::time::Instant::now();
+
+    req.env = merge_env_file(&state, req.env_file.as_deref(), req.env.take()).await?;
+
+    let mut cmd = build_command(&req.command, req.args.as_ref());
 
-    if let Some(cwd) = req.cwd {
-        let valid_cwd = validate_path(&state.config.workspace_path, &cwd)?;
-        cmd.current_dir(valid_cwd);
+    let mut work_dir = state.config.workspace_path.clone();
+    if let Some(cwd) = &req.cwd {
+        let valid_cwd = validate_path(&state.config.workspace_path, cwd)?;
+        if req.create_cwd {
+            ensure_directory(&valid_cwd).await?;
+        }
+        cmd.current_dir(&valid_cwd);
+        work_dir = valid_cwd;
     }
 
-    if let Some(env) = req.env {
+    if let Some(env) = &req.env {
         cmd.envs(env);
     }
+    apply_exec_path(
+        &mut cmd,
+        &state.config,
+        &work_dir,
+        req.env.as_ref(),
+        req.path_prepend.as_deref(),
+        req.path_append.as_deref(),
+    );
 
+    let stdin_data = decode_stdin(req.stdin.as_deref(), req.stdin_encoding.as_deref())?;
+    if stdin_data.is_some() {
+        cmd.stdin(Stdio::piped());
+    }
     cmd.stdout(Stdio::piped());
     cmd.stderr(Stdio::piped());
+    // A client that disconnects drops this future (or the chunked stream), and
+    // with it the child, so the process does not keep running unobserved
+    cmd.kill_on_drop(true);
+    // Own process group, so the output limit can stop whole pipelines
+    cmd.process_group(0);
 
     let time_limit = Duration::from_secs(req.timeout.unwrap_or(30));
 
-    let child_result = cmd.spawn();
+    let child_result = cmd.spawn().map(|mut child| {
+        if let Some(data) = stdin_data {
+            spawn_stdin_writer(&mut child, data);
+        }
+        child
+    });
+
+    let output_limit = req
+        .max_output_bytes
+        .map_or(state.config.max_output_bytes, |n| {
+            n.min(state.config.max_output_bytes)
+        });
 
     match child_result {
+        Ok(child) if chunked => Ok(stream_chunked_output(child, time_limit)),
         Ok(child) => {
-            let output_result = timeout(time_limit, child.wait_with_output()).await;
+            let mut disconnect = DisconnectGuard {
+                trace: &trace,
+                command: &req.command,
+                finished: false,
+            };
+            let output_result = timeout(
+                time_limit,
+                wait_with_capped_output(child, output_limit, state.config.kill_on_output_limit),
+            )
+            .await;
+            disconnect.finished = true;
 
             let end_time = crate::utils::common::format_time(
                 std::time::SystemTime::now()
@@ -471,24 +1530,43 @@ pub async fn exec_process_sync(
 
             match output_result {
                 Ok(Ok(output)) => Ok(Json(ApiResponse::success(SyncExecutionResponse {
-                    stdout: String::from_utf8_lossy(&output.stdout).to_string(),
-                    stderr: String::from_utf8_lossy(&output.stderr).to_string(),
+                    truncated: output.stdout.truncated || output.stderr.truncated,
+                    stdout: output.stdout.into_string(),
+                    stderr: output.stderr.into_string(),
                     exit_code: output.status.code(),
                     duration_ms,
                     start_time,
                     end_time,
-                }))),
+                    failure_reason: None,
+                }))
+                .into_response()),
                 Ok(Err(e)) => Err(AppError::InternalServerError(format!(
                     "Failed to wait for process: {}",
                     e
                 ))),
-                Err(_) => Err(AppError::InternalServerError(
-                    "Process execution timed out".to_string(),
-                )),
+                Err(_) => {
+                    let response = SyncExecutionResponse {
+                        stdout: "".to_string(),
+                        stderr: "".to_string(),
+                        exit_code: None,
+                        duration_ms,
+                        start_time,
+                        end_time,
+                        failure_reason: Some(FailureReason::Timeout),
+                        truncated: false,
+                    };
+                    Err(AppError::OperationError(
+                        "Process execution timed out".to_string(),
+                        serde_json::to_value(response).unwrap(),
+                    ))
+                }
             }
         }
         Err(e) => {
-            let stderr_message = if e.kind() == ErrorKind::NotFound {
+            let failure_reason = spawn_failure_reason(&e, &work_dir);
+            let stderr_message = if failure_reason == Some(FailureReason::CwdInvalid) {
+                format!("chdir {}: {}", work_dir.display(), e)
+            } else if e.kind() == ErrorKind::NotFound {
                 format!(
                     "exec: \"{}\": executable file not found in $PATH",
                     req.command
@@ -511,6 +1589,8 @@ pub async fn exec_process_sync(
                 duration_ms,
                 start_time,
                 end_time,
+                failure_reason,
+                truncated: false,
             };
             Err(AppError::OperationError(
                 "".to_string(),
@@ -520,19 +1600,382 @@ pub async fn exec_process_sync(
     }
 }
 
-#[derive(Deserialize, Clone)]
+/// Appended to output cut off at the `exec-sync` output limit
+const OUTPUT_TRUNCATED: &str = "\n[output truncated]\n";
+
+/// Output of one stream, cut off at a byte limit.
+#[derive(Default)]
+struct CappedOutput {
+    data: Vec<u8>,
+    truncated: bool,
+}
+
+impl CappedOutput {
+    fn into_string(self) -> String {
+        let mut text = String::from_utf8_lossy(&self.data).into_owned();
+        if self.truncated {
+            text.push_str(OUTPUT_TRUNCATED);
+        }
+        text
+    }
+}
+
+struct CappedProcessOutput {
+    status: std::process::ExitStatus,
+    stdout: CappedOutput,
+    stderr: CappedOutput,
+}
+
+/// Like `Child::wait_with_output`, but keeps at most `limit` bytes of each
+/// stream. The rest is read and discarded so the process does not block on a
+/// full pipe; with `kill_on_limit` it is killed as soon as a stream overflows.
+/// The child must lead its own process group, which is killed as a whole so
+/// that pipelines it started stop writing too.
+async fn wait_with_capped_output(
+    mut child: tokio::process::Child,
+    limit: usize,
+    kill_on_limit: bool,
+) -> std::io::Result<CappedProcessOutput> {
+    let overflowed = tokio::sync::Notify::new();
+    let stdout = child.stdout.take();
+    let stderr = child.stderr.take();
+    let reading = async {
+        tokio::try_join!(
+            read_capped(stdout, limit, &overflowed),
+            read_capped(stderr, limit, &overflowed)
+        )
+    };
+    tokio::pin!(reading);
+
+    let (stdout, stderr) = tokio::select! {
+        output = &mut reading => output?,
+        _ = overflowed.notified(), if kill_on_limit => {
+            match child.id() {
+                Some(pid) => {
+                    let _ = nix::sys::signal::kill(
+                        nix::unistd::Pid::from_raw(-(pid as i32)),
+                        nix::sys::signal::Signal::SIGKILL,
+                    );
+                }
+                None => {
+                    let _ = child.start_kill();
+                }
+            }
+            reading.await?
+        }
+    };
+    let status = child.wait().await?;
+    Ok(CappedProcessOutput {
+        status,
+        stdout,
+        stderr,
+    })
+}
+
+/// Read `reader` to the end, keeping the first `limit` bytes and notifying
+/// `overflowed` once more arrive.
+async fn read_capped<R: tokio::io::AsyncRead + Unpin>(
+    reader: Option<R>,
+    limit: usize,
+    overflowed: &tokio::sync::Notify,
+) -> std::io::Result<CappedOutput> {
+    use tokio::io::AsyncReadExt;
+    let mut output = CappedOutput::default();
+    let Some(mut reader) = reader else {
+        return Ok(output);
+    };
+    let mut buf = vec![0u8; 8192];
+    loop {
+        let n = reader.read(&mut buf).await?;
+        if n == 0 {
+            return Ok(output);
+        }
+        let keep = n.min(limit - output.data.len());
+        output.data.extend_from_slice(&buf[..keep]);
+        if keep < n && !output.truncated {
+            output.truncated = true;
+            overflowed.notify_one();
+        }
+    }
+}
+
+/// Stream raw stdout and stderr as plain chunked text while the process runs,
+/// then finish with an `[exit code: N]` line (`[exit code: timeout]` when the
+/// time limit is hit).
+fn stream_chunked_output(mut child: tokio::process::Child, time_limit: Duration) -> Response {
+    let (tx, rx) = tokio::sync::mpsc::channel::<Result<Vec<u8>, std::io::Error>>(32);
+
+    let mut readers = Vec::new();
+    if let Some(stdout) = child.stdout.take() {
+        readers.push(tokio::spawn(forward_raw_output(stdout, tx.clone())));
+    }
+    if let Some(stderr) = child.stderr.take() {
+        readers.push(tokio::spawn(forward_raw_output(stderr, tx.clone())));
+    }
+
+    tokio::spawn(async move {
+        // The child lives inside the wait future; dropping it on timeout or
+        // disconnect kills the process
+        let wait = timeout(time_limit, async move {
+            // Drain output before reaping so the exit line is always last
+            for reader in readers {
+                let _ = reader.await;
+            }
+            child.wait().await
+        });
+        let status = tokio::select! {
+            status = wait => status,
+            _ = tx.closed() => return,
+        };
+        let exit = match status {
+            Ok(Ok(status)) => status
+                .code()
+                .or_else(|| status.signal().map(|sig| 128 + sig))
+                .map(|code| code.to_string())
+                .unwrap_or_else(|| "unknown".to_string()),
+            Ok(Err(e)) => format!("error: {}", e),
+            Err(_) => "timeout".to_string(),
+        };
+        let _ = tx
+            .send(Ok(format!("\n[exit code: {}]\n", exit).into_bytes()))
+            .await;
+    });
+
+    let body = axum::body::Body::from_stream(tokio_stream::wrappers::ReceiverStream::new(rx));
+    (
+        [(
+            axum::http::header::CONTENT_TYPE,
+            "text/plain; charset=utf-8",
+        )],
+        body,
+    )
+        .into_response()
+}
+
+async fn forward_raw_output<R: tokio::io::AsyncRead + Unpin>(
+    mut reader: R,
+    tx: tokio::sync::mpsc::Sender<Result<Vec<u8>, std::io::Error>>,
+) {
+    use tokio::io::AsyncReadExt;
+    let mut buf = vec![0u8; 8192];
+    loop {
+        match reader.read(&mut buf).await {
+            Ok(0) => break,
+            Ok(n) => {
+                if tx.send(Ok(buf[..n].to_vec())).await.is_err() {
+                    // Client went away
+                    break;
+                }
+            }
+            Err(e) => {
+                println!("Failed to read process output: {}", e);
+                break;
+            }
+        }
+    }
+}
+
+#[derive(Deserialize, JsonSchema)]
+pub struct RunScriptRequest {
+    script: String,
+    interpreter: Option<String>,
+    args: Option<Vec<String>>,
+    env: Option<std::collections::HashMap<String, String>>,
+    timeout: Option<u64>,
+}
+
+/// Write a script into a fresh temporary directory under the workspace, run it
+/// with the given interpreter and remove the directory afterwards.
+pub async fn run_script(
+    State(state): State<Arc<AppState>>,
+    audit: AuditContext,
+    Json(req): Json<RunScriptRequest>,
+) -> Result<Json<ApiResponse<SyncExecutionResponse>>, AppError> {
+    let interpreter = req.interpreter.as_deref().unwrap_or("/bin/sh");
+    state
+        .audit
+        .record(
+            AuditEntry::new("run-script", interpreter, &audit)
+                .args(req.args.as_ref())
+                .env(req.env.as_ref()),
+        )
+        .await;
+
+    let sandbox_dir = state.config.workspace_path.join(format!(
+        ".devbox-run-{}",
+        crate::utils::common::generate_id()
+    ));
+    ensure_directory(&sandbox_dir).await?;
+
+    let result = run_script_in(&state, &sandbox_dir, req).await;
+
+    if let Err(e) = tokio::fs::remove_dir_all(&sandbox_dir).await {
+        println!(
+            "Failed to clean up script directory {:?}: {}",
+            sandbox_dir, e
+        );
+    }
+
+    result.map(|r| Json(ApiResponse::success(r)))
+}
+
+async fn run_script_in(
+    state: &AppState,
+    dir: &std::path::Path,
+    req: RunScriptRequest,
+) -> Result<SyncExecutionResponse, AppError> {
+    let script_path = dir.join("script");
+    tokio::fs::write(&script_path, req.script.as_bytes()).await?;
+
+    let start_time = crate::utils::common::format_time(
+        std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)
+            .expect("Time went backwards")
+            .as_secs(),
+    );
+    let start_instant = std::time::Instant::now();
+    let end_time = || {
+        crate::utils::common::format_time(
+            std::time::SystemTime::now()
+                .duration_since(std::time::UNIX_EPOCH)
+                .expect("Time went backwards")
+                .as_secs(),
+        )
+    };
+
+    let interpreter = req.interpreter.unwrap_or_else(|| "/bin/sh".to_string());
+    let mut cmd = Command::new(&interpreter);
+    cmd.arg(&script_path);
+    if let Some(args) = &req.args {
+        cmd.args(args);
+    }
+    if let Some(env) = &req.env {
+        cmd.envs(env);
+    }
+    apply_exec_path(&mut cmd, &state.config, dir, req.env.as_ref(), None, None);
+    cmd.current_dir(dir);
+    cmd.stdout(Stdio::piped());
+    cmd.stderr(Stdio::piped());
+    // Make sure a timed out script does not outlive its directory
+    cmd.kill_on_drop(true);
+    // Own process group, so the output limit and the timeout stop whole pipelines
+    cmd.process_group(0);
+
+    let child = match cmd.spawn() {
+        Ok(child) => child,
+        Err(e) => {
+            let failure_reason = spawn_failure_reason(&e, dir);
+            let stderr = if e.kind() == ErrorKind::NotFound {
+                format!(
+                    "exec: \"{}\": executable file not found in $PATH",
+                    interpreter
+                )
+            } else {
+                e.to_string()
+            };
+            let response = SyncExecutionResponse {
+                stdout: "".to_string(),
+                stderr,
+                exit_code: Some(127),
+                duration_ms: start_instant.elapsed().as_millis(),
+                start_time,
+                end_time: end_time(),
+                failure_reason,
+                truncated: false,
+            };
+            return Err(AppError::OperationError(
+                format!("Failed to start interpreter {}", interpreter),
+                serde_json::to_value(response).unwrap(),
+            ));
+        }
+    };
+    let pid = child.id();
+
+    let time_limit = Duration::from_secs(req.timeout.unwrap_or(30));
+    let output_result = timeout(
+        time_limit,
+        wait_with_capped_output(
+            child,
+            state.config.max_output_bytes,
+            state.config.kill_on_output_limit,
+        ),
+    )
+    .await;
+
+    match output_result {
+        Ok(Ok(output)) => Ok(SyncExecutionResponse {
+            truncated: output.stdout.truncated || output.stderr.truncated,
+            stdout: output.stdout.into_string(),
+            stderr: output.stderr.into_string(),
+            exit_code: output.status.code(),
+            duration_ms: start_instant.elapsed().as_millis(),
+            start_time,
+            end_time: end_time(),
+            failure_reason: None,
+        }),
+        Ok(Err(e)) => Err(AppError::InternalServerError(format!(
+            "Failed to wait for script: {}",
+            e
+        ))),
+        Err(_) => {
+            // Dropping the child killed only the interpreter
+            if let Some(pid) = pid {
+                let _ = nix::sys::signal::kill(
+                    nix::unistd::Pid::from_raw(-(pid as i32)),
+                    nix::sys::signal::Signal::SIGKILL,
+                );
+            }
+            let response = SyncExecutionResponse {
+                stdout: "".to_string(),
+                stderr: "".to_string(),
+                exit_code: None,
+                duration_ms: start_instant.elapsed().as_millis(),
+                start_time,
+                end_time: end_time(),
+                failure_reason: Some(FailureReason::Timeout),
+                truncated: false,
+            };
+            Err(AppError::OperationError(
+                "Script execution timed out".to_string(),
+                serde_json::to_value(response).unwrap(),
+            ))
+        }
+    }
+}
+
+#[derive(Deserialize, Clone, JsonSchema)]
 pub struct SyncStreamExecutionRequest {
     command: String,
     args: Option<Vec<String>>,
     cwd: Option<String>,
     env: Option<std::collections::HashMap<String, String>>,
+    #[serde(rename = "pathPrepend")]
+    path_prepend: Option<Vec<String>>,
+    #[serde(rename = "pathAppend")]
+    path_append: Option<Vec<String>>,
     timeout: Option<u64>,
+    /// Run under a pseudo-terminal; all output arrives as "stdout" events
+    #[serde(default)]
+    pty: bool,
 }
 
 pub async fn exec_process_sync_stream(
     State(state): State<Arc<AppState>>,
+    audit: AuditContext,
     Json(req): Json<SyncStreamExecutionRequest>,
 ) -> Sse<impl Stream<Item = Result<Event, Infallible>>> {
+    state
+        .audit
+        .record(
+            AuditEntry::new("exec-stream", &req.command, &audit)
+                .args(req.args.as_ref())
+                .cwd(req.cwd.as_ref())
+                .env(req.env.as_ref()),
+        )
+        .await;
+
+    let keep_alive = sse_keep_alive(&state.config);
+    let shutdown = state.shutdown.subscribe();
     let stream = stream::unfold(
         (state, req, false), // state, req, has_started
         move |(state, req, has_started)| async move {
@@ -563,104 +2006,91 @@ pub async fn exec_process_sync_stream(
                     )))
                     .await;
 
-                let mut cmd = if let Some(args) = &req_for_task.args {
-                    let mut c = Command::new(&req_for_task.command);
-                    c.args(args);
-                    c
-                } else {
-                    match shell_words::split(&req_for_task.command) {
-                        Ok(parts) => {
-                            if !parts.is_empty() {
-                                let mut c = Command::new(&parts[0]);
-                                c.args(&parts[1..]);
-                                c
-                            } else {
-                                Command::new(&req_for_task.command)
-                            }
-                        }
-                        Err(_) => Command::new(&req_for_task.command),
-                    }
-                };
+                let mut cmd = build_command(&req_for_task.command, req_for_task.args.as_ref());
 
+                let mut work_dir = state_for_task.config.workspace_path.clone();
                 if let Some(cwd) = &req_for_task.cwd {
                     if let Ok(valid_cwd) = validate_path(&state_for_task.config.workspace_path, cwd)
                     {
-                        cmd.current_dir(valid_cwd);
+                        cmd.current_dir(&valid_cwd);
+                        work_dir = valid_cwd;
                     }
                 }
 
+                let pty_master = if req_for_task.pty {
+                    match attach_pty(&mut cmd) {
+                        Ok(master) => Some(master),
+                        Err(e) => {
+                            let _ = tx
+                                .send(Ok(Event::default().event("error").data(
+                                    serde_json::to_string(&StreamErrorEvent {
+                                        error: format!("Failed to allocate pty: {}", e),
+                                        duration_ms: 0,
+                                        timestamp: crate::utils::common::format_time(
+                                            std::time::SystemTime::now()
+                                                .duration_since(std::time::UNIX_EPOCH)
+                                                .expect("Time went backwards")
+                                                .as_secs(),
+                                        ),
+                                    })
+                                    .unwrap(),
+                                )))
+                                .await;
+                            return;
+                        }
+                    }
+                } else {
+                    cmd.stdout(Stdio::piped());
+                    cmd.stderr(Stdio::piped());
+                    None
+                };
+
                 if let Some(env) = &req_for_task.env {
                     cmd.envs(env);
                 }
-
-                cmd.stdout(Stdio::piped());
-                cmd.stderr(Stdio::piped());
+                apply_exec_path(
+                    &mut cmd,
+                    &state_for_task.config,
+                    &work_dir,
+                    req_for_task.env.as_ref(),
+                    req_for_task.path_prepend.as_deref(),
+                    req_for_task.path_append.as_deref(),
+                );
 
                 let time_limit = Duration::from_secs(req_for_task.timeout.unwrap_or(300));
                 let start_instant = std::time::Instant::now();
 
-                match cmd.spawn() {
+                let spawn_result = cmd.spawn();
+                // Close our copies of the PTY slave so the master reports EOF on exit
+                drop(cmd);
+
+                match spawn_result {
                     Ok(mut child) => {
                         let stdout = child.stdout.take();
                         let stderr = child.stderr.take();
 
+                        if let Some(master) = pty_master {
+                            tokio::spawn(forward_sse_lines(master, tx_stdout.clone(), "stdout"));
+                        }
+
                         if let Some(stdout) = stdout {
-                            let tx = tx_stdout.clone();
-                            tokio::spawn(async move {
-                                let mut reader = BufReader::new(stdout);
-                                let mut line = String::new();
-                                while let Ok(n) = reader.read_line(&mut line).await {
-                                    if n == 0 {
-                                        break;
-                                    }
-                                    let _ = tx
-                                        .send(Ok(Event::default().event("stdout").data(
-                                            serde_json::to_string(&StreamOutputEvent {
-                                                output: line.clone(),
-                                                timestamp: crate::utils::common::format_time(
-                                                    std::time::SystemTime::now()
-                                                        .duration_since(std::time::UNIX_EPOCH)
-                                                        .expect("Time went backwards")
-                                                        .as_secs(),
-                                                ),
-                                            })
-                                            .unwrap(),
-                                        )))
-                                        .await;
-                                    line.clear();
-                                }
-                            });
+                            tokio::spawn(forward_sse_lines(stdout, tx_stdout.clone(), "stdout"));
                         }
 
                         if let Some(stderr) = stderr {
-                            let tx = tx_stderr.clone();
-                            tokio::spawn(async move {
-                                let mut reader = BufReader::new(stderr);
-                                let mut line = String::new();
-                                while let Ok(n) = reader.read_line(&mut line).await {
-                                    if n == 0 {
-                                        break;
-                                    }
-                                    let _ = tx
-                                        .send(Ok(Event::default().event("stderr").data(
-                                            serde_json::to_string(&StreamOutputEvent {
-                                                output: line.clone(),
-                                                timestamp: crate::utils::common::format_time(
-                                                    std::time::SystemTime::now()
-                                                        .duration_since(std::time::UNIX_EPOCH)
-                                                        .expect("Time went backwards")
-                                                        .as_secs(),
-                                                ),
-                                            })
-                                            .unwrap(),
-                                        )))
-                                        .await;
-                                    line.clear();
-                                }
-                            });
+                            tokio::spawn(forward_sse_lines(stderr, tx_stderr.clone(), "stderr"));
                         }
 
-                        let wait_result = timeout(time_limit, child.wait()).await;
+                        // The command is stopped on timeout and on server shutdown
+                        let mut shutdown = state_for_task.shutdown.subscribe();
+                        let wait_result = tokio::select! {
+                            r = timeout(time_limit, child.wait()) => {
+                                r.map_err(|_| "Execution timeout")
+                            }
+                            _ = shutdown.wait_for(|&stopping| stopping) => {
+                                Err("Server shutting down")
+                            }
+                        };
                         let duration = start_instant.elapsed().as_millis() as i64;
 
                         match wait_result {
@@ -698,12 +2128,12 @@ pub async fn exec_process_sync_stream(
                                     )))
                                     .await;
                             }
-                            Err(_) => {
+                            Err(reason) => {
                                 let _ = child.start_kill();
                                 let _ = tx
                                     .send(Ok(Event::default().event("error").data(
                                         serde_json::to_string(&StreamErrorEvent {
-                                            error: "Execution timeout".to_string(),
+                                            error: reason.to_string(),
                                             duration_ms: duration,
                                             timestamp: crate::utils::common::format_time(
                                                 std::time::SystemTime::now()
@@ -745,33 +2175,628 @@ pub async fn exec_process_sync_stream(
 
     // Flatten the stream of streams
     let flattened = stream.flatten();
-    Sse::new(flattened).keep_alive(axum::response::sse::KeepAlive::default())
+    Sse::new(until_shutdown(shutdown, flattened)).keep_alive(keep_alive)
 }
 
+/// Send each line read from `reader` as an SSE event named `event`.
+async fn forward_sse_lines<R: tokio::io::AsyncRead + Unpin>(
+    reader: R,
+    tx: tokio::sync::mpsc::Sender<Result<Event, Infallible>>,
+    event: &'static str,
+) {
+    let mut reader = BufReader::new(reader);
+    let mut line = String::new();
+    while let Ok(n) = reader.read_line(&mut line).await {
+        if n == 0 {
+            break;
+        }
+        let _ = tx
+            .send(Ok(Event::default().event(event).data(
+                serde_json::to_string(&StreamOutputEvent {
+                    output: line.clone(),
+                    timestamp: crate::utils::common::format_time(
+                        std::time::SystemTime::now()
+                            .duration_since(std::time::UNIX_EPOCH)
+                            .expect("Time went backwards")
+                            .as_secs(),
+                    ),
+                })
+                .unwrap(),
+            )))
+            .await;
+        line.clear();
+    }
+}
+
+/// Append each output line to the process log and broadcast it. Lines are
+/// decoded from `encoding`; invalid sequences become U+FFFD instead of ending
+/// the stream. Lines longer than `MAX_LOG_LINE_BYTES` are cut and marked, and
+/// only the last `MAX_LOG_LINES` lines are kept.
 async fn pump_log<R: tokio::io::AsyncRead + Unpin>(
     reader: BufReader<R>,
     pid: String,
     state: Arc<AppState>,
     tx: tokio::sync::broadcast::Sender<String>,
     prefix: &str,
+    encoding: &'static encoding_rs::Encoding,
 ) {
     let mut reader = reader;
-    let mut line = String::new();
-    const MAX_LOG_LINES: usize = 10000;
+    let mut line = Vec::new();
+    let max_lines = state.config.max_log_lines;
+    let max_line_bytes = state.config.max_log_line_bytes;
 
-    while let Ok(n) = reader.read_line(&mut line).await {
+    while let Ok((n, truncated)) =
+        crate::utils::common::read_line_limited(&mut reader, &mut line, max_line_bytes).await
+    {
         if n == 0 {
             break;
         }
-        let log_entry = format!("{} {}", prefix, line);
+        let (text, _) = encoding.decode_without_bom_handling(&line);
+        let log_entry = if truncated {
+            let newline = if text.ends_with('\n') { "\n" } else { "" };
+            format!(
+                "{} {}{}{}",
+                prefix,
+                text.trim_end_matches('\n'),
+                crate::utils::common::TRUNCATION_MARKER,
+                newline
+            )
+        } else {
+            format!("{} {}", prefix, text)
+        };
         if let Some(proc) = state.processes.read().await.get(&pid) {
             let mut logs = proc.logs.write().await;
-            if logs.len() >= MAX_LOG_LINES {
+            while logs.len() >= max_lines.max(1) {
                 logs.pop_front();
+                proc.log_start_sequence.fetch_add(1, Ordering::Relaxed);
             }
             logs.push_back(log_entry.clone());
+            // Sent under the log lock, so a reader that snapshots the buffer and
+            // subscribes under it sees every line exactly once
+            let _ = tx.send(log_entry);
+        } else {
+            let _ = tx.send(log_entry);
         }
-        let _ = tx.send(log_entry);
         line.clear();
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_exec_path() {
+        let work_dir = std::path::Path::new("/work/app");
+        assert_eq!(
+            exec_path(
+                Some("/usr/bin:/bin"),
+                work_dir,
+                &["node_modules/.bin".to_string()],
+                &["/opt/tools".to_string()],
+            ),
+            "/work/app/node_modules/.bin:/usr/bin:/bin:/opt/tools"
+        );
+        assert_eq!(exec_path(None, work_dir, &["/a".to_string()], &[]), "/a");
+    }
+
+    #[test]
+    fn test_spawn_failure_reason() {
+        let not_found = std::io::Error::from(ErrorKind::NotFound);
+        let denied = std::io::Error::from(ErrorKind::PermissionDenied);
+        let tmp = std::env::temp_dir();
+
+        assert_eq!(
+            spawn_failure_reason(&not_found, &tmp),
+            Some(FailureReason::CommandNotFound)
+        );
+        assert_eq!(
+            spawn_failure_reason(&denied, &tmp),
+            Some(FailureReason::PermissionDenied)
+        );
+        assert_eq!(
+            spawn_failure_reason(&not_found, std::path::Path::new("/nonexistent/dir")),
+            Some(FailureReason::CwdInvalid)
+        );
+        assert_eq!(
+            spawn_failure_reason(&std::io::Error::from(ErrorKind::Other), &tmp),
+            None
+        );
+    }
+
+    #[test]
+    fn test_parse_signal() {
+        use nix::sys::signal::Signal;
+        assert_eq!(parse_signal(None).unwrap(), Signal::SIGKILL);
+        assert_eq!(parse_signal(Some("SIGINT")).unwrap(), Signal::SIGINT);
+        assert_eq!(parse_signal(Some("SIGKILL")).unwrap(), Signal::SIGKILL);
+        assert!(matches!(
+            parse_signal(Some("SIGTREM")),
+            Err(AppError::Validation(_))
+        ));
+    }
+
+    #[test]
+    fn test_decode_stdin() {
+        assert_eq!(decode_stdin(None, Some("base64")).unwrap(), None);
+        assert_eq!(
+            decode_stdin(Some("hi\n"), None).unwrap(),
+            Some(b"hi\n".to_vec())
+        );
+        assert_eq!(
+            decode_stdin(Some("AAEC"), Some("base64")).unwrap(),
+            Some(vec![0, 1, 2])
+        );
+        assert!(decode_stdin(Some("!!"), Some("base64")).is_err());
+        assert!(decode_stdin(Some("hi"), Some("hex")).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_shutdown_processes() {
+        let state = Arc::new(AppState::new(crate::config::Config::load()));
+        let mut pids = Vec::new();
+        for _ in 0..3 {
+            let req = serde_json::from_value(serde_json::json!({
+                "command": "sleep",
+                "args": ["30"],
+                "cwd": std::env::temp_dir(),
+            }))
+            .unwrap();
+            let response = start_process(&state, req).await.unwrap();
+            pids.push(response.pid.unwrap());
+        }
+
+        assert!(shutdown_processes(&state.processes, Duration::from_secs(5)).await);
+        let processes = state.processes.read().await;
+        assert!(processes.values().all(|p| p.status == "killed"));
+        for pid in pids {
+            // Reaped by the monitors, so the pids no longer exist
+            let alive = nix::sys::signal::kill(nix::unistd::Pid::from_raw(pid as i32), None);
+            assert!(alive.is_err());
+        }
+    }
+
+    #[tokio::test]
+    async fn test_cpu_limit() {
+        let mut cmd = build_command("sh", Some(&vec!["-c".into(), "while :; do :; done".into()]));
+        assert!(apply_limits(&mut cmd, Some(0), None).is_err());
+        apply_limits(&mut cmd, None, Some(1)).unwrap();
+
+        let status = timeout(Duration::from_secs(10), cmd.status())
+            .await
+            .expect("the busy loop should be stopped by its CPU limit")
+            .unwrap();
+        assert_eq!(status.signal(), Some(nix::libc::SIGXCPU));
+    }
+
+    #[tokio::test]
+    async fn test_exec_sync_killed_on_disconnect() {
+        let state = Arc::new(AppState::new(crate::config::Config::load()));
+        let pid_file = std::env::temp_dir().join(format!("exec-sync-test-{}", std::process::id()));
+        let req = serde_json::from_value(serde_json::json!({
+            "command": "sh",
+            "args": ["-c", format!("echo $$ > {}; exec sleep 30", pid_file.display())],
+        }))
+        .unwrap();
+
+        // The server drops the handler future when the client disconnects
+        let handler = exec_process_sync(
+            State(state),
+            Query(SyncExecutionParams { stream: None }),
+            TraceId("test".to_string()),
+            AuditContext::default(),
+            Json(req),
+        );
+        assert!(timeout(Duration::from_millis(500), handler).await.is_err());
+
+        let pid = std::fs::read_to_string(&pid_file).unwrap();
+        std::fs::remove_file(&pid_file).unwrap();
+        // tokio reaps killed children lazily, so a zombie counts as exited
+        let stat = format!("/proc/{}/stat", pid.trim());
+        for _ in 0..50 {
+            match std::fs::read_to_string(&stat) {
+                Ok(stat) if !stat.contains(") Z ") => {}
+                _ => return,
+            }
+            tokio::time::sleep(Duration::from_millis(100)).await;
+        }
+        panic!("the process outlived the request");
+    }
+
+    #[tokio::test]
+    async fn test_stdin_is_echoed_back() {
+        let mut cmd = build_command("cat", None);
+        cmd.stdin(Stdio::piped());
+        cmd.stdout(Stdio::piped());
+        let mut child = cmd.spawn().unwrap();
+        spawn_stdin_writer(&mut child, b"line one\nline two\n".to_vec());
+
+        // cat only exits once stdin is closed
+        let output = timeout(Duration::from_secs(5), child.wait_with_output())
+            .await
+            .expect("cat should see EOF")
+            .unwrap();
+        assert!(output.status.success());
+        assert_eq!(output.stdout, b"line one\nline two\n");
+    }
+
+    #[tokio::test]
+    async fn test_capped_output() {
+        let spawn = |script: &str| {
+            let mut cmd = build_command("sh", Some(&vec!["-c".into(), script.into()]));
+            cmd.stdout(Stdio::piped());
+            cmd.stderr(Stdio::piped());
+            cmd.kill_on_drop(true);
+            cmd.process_group(0);
+            cmd.spawn().unwrap()
+        };
+
+        // Output past the limit is drained and the command finishes
+        let child = spawn("head -c 100000 /dev/zero; echo done >&2");
+        let output = timeout(
+            Duration::from_secs(5),
+            wait_with_capped_output(child, 1000, false),
+        )
+        .await
+        .unwrap()
+        .unwrap();
+        assert!(output.status.success());
+        assert_eq!(output.stdout.data.len(), 1000);
+        assert!(output.stdout.truncated);
+        assert!(!output.stderr.truncated);
+        assert_eq!(output.stderr.into_string(), "done\n");
+        assert!(output.stdout.into_string().ends_with(OUTPUT_TRUNCATED));
+
+        let child = spawn("exec yes");
+        let output = timeout(
+            Duration::from_secs(5),
+            wait_with_capped_output(child, 1000, true),
+        )
+        .await
+        .expect("the command should be killed at the limit")
+        .unwrap();
+        assert_eq!(output.status.signal(), Some(nix::libc::SIGKILL));
+        assert_eq!(output.stdout.data.len(), 1000);
+
+        // The writer of a pipeline is not the child itself
+        let child = spawn("yes | cat");
+        let output = timeout(
+            Duration::from_secs(5),
+            wait_with_capped_output(child, 1000, true),
+        )
+        .await
+        .expect("the whole pipeline should be killed at the limit")
+        .unwrap();
+        assert_eq!(output.status.signal(), Some(nix::libc::SIGKILL));
+        assert!(output.stdout.truncated);
+    }
+
+    /// Register a process without a child and log `lines` through the same
+    /// path as real output, keeping at most `max_lines`.
+    async fn logged_process(lines: &[&str], max_lines: usize) -> Arc<AppState> {
+        let mut config = crate::config::Config::load();
+        config.max_log_lines = max_lines;
+        let state = Arc::new(AppState::new(config));
+
+        let req = serde_json::from_value(serde_json::json!({ "command": "true" })).unwrap();
+        let tx = tokio::sync::broadcast::channel(100).0;
+        let info = ProcessInfo::new(
+            "p1".to_string(),
+            None,
+            "true".to_string(),
+            None,
+            tx.clone(),
+            req,
+        );
+        state.processes.write().await.insert("p1".to_string(), info);
+
+        let output = lines.iter().map(|l| format!("{}\n", l)).collect::<String>();
+        pump_log(
+            BufReader::new(output.as_bytes()),
+            "p1".to_string(),
+            state.clone(),
+            tx,
+            "[stdout]",
+            encoding_rs::UTF_8,
+        )
+        .await;
+        state
+    }
+
+    /// Ids of the lines an SSE log stream replays before its `live` event.
+    async fn replayed_ids(state: &Arc<AppState>, from: &str) -> Vec<u64> {
+        let params = [("stream", "true"), ("from", from)]
+            .into_iter()
+            .map(|(k, v)| (k.to_string(), v.to_string()))
+            .collect();
+        let response = get_process_logs(
+            State(state.clone()),
+            Path("p1".to_string()),
+            axum::http::HeaderMap::new(),
+            Query(params),
+        )
+        .await
+        .unwrap();
+
+        let mut body = response.into_body().into_data_stream();
+        let mut text = String::new();
+        let live = |line: &str| line.starts_with("event:") && line.trim_end().ends_with("live");
+        while !text.lines().any(live) {
+            let chunk = timeout(Duration::from_secs(5), body.next())
+                .await
+                .expect("the replay should end in a live event")
+                .unwrap()
+                .unwrap();
+            text.push_str(&String::from_utf8_lossy(&chunk));
+        }
+        text.lines()
+            .filter_map(|line| line.strip_prefix("id:"))
+            .map(|id| id.trim().parse().unwrap())
+            .collect()
+    }
+
+    #[tokio::test]
+    async fn test_log_stream_resumes_after_eviction() {
+        let state = logged_process(&["one", "two", "three", "four", "five"], 3).await;
+
+        // Lines keep their ids after "one" and "two" are evicted
+        assert_eq!(replayed_ids(&state, "3").await, vec![3, 4]);
+        // Resuming from an evicted line starts at the oldest one kept
+        assert_eq!(replayed_ids(&state, "1").await, vec![2, 3, 4]);
+        assert_eq!(replayed_ids(&state, "beginning").await, vec![2, 3, 4]);
+        assert!(replayed_ids(&state, "end").await.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_log_search_sequence_survives_eviction() {
+        let state = logged_process(&["one", "two", "three", "four", "five"], 3).await;
+
+        let search = |q: &str| {
+            search_process_logs(
+                State(state.clone()),
+                Path("p1".to_string()),
+                Query(LogSearchParams {
+                    q: q.to_string(),
+                    regex: false,
+                    level: None,
+                    limit: None,
+                }),
+            )
+        };
+        // "one" and "two" were evicted; the rest keep their sequence numbers
+        let found = search("four").await.unwrap();
+        assert_eq!(found.data.matches.len(), 1);
+        assert_eq!(found.data.matches[0].index, 3);
+        assert!(search("one").await.unwrap().data.matches.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_timeout_kills_process_group() {
+        let state = Arc::new(AppState::new(crate::config::Config::load()));
+        let pid_file = std::env::temp_dir().join(format!("timeout-test-{}", std::process::id()));
+        let req = serde_json::from_value(serde_json::json!({
+            "command": "sh",
+            "args": ["-c", format!("sleep 30 & echo $! > {}; wait", pid_file.display())],
+            "timeout": 1,
+        }))
+        .unwrap();
+        let id = start_process(&state, req).await.unwrap().process_id;
+
+        let mut failure_reason = None;
+        for _ in 0..50 {
+            if let Some(proc) = state.processes.read().await.get(&id) {
+                if proc.status != "running" {
+                    failure_reason = proc.failure_reason;
+                    break;
+                }
+            }
+            tokio::time::sleep(Duration::from_millis(100)).await;
+        }
+        assert_eq!(failure_reason, Some(FailureReason::Timeout));
+
+        // The background sleep is in the shell's group and dies with it
+        let pid = std::fs::read_to_string(&pid_file).unwrap();
+        std::fs::remove_file(&pid_file).unwrap();
+        let stat = format!("/proc/{}/stat", pid.trim());
+        for _ in 0..50 {
+            match std::fs::read_to_string(&stat) {
+                Ok(stat) if !stat.contains(") Z ") => {}
+                _ => return,
+            }
+            tokio::time::sleep(Duration::from_millis(100)).await;
+        }
+        panic!("the background process outlived the timeout");
+    }
+
+    #[tokio::test]
+    async fn test_cpu_limit_with_sigxcpu_ignored() {
+        let state = Arc::new(AppState::new(crate::config::Config::load()));
+        let req = serde_json::from_value(serde_json::json!({
+            "command": "sh",
+            "args": ["-c", "trap '' XCPU; while :; do :; done"],
+            "maxCpuSeconds": 1,
+        }))
+        .unwrap();
+        let id = start_process(&state, req).await.unwrap().process_id;
+
+        // SIGXCPU is ignored, so the hard limit a second later sends SIGKILL
+        for _ in 0..100 {
+            if let Some(proc) = state.processes.read().await.get(&id) {
+                if proc.status != "running" {
+                    assert_eq!(proc.exit_code, Some(128 + nix::libc::SIGKILL));
+                    assert_eq!(proc.failure_reason, Some(FailureReason::CpuLimit));
+                    return;
+                }
+            }
+            tokio::time::sleep(Duration::from_millis(100)).await;
+        }
+        panic!("the busy loop should be stopped by its CPU limit");
+    }
+
+    #[tokio::test]
+    async fn test_run_script_timeout() {
+        let dir = std::env::temp_dir().join(format!("run-script-test-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let mut config = crate::config::Config::load();
+        config.workspace_path = dir.clone();
+        let state = AppState::new(config);
+
+        let req = serde_json::from_value(serde_json::json!({
+            "script": "sleep 30 & echo $! > pid; wait",
+            "timeout": 1,
+        }))
+        .unwrap();
+        let result = run_script_in(&state, &dir, req).await;
+        let pid = std::fs::read_to_string(dir.join("pid")).unwrap();
+        std::fs::remove_dir_all(&dir).unwrap();
+        match result {
+            Err(AppError::OperationError(_, data)) => {
+                assert_eq!(data["failureReason"], "timeout");
+            }
+            _ => panic!("expected a timeout"),
+        }
+
+        // The background sleep is in the script's group and dies with it
+        let stat = format!("/proc/{}/stat", pid.trim());
+        for _ in 0..50 {
+            match std::fs::read_to_string(&stat) {
+                Ok(stat) if !stat.contains(") Z ") => {}
+                _ => return,
+            }
+            tokio::time::sleep(Duration::from_millis(100)).await;
+        }
+        panic!("the background process outlived the timeout");
+    }
+
+    #[tokio::test]
+    async fn test_merged_log_stream() {
+        let state = Arc::new(AppState::new(crate::config::Config::load()));
+        let mut senders = Vec::new();
+        for id in ["p1", "p2"] {
+            let req = serde_json::from_value(serde_json::json!({ "command": "true" })).unwrap();
+            let tx = tokio::sync::broadcast::channel(100).0;
+            let info =
+                ProcessInfo::new(id.to_string(), None, id.to_string(), None, tx.clone(), req);
+            state.processes.write().await.insert(id.to_string(), info);
+            senders.push(tx);
+        }
+        let open = |ids: &str| {
+            stream_merged_logs(
+                State(state.clone()),
+                Query(MergedLogStreamParams {
+                    ids: ids.to_string(),
+                    level: Some("stderr".to_string()),
+                }),
+            )
+        };
+        assert!(matches!(open(" , ").await, Err(AppError::BadRequest(_))));
+        assert!(matches!(open("p1,nope").await, Err(AppError::NotFound(_))));
+
+        let response = open("p1, p2").await.unwrap();
+        senders[0]
+            .send("[stdout] filtered out".to_string())
+            .unwrap();
+        senders[0].send("[stderr] from one".to_string()).unwrap();
+        senders[1].send("[stderr] from two".to_string()).unwrap();
+
+        let mut body = response.into_body().into_data_stream();
+        let mut events = Vec::new();
+        let mut text = String::new();
+        while events.len() < 2 {
+            let chunk = timeout(Duration::from_secs(5), body.next())
+                .await
+                .expect("both stderr lines should arrive")
+                .unwrap()
+                .unwrap();
+            text.push_str(&String::from_utf8_lossy(&chunk));
+            // Keep a partial last line for the next chunk
+            let complete = text.rfind('\n').map_or(0, |i| i + 1);
+            for line in text[..complete].lines() {
+                if let Some(data) = line.strip_prefix("data:") {
+                    let event: serde_json::Value = serde_json::from_str(data.trim()).unwrap();
+                    events.push((event["processId"].clone(), event["content"].clone()));
+                }
+            }
+            text.drain(..complete);
+        }
+        events.sort_by_key(|(id, _)| id.to_string());
+        assert_eq!(
+            events,
+            vec![
+                (serde_json::json!("p1"), serde_json::json!("from one")),
+                (serde_json::json!("p2"), serde_json::json!("from two")),
+            ]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_chunked_output() {
+        let run = |script: &str, time_limit: Duration| {
+            let mut cmd = build_command("sh", Some(&vec!["-c".into(), script.into()]));
+            cmd.stdout(Stdio::piped());
+            cmd.stderr(Stdio::piped());
+            cmd.kill_on_drop(true);
+            let response = stream_chunked_output(cmd.spawn().unwrap(), time_limit);
+            async move {
+                let body = axum::body::to_bytes(response.into_body(), usize::MAX);
+                let body = timeout(Duration::from_secs(5), body)
+                    .await
+                    .unwrap()
+                    .unwrap();
+                String::from_utf8(body.to_vec()).unwrap()
+            }
+        };
+
+        // Both streams are forwarded raw, and the exit line comes last
+        let body = run("echo out; echo err >&2; exit 3", Duration::from_secs(5)).await;
+        assert!(body.contains("out\n"), "{}", body);
+        assert!(body.contains("err\n"), "{}", body);
+        assert!(body.ends_with("\n[exit code: 3]\n"), "{}", body);
+
+        let body = run("echo started; exec sleep 30", Duration::from_millis(200)).await;
+        assert_eq!(body, "started\n\n[exit code: timeout]\n");
+    }
+
+    #[tokio::test]
+    async fn test_lookup_and_kill_by_pid() {
+        let state = Arc::new(AppState::new(crate::config::Config::load()));
+        let req = serde_json::from_value(serde_json::json!({
+            "command": "sleep",
+            "args": ["30"],
+        }))
+        .unwrap();
+        let started = start_process(&state, req).await.unwrap();
+        let pid = started.pid.unwrap();
+
+        let status =
+            get_process_status_by_pid(State(state.clone()), Query(ProcessPidParams { pid }))
+                .await
+                .unwrap();
+        assert_eq!(status.data.process_id, started.process_id);
+
+        let kill = |params: &[(&str, &str)]| {
+            let params = params
+                .iter()
+                .map(|(k, v)| (k.to_string(), v.to_string()))
+                .collect();
+            kill_process_by_pid(State(state.clone()), Query(params))
+        };
+        assert!(matches!(kill(&[]).await, Err(AppError::BadRequest(_))));
+        assert!(matches!(
+            kill(&[("pid", "abc")]).await,
+            Err(AppError::BadRequest(_))
+        ));
+        // PID 0 is never a tracked child
+        assert!(matches!(
+            kill(&[("pid", "0")]).await,
+            Err(AppError::NotFound(_))
+        ));
+
+        let pid = pid.to_string();
+        kill(&[("pid", pid.as_str()), ("signal", "SIGKILL")])
+            .await
+            .unwrap();
+        let processes = state.processes.read().await;
+        assert_eq!(processes[&started.process_id].status, "killed");
+    }
+}
@@ -1,26 +1,43 @@
+use crate::audit::{AuditContext, AuditEntry};
 use crate::error::AppError;
 use crate::response::ApiResponse;
-use crate::state::{session::SessionInfo, AppState};
+use crate::state::{
+    session::{SessionInfo, SessionStore},
+    AppState,
+};
+use crate::utils::env_file::merge_env_file;
 use crate::utils::path::validate_path;
 use axum::{
     extract::{Path, Query, State},
+    response::{IntoResponse, Response},
     Json,
 };
+use schemars::JsonSchema;
 use serde::{Deserialize, Serialize};
 use std::process::Stdio;
 use std::sync::Arc;
 use tokio::io::{AsyncWriteExt, BufReader};
 use tokio::process::Command;
+use tokio::sync::broadcast::{self, error::RecvError, error::TryRecvError};
 
-#[derive(Deserialize)]
+#[derive(Deserialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct CreateSessionRequest {
     working_dir: Option<String>,
     env: Option<std::collections::HashMap<String, String>>,
+    /// Workspace dotenv file merged under `env` (explicit values win)
+    env_file: Option<String>,
+    /// Path or name (looked up in `PATH`) of the shell; `DEFAULT_SHELL` when unset
     shell: Option<String>,
+    /// Extra arguments for the shell, e.g. `--login`
+    shell_args: Option<Vec<String>>,
+    /// Address space limit for the shell and everything it runs
+    max_memory_mb: Option<u64>,
+    /// Wall-clock lifetime in seconds after which the session is terminated
+    max_lifetime: Option<u64>,
 }
 
-#[derive(Serialize)]
+#[derive(Serialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct CreateSessionResponse {
     session_id: String,
@@ -35,13 +52,13 @@ pub struct ListSessionsResponse {
     sessions: Vec<crate::state::session::SessionStatus>,
 }
 
-#[derive(Serialize)]
+#[derive(Serialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct SessionOperationResponse {
     success: bool,
 }
 
-#[derive(Serialize)]
+#[derive(Serialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct SessionExecResponse {
     exit_code: i32,
@@ -50,12 +67,26 @@ pub struct SessionExecResponse {
     duration: u64,
 }
 
-#[derive(Serialize)]
+#[derive(Serialize, JsonSchema)]
 #[serde(rename_all = "camelCase")]
 pub struct SessionCdResponse {
     working_dir: String,
 }
 
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+pub struct SessionTouchResponse {
+    session_id: String,
+    last_used_at: String,
+}
+
+#[derive(Serialize, JsonSchema)]
+#[serde(rename_all = "camelCase")]
+pub struct SessionEnvResponse {
+    session_id: String,
+    env: std::collections::HashMap<String, String>,
+}
+
 #[derive(Serialize)]
 #[serde(rename_all = "camelCase")]
 pub struct SessionLogsResponse {
@@ -63,34 +94,158 @@ pub struct SessionLogsResponse {
     logs: Vec<String>,
 }
 
+/// A shell under an address space limit that dies from one of these signals
+/// most likely ran out of memory (failed allocations abort or fault). The
+/// limit never sends SIGKILL itself, so a killed shell is not counted.
+fn killed_by_memory_limit(status: &std::process::ExitStatus) -> bool {
+    use nix::sys::signal::Signal;
+    use std::os::unix::process::ExitStatusExt;
+    status.signal().is_some_and(|sig| {
+        [Signal::SIGSEGV, Signal::SIGABRT, Signal::SIGBUS]
+            .iter()
+            .any(|s| *s as i32 == sig)
+    })
+}
+
+/// Check that `shell` names an executable file, looking bare names up in
+/// `path` the way the spawn will.
+fn check_shell(shell: &str, path: Option<&str>) -> Result<(), AppError> {
+    use std::os::unix::fs::PermissionsExt;
+    let is_executable = |candidate: &std::path::Path| {
+        std::fs::metadata(candidate)
+            .is_ok_and(|m| m.is_file() && m.permissions().mode() & 0o111 != 0)
+    };
+
+    if shell.contains('/') {
+        let candidate = std::path::Path::new(shell);
+        if !candidate.exists() {
+            return Err(AppError::Validation(format!("Shell not found: {}", shell)));
+        }
+        if !is_executable(candidate) {
+            return Err(AppError::Validation(format!(
+                "Shell is not an executable file: {}",
+                shell
+            )));
+        }
+        return Ok(());
+    }
+
+    let found = path
+        .is_some_and(|path| std::env::split_paths(path).any(|dir| is_executable(&dir.join(shell))));
+    if !found {
+        return Err(AppError::Validation(format!(
+            "Shell not found in PATH: {}",
+            shell
+        )));
+    }
+    Ok(())
+}
+
+/// Forward one of the shell's output streams into the session logs. Markers
+/// printed for `session_exec` go to `markers` instead, after any output that
+/// preceded them on the same line.
+async fn pump_session_output<R: tokio::io::AsyncRead + Unpin>(
+    stream: R,
+    level: &'static str,
+    state: Arc<AppState>,
+    session_id: String,
+    tx: broadcast::Sender<String>,
+    markers: broadcast::Sender<String>,
+) {
+    let mut reader = BufReader::new(stream);
+    let mut line = String::new();
+    use tokio::io::AsyncBufReadExt;
+    const MAX_LOG_LINES: usize = 10000;
+
+    while let Ok(n) = reader.read_line(&mut line).await {
+        if n == 0 {
+            break;
+        }
+        let (output, marker) = split_exit_marker(&line);
+        if !output.is_empty() {
+            let log_entry = format!("[{}] {}", level, output);
+            if let Some(sess) = state.sessions.read().await.get(&session_id) {
+                let mut logs = sess.logs.write().await;
+                if logs.len() >= MAX_LOG_LINES {
+                    logs.pop_front();
+                }
+                logs.push_back(log_entry.clone());
+            }
+            let _ = tx.send(log_entry);
+        }
+        if let Some(marker) = marker {
+            let _ = markers.send(format!("[{}] {}", level, marker.trim_end()));
+        }
+        line.clear();
+    }
+}
+
 pub async fn create_session(
     State(state): State<Arc<AppState>>,
     Json(req): Json<CreateSessionRequest>,
 ) -> Result<Json<ApiResponse<CreateSessionResponse>>, AppError> {
-    let shell = req.shell.unwrap_or_else(|| "/bin/bash".to_string());
+    let shell = req
+        .shell
+        .unwrap_or_else(|| state.config.default_shell.clone());
     let cwd = req
         .working_dir
         .unwrap_or_else(|| state.config.workspace_path.to_string_lossy().to_string());
 
     let valid_cwd = validate_path(&state.config.workspace_path, &cwd)?;
+    let env = merge_env_file(&state, req.env_file.as_deref(), req.env).await?;
+
+    if req.max_memory_mb == Some(0) || req.max_lifetime == Some(0) {
+        return Err(AppError::BadRequest(
+            "maxMemoryMb and maxLifetime must be greater than zero".to_string(),
+        ));
+    }
+
+    // A `PATH` in the session environment is the one the spawn searches
+    let search_path = env
+        .as_ref()
+        .and_then(|env| env.get("PATH").cloned())
+        .or_else(|| std::env::var("PATH").ok());
+    check_shell(&shell, search_path.as_deref())?;
 
     let mut cmd = Command::new(&shell);
+    if let Some(args) = &req.shell_args {
+        cmd.args(args);
+    }
     cmd.current_dir(&valid_cwd);
 
-    if let Some(env) = req.env.clone() {
+    if let Some(mb) = req.max_memory_mb {
+        let bytes = mb.saturating_mul(1024 * 1024);
+        // SAFETY: the forked shell only sets its own RLIMIT_AS here, to a
+        // byte count computed before the fork, before it execs.
+        unsafe {
+            cmd.pre_exec(move || {
+                nix::sys::resource::setrlimit(nix::sys::resource::Resource::RLIMIT_AS, bytes, bytes)
+                    .map_err(std::io::Error::from)
+            });
+        }
+    }
+
+    if let Some(env) = &env {
         cmd.envs(env);
     }
 
     cmd.stdin(Stdio::piped());
     cmd.stdout(Stdio::piped());
     cmd.stderr(Stdio::piped());
+    // Own process group, so `signal_session` reaches the commands the shell
+    // runs. The shell no longer gets signals sent to the server's group.
+    cmd.process_group(0);
 
     let mut child = cmd
         .spawn()
         .map_err(|e| AppError::InternalServerError(format!("Failed to spawn shell: {}", e)))?;
     let session_id = crate::utils::common::generate_id();
 
-    let stdin = child.stdin.take().expect("stdin piped");
+    let mut stdin = child.stdin.take().expect("stdin piped");
+    // A non-interactive shell exits after its foreground command dies from
+    // SIGINT unless it handles SIGINT itself; a trap keeps the session alive
+    // while the commands it starts still get the default disposition.
+    let _ = stdin.write_all(b"trap : INT\n").await;
     let stdout = child.stdout.take().expect("stdout piped");
     let stderr = child.stderr.take().expect("stderr piped");
 
@@ -103,73 +258,57 @@ pub async fn create_session(
         pid,
         shell: shell.clone(),
         cwd: valid_cwd.to_string_lossy().to_string(),
-        env: req.env.unwrap_or_default(),
+        env: env.unwrap_or_default(),
         child: Some(child),
         stdin,
         log_broadcast: tx.clone(),
     });
 
+    let markers = session_info.exec_markers.clone();
     {
         let mut sessions = state.sessions.write().await;
         sessions.insert(session_id.clone(), session_info);
     }
 
-    let state_clone = state.clone();
-    let sid_clone = session_id.clone();
-    let tx_clone = tx.clone();
-
-    tokio::spawn(async move {
-        let mut reader = BufReader::new(stdout);
-        let mut line = String::new();
-        use tokio::io::AsyncBufReadExt;
-        const MAX_LOG_LINES: usize = 10000;
-
-        while let Ok(n) = reader.read_line(&mut line).await {
-            if n == 0 {
-                break;
-            }
-            let log_entry = format!("[stdout] {}", line);
-            if let Some(sess) = state_clone.sessions.read().await.get(&sid_clone) {
-                let mut logs = sess.logs.write().await;
-                if logs.len() >= MAX_LOG_LINES {
-                    logs.pop_front();
+    tokio::spawn(pump_session_output(
+        stdout,
+        "stdout",
+        state.clone(),
+        session_id.clone(),
+        tx.clone(),
+        markers.clone(),
+    ));
+    tokio::spawn(pump_session_output(
+        stderr,
+        "stderr",
+        state.clone(),
+        session_id.clone(),
+        tx,
+        markers,
+    ));
+
+    if let Some(secs) = req.max_lifetime {
+        let state_lifetime = state.clone();
+        let sid_lifetime = session_id.clone();
+        tokio::spawn(async move {
+            tokio::time::sleep(tokio::time::Duration::from_secs(secs)).await;
+            let mut sessions = state_lifetime.sessions.write().await;
+            if let Some(sess) = sessions.get_mut(&sid_lifetime) {
+                if sess.status != "active" {
+                    return;
                 }
-                logs.push_back(log_entry.clone());
-            }
-            let _ = tx_clone.send(log_entry);
-            line.clear();
-        }
-    });
-
-    let state_clone_err = state.clone();
-    let sid_clone_err = session_id.clone();
-    let tx_clone_err = tx.clone();
-
-    tokio::spawn(async move {
-        let mut reader = BufReader::new(stderr);
-        let mut line = String::new();
-        use tokio::io::AsyncBufReadExt;
-        const MAX_LOG_LINES: usize = 10000;
-
-        while let Ok(n) = reader.read_line(&mut line).await {
-            if n == 0 {
-                break;
-            }
-            let log_entry = format!("[stderr] {}", line);
-            if let Some(sess) = state_clone_err.sessions.read().await.get(&sid_clone_err) {
-                let mut logs = sess.logs.write().await;
-                if logs.len() >= MAX_LOG_LINES {
-                    logs.pop_front();
+                if let Some(pid) = sess.pid {
+                    let _ = signal_session_group(pid, nix::sys::signal::Signal::SIGKILL);
                 }
-                logs.push_back(log_entry.clone());
+                sess.termination_reason = Some("lifetime_exceeded".to_string());
+                sess.status = "terminated".to_string();
             }
-            let _ = tx_clone_err.send(log_entry);
-            line.clear();
-        }
-    });
+        });
+    }
 
     let state_clone_cleanup = state.clone();
     let sid_clone_cleanup = session_id.clone();
+    let memory_limited = req.max_memory_mb.is_some();
 
     tokio::spawn(async move {
         // Take the child process out of the state to wait on it
@@ -183,13 +322,19 @@ pub async fn create_session(
         };
 
         if let Some(mut child) = child {
-            let _ = child.wait().await;
+            let exit_status = child.wait().await;
 
             // Update status to terminated
             {
                 let mut sessions = state_clone_cleanup.sessions.write().await;
                 if let Some(sess) = sessions.get_mut(&sid_clone_cleanup) {
                     sess.status = "terminated".to_string();
+                    if sess.termination_reason.is_none()
+                        && memory_limited
+                        && exit_status.is_ok_and(|s| killed_by_memory_limit(&s))
+                    {
+                        sess.termination_reason = Some("memory_limit".to_string());
+                    }
                 }
             }
 
@@ -211,7 +356,8 @@ pub async fn create_session(
 
 pub async fn list_sessions(
     State(state): State<Arc<AppState>>,
-) -> Result<Json<ApiResponse<ListSessionsResponse>>, AppError> {
+    headers: axum::http::HeaderMap,
+) -> Result<Response, AppError> {
     let sessions = state.sessions.read().await;
     let mut result = Vec::new();
 
@@ -219,9 +365,14 @@ pub async fn list_sessions(
         result.push(sess.to_status());
     }
 
+    if crate::response::wants_ndjson(&headers) {
+        return Ok(crate::response::ndjson_response(result));
+    }
+
     Ok(Json(ApiResponse::success(ListSessionsResponse {
         sessions: result,
-    })))
+    }))
+    .into_response())
 }
 
 pub async fn get_session(
@@ -236,9 +387,36 @@ pub async fn get_session(
     Ok(Json(ApiResponse::success(sess.to_status())))
 }
 
-#[derive(Deserialize)]
+/// Marks an active session as used without running anything, so idle but
+/// connected clients keep it alive.
+pub async fn touch_session(
+    State(state): State<Arc<AppState>>,
+    Path(id): Path<String>,
+) -> Result<Json<ApiResponse<SessionTouchResponse>>, AppError> {
+    let mut sessions = state.sessions.write().await;
+    let sess = sessions
+        .get_mut(&id)
+        .ok_or_else(|| AppError::NotFound("Session not found".to_string()))?;
+
+    if sess.status != "active" {
+        return Err(AppError::Conflict(format!("Session is {}", sess.status)));
+    }
+
+    sess.last_used_at = std::time::SystemTime::now();
+
+    Ok(Json(ApiResponse::success(SessionTouchResponse {
+        session_id: id,
+        last_used_at: sess.to_status().last_used_at,
+    })))
+}
+
+#[derive(Deserialize, JsonSchema)]
 pub struct UpdateSessionEnvRequest {
+    #[serde(default)]
     env: std::collections::HashMap<String, String>,
+    /// Variables to remove (update only; replace drops whatever `env` lacks)
+    #[serde(default)]
+    unset: Vec<String>,
 }
 
 pub async fn update_session_env(
@@ -246,6 +424,21 @@ pub async fn update_session_env(
     Path(id): Path<String>,
     Json(req): Json<UpdateSessionEnvRequest>,
 ) -> Result<Json<ApiResponse<SessionOperationResponse>>, AppError> {
+    // Build all commands first so an invalid key leaves the session untouched
+    let mut commands = Vec::with_capacity(req.env.len() + req.unset.len());
+    for (k, v) in &req.env {
+        commands.push(export_command(k, v)?);
+    }
+    for k in &req.unset {
+        if req.env.contains_key(k) {
+            return Err(AppError::Validation(format!(
+                "Environment variable {} is both set and unset",
+                k
+            )));
+        }
+        commands.push(unset_command(k)?);
+    }
+
     let mut sessions = state.sessions.write().await;
     let sess = sessions
         .get_mut(&id)
@@ -255,12 +448,67 @@ pub async fn update_session_env(
     for (k, v) in &req.env {
         sess.env.insert(k.clone(), v.clone());
     }
+    for k in &req.unset {
+        sess.env.remove(k);
+    }
     sess.last_used_at = std::time::SystemTime::now();
 
     // Send export commands to shell
     if let Some(stdin) = &mut sess.stdin {
-        for (k, v) in &req.env {
-            let cmd = format!("export {}={}\n", k, v);
+        for cmd in commands {
+            stdin.write_all(cmd.as_bytes()).await.map_err(|e| {
+                AppError::InternalServerError(format!("Failed to write to stdin: {}", e))
+            })?;
+        }
+    }
+
+    Ok(Json(ApiResponse::success(SessionOperationResponse {
+        success: true,
+    })))
+}
+
+pub async fn get_session_env(
+    State(state): State<Arc<AppState>>,
+    Path(id): Path<String>,
+) -> Result<Json<ApiResponse<SessionEnvResponse>>, AppError> {
+    let sessions = state.sessions.read().await;
+    let sess = sessions
+        .get(&id)
+        .ok_or_else(|| AppError::NotFound("Session not found".to_string()))?;
+
+    Ok(Json(ApiResponse::success(SessionEnvResponse {
+        session_id: id,
+        env: sess.env.clone(),
+    })))
+}
+
+/// Replace the whole session environment: variables missing from the request
+/// are unset in the shell, all others are (re-)exported.
+pub async fn replace_session_env(
+    State(state): State<Arc<AppState>>,
+    Path(id): Path<String>,
+    Json(req): Json<UpdateSessionEnvRequest>,
+) -> Result<Json<ApiResponse<SessionOperationResponse>>, AppError> {
+    let mut sessions = state.sessions.write().await;
+    let sess = sessions
+        .get_mut(&id)
+        .ok_or_else(|| AppError::NotFound("Session not found".to_string()))?;
+
+    let mut commands = Vec::new();
+    for k in sess.env.keys() {
+        if !req.env.contains_key(k) && is_valid_env_key(k) {
+            commands.push(format!("unset {}\n", k));
+        }
+    }
+    for (k, v) in &req.env {
+        commands.push(export_command(k, v)?);
+    }
+
+    sess.env = req.env;
+    sess.last_used_at = std::time::SystemTime::now();
+
+    if let Some(stdin) = &mut sess.stdin {
+        for cmd in commands {
             stdin.write_all(cmd.as_bytes()).await.map_err(|e| {
                 AppError::InternalServerError(format!("Failed to write to stdin: {}", e))
             })?;
@@ -272,26 +520,230 @@ pub async fn update_session_env(
     })))
 }
 
-#[derive(Deserialize)]
+fn is_valid_env_key(key: &str) -> bool {
+    let mut chars = key.chars();
+    match chars.next() {
+        Some(c) if c == '_' || c.is_ascii_alphabetic() => {}
+        _ => return false,
+    }
+    chars.all(|c| c == '_' || c.is_ascii_alphanumeric())
+}
+
+fn check_env_key(key: &str) -> Result<(), AppError> {
+    if !is_valid_env_key(key) {
+        return Err(AppError::Validation(format!(
+            "Invalid environment variable name: {:?}",
+            key
+        )));
+    }
+    Ok(())
+}
+
+/// Build a shell-safe `export` line for a session environment variable.
+fn export_command(key: &str, value: &str) -> Result<String, AppError> {
+    check_env_key(key)?;
+    // The environment cannot hold NUL bytes; the shell would cut the value
+    if value.contains('\0') {
+        return Err(AppError::Validation(format!(
+            "Value of environment variable {} contains a NUL byte",
+            key
+        )));
+    }
+    Ok(format!("export {}={}\n", key, shell_words::quote(value)))
+}
+
+/// Build the `unset` line removing a session environment variable.
+fn unset_command(key: &str) -> Result<String, AppError> {
+    check_env_key(key)?;
+    Ok(format!("unset {}\n", key))
+}
+
+#[derive(Deserialize, JsonSchema)]
 pub struct SessionExecRequest {
     command: String,
+    /// Seconds to wait for the command to finish (default 30)
+    timeout: Option<u64>,
+    /// Variables exported for this command only
+    #[serde(default)]
+    env: std::collections::HashMap<String, String>,
+}
+
+/// Default time limit of `session_exec` in seconds
+const DEFAULT_EXEC_TIMEOUT: u64 = 30;
+
+/// Start of the marker the shell prints once a `session_exec` command is done
+const EXIT_MARKER_PREFIX: &str = "__DEVBOX_EXIT_";
+
+/// Split an output line at an exit marker. Output without a trailing newline
+/// ends up on the marker's line, so the marker is searched for anywhere.
+fn split_exit_marker(line: &str) -> (&str, Option<&str>) {
+    match line.find(EXIT_MARKER_PREFIX) {
+        Some(i) => (&line[..i], Some(&line[i..])),
+        None => (line, None),
+    }
+}
+
+/// Shell input running `command` followed by `marker`: on stdout together
+/// with the exit status, on stderr alone so that stream can be drained too.
+/// `setup` runs right before the command and `restore` right after it, before
+/// the marker, so both are done by the time the response is sent.
+fn exec_script(command: &str, marker: &str, setup: &str, restore: &str) -> String {
+    format!(
+        "{}{}\n__devbox_status=$?\n{}printf '%s %s\\n' '{m}' \"$__devbox_status\"; printf '%s\\n' '{m}' >&2\n",
+        setup,
+        command,
+        restore,
+        m = marker
+    )
+}
+
+/// Shell lines exporting the variables of a single `session_exec` command
+/// and lines undoing them afterwards. The shell saves what each variable held
+/// before, since it may have been inherited or exported by hand: variables
+/// that were set get their old value back, all others are unset.
+fn scoped_env_commands(
+    env: &std::collections::HashMap<String, String>,
+) -> Result<(String, String), AppError> {
+    let mut keys: Vec<_> = env.keys().collect();
+    keys.sort();
+    let mut setup = String::new();
+    let mut restore = String::new();
+    for key in keys {
+        let export = export_command(key, &env[key])?;
+        // Keys are plain identifiers, so they can be spliced into names
+        setup.push_str(&format!(
+            "__devbox_isset_{k}=${{{k}+x}}; __devbox_saved_{k}=${{{k}-}}\n{}",
+            export,
+            k = key
+        ));
+        restore.push_str(&format!(
+            "if [ -n \"$__devbox_isset_{k}\" ]; then export {k}=\"$__devbox_saved_{k}\"; else unset {k}; fi; unset __devbox_isset_{k} __devbox_saved_{k}\n",
+            k = key
+        ));
+    }
+    Ok((setup, restore))
+}
+
+/// Output of one `session_exec` command, collected from the session logs.
+#[derive(Default)]
+struct ExecOutput {
+    stdout: String,
+    stderr: String,
+    exit_code: Option<i32>,
+    stderr_done: bool,
+}
+
+impl ExecOutput {
+    fn push(&mut self, entry: &str) {
+        if let Some(text) = entry.strip_prefix("[stdout] ") {
+            self.stdout.push_str(text);
+        } else if let Some(text) = entry.strip_prefix("[stderr] ") {
+            self.stderr.push_str(text);
+        }
+    }
+
+    /// Collect output until `marker` has been seen on both streams. Output
+    /// is sent before the marker that follows it, so whatever is still
+    /// queued when a marker arrives is drained first.
+    async fn collect(
+        &mut self,
+        logs: &mut broadcast::Receiver<String>,
+        markers: &mut broadcast::Receiver<String>,
+        marker: &str,
+    ) {
+        loop {
+            tokio::select! {
+                entry = logs.recv() => match entry {
+                    Ok(entry) => self.push(&entry),
+                    Err(RecvError::Lagged(_)) => {}
+                    Err(RecvError::Closed) => return,
+                },
+                received = markers.recv() => match received {
+                    Ok(received) => {
+                        let Some((stream, status)) = received.split_once(marker) else {
+                            continue;
+                        };
+                        loop {
+                            match logs.try_recv() {
+                                Ok(entry) => self.push(&entry),
+                                Err(TryRecvError::Lagged(_)) => {}
+                                Err(_) => break,
+                            }
+                        }
+                        if stream.starts_with("[stdout]") {
+                            self.exit_code = Some(status.trim().parse().unwrap_or(-1));
+                        } else {
+                            self.stderr_done = true;
+                        }
+                        if self.exit_code.is_some() && self.stderr_done {
+                            return;
+                        }
+                    }
+                    Err(RecvError::Lagged(_)) => {}
+                    Err(RecvError::Closed) => return,
+                },
+            }
+        }
+    }
 }
 
+/// Run a command in the session's shell and wait for it to finish. Commands
+/// of one session run one at a time; output anything else in the shell
+/// prints meanwhile (background jobs) is included.
 pub async fn session_exec(
     State(state): State<Arc<AppState>>,
     Path(id): Path<String>,
+    audit: AuditContext,
     Json(req): Json<SessionExecRequest>,
 ) -> Result<Json<ApiResponse<SessionExecResponse>>, AppError> {
-    let mut sessions = state.sessions.write().await;
-    let sess = sessions
-        .get_mut(&id)
+    state
+        .audit
+        .record(
+            AuditEntry::new("session-exec", &req.command, &audit)
+                .env(Some(&req.env).filter(|env| !env.is_empty()))
+                .session_id(&id),
+        )
+        .await;
+
+    let exec_lock = state
+        .sessions
+        .read()
+        .await
+        .get(&id)
+        .map(|sess| sess.exec_lock.clone())
         .ok_or_else(|| AppError::NotFound("Session not found".to_string()))?;
+    let _exec_guard = exec_lock.lock().await;
 
-    if let Some(stdin) = &mut sess.stdin {
-        let cmd = format!("{}\n", req.command);
-        stdin.write_all(cmd.as_bytes()).await.map_err(|e| {
-            AppError::InternalServerError(format!("Failed to write to stdin: {}", e))
-        })?;
+    let start_instant = std::time::Instant::now();
+    let marker = format!(
+        "{}{}__",
+        EXIT_MARKER_PREFIX,
+        crate::utils::common::generate_id()
+    );
+
+    let (mut logs_rx, mut markers_rx) = {
+        let mut sessions = state.sessions.write().await;
+        let sess = sessions
+            .get_mut(&id)
+            .ok_or_else(|| AppError::NotFound("Session not found".to_string()))?;
+        if sess.status != "active" {
+            return Err(AppError::Conflict(format!("Session {} is not active", id)));
+        }
+        let (setup, restore) = scoped_env_commands(&req.env)?;
+        let receivers = (
+            sess.log_broadcast.subscribe(),
+            sess.exec_markers.subscribe(),
+        );
+        let stdin = sess
+            .stdin
+            .as_mut()
+            .ok_or_else(|| AppError::Conflict("Session stdin is closed".to_string()))?;
+        stdin
+            .write_all(exec_script(&req.command, &marker, &setup, &restore).as_bytes())
+            .await
+            .map_err(|e| {
+                AppError::InternalServerError(format!("Failed to write to stdin: {}", e))
+            })?;
 
         let log_entry = format!("[exec] {}", req.command);
         {
@@ -303,17 +755,83 @@ pub async fn session_exec(
             logs.push_back(log_entry.clone());
         }
         let _ = sess.log_broadcast.send(log_entry);
+        sess.last_used_at = std::time::SystemTime::now();
+        receivers
+    };
+
+    let timeout_secs = req.timeout.unwrap_or(DEFAULT_EXEC_TIMEOUT);
+    let mut output = ExecOutput::default();
+    let finished = tokio::time::timeout(
+        std::time::Duration::from_secs(timeout_secs),
+        output.collect(&mut logs_rx, &mut markers_rx, &marker),
+    )
+    .await
+    .is_ok();
+
+    let response = SessionExecResponse {
+        exit_code: output.exit_code.unwrap_or(-1),
+        stdout: output.stdout,
+        stderr: output.stderr,
+        duration: start_instant.elapsed().as_millis() as u64,
+    };
+    if !finished {
+        return Err(AppError::OperationError(
+            format!("Session command did not finish within {}s", timeout_secs),
+            serde_json::to_value(response).unwrap(),
+        ));
     }
+    Ok(Json(ApiResponse::success(response)))
+}
 
-    Ok(Json(ApiResponse::success(SessionExecResponse {
-        exit_code: 0,
-        stdout: "".to_string(),
-        stderr: "".to_string(),
-        duration: 0,
-    })))
+/// Longest a raw input write may wait for the shell to read it. The session
+/// store stays locked meanwhile, so this is kept short.
+const INPUT_WRITE_TIMEOUT: std::time::Duration = std::time::Duration::from_secs(5);
+
+/// Write raw bytes (keystrokes) to the shell's stdin, for interactive programs
+/// driven over the WebSocket. Returns the number of bytes written.
+pub(crate) async fn write_session_input(
+    state: &AppState,
+    id: &str,
+    data: &[u8],
+) -> Result<usize, AppError> {
+    let mut sessions = state.sessions.write().await;
+    let sess = sessions
+        .get_mut(id)
+        .ok_or_else(|| AppError::NotFound("Session not found".to_string()))?;
+    if sess.status != "active" {
+        return Err(AppError::Conflict(format!("Session {} is terminated", id)));
+    }
+    let stdin = sess
+        .stdin
+        .as_mut()
+        .ok_or_else(|| AppError::Conflict("Session stdin is closed".to_string()))?;
+
+    let write = async {
+        stdin.write_all(data).await?;
+        stdin.flush().await
+    };
+    match tokio::time::timeout(INPUT_WRITE_TIMEOUT, write).await {
+        Ok(Ok(())) => {}
+        Ok(Err(e)) if e.kind() == std::io::ErrorKind::BrokenPipe => {
+            return Err(AppError::Conflict("Session shell has exited".to_string()));
+        }
+        Ok(Err(e)) => {
+            return Err(AppError::InternalServerError(format!(
+                "Failed to write to stdin: {}",
+                e
+            )));
+        }
+        Err(_) => {
+            return Err(AppError::Conflict(
+                "Timed out waiting for the session to read input".to_string(),
+            ));
+        }
+    }
+    sess.last_used_at = std::time::SystemTime::now();
+    Ok(data.len())
 }
 
-#[derive(Deserialize)]
+#[derive(Deserialize, JsonSchema)]
 pub struct SessionCdRequest {
     path: String,
 }
@@ -342,6 +860,7 @@ pub async fn session_cd(
         })?;
 
         sess.cwd = new_path.to_string_lossy().to_string();
+        sess.last_used_at = std::time::SystemTime::now();
 
         let log_entry = format!("[cd] {}", new_path.to_string_lossy());
         {
@@ -360,6 +879,92 @@ pub async fn session_cd(
     })))
 }
 
+/// Signal the session's shell together with everything it started: the shell
+/// leads its own process group, so killing only its pid would orphan them.
+fn signal_session_group(pid: u32, signal: nix::sys::signal::Signal) -> nix::Result<()> {
+    nix::sys::signal::kill(nix::unistd::Pid::from_raw(-(pid as i32)), signal)
+}
+
+/// How often sessions are checked against `SESSION_IDLE_TIMEOUT`
+pub const IDLE_CHECK_INTERVAL: std::time::Duration = std::time::Duration::from_secs(30);
+
+/// Kill the shells of active sessions unused for longer than `idle_timeout`.
+/// A session running a `session_exec` command is busy, not idle. Terminated
+/// sessions stay queryable until the cleanup after the shell exits removes them.
+pub async fn terminate_idle_sessions(sessions: &SessionStore, idle_timeout: std::time::Duration) {
+    let now = std::time::SystemTime::now();
+    let mut sessions = sessions.write().await;
+    for sess in sessions.values_mut() {
+        if sess.status != "active" || sess.exec_lock.try_lock().is_err() {
+            continue;
+        }
+        let idle = now.duration_since(sess.last_used_at).unwrap_or_default();
+        if idle < idle_timeout {
+            continue;
+        }
+        if let Some(pid) = sess.pid {
+            let _ = signal_session_group(pid, nix::sys::signal::Signal::SIGKILL);
+        }
+        sess.termination_reason = Some("idle_timeout".to_string());
+        sess.status = "terminated".to_string();
+        println!(
+            "Terminated session {} after {}s idle",
+            sess.id,
+            idle.as_secs()
+        );
+    }
+}
+
+/// Send SIGTERM to the process group of every active session, on server
+/// shutdown.
+pub async fn terminate_all_sessions(sessions: &SessionStore) {
+    let mut sessions = sessions.write().await;
+    for sess in sessions.values_mut() {
+        if sess.status != "active" {
+            continue;
+        }
+        if let Some(pid) = sess.pid {
+            let _ = signal_session_group(pid, nix::sys::signal::Signal::SIGTERM);
+        }
+        sess.termination_reason = Some("shutdown".to_string());
+        sess.status = "terminated".to_string();
+    }
+}
+
+#[derive(Deserialize, JsonSchema)]
+pub struct SessionSignalRequest {
+    signal: String,
+}
+
+/// Send a signal (e.g. SIGINT for Ctrl-C) to the session's process group: the
+/// shell and the commands it is running.
+pub async fn signal_session(
+    State(state): State<Arc<AppState>>,
+    Path(id): Path<String>,
+    Json(req): Json<SessionSignalRequest>,
+) -> Result<Json<ApiResponse<SessionOperationResponse>>, AppError> {
+    let mut sessions = state.sessions.write().await;
+    let sess = sessions
+        .get_mut(&id)
+        .ok_or_else(|| AppError::NotFound("Session not found".to_string()))?;
+
+    if sess.status != "active" {
+        return Err(AppError::Conflict(format!("Session {} is not active", id)));
+    }
+    let pid = sess.pid.ok_or_else(|| {
+        AppError::NotFound("Session PID not found (session might have exited)".to_string())
+    })?;
+
+    let signal = crate::handlers::process::parse_signal(Some(&req.signal))?;
+    signal_session_group(pid, signal)
+        .map_err(|e| AppError::InternalServerError(format!("Failed to signal session: {}", e)))?;
+    sess.last_used_at = std::time::SystemTime::now();
+
+    Ok(Json(ApiResponse::success(SessionOperationResponse {
+        success: true,
+    })))
+}
+
 pub async fn terminate_session(
     State(state): State<Arc<AppState>>,
     Path(id): Path<String>,
@@ -370,12 +975,10 @@ pub async fn terminate_session(
         .ok_or_else(|| AppError::NotFound("Session not found".to_string()))?;
 
     if let Some(pid) = sess.pid {
-        nix::sys::signal::kill(
-            nix::unistd::Pid::from_raw(pid as i32),
-            nix::sys::signal::Signal::SIGKILL,
-        )
-        .map_err(|e| AppError::InternalServerError(format!("Failed to kill session: {}", e)))?;
+        signal_session_group(pid, nix::sys::signal::Signal::SIGKILL)
+            .map_err(|e| AppError::InternalServerError(format!("Failed to kill session: {}", e)))?;
         sess.status = "terminated".to_string();
+        sess.termination_reason = Some("requested".to_string());
     } else {
         return Err(AppError::NotFound(
             "Session PID not found (session might have exited)".to_string(),
@@ -437,4 +1040,201 @@ mod tests {
         assert!(json.contains("\"shell\":\"/bin/bash\""));
         assert!(json.contains("\"cwd\":\"/home/devbox/project\""));
     }
+
+    #[test]
+    fn test_check_shell() {
+        assert!(check_shell("/bin/sh", None).is_ok());
+        assert!(check_shell("sh", Some("/nonexistent:/bin")).is_ok());
+        assert!(matches!(
+            check_shell("sh", Some("/nonexistent")),
+            Err(AppError::Validation(_))
+        ));
+        assert!(matches!(
+            check_shell("/nonexistent/shell", None),
+            Err(AppError::Validation(_))
+        ));
+        // Exists but is a directory
+        assert!(matches!(
+            check_shell("/bin", None),
+            Err(AppError::Validation(_))
+        ));
+    }
+
+    #[test]
+    fn test_split_exit_marker() {
+        assert_eq!(split_exit_marker("hello\n"), ("hello\n", None));
+        assert_eq!(
+            split_exit_marker("__DEVBOX_EXIT_ab__ 0\n"),
+            ("", Some("__DEVBOX_EXIT_ab__ 0\n"))
+        );
+        assert_eq!(
+            split_exit_marker("no newline__DEVBOX_EXIT_ab__ 2\n"),
+            ("no newline", Some("__DEVBOX_EXIT_ab__ 2\n"))
+        );
+    }
+
+    #[tokio::test]
+    async fn test_exec_output_collect() {
+        let (logs, mut logs_rx) = broadcast::channel(16);
+        let (markers, mut markers_rx) = broadcast::channel(16);
+        let marker = "__DEVBOX_EXIT_ab__";
+
+        logs.send("[exec] ls".to_string()).unwrap();
+        logs.send("[stdout] a\n".to_string()).unwrap();
+        logs.send("[stderr] oops\n".to_string()).unwrap();
+        markers
+            .send("[stdout] __DEVBOX_EXIT_old__ 0".to_string())
+            .unwrap();
+        markers.send(format!("[stdout] {} 3", marker)).unwrap();
+        markers.send(format!("[stderr] {}", marker)).unwrap();
+
+        let mut output = ExecOutput::default();
+        output.collect(&mut logs_rx, &mut markers_rx, marker).await;
+        assert_eq!(output.stdout, "a\n");
+        assert_eq!(output.stderr, "oops\n");
+        assert_eq!(output.exit_code, Some(3));
+    }
+
+    #[test]
+    fn test_export_command_escaping() {
+        assert_eq!(export_command("FOO", "bar").unwrap(), "export FOO=bar\n");
+        assert_eq!(
+            export_command("FOO", "a b; rm -rf /").unwrap(),
+            "export FOO='a b; rm -rf /'\n"
+        );
+        assert!(export_command("FOO=1;", "x").is_err());
+        assert!(export_command("1FOO", "x").is_err());
+        assert!(export_command("", "x").is_err());
+        assert!(export_command("FOO", "a\0b").is_err());
+        assert_eq!(unset_command("FOO").unwrap(), "unset FOO\n");
+        assert!(unset_command("FOO; rm -rf /").is_err());
+    }
+
+    #[test]
+    fn test_scoped_env_commands() {
+        let env = std::collections::HashMap::from([
+            ("TOKEN".to_string(), "a'b $(id)".to_string()),
+            ("HOME".to_string(), "/tmp".to_string()),
+            ("EMPTY".to_string(), "set".to_string()),
+        ]);
+        let (setup, restore) = scoped_env_commands(&env).unwrap();
+        let script = format!(
+            "EMPTY=\nHOME='/home/my dir'\nunset TOKEN\n{}{}",
+            exec_script(
+                "echo \"during $HOME $TOKEN $EMPTY\"",
+                "__DEVBOX_EXIT_ab__",
+                &setup,
+                &restore
+            ),
+            "echo \"after $HOME ${TOKEN-unset} ${EMPTY+set}:$EMPTY\"\nset | grep -c __devbox_saved_ || true\n",
+        );
+
+        let output = std::process::Command::new("sh")
+            .arg("-c")
+            .arg(&script)
+            .output()
+            .unwrap();
+        let stdout = String::from_utf8(output.stdout).unwrap();
+        let lines: Vec<_> = stdout.lines().collect();
+        assert_eq!(lines[0], "during /tmp a'b $(id) set");
+        assert_eq!(lines[1], "__DEVBOX_EXIT_ab__ 0");
+        // Inherited values are back, including an empty one
+        assert_eq!(lines[2], "after /home/my dir unset set:");
+        assert_eq!(lines[3], "0");
+
+        let bad = std::collections::HashMap::from([("A;B".to_string(), String::new())]);
+        assert!(scoped_env_commands(&bad).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_idle_session_terminated_with_children() {
+        let dir = std::env::temp_dir().join(format!("idle-session-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let mut config = crate::config::Config::load();
+        config.workspace_path = dir.clone();
+        let state = Arc::new(AppState::new(config));
+
+        let req = serde_json::from_value(serde_json::json!({ "shell": "/bin/sh" })).unwrap();
+        let Json(created) = create_session(State(state.clone()), Json(req))
+            .await
+            .unwrap();
+        let id = created.data.session_id;
+        write_session_input(&state, &id, b"sleep 30 & echo $! > child.pid\n")
+            .await
+            .unwrap();
+        let mut child_pid = None;
+        for _ in 0..50 {
+            if let Ok(pid) = std::fs::read_to_string(dir.join("child.pid")) {
+                if pid.ends_with('\n') {
+                    child_pid = Some(pid.trim().parse::<i32>().unwrap());
+                    break;
+                }
+            }
+            tokio::time::sleep(std::time::Duration::from_millis(100)).await;
+        }
+        let child_pid = child_pid.expect("the shell started sleep");
+
+        // Recently used sessions are left alone
+        let idle_timeout = std::time::Duration::from_secs(60);
+        terminate_idle_sessions(&state.sessions, idle_timeout).await;
+        assert_eq!(state.sessions.read().await[&id].status, "active");
+
+        if let Some(sess) = state.sessions.write().await.get_mut(&id) {
+            sess.last_used_at = std::time::SystemTime::now() - 2 * idle_timeout;
+        }
+        terminate_idle_sessions(&state.sessions, idle_timeout).await;
+        {
+            let sessions = state.sessions.read().await;
+            assert_eq!(sessions[&id].status, "terminated");
+            assert_eq!(
+                sessions[&id].termination_reason.as_deref(),
+                Some("idle_timeout")
+            );
+        }
+
+        // The background job went down with the shell. It is not our child, so
+        // it may linger as a zombie until init reaps it.
+        let mut gone = false;
+        for _ in 0..50 {
+            let stat = std::fs::read_to_string(format!("/proc/{}/stat", child_pid));
+            if stat.map_or(true, |stat| stat.contains(") Z ")) {
+                gone = true;
+                break;
+            }
+            tokio::time::sleep(std::time::Duration::from_millis(100)).await;
+        }
+        std::fs::remove_dir_all(&dir).unwrap();
+        assert!(gone, "the session's background job outlived it");
+    }
+
+    #[tokio::test]
+    async fn test_session_exec_audits_env() {
+        let audit_log = std::env::temp_dir().join(format!("session-audit-{}", std::process::id()));
+        let mut config = crate::config::Config::load();
+        config.audit_log = Some(audit_log.clone());
+        let state = Arc::new(AppState::new(config));
+
+        let req = serde_json::from_value(serde_json::json!({
+            "command": "echo $GREETING",
+            "env": { "GREETING": "hello", "API_TOKEN": "secret" },
+        }))
+        .unwrap();
+        // The command is audited before the session is looked up
+        let result = session_exec(
+            State(state),
+            Path("missing".to_string()),
+            AuditContext::default(),
+            Json(req),
+        )
+        .await;
+        assert!(matches!(result, Err(AppError::NotFound(_))));
+
+        let log = std::fs::read_to_string(&audit_log).unwrap();
+        std::fs::remove_file(&audit_log).unwrap();
+        let entry: serde_json::Value = serde_json::from_str(log.trim()).unwrap();
+        assert_eq!(entry["kind"], "session-exec");
+        assert_eq!(entry["sessionId"], "missing");
+        assert_eq!(entry["env"]["GREETING"], "hello");
+        assert_eq!(entry["env"]["API_TOKEN"], "[REDACTED]");
+    }
 }
@@ -1,16 +1,26 @@
+use crate::audit::{AuditContext, AuditEntry};
+use crate::middleware::cors::origin_allowed;
 use crate::state::AppState;
 use axum::{
     extract::{
         ws::{Message, WebSocket, WebSocketUpgrade},
         State,
     },
-    response::IntoResponse,
+    http::{header, HeaderMap, StatusCode},
+    response::{IntoResponse, Response},
 };
-use futures::{sink::SinkExt, stream::StreamExt};
+use futures::{sink::SinkExt, stream::StreamExt, Sink, Stream};
 use serde::{Deserialize, Serialize};
 use std::collections::HashMap;
+use std::sync::atomic::{AtomicI64, Ordering};
 use std::sync::Arc;
 use std::time::{SystemTime, UNIX_EPOCH};
+use tokio::sync::broadcast::error::RecvError;
+use tokio::sync::mpsc::{self, error::TrySendError};
+use tokio::sync::Notify;
+
+/// Messages queued for one client before its subscriptions fall behind
+const CLIENT_SEND_BUFFER: usize = 100;
 
 #[derive(Deserialize)]
 struct SubscriptionOptions {
@@ -18,17 +28,114 @@ struct SubscriptionOptions {
     levels: Option<Vec<String>>,
     #[serde(default)]
     tail: Option<usize>,
+    /// Only forward log lines whose content matches this pattern
+    #[serde(default, alias = "grep")]
+    pattern: Option<String>,
+    /// Treat `pattern` as a regular expression instead of a literal substring
+    #[serde(default)]
+    regex: bool,
+}
+
+/// Content filter applied to each log line before it is sent to the client.
+#[derive(Clone)]
+enum LogFilter {
+    Substring(String),
+    Regex(regex::Regex),
+}
+
+impl LogFilter {
+    fn from_options(options: Option<&SubscriptionOptions>) -> Result<Option<Self>, String> {
+        let Some(opts) = options else {
+            return Ok(None);
+        };
+        match &opts.pattern {
+            Some(p) if !p.is_empty() => {
+                if opts.regex {
+                    regex::Regex::new(p)
+                        .map(|re| Some(LogFilter::Regex(re)))
+                        .map_err(|e| format!("Invalid pattern: {}", e))
+                } else {
+                    Ok(Some(LogFilter::Substring(p.clone())))
+                }
+            }
+            _ => Ok(None),
+        }
+    }
+
+    fn matches(&self, content: &str) -> bool {
+        match self {
+            LogFilter::Substring(s) => content.contains(s.as_str()),
+            LogFilter::Regex(re) => re.is_match(content),
+        }
+    }
+
+    fn pattern(&self) -> &str {
+        match self {
+            LogFilter::Substring(s) => s,
+            LogFilter::Regex(re) => re.as_str(),
+        }
+    }
+}
+
+fn filter_allows(filter: &Option<LogFilter>, content: &str) -> bool {
+    filter.as_ref().map_or(true, |f| f.matches(content))
+}
+
+/// Level and content filters of one subscription. Shared with the forwarding
+/// task so "modify" can change them without tearing down the subscription.
+struct SubscriptionFilters {
+    levels: Vec<String>,
+    content: Option<LogFilter>,
+}
+
+impl SubscriptionFilters {
+    fn allows(&self, level: &str, content: &str) -> bool {
+        (self.levels.is_empty() || self.levels.iter().any(|l| l == level))
+            && filter_allows(&self.content, content)
+    }
+
+    /// Confirmation payload describing the current filters
+    fn describe(
+        &self,
+    ) -> (
+        HashMap<String, bool>,
+        Option<HashMap<String, serde_json::Value>>,
+    ) {
+        let levels = self.levels.iter().map(|l| (l.clone(), true)).collect();
+        let extra = self.content.as_ref().map(|f| {
+            HashMap::from([
+                ("pattern".to_string(), serde_json::json!(f.pattern())),
+                (
+                    "regex".to_string(),
+                    serde_json::json!(matches!(f, LogFilter::Regex(_))),
+                ),
+            ])
+        });
+        (levels, extra)
+    }
 }
 
 #[derive(Deserialize)]
 struct SubscriptionRequest {
-    action: String, // "subscribe", "unsubscribe", "list"
+    action: String, // "subscribe", "unsubscribe", "modify", "kill", "input", "list", "ping"
     #[serde(default, rename = "type")]
     target_type: Option<String>, // "process", "session"
     #[serde(default, rename = "targetId")]
     target_id: Option<String>,
     #[serde(default)]
     options: Option<SubscriptionOptions>,
+    /// Opaque value echoed back in the "pong" reply
+    #[serde(default)]
+    nonce: Option<serde_json::Value>,
+    /// Signal for the "kill" action (SIGTERM, SIGINT, SIGHUP or SIGKILL)
+    #[serde(default)]
+    signal: Option<String>,
+    /// Raw input for the "input" action
+    #[serde(default)]
+    data: Option<String>,
+    /// Encoding of `data`: "base64" for binary input; plain UTF-8 otherwise
+    #[serde(default)]
+    encoding: Option<String>,
 }
 
 #[derive(Serialize)]
@@ -37,6 +144,7 @@ struct LogEntry {
     level: String,
     content: String,
     timestamp: i64,
+    /// Position of the entry in the target's log buffer
     sequence: i64,
     #[serde(skip_serializing_if = "Option::is_none")]
     source: Option<String>,
@@ -56,6 +164,8 @@ struct LogMessage {
     data_type: String,
     target_id: String,
     log: LogEntry,
+    /// Position among the messages of this subscription, replayed and live
+    /// alike: 0, 1, 2... A gap means messages were dropped.
     sequence: i64,
     #[serde(skip_serializing_if = "Option::is_none")]
     is_history: Option<bool>,
@@ -64,13 +174,19 @@ struct LogMessage {
 #[derive(Serialize)]
 #[serde(rename_all = "camelCase")]
 struct SubscriptionResult {
-    action: String, // "subscribed", "unsubscribed"
+    action: String, // "subscribed", "unsubscribed", "modified", "killed"
     #[serde(rename = "type")]
     target_type: String,
     target_id: String,
     #[serde(skip_serializing_if = "Option::is_none")]
     levels: Option<HashMap<String, bool>>,
     timestamp: i64,
+    /// Number of buffered entries available for `tail` replay
+    #[serde(skip_serializing_if = "Option::is_none")]
+    available_history: Option<usize>,
+    /// Sequence of the newest buffered entry; live entries continue from the next one
+    #[serde(skip_serializing_if = "Option::is_none")]
+    latest_sequence: Option<i64>,
     #[serde(skip_serializing_if = "Option::is_none")]
     extra: Option<HashMap<String, serde_json::Value>>,
 }
@@ -82,6 +198,16 @@ struct ErrorMessage {
     message: String,
 }
 
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct PongMessage {
+    #[serde(rename = "type")]
+    msg_type: String, // "pong"
+    timestamp: i64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    nonce: Option<serde_json::Value>,
+}
+
 #[derive(Serialize)]
 #[serde(rename_all = "camelCase")]
 struct ListMessage {
@@ -100,21 +226,40 @@ struct SubscriptionInfo {
     log_levels: Vec<String>,
     created_at: i64,
     active: bool,
+    /// Sequence the next log message of the subscription will carry
+    next_sequence: i64,
 }
 
 struct ActiveSubscriptionEntry {
     info: SubscriptionInfo,
+    filters: Arc<std::sync::RwLock<SubscriptionFilters>>,
+    /// Shared with the forwarding task, which numbers the live messages
+    next_sequence: Arc<AtomicI64>,
     handle: tokio::task::JoinHandle<()>,
 }
 
+/// Upgrade to a WebSocket. Browsers always send `Origin`, so a page from an
+/// origin not in `WS_ALLOWED_ORIGINS` is refused before the upgrade; clients
+/// that send no `Origin` are not browsers and are let through.
 pub async fn ws_handler(
     ws: WebSocketUpgrade,
     State(state): State<Arc<AppState>>,
-) -> impl IntoResponse {
-    ws.on_upgrade(|socket| handle_socket(socket, state))
+    audit: AuditContext,
+    headers: HeaderMap,
+) -> Response {
+    if let Some(origin) = headers.get(header::ORIGIN) {
+        let allowed = origin
+            .to_str()
+            .is_ok_and(|o| origin_allowed(&state.config.ws_allowed_origins, o));
+        if !allowed {
+            return (StatusCode::FORBIDDEN, "WebSocket origin not allowed").into_response();
+        }
+    }
+    ws.on_upgrade(|socket| handle_socket(socket, state, audit))
 }
 
-fn parse_log_entry(raw_log: &str) -> (String, String) {
+/// Split a raw buffered log line into its level and content.
+pub(crate) fn parse_log_entry(raw_log: &str) -> (String, String) {
     if raw_log.starts_with("[stdout] ") {
         ("stdout".to_string(), raw_log[9..].to_string())
     } else if raw_log.starts_with("[stderr] ") {
@@ -136,9 +281,61 @@ fn parse_log_entry(raw_log: &str) -> (String, String) {
     }
 }
 
-async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
-    let (mut sender, mut receiver) = socket.split();
-    let (tx, mut rx) = tokio::sync::mpsc::channel::<String>(100);
+/// Queue a live message for the client, returning false once it is gone.
+///
+/// By default a full queue makes the subscription wait; meanwhile its
+/// broadcast receiver drops the oldest entries, which shows up as a gap in
+/// the message sequence. With `disconnect_when_full` the client is flagged
+/// through `overflowed` instead, and the connection is closed.
+async fn queue_live(
+    tx: &mpsc::Sender<String>,
+    msg: String,
+    disconnect_when_full: bool,
+    overflowed: &Notify,
+) -> bool {
+    if !disconnect_when_full {
+        return tx.send(msg).await.is_ok();
+    }
+    match tx.try_send(msg) {
+        Ok(()) => true,
+        Err(TrySendError::Full(_)) => {
+            overflowed.notify_one();
+            false
+        }
+        Err(TrySendError::Closed(_)) => false,
+    }
+}
+
+/// Next message of an optional event channel; never resolves without one.
+async fn next_event(
+    events: &mut Option<tokio::sync::broadcast::Receiver<String>>,
+) -> Option<String> {
+    match events {
+        Some(rx) => rx.recv().await.ok(),
+        None => std::future::pending().await,
+    }
+}
+
+async fn handle_socket(socket: WebSocket, state: Arc<AppState>, audit: AuditContext) {
+    let (sender, receiver) = socket.split();
+    serve_client(sender, receiver, state, audit).await;
+}
+
+/// Answer the requests of one client until it leaves or the server shuts
+/// down. Takes the two halves of the socket so tests can drive it directly.
+async fn serve_client<S, R>(
+    mut sender: S,
+    mut receiver: R,
+    state: Arc<AppState>,
+    audit: AuditContext,
+) where
+    S: Sink<Message> + Unpin + Send + 'static,
+    R: Stream<Item = Result<Message, axum::Error>> + Unpin,
+{
+    let _client = state.metrics.track_websocket();
+    let (tx, mut rx) = mpsc::channel::<String>(CLIENT_SEND_BUFFER);
+    let disconnect_slow = state.config.ws_disconnect_slow_clients;
+    let overflowed = Arc::new(Notify::new());
 
     // Keep track of active subscriptions for this client
     // Key: "type:target_id"
@@ -153,8 +350,21 @@ async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
         }
     });
 
-    // Handle incoming messages
-    while let Some(Ok(msg)) = receiver.next().await {
+    let mut shutdown = state.shutdown.subscribe();
+
+    // Handle incoming messages until the client leaves or the server shuts down
+    loop {
+        let msg = tokio::select! {
+            msg = receiver.next() => match msg {
+                Some(Ok(msg)) => msg,
+                _ => break,
+            },
+            _ = shutdown.wait_for(|&stopping| stopping) => break,
+            _ = overflowed.notified() => {
+                println!("Closing WebSocket client that is not reading its messages");
+                break;
+            }
+        };
         if let Message::Text(text) = msg {
             if let Ok(req) = serde_json::from_str::<SubscriptionRequest>(&text) {
                 let timestamp = SystemTime::now()
@@ -189,23 +399,54 @@ async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
                             .and_then(|o| o.levels.clone())
                             .unwrap_or_default();
                         let tail = req.options.as_ref().and_then(|o| o.tail).unwrap_or(0);
+                        let filters = match LogFilter::from_options(req.options.as_ref()) {
+                            Ok(content) => SubscriptionFilters {
+                                levels: levels.clone(),
+                                content,
+                            },
+                            Err(message) => {
+                                let _ = tx
+                                    .send(
+                                        serde_json::to_string(&ErrorMessage {
+                                            status: 1400,
+                                            message,
+                                        })
+                                        .unwrap(),
+                                    )
+                                    .await;
+                                continue;
+                            }
+                        };
+
+                        // Replayed and live messages share one numbering
+                        let next_sequence = Arc::new(AtomicI64::new(0));
+
+                        // Replayed entries are collected under the log lock, which also
+                        // covers the broadcast subscription so nothing is missed or
+                        // repeated, and sent once it is released: a slow client must
+                        // not hold up the process writing its output.
+                        let mut history = Vec::new();
 
                         // Subscribe logic
                         let broadcast_rx = match target_type.as_str() {
                             "process" => {
                                 let processes = state_clone.processes.read().await;
                                 if let Some(proc) = processes.get(&target_id) {
-                                    // Send historical logs if requested
+                                    let logs = proc.logs.read().await;
+                                    // Evicted lines keep their numbers, so entries carry
+                                    // the same sequence as the SSE stream and log search
+                                    let first =
+                                        proc.log_start_sequence.load(Ordering::Relaxed) as i64;
+                                    // Replay buffered logs if requested
                                     if tail > 0 {
-                                        let logs = proc.logs.read().await;
                                         let start_idx = if logs.len() > tail {
                                             logs.len() - tail
                                         } else {
                                             0
                                         };
-                                        for (i, log) in logs.iter().skip(start_idx).enumerate() {
+                                        for (i, log) in logs.iter().enumerate().skip(start_idx) {
                                             let (level, content) = parse_log_entry(log);
-                                            if !levels.is_empty() && !levels.contains(&level) {
+                                            if !filters.allows(&level, &content) {
                                                 continue;
                                             }
 
@@ -217,20 +458,26 @@ async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
                                                     level,
                                                     content,
                                                     timestamp, // Historical logs use current time for now as we don't store timestamp per log line
-                                                    sequence: i as i64,
+                                                    sequence: first + i as i64,
                                                     source: None,
                                                     target_id: Some(target_id.clone()),
                                                     target_type: Some(target_type.clone()),
                                                     message: None,
                                                 },
-                                                sequence: i as i64,
+                                                sequence: next_sequence
+                                                    .fetch_add(1, Ordering::Relaxed),
                                                 is_history: Some(true),
                                             })
                                             .unwrap();
-                                            let _ = tx_clone.send(msg).await;
+                                            history.push(msg);
                                         }
                                     }
-                                    Some(proc.log_broadcast.subscribe())
+                                    Some((
+                                        proc.log_broadcast.subscribe(),
+                                        first,
+                                        logs.len(),
+                                        Some(proc.events.subscribe()),
+                                    ))
                                 } else {
                                     None
                                 }
@@ -238,17 +485,17 @@ async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
                             "session" => {
                                 let sessions = state_clone.sessions.read().await;
                                 if let Some(sess) = sessions.get(&target_id) {
-                                    // Send historical logs if requested
+                                    let logs = sess.logs.read().await;
+                                    // Replay buffered logs if requested
                                     if tail > 0 {
-                                        let logs = sess.logs.read().await;
                                         let start_idx = if logs.len() > tail {
                                             logs.len() - tail
                                         } else {
                                             0
                                         };
-                                        for (i, log) in logs.iter().skip(start_idx).enumerate() {
+                                        for (i, log) in logs.iter().enumerate().skip(start_idx) {
                                             let (level, content) = parse_log_entry(log);
-                                            if !levels.is_empty() && !levels.contains(&level) {
+                                            if !filters.allows(&level, &content) {
                                                 continue;
                                             }
 
@@ -266,25 +513,41 @@ async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
                                                     target_type: Some(target_type.clone()),
                                                     message: None,
                                                 },
-                                                sequence: i as i64,
+                                                sequence: next_sequence
+                                                    .fetch_add(1, Ordering::Relaxed),
                                                 is_history: Some(true),
                                             })
                                             .unwrap();
-                                            let _ = tx_clone.send(msg).await;
+                                            history.push(msg);
                                         }
                                     }
-                                    Some(sess.log_broadcast.subscribe())
+                                    Some((sess.log_broadcast.subscribe(), 0, logs.len(), None))
                                 } else {
                                     None
                                 }
                             }
+                            "upload" => Some((
+                                crate::state::upload::subscribe(&state_clone.uploads, &target_id)
+                                    .await,
+                                0,
+                                0,
+                                None,
+                            )),
                             _ => None,
                         };
 
-                        if let Some(mut rx) = broadcast_rx {
+                        if let Some((mut rx, first_sequence, available_history, mut events)) =
+                            broadcast_rx
+                        {
+                            for msg in history {
+                                let _ = tx.send(msg).await;
+                            }
                             let target_type_inner = target_type.clone();
                             let target_id_inner = target_id.clone();
-                            let levels_inner = levels.clone();
+                            let filters = Arc::new(std::sync::RwLock::new(filters));
+                            let filters_inner = filters.clone();
+                            let next_sequence_inner = next_sequence.clone();
+                            let overflowed_inner = overflowed.clone();
 
                             // We need a way to stop this task when unsubscribed.
                             // For now, we rely on the channel being closed or the client disconnecting.
@@ -303,12 +566,65 @@ async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
                             // This is a limitation of the current Rust implementation structure compared to Go's centralized manager.
                             // We will accept this for now as it matches the previous behavior, just with better data format.
 
+                            let upload_guard = (target_type == "upload").then(|| {
+                                crate::state::upload::SubscriptionGuard::new(
+                                    &state_clone.uploads,
+                                    &target_id,
+                                )
+                            });
+
                             let handle = tokio::spawn(async move {
-                                let mut sequence = 0;
-                                while let Ok(log) = rx.recv().await {
+                                let _upload_guard = upload_guard;
+                                // Live entries continue the buffer's sequence numbering
+                                let mut entry_sequence = first_sequence + available_history as i64;
+                                loop {
+                                    let log = tokio::select! {
+                                        log = rx.recv() => match log {
+                                            Ok(log) => log,
+                                            // Too slow to keep up: skip the missed entries and
+                                            // leave a gap so the client can tell
+                                            Err(RecvError::Lagged(missed)) => {
+                                                entry_sequence += missed as i64;
+                                                next_sequence_inner
+                                                    .fetch_add(missed as i64, Ordering::Relaxed);
+                                                continue;
+                                            }
+                                            Err(RecvError::Closed) => break,
+                                        },
+                                        // Process events are already serialized
+                                        // messages and bypass the log filters
+                                        Some(event) = next_event(&mut events) => {
+                                            if !queue_live(&tx_clone, event, disconnect_slow, &overflowed_inner).await {
+                                                break;
+                                            }
+                                            continue;
+                                        }
+                                    };
+
+                                    // Upload progress events are already serialized messages
+                                    if target_type_inner == "upload" {
+                                        if !queue_live(
+                                            &tx_clone,
+                                            log,
+                                            disconnect_slow,
+                                            &overflowed_inner,
+                                        )
+                                        .await
+                                        {
+                                            break;
+                                        }
+                                        continue;
+                                    }
+
                                     let (level, content) = parse_log_entry(&log);
+                                    let sequence = entry_sequence;
+                                    entry_sequence += 1;
 
-                                    if !levels_inner.is_empty() && !levels_inner.contains(&level) {
+                                    let allowed = filters_inner
+                                        .read()
+                                        .map(|f| f.allows(&level, &content))
+                                        .unwrap_or(true);
+                                    if !allowed {
                                         continue;
                                     }
 
@@ -332,18 +648,28 @@ async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
                                             target_type: Some(target_type_inner.clone()),
                                             message: None,
                                         },
-                                        sequence,
+                                        sequence: next_sequence_inner
+                                            .fetch_add(1, Ordering::Relaxed),
                                         is_history: Some(false),
                                     })
                                     .unwrap();
 
-                                    if tx_clone.send(msg).await.is_err() {
+                                    if !queue_live(
+                                        &tx_clone,
+                                        msg,
+                                        disconnect_slow,
+                                        &overflowed_inner,
+                                    )
+                                    .await
+                                    {
                                         break;
                                     }
-                                    sequence += 1;
                                 }
                             });
 
+                            let (levels_map, extra) =
+                                filters.read().map(|f| f.describe()).unwrap_or_default();
+
                             // Add to active subscriptions
                             active_subscriptions.insert(
                                 sub_key.clone(),
@@ -355,16 +681,15 @@ async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
                                         log_levels: levels.clone(),
                                         created_at: timestamp,
                                         active: true,
+                                        next_sequence: 0,
                                     },
+                                    filters,
+                                    next_sequence,
                                     handle,
                                 },
                             );
 
                             // Send confirmation
-                            let mut levels_map = HashMap::new();
-                            for l in levels {
-                                levels_map.insert(l, true);
-                            }
 
                             let _ = tx
                                 .send(
@@ -374,7 +699,11 @@ async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
                                         target_id: target_id.clone(),
                                         levels: Some(levels_map),
                                         timestamp,
-                                        extra: None,
+                                        available_history: Some(available_history),
+                                        latest_sequence: Some(
+                                            first_sequence + available_history as i64 - 1,
+                                        ),
+                                        extra,
                                     })
                                     .unwrap(),
                                 )
@@ -391,6 +720,16 @@ async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
                                 )
                                 .await;
                         }
+                    } else {
+                        let _ = tx
+                            .send(
+                                serde_json::to_string(&ErrorMessage {
+                                    status: 1400,
+                                    message: "type and targetId are required".to_string(),
+                                })
+                                .unwrap(),
+                            )
+                            .await;
                     }
                 } else if req.action == "unsubscribe" {
                     if let (Some(target_type), Some(target_id)) =
@@ -407,6 +746,8 @@ async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
                                         target_id: target_id.clone(),
                                         levels: None,
                                         timestamp,
+                                        available_history: None,
+                                        latest_sequence: None,
                                         extra: None,
                                     })
                                     .unwrap(),
@@ -423,11 +764,229 @@ async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
                                 )
                                 .await;
                         }
+                    } else {
+                        let _ = tx
+                            .send(
+                                serde_json::to_string(&ErrorMessage {
+                                    status: 1400,
+                                    message: "type and targetId are required".to_string(),
+                                })
+                                .unwrap(),
+                            )
+                            .await;
+                    }
+                } else if req.action == "modify" {
+                    if let (Some(target_type), Some(target_id)) =
+                        (req.target_type.clone(), req.target_id.clone())
+                    {
+                        let sub_key = format!("{}:{}", target_type, target_id);
+                        let Some(entry) = active_subscriptions.get_mut(&sub_key) else {
+                            let _ = tx
+                                .send(
+                                    serde_json::to_string(&ErrorMessage {
+                                        status: 1404,
+                                        message: "Subscription not found".to_string(),
+                                    })
+                                    .unwrap(),
+                                )
+                                .await;
+                            continue;
+                        };
+
+                        // Omitted fields keep their current value; an empty
+                        // pattern clears the content filter
+                        let content = match req.options.as_ref() {
+                            Some(opts) if opts.pattern.is_some() => {
+                                match LogFilter::from_options(Some(opts)) {
+                                    Ok(f) => Some(f),
+                                    Err(message) => {
+                                        let _ = tx
+                                            .send(
+                                                serde_json::to_string(&ErrorMessage {
+                                                    status: 1400,
+                                                    message,
+                                                })
+                                                .unwrap(),
+                                            )
+                                            .await;
+                                        continue;
+                                    }
+                                }
+                            }
+                            _ => None,
+                        };
+                        let levels = req.options.as_ref().and_then(|o| o.levels.clone());
+
+                        let (levels_map, extra) = {
+                            let mut filters = match entry.filters.write() {
+                                Ok(f) => f,
+                                Err(poisoned) => poisoned.into_inner(),
+                            };
+                            if let Some(levels) = levels {
+                                filters.levels = levels;
+                            }
+                            if let Some(content) = content {
+                                filters.content = content;
+                            }
+                            entry.info.log_levels = filters.levels.clone();
+                            filters.describe()
+                        };
+
+                        let _ = tx
+                            .send(
+                                serde_json::to_string(&SubscriptionResult {
+                                    action: "modified".to_string(),
+                                    target_type,
+                                    target_id,
+                                    levels: Some(levels_map),
+                                    timestamp,
+                                    available_history: None,
+                                    latest_sequence: None,
+                                    extra,
+                                })
+                                .unwrap(),
+                            )
+                            .await;
+                    } else {
+                        let _ = tx
+                            .send(
+                                serde_json::to_string(&ErrorMessage {
+                                    status: 1400,
+                                    message: "type and targetId are required".to_string(),
+                                })
+                                .unwrap(),
+                            )
+                            .await;
+                    }
+                } else if req.action == "kill" {
+                    let Some(target_id) = req.target_id.clone() else {
+                        let _ = tx
+                            .send(
+                                serde_json::to_string(&ErrorMessage {
+                                    status: 1400,
+                                    message: "targetId is required".to_string(),
+                                })
+                                .unwrap(),
+                            )
+                            .await;
+                        continue;
+                    };
+
+                    // Only processes this connection is watching can be killed
+                    let sub_key = format!("process:{}", target_id);
+                    let result = if state.config.read_only {
+                        Err(crate::middleware::read_only::read_only_error())
+                    } else if active_subscriptions.contains_key(&sub_key) {
+                        crate::handlers::process::signal_process(
+                            &state,
+                            &target_id,
+                            req.signal.as_deref(),
+                        )
+                        .await
+                    } else {
+                        Err(crate::error::AppError::Forbidden(
+                            "Not subscribed to this process".to_string(),
+                        ))
+                    };
+
+                    // Only known signal names get this far
+                    let signal = req.signal.as_deref().unwrap_or("SIGKILL");
+                    let msg = match result {
+                        Ok(()) => serde_json::to_string(&SubscriptionResult {
+                            action: "killed".to_string(),
+                            target_type: "process".to_string(),
+                            target_id,
+                            levels: None,
+                            timestamp,
+                            available_history: None,
+                            latest_sequence: None,
+                            extra: Some(HashMap::from([(
+                                "signal".to_string(),
+                                serde_json::json!(signal),
+                            )])),
+                        }),
+                        Err(e) => serde_json::to_string(&ErrorMessage {
+                            status: e.status() as u16,
+                            message: e.message().to_string(),
+                        }),
+                    };
+                    let _ = tx.send(msg.unwrap()).await;
+                } else if req.action == "input" {
+                    let Some(target_id) = req.target_id.clone() else {
+                        let _ = tx
+                            .send(
+                                serde_json::to_string(&ErrorMessage {
+                                    status: 1400,
+                                    message: "targetId is required".to_string(),
+                                })
+                                .unwrap(),
+                            )
+                            .await;
+                        continue;
+                    };
+
+                    // Keystrokes are only accepted for sessions this connection
+                    // is watching, so the client sees the output they produce
+                    let sub_key = format!("session:{}", target_id);
+                    let data = req.data.unwrap_or_default();
+                    let input = if req.encoding.as_deref() == Some("base64") {
+                        use base64::{engine::general_purpose, Engine as _};
+                        general_purpose::STANDARD.decode(&data).map_err(|e| {
+                            crate::error::AppError::BadRequest(format!("Invalid base64: {}", e))
+                        })
+                    } else {
+                        Ok(data.into_bytes())
+                    };
+                    let result = if state.config.read_only {
+                        Err(crate::middleware::read_only::read_only_error())
+                    } else if !active_subscriptions.contains_key(&sub_key) {
+                        Err(crate::error::AppError::Forbidden(
+                            "Not subscribed to this session".to_string(),
+                        ))
+                    } else {
+                        match input {
+                            Ok(bytes) => {
+                                // Keystrokes run commands too, so they are audited
+                                state
+                                    .audit
+                                    .record(
+                                        AuditEntry::new(
+                                            "session-input",
+                                            &String::from_utf8_lossy(&bytes),
+                                            &audit,
+                                        )
+                                        .session_id(&target_id),
+                                    )
+                                    .await;
+                                crate::handlers::session::write_session_input(
+                                    &state, &target_id, &bytes,
+                                )
+                                .await
+                            }
+                            Err(e) => Err(e),
+                        }
+                    };
+
+                    // Successful writes are not acknowledged; their effect
+                    // arrives as session output
+                    if let Err(e) = result {
+                        let _ = tx
+                            .send(
+                                serde_json::to_string(&ErrorMessage {
+                                    status: e.status() as u16,
+                                    message: e.message().to_string(),
+                                })
+                                .unwrap(),
+                            )
+                            .await;
                     }
                 } else if req.action == "list" {
                     let subscriptions: Vec<SubscriptionInfo> = active_subscriptions
                         .values()
-                        .map(|s| s.info.clone())
+                        .map(|s| SubscriptionInfo {
+                            next_sequence: s.next_sequence.load(Ordering::Relaxed),
+                            ..s.info.clone()
+                        })
                         .collect();
 
                     let _ = tx
@@ -439,10 +998,229 @@ async fn handle_socket(socket: WebSocket, state: Arc<AppState>) {
                             .unwrap(),
                         )
                         .await;
+                } else if req.action == "ping" {
+                    let _ = tx
+                        .send(
+                            serde_json::to_string(&PongMessage {
+                                msg_type: "pong".to_string(),
+                                timestamp,
+                                nonce: req.nonce,
+                            })
+                            .unwrap(),
+                        )
+                        .await;
+                } else {
+                    let _ = tx
+                        .send(
+                            serde_json::to_string(&ErrorMessage {
+                                status: 1400,
+                                message: format!("Unknown action: {}", req.action),
+                            })
+                            .unwrap(),
+                        )
+                        .await;
                 }
             }
         }
     }
 
+    // Subscriptions that never receive anything would otherwise wait forever
+    for (_, entry) in active_subscriptions.drain() {
+        entry.handle.abort();
+    }
     send_task.abort();
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::state::process::ProcessInfo;
+    use futures::channel::mpsc::{unbounded, UnboundedReceiver, UnboundedSender};
+    use serde_json::json;
+    use std::time::Duration;
+
+    /// A client talking to `serve_client` without a real socket.
+    struct TestClient {
+        requests: UnboundedSender<Result<Message, axum::Error>>,
+        replies: UnboundedReceiver<Message>,
+    }
+
+    impl TestClient {
+        fn connect(state: Arc<AppState>) -> Self {
+            let (requests, receiver) = unbounded();
+            let (sender, replies) = unbounded();
+            tokio::spawn(serve_client(
+                sender,
+                receiver,
+                state,
+                AuditContext::default(),
+            ));
+            TestClient { requests, replies }
+        }
+
+        /// Send `request` and return the first message that follows.
+        async fn request(&mut self, request: serde_json::Value) -> serde_json::Value {
+            self.requests
+                .unbounded_send(Ok(Message::Text(request.to_string().into())))
+                .unwrap();
+            self.next().await
+        }
+
+        async fn next(&mut self) -> serde_json::Value {
+            let msg = tokio::time::timeout(Duration::from_secs(5), self.replies.next())
+                .await
+                .expect("no message from the server")
+                .expect("the server closed the connection");
+            match msg {
+                Message::Text(text) => serde_json::from_str(text.as_str()).unwrap(),
+                other => panic!("unexpected message: {:?}", other),
+            }
+        }
+    }
+
+    /// Register process "p1" without a child. Its buffer holds `lines`, the
+    /// first of them numbered `first` as if older lines had been evicted.
+    async fn process_with_logs(first: u64, lines: &[&str]) -> Arc<AppState> {
+        let state = Arc::new(AppState::new(crate::config::Config::load()));
+        let req = serde_json::from_value(json!({ "command": "true" })).unwrap();
+        let tx = tokio::sync::broadcast::channel(100).0;
+        let info = ProcessInfo::new("p1".to_string(), None, "true".to_string(), None, tx, req);
+        info.log_start_sequence.store(first, Ordering::Relaxed);
+        info.logs
+            .write()
+            .await
+            .extend(lines.iter().map(|l| format!("[stdout] {}", l)));
+        state.processes.write().await.insert("p1".to_string(), info);
+        state
+    }
+
+    /// Append a line to "p1" the way the output pump does.
+    async fn log_line(state: &AppState, line: &str) {
+        let processes = state.processes.read().await;
+        let proc = processes.get("p1").unwrap();
+        let line = format!("[stdout] {}", line);
+        let mut logs = proc.logs.write().await;
+        logs.push_back(line.clone());
+        let _ = proc.log_broadcast.send(line);
+    }
+
+    #[tokio::test]
+    async fn test_subscribe_sequencing() {
+        let state = process_with_logs(2, &["three", "four", "five"]).await;
+        let mut client = TestClient::connect(state.clone());
+
+        // Replayed entries come first and keep their log sequence
+        let msg = client
+            .request(json!({
+                "action": "subscribe",
+                "type": "process",
+                "targetId": "p1",
+                "options": { "tail": 2 },
+            }))
+            .await;
+        assert_eq!(msg["log"]["content"], "four");
+        assert_eq!(msg["log"]["sequence"], 3);
+        assert_eq!(msg["sequence"], 0);
+        assert_eq!(msg["isHistory"], true);
+        let msg = client.next().await;
+        assert_eq!(msg["log"]["content"], "five");
+        assert_eq!(msg["log"]["sequence"], 4);
+        assert_eq!(msg["sequence"], 1);
+
+        let ack = client.next().await;
+        assert_eq!(ack["action"], "subscribed");
+        assert_eq!(ack["availableHistory"], 3);
+        assert_eq!(ack["latestSequence"], 4);
+
+        // Live entries continue both numberings
+        log_line(&state, "six").await;
+        let msg = client.next().await;
+        assert_eq!(msg["log"]["content"], "six");
+        assert_eq!(msg["log"]["sequence"], 5);
+        assert_eq!(msg["sequence"], 2);
+        assert_eq!(msg["isHistory"], false);
+    }
+
+    #[tokio::test]
+    async fn test_process_exit_event() {
+        let state = process_with_logs(0, &[]).await;
+        let mut client = TestClient::connect(state.clone());
+        let ack = client
+            .request(json!({
+                "action": "subscribe",
+                "type": "process",
+                "targetId": "p1",
+                "options": { "levels": ["stderr"] },
+            }))
+            .await;
+        assert_eq!(ack["action"], "subscribed");
+
+        // Level filters do not apply to events
+        if let Some(proc) = state.processes.write().await.get_mut("p1") {
+            proc.status = "completed".to_string();
+            proc.exit_code = Some(0);
+            proc.broadcast_event("process_exit");
+        }
+        let event = client.next().await;
+        assert_eq!(event["type"], "process_exit");
+        assert_eq!(event["targetId"], "p1");
+        assert_eq!(event["status"], "completed");
+        assert_eq!(event["exitCode"], 0);
+    }
+
+    #[tokio::test]
+    async fn test_kill_and_modify_need_subscription() {
+        let state = process_with_logs(0, &[]).await;
+        let mut client = TestClient::connect(state);
+
+        let kill = json!({ "action": "kill", "targetId": "p1" });
+        let modify = json!({
+            "action": "modify",
+            "type": "process",
+            "targetId": "p1",
+            "options": { "levels": ["stderr"] },
+        });
+        assert_eq!(client.request(kill.clone()).await["status"], 1403);
+        assert_eq!(client.request(modify.clone()).await["status"], 1404);
+
+        let ack = client
+            .request(json!({ "action": "subscribe", "type": "process", "targetId": "p1" }))
+            .await;
+        assert_eq!(ack["action"], "subscribed");
+
+        // Past the subscription check; "p1" has no PID to signal
+        let reply = client.request(kill).await;
+        assert_eq!(reply["status"], 1404, "{}", reply);
+        let reply = client.request(modify).await;
+        assert_eq!(reply["action"], "modified");
+        assert_eq!(reply["levels"], json!({ "stderr": true }));
+    }
+
+    #[tokio::test]
+    async fn test_malformed_requests_get_errors() {
+        let state = process_with_logs(0, &[]).await;
+        let mut client = TestClient::connect(state);
+
+        let reply = client.request(json!({ "action": "shout" })).await;
+        assert_eq!(reply["status"], 1400);
+        assert_eq!(reply["message"], "Unknown action: shout");
+
+        for request in [
+            json!({ "action": "kill" }),
+            json!({ "action": "input", "data": "ls\n" }),
+            json!({ "action": "subscribe", "type": "process" }),
+            json!({ "action": "unsubscribe", "targetId": "p1" }),
+            json!({ "action": "modify" }),
+        ] {
+            let reply = client.request(request.clone()).await;
+            assert_eq!(reply["status"], 1400, "{}: {}", request, reply);
+        }
+
+        // The connection stays usable
+        let pong = client
+            .request(json!({ "action": "ping", "nonce": 7 }))
+            .await;
+        assert_eq!(pong["type"], "pong");
+        assert_eq!(pong["nonce"], 7);
+    }
+}
@@ -1,11 +1,14 @@
+mod audit;
 mod config;
 mod error;
 mod handlers;
 mod middleware;
 mod monitor;
+mod openapi;
 mod response;
 mod router;
 mod state;
+mod tls;
 mod utils;
 
 use std::net::SocketAddr;
@@ -33,6 +36,42 @@ async fn main() {
         println!("    --workspace-path=<PATH>     Sets the base workspace directory. [env: WORKSPACE_PATH] [default: /home/devbox/project]");
         println!("    --max-file-size=<BYTES>     Sets the maximum file size for uploads in bytes. [env: MAX_FILE_SIZE] [default: 104857600]");
         println!("    --token=<TOKEN>             Sets the authentication token. [env: TOKEN / DEVBOX_JWT_SECRET] [default: a random token if not provided]");
+        println!("    --default-shell=<PATH>      Sets the shell used for new sessions. [env: DEFAULT_SHELL] [default: /bin/bash]");
+        println!("    --read-only                 Rejects all mutating requests. [env: READ_ONLY] [default: false]");
+        println!("    --temp-dir=<PATH>           Sets the directory for temporary upload files. [env: TEMP_DIR] [default: next to the destination]");
+        println!("    --audit-log=<PATH>          Appends an audit record of every executed command to this file. [env: AUDIT_LOG] [default: disabled]");
+        println!("    --default-exec-path=<PATH>  Sets the PATH for executed commands. [env: DEFAULT_EXEC_PATH] [default: the server's PATH]");
+        println!("    --max-traversal-depth=<N>   Sets the maximum directory depth for recursive operations. [env: MAX_TRAVERSAL_DEPTH] [default: 64]");
+        println!("    --response-envelope=<BOOL>  Wraps successful JSON responses in the status envelope. [env: RESPONSE_ENVELOPE] [default: true]");
+        println!("    --coalesce-reads=<BOOL>     Shares results between identical concurrent stat/hash requests. [env: COALESCE_READS] [default: true]");
+        println!("    --max-batch-files=<N>       Sets the maximum number of files per batch upload. [env: MAX_BATCH_FILES] [default: 1000]");
+        println!("    --max-batch-size=<BYTES>    Sets the maximum combined size of a batch upload. [env: MAX_BATCH_SIZE] [default: 1073741824]");
+        println!("    --max-upload-concurrency=<N> Sets how many batch upload files are finalized in parallel. [env: MAX_UPLOAD_CONCURRENCY] [default: 4]");
+        println!("    --max-body-size=<BYTES>     Sets the maximum request body size, except for file uploads. [env: MAX_BODY_SIZE] [default: 2097152]");
+        println!("    --max-read-size=<BYTES>     Sets the maximum file size returned inline by JSON reads. [env: MAX_READ_SIZE] [default: 10485760]");
+        println!("    --tls-cert-file=<PATH>      Serves HTTPS with this PEM certificate chain. [env: TLS_CERT_FILE] [default: plain HTTP]");
+        println!("    --tls-key-file=<PATH>       Sets the PEM private key for the TLS certificate. [env: TLS_KEY_FILE]");
+        println!("    --client-ca-file=<PATH>     Requires client certificates signed by this PEM CA bundle. [env: CLIENT_CA_FILE] [default: disabled]");
+        println!("    --dedup                     Hardlinks uploads with identical content to one stored copy. [env: DEDUP] [default: false]");
+        println!("    --dedup-dir=<PATH>          Sets where deduplicated blobs are stored, outside the workspace on its filesystem. [env: DEDUP_DIR] [default: .devbox-dedup next to the workspace]");
+        println!("    --read-only-paths=<PATHS>   Comma-separated path prefixes that may be read but not modified. [env: READ_ONLY_PATHS] [default: none]");
+        println!("    --denied-paths=<GLOBS>      Comma-separated workspace path globs no file operation may access. [env: DENIED_PATHS] [default: none]");
+        println!("    --trash-dir=<PATH>          Moves deleted paths into this directory so they can be restored. [env: TRASH_DIR] [default: delete permanently]");
+        println!("    --max-log-lines=<N>         Sets how many output lines are kept per process. [env: MAX_LOG_LINES] [default: 10000]");
+        println!("    --max-log-line-bytes=<BYTES> Truncates longer process output lines. [env: MAX_LOG_LINE_BYTES] [default: 1048576]");
+        println!("    --max-output-bytes=<BYTES>  Sets how much stdout and stderr exec-sync keeps per stream. [env: MAX_OUTPUT_BYTES] [default: 16777216]");
+        println!("    --kill-on-output-limit      Kills exec-sync commands whose output exceeds the limit. [env: KILL_ON_OUTPUT_LIMIT] [default: false]");
+        println!("    --rate-limit=<N>            Limits each client to N requests per second (429 beyond). [env: RATE_LIMIT] [default: unlimited]");
+        println!("    --rate-limit-burst=<N>      Sets how many requests a client may burst above the rate. [env: RATE_LIMIT_BURST] [default: the rate]");
+        println!("    --trust-forwarded-for       Identifies rate-limited clients by X-Forwarded-For. [env: TRUST_FORWARDED_FOR] [default: false]");
+        println!("    --cors-allowed-origins=<ORIGINS> Comma-separated browser origins allowed to call the API (* for any). [env: CORS_ALLOWED_ORIGINS] [default: none]");
+        println!("    --cors-allowed-methods=<METHODS> Methods announced in CORS preflight responses. [env: CORS_ALLOWED_METHODS] [default: GET,POST,PUT,PATCH,DELETE,OPTIONS]");
+        println!("    --ws-allowed-origins=<ORIGINS> Comma-separated origins allowed to open WebSocket connections. [env: WS_ALLOWED_ORIGINS] [default: *]");
+        println!("    --ws-disconnect-slow-clients Closes WebSocket clients whose send queue is full instead of dropping messages. [env: WS_DISCONNECT_SLOW_CLIENTS] [default: false]");
+        println!("    --session-idle-timeout=<SECS> Terminates sessions unused for this many seconds. [env: SESSION_IDLE_TIMEOUT] [default: never]");
+        println!("    --workspace-quota=<BYTES>   Sets how many bytes the workspace may occupy before writes are rejected. [env: WORKSPACE_QUOTA] [default: unlimited]");
+        println!("    --shutdown-timeout=<SECS>   Sets how long in-flight requests may take to finish on shutdown. [env: SHUTDOWN_TIMEOUT] [default: 30]");
+        println!("    --sse-keepalive-interval=<SECS> Sends a keepalive comment on idle SSE streams this often. [env: SSE_KEEPALIVE_INTERVAL] [default: 15]");
         println!();
         println!("    --help                      Prints this help information.");
         println!("    --version                   Prints version information.");
@@ -47,9 +86,59 @@ async fn main() {
     // Initialize logging
     println!("Workspace path: {:?}", config.workspace_path);
 
+    if let Some(temp_dir) = &config.temp_dir {
+        if let Err(e) = std::fs::create_dir_all(temp_dir) {
+            println!("Warning: failed to create temp dir {:?}: {}", temp_dir, e);
+        }
+    }
+
+    let tls_config = match (&config.tls_cert_file, &config.tls_key_file) {
+        (Some(cert), Some(key)) => {
+            match tls::load_server_config(cert, key, config.client_ca_file.as_deref()) {
+                Ok(tls_config) => Some(tls_config),
+                Err(e) => {
+                    eprintln!("Error: {}", e);
+                    process::exit(1);
+                }
+            }
+        }
+        (None, None) if config.client_ca_file.is_none() => None,
+        _ => {
+            eprintln!("Error: TLS requires both TLS_CERT_FILE and TLS_KEY_FILE, and CLIENT_CA_FILE requires TLS");
+            process::exit(1);
+        }
+    };
+
     // Initialize state
     let state = state::AppState::new(config.clone());
 
+    if let Some(store) = state.dedup.clone() {
+        tokio::spawn(async move {
+            let mut interval = tokio::time::interval(utils::dedup::SWEEP_INTERVAL);
+            loop {
+                interval.tick().await;
+                store.sweep().await;
+            }
+        });
+    }
+
+    if let Some(secs) = config.session_idle_timeout {
+        let sessions = state.sessions.clone();
+        let idle_timeout = std::time::Duration::from_secs(secs);
+        tokio::spawn(async move {
+            let mut interval = tokio::time::interval(handlers::session::IDLE_CHECK_INTERVAL);
+            loop {
+                interval.tick().await;
+                handlers::session::terminate_idle_sessions(&sessions, idle_timeout).await;
+            }
+        });
+    }
+
+    let shutdown = state.shutdown.clone();
+    let processes = state.processes.clone();
+    let sessions = state.sessions.clone();
+    let drain_timeout = std::time::Duration::from_secs(config.shutdown_timeout);
+
     // Create router
     let app = router::create_router(state);
 
@@ -58,14 +147,86 @@ async fn main() {
     let listener = tokio::net::TcpListener::bind(addr)
         .await
         .expect("Failed to bind to address");
-    println!("Server running on {}", addr);
-    axum::serve(listener, app)
-        .with_graceful_shutdown(shutdown_signal())
-        .await
-        .expect("Failed to start server");
+
+    let drained = match tls_config {
+        Some(tls_config) => {
+            let listener =
+                tls::TlsListener::new(listener, tls_config).expect("Failed to bind to address");
+            println!(
+                "Server running on {} (TLS{})",
+                addr,
+                if config.client_ca_file.is_some() {
+                    ", client certificates required"
+                } else {
+                    ""
+                }
+            );
+            let server = axum::serve(
+                listener,
+                app.into_make_service_with_connect_info::<SocketAddr>(),
+            )
+            .with_graceful_shutdown(shutdown_signal(shutdown.clone()));
+            drain(server, shutdown.subscribe(), drain_timeout).await
+        }
+        None => {
+            println!("Server running on {}", addr);
+            let server = axum::serve(
+                listener,
+                app.into_make_service_with_connect_info::<SocketAddr>(),
+            )
+            .with_graceful_shutdown(shutdown_signal(shutdown.clone()));
+            drain(server, shutdown.subscribe(), drain_timeout).await
+        }
+    };
+
+    if !handlers::process::shutdown_processes(&processes, handlers::process::SHUTDOWN_GRACE).await {
+        eprintln!("Warning: some processes did not exit after SIGKILL");
+    }
+    handlers::session::terminate_all_sessions(&sessions).await;
+
+    if !drained {
+        eprintln!(
+            "Error: in-flight requests did not finish within {}s",
+            drain_timeout.as_secs()
+        );
+        process::exit(1);
+    }
+    println!("Server stopped");
+}
+
+/// Run the server until it stops. Once shutdown starts, no new connections
+/// are accepted and in-flight requests get `timeout` to finish; returns false
+/// when they did not.
+async fn drain<F>(
+    server: F,
+    mut shutdown: tokio::sync::watch::Receiver<bool>,
+    timeout: std::time::Duration,
+) -> bool
+where
+    F: std::future::IntoFuture<Output = std::io::Result<()>>,
+{
+    let server = server.into_future();
+    tokio::pin!(server);
+    tokio::select! {
+        result = &mut server => {
+            result.expect("Failed to start server");
+            true
+        }
+        _ = shutdown.wait_for(|&stopping| stopping) => {
+            match tokio::time::timeout(timeout, &mut server).await {
+                Ok(result) => {
+                    result.expect("Failed to start server");
+                    true
+                }
+                Err(_) => false,
+            }
+        }
+    }
 }
 
-async fn shutdown_signal() {
+/// Wait for SIGINT or SIGTERM, then tell long-lived handlers (WebSockets, SSE) to
+/// finish so the connections can drain.
+async fn shutdown_signal(shutdown: tokio::sync::watch::Sender<bool>) {
     #[cfg(unix)]
     {
         use tokio::signal::unix::{signal, SignalKind};
@@ -83,6 +244,7 @@ async fn shutdown_signal() {
     }
 
     println!("Shutdown signal received, stopping server...");
+    shutdown.send_replace(true);
 }
 
 async fn wait_for_ctrl_c() {
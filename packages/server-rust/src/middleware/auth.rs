@@ -15,7 +15,16 @@ pub async fn auth_middleware(
 ) -> Result<Response, StatusCode> {
     // Skip auth for health checks
     let path = req.uri().path();
-    if path == "/health" || path == "/health/live" || path == "/health/ready" {
+    if matches!(
+        path,
+        "/health" | "/health/live" | "/health/ready" | "/healthz" | "/readyz"
+    ) {
+        return Ok(next.run(req).await);
+    }
+
+    // With mutual TLS and no token configured the client certificate, verified
+    // during the handshake, is the only credential
+    if state.config.token.is_none() && state.config.client_ca_file.is_some() {
         return Ok(next.run(req).await);
     }
 
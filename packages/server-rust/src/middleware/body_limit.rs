@@ -0,0 +1,39 @@
+use crate::error::AppError;
+use crate::state::AppState;
+use axum::{
+    extract::{Request, State},
+    http::header,
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use std::sync::Arc;
+
+/// Upload routes that stream their bodies to disk and enforce `MAX_FILE_SIZE`
+/// themselves instead of `MAX_BODY_SIZE`.
+const BODY_LIMIT_EXEMPT_ROUTES: &[&str] = &["/api/v1/files/write", "/api/v1/files/batch-upload"];
+
+/// Rejects requests whose declared `Content-Length` exceeds `MAX_BODY_SIZE`
+/// before any of the body is read. Chunked bodies without a length are cut
+/// off at the same limit by the router's `DefaultBodyLimit`.
+pub async fn body_limit_middleware(
+    State(state): State<Arc<AppState>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    if BODY_LIMIT_EXEMPT_ROUTES.contains(&req.uri().path()) {
+        return next.run(req).await;
+    }
+
+    let limit = state.config.max_body_size;
+    let declared = req
+        .headers()
+        .get(header::CONTENT_LENGTH)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.parse::<u64>().ok());
+    if declared.is_some_and(|len| len > limit) {
+        return AppError::BadRequest(format!("Request body exceeds the {} byte limit", limit))
+            .into_response();
+    }
+
+    next.run(req).await
+}
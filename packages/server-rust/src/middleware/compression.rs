@@ -0,0 +1,156 @@
+//! Gzip response compression for clients sending `Accept-Encoding: gzip`.
+
+use axum::{
+    body::{Body, Bytes},
+    extract::Request,
+    http::{header, HeaderValue, Method, StatusCode},
+    middleware::Next,
+    response::Response,
+};
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use futures::StreamExt;
+use std::io::Write;
+
+/// Bodies with a known length below this are sent as is
+const MIN_COMPRESS_SIZE: u64 = 1024;
+
+/// Content types that are already compressed
+const COMPRESSED_CONTENT_TYPES: &[&str] = &["application/gzip", "application/zip"];
+
+/// Compresses response bodies on the fly. Each chunk is flushed as soon as it
+/// is compressed, so streamed responses (SSE, followed logs, chunked output)
+/// still reach the client incrementally. WebSocket upgrades, range responses,
+/// already encoded bodies and compressed archives are passed through.
+pub async fn gzip_middleware(req: Request, next: Next) -> Response {
+    let wants_gzip = req.method() != Method::HEAD
+        && req
+            .headers()
+            .get(header::ACCEPT_ENCODING)
+            .and_then(|v| v.to_str().ok())
+            .is_some_and(accepts_gzip);
+
+    let mut response = next.run(req).await;
+    if !wants_gzip || !should_compress(&response) {
+        return response;
+    }
+
+    let headers = response.headers_mut();
+    headers.remove(header::CONTENT_LENGTH);
+    headers.insert(header::CONTENT_ENCODING, HeaderValue::from_static("gzip"));
+    headers.append(header::VARY, HeaderValue::from_static("Accept-Encoding"));
+
+    response.map(|body| Body::from_stream(gzip_stream(body)))
+}
+
+fn should_compress(response: &Response) -> bool {
+    let status = response.status();
+    if status == StatusCode::SWITCHING_PROTOCOLS
+        || status == StatusCode::NO_CONTENT
+        || status == StatusCode::NOT_MODIFIED
+        || status == StatusCode::PARTIAL_CONTENT
+    {
+        return false;
+    }
+
+    let headers = response.headers();
+    if headers.contains_key(header::CONTENT_ENCODING) || headers.contains_key(header::CONTENT_RANGE)
+    {
+        return false;
+    }
+    let content_type = headers
+        .get(header::CONTENT_TYPE)
+        .and_then(|v| v.to_str().ok())
+        .unwrap_or("");
+    if COMPRESSED_CONTENT_TYPES
+        .iter()
+        .any(|t| content_type.starts_with(t))
+    {
+        return false;
+    }
+    let length = headers
+        .get(header::CONTENT_LENGTH)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.parse::<u64>().ok());
+    !length.is_some_and(|len| len < MIN_COMPRESS_SIZE)
+}
+
+/// Whether an `Accept-Encoding` value allows gzip (`gzip` or `*` without
+/// `q=0`).
+fn accepts_gzip(value: &str) -> bool {
+    value.split(',').any(|item| {
+        let mut parts = item.split(';').map(str::trim);
+        let coding = parts.next().unwrap_or("");
+        let rejected = parts.any(|p| {
+            p.strip_prefix("q=")
+                .and_then(|q| q.parse::<f32>().ok())
+                .is_some_and(|q| q == 0.0)
+        });
+        (coding.eq_ignore_ascii_case("gzip") || coding == "*") && !rejected
+    })
+}
+
+fn gzip_stream(body: Body) -> impl futures::Stream<Item = std::io::Result<Bytes>> {
+    let encoder = GzEncoder::new(Vec::new(), Compression::default());
+    futures::stream::unfold(
+        (body.into_data_stream(), Some(encoder)),
+        |(mut chunks, mut encoder)| async move {
+            let enc = encoder.as_mut()?;
+            loop {
+                match chunks.next().await {
+                    Some(Ok(chunk)) => {
+                        if let Err(e) = enc.write_all(&chunk).and_then(|_| enc.flush()) {
+                            return Some((Err(e), (chunks, None)));
+                        }
+                        let out = std::mem::take(enc.get_mut());
+                        if !out.is_empty() {
+                            return Some((Ok(Bytes::from(out)), (chunks, encoder)));
+                        }
+                    }
+                    Some(Err(e)) => {
+                        return Some((Err(std::io::Error::other(e)), (chunks, None)));
+                    }
+                    None => {
+                        let out = encoder.take()?.finish().map(Bytes::from);
+                        return Some((out, (chunks, None)));
+                    }
+                }
+            }
+        },
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_accepts_gzip() {
+        assert!(accepts_gzip("gzip"));
+        assert!(accepts_gzip("gzip, deflate, br"));
+        assert!(accepts_gzip("br;q=1.0, GZIP;q=0.5"));
+        assert!(accepts_gzip("*"));
+        assert!(!accepts_gzip("gzip;q=0"));
+        assert!(!accepts_gzip("deflate, br"));
+        assert!(!accepts_gzip("identity"));
+    }
+
+    #[tokio::test]
+    async fn test_gzip_stream() {
+        let text = "hello world\n".repeat(200);
+        let body = Body::from(text.clone());
+        let compressed: Vec<u8> = gzip_stream(body)
+            .map(|chunk| chunk.unwrap().to_vec())
+            .concat()
+            .await;
+
+        let mut decoded = String::new();
+        std::io::Read::read_to_string(
+            &mut flate2::read::GzDecoder::new(&compressed[..]),
+            &mut decoded,
+        )
+        .unwrap();
+        assert_eq!(decoded, text);
+        assert!(compressed.len() < text.len());
+    }
+}
@@ -0,0 +1,108 @@
+//! CORS for browser clients calling the API directly (`CORS_ALLOWED_ORIGINS`).
+
+use crate::state::AppState;
+use axum::{
+    extract::{Request, State},
+    http::{header, HeaderValue, Method, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use std::sync::Arc;
+
+/// Request headers allowed when a preflight does not list any
+const DEFAULT_ALLOWED_HEADERS: &str = "Authorization, Content-Type, Accept, Range, Idempotency-Key";
+
+/// Response headers browsers may read besides the CORS-safelisted ones
+const EXPOSED_HEADERS: &str =
+    "Content-Disposition, Content-Range, Content-Length, Retry-After, Idempotent-Replayed, ETag";
+
+/// How long browsers may cache a preflight result, in seconds
+const PREFLIGHT_MAX_AGE: &str = "600";
+
+/// Answers preflight requests and adds CORS headers to responses for allowed
+/// origins. Runs before authentication since browsers send preflights without
+/// credentials. Requests from other origins get no CORS headers, so browsers
+/// block them.
+pub async fn cors_middleware(
+    State(state): State<Arc<AppState>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    let origin = req
+        .headers()
+        .get(header::ORIGIN)
+        .filter(|v| {
+            v.to_str()
+                .is_ok_and(|o| origin_allowed(&state.config.cors_allowed_origins, o))
+        })
+        .cloned();
+    let Some(origin) = origin else {
+        return next.run(req).await;
+    };
+
+    let is_preflight = req.method() == Method::OPTIONS
+        && req
+            .headers()
+            .contains_key(header::ACCESS_CONTROL_REQUEST_METHOD);
+    if is_preflight {
+        let allowed_headers = req
+            .headers()
+            .get(header::ACCESS_CONTROL_REQUEST_HEADERS)
+            .cloned()
+            .unwrap_or(HeaderValue::from_static(DEFAULT_ALLOWED_HEADERS));
+        let methods = state.config.cors_allowed_methods.join(", ");
+
+        let mut response = StatusCode::NO_CONTENT.into_response();
+        let headers = response.headers_mut();
+        headers.insert(header::ACCESS_CONTROL_ALLOW_ORIGIN, origin);
+        headers.insert(header::VARY, HeaderValue::from_static("Origin"));
+        if let Ok(methods) = HeaderValue::from_str(&methods) {
+            headers.insert(header::ACCESS_CONTROL_ALLOW_METHODS, methods);
+        }
+        headers.insert(header::ACCESS_CONTROL_ALLOW_HEADERS, allowed_headers);
+        headers.insert(
+            header::ACCESS_CONTROL_MAX_AGE,
+            HeaderValue::from_static(PREFLIGHT_MAX_AGE),
+        );
+        return response;
+    }
+
+    let mut response = next.run(req).await;
+    let headers = response.headers_mut();
+    headers.insert(header::ACCESS_CONTROL_ALLOW_ORIGIN, origin);
+    headers.append(header::VARY, HeaderValue::from_static("Origin"));
+    headers.insert(
+        header::ACCESS_CONTROL_EXPOSE_HEADERS,
+        HeaderValue::from_static(EXPOSED_HEADERS),
+    );
+    response
+}
+
+/// Whether `origin` matches an allowed origin exactly (ignoring a trailing
+/// slash and case) or `*` is allowed.
+pub(crate) fn origin_allowed(allowed: &[String], origin: &str) -> bool {
+    allowed.iter().any(|a| {
+        a == "*"
+            || a.trim_end_matches('/')
+                .eq_ignore_ascii_case(origin.trim_end_matches('/'))
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_origin_allowed() {
+        let allowed = vec![
+            "https://app.example.com".to_string(),
+            "http://localhost:3000/".to_string(),
+        ];
+        assert!(origin_allowed(&allowed, "https://app.example.com"));
+        assert!(origin_allowed(&allowed, "http://localhost:3000"));
+        assert!(!origin_allowed(&allowed, "https://evil.example.com"));
+        assert!(!origin_allowed(&allowed, "http://app.example.com"));
+        assert!(!origin_allowed(&[], "https://app.example.com"));
+        assert!(origin_allowed(&["*".to_string()], "https://any.example"));
+    }
+}
@@ -0,0 +1,313 @@
+//! `Idempotency-Key` support for the upload routes.
+//!
+//! The first request with a key runs normally; its successful response is
+//! kept for `IDEMPOTENCY_TTL` together with a SHA-256 of the method, URI and
+//! body. A retry with the same key and identical bytes gets the stored
+//! response back (marked with `Idempotent-Replayed: true`) without writing
+//! again. Failed requests are not stored, so they can be retried as usual.
+
+use crate::error::{AppError, ErrorDetails};
+use crate::state::AppState;
+use axum::{
+    body::{to_bytes, Body, Bytes, HttpBody},
+    extract::{Request, State},
+    http::{header, HeaderValue, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use futures::StreamExt;
+use http_body::{Frame, SizeHint};
+use sha2::{Digest, Sha256};
+use std::collections::HashMap;
+use std::pin::Pin;
+use std::sync::{Arc, Mutex};
+use std::task::{ready, Context, Poll};
+use std::time::{Duration, Instant};
+
+/// How long a completed response is replayed for its key
+pub const IDEMPOTENCY_TTL: Duration = Duration::from_secs(60 * 60);
+
+/// Completed responses kept at most; the oldest are dropped first
+const MAX_ENTRIES: usize = 1000;
+
+/// Longest accepted key
+const MAX_KEY_LENGTH: usize = 255;
+
+const IDEMPOTENCY_KEY: &str = "idempotency-key";
+
+/// Set on replayed responses
+const IDEMPOTENT_REPLAYED: &str = "idempotent-replayed";
+
+#[derive(Clone)]
+struct CachedResponse {
+    status: StatusCode,
+    content_type: Option<HeaderValue>,
+    body: Bytes,
+}
+
+impl CachedResponse {
+    fn replay(&self) -> Response {
+        let mut response = (self.status, self.body.clone()).into_response();
+        if let Some(content_type) = &self.content_type {
+            response
+                .headers_mut()
+                .insert(header::CONTENT_TYPE, content_type.clone());
+        }
+        response
+            .headers_mut()
+            .insert(IDEMPOTENT_REPLAYED, HeaderValue::from_static("true"));
+        response
+    }
+}
+
+enum Entry {
+    InFlight,
+    Completed {
+        fingerprint: Vec<u8>,
+        response: CachedResponse,
+        stored: Instant,
+    },
+}
+
+enum Lookup {
+    /// First use of the key; the caller must `complete` or `abandon` it
+    New,
+    InFlight,
+    Completed(Vec<u8>, CachedResponse),
+}
+
+#[derive(Default)]
+pub struct IdempotencyCache {
+    entries: Mutex<HashMap<String, Entry>>,
+}
+
+impl IdempotencyCache {
+    fn begin(&self, key: &str) -> Lookup {
+        let mut entries = self.entries.lock().unwrap();
+        match entries.get(key) {
+            Some(Entry::InFlight) => return Lookup::InFlight,
+            Some(Entry::Completed {
+                fingerprint,
+                response,
+                stored,
+            }) if stored.elapsed() < IDEMPOTENCY_TTL => {
+                return Lookup::Completed(fingerprint.clone(), response.clone());
+            }
+            _ => {}
+        }
+
+        entries.retain(|_, entry| match entry {
+            Entry::InFlight => true,
+            Entry::Completed { stored, .. } => stored.elapsed() < IDEMPOTENCY_TTL,
+        });
+        if entries.len() >= MAX_ENTRIES {
+            let oldest = entries
+                .iter()
+                .filter_map(|(key, entry)| match entry {
+                    Entry::Completed { stored, .. } => Some((*stored, key.clone())),
+                    Entry::InFlight => None,
+                })
+                .min();
+            if let Some((_, key)) = oldest {
+                entries.remove(&key);
+            }
+        }
+        entries.insert(key.to_string(), Entry::InFlight);
+        Lookup::New
+    }
+
+    fn complete(&self, key: &str, fingerprint: Vec<u8>, response: CachedResponse) {
+        self.entries.lock().unwrap().insert(
+            key.to_string(),
+            Entry::Completed {
+                fingerprint,
+                response,
+                stored: Instant::now(),
+            },
+        );
+    }
+
+    fn abandon(&self, key: &str) {
+        let mut entries = self.entries.lock().unwrap();
+        if matches!(entries.get(key), Some(Entry::InFlight)) {
+            entries.remove(key);
+        }
+    }
+}
+
+/// Releases the key when the request fails or is cancelled before it completes
+struct Pending<'a> {
+    cache: &'a IdempotencyCache,
+    key: &'a str,
+}
+
+impl Drop for Pending<'_> {
+    fn drop(&mut self) {
+        self.cache.abandon(self.key);
+    }
+}
+
+/// Request body that hashes its data as the handler reads it, keeping the
+/// size hint that the upload handlers use to reject oversized files early.
+struct HashingBody {
+    inner: Body,
+    hasher: Arc<Mutex<Sha256>>,
+}
+
+impl HttpBody for HashingBody {
+    type Data = Bytes;
+    type Error = axum::Error;
+
+    fn poll_frame(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Option<Result<Frame<Bytes>, axum::Error>>> {
+        let frame = ready!(Pin::new(&mut self.inner).poll_frame(cx));
+        if let Some(Ok(frame)) = &frame {
+            if let Some(data) = frame.data_ref() {
+                self.hasher.lock().unwrap().update(data);
+            }
+        }
+        Poll::Ready(frame)
+    }
+
+    fn is_end_stream(&self) -> bool {
+        self.inner.is_end_stream()
+    }
+
+    fn size_hint(&self) -> SizeHint {
+        self.inner.size_hint()
+    }
+}
+
+/// Replays the stored response of a completed request with the same
+/// `Idempotency-Key`. Requests without the header are passed through.
+pub async fn idempotency_middleware(
+    State(state): State<Arc<AppState>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    let Some(key) = req.headers().get(IDEMPOTENCY_KEY) else {
+        return next.run(req).await;
+    };
+    let key = match key.to_str() {
+        Ok(key) if !key.is_empty() && key.len() <= MAX_KEY_LENGTH => key.to_string(),
+        _ => {
+            return AppError::BadRequest(format!(
+                "Idempotency-Key must be 1 to {} visible ASCII characters",
+                MAX_KEY_LENGTH
+            ))
+            .into_response()
+        }
+    };
+
+    let (parts, body) = req.into_parts();
+    let mut hasher = Sha256::new();
+    hasher.update(parts.method.as_str());
+    hasher.update(b" ");
+    hasher.update(parts.uri.to_string());
+    hasher.update(b"\n");
+
+    let cache = &state.idempotency;
+    match cache.begin(&key) {
+        Lookup::New => {}
+        Lookup::InFlight => {
+            return AppError::Conflict(
+                "A request with this Idempotency-Key is still in progress".to_string(),
+            )
+            .into_response()
+        }
+        Lookup::Completed(fingerprint, response) => {
+            // The retry carries the body again; it has to match the original
+            let mut stream = body.into_data_stream();
+            while let Some(chunk) = stream.next().await {
+                match chunk {
+                    Ok(data) => hasher.update(&data),
+                    Err(e) => return AppError::BadRequest(e.to_string()).into_response(),
+                }
+            }
+            if hasher.finalize().to_vec() != fingerprint {
+                return AppError::Conflict(
+                    "Idempotency-Key was already used for a different request".to_string(),
+                )
+                .into_response();
+            }
+            return response.replay();
+        }
+    }
+
+    let _pending = Pending { cache, key: &key };
+    let hasher = Arc::new(Mutex::new(hasher));
+    let body = Body::new(HashingBody {
+        inner: body,
+        hasher: hasher.clone(),
+    });
+    let response = next.run(Request::from_parts(parts, body)).await;
+    if !response.status().is_success() || response.extensions().get::<ErrorDetails>().is_some() {
+        return response;
+    }
+
+    let (parts, body) = response.into_parts();
+    let bytes = match to_bytes(body, usize::MAX).await {
+        Ok(b) => b,
+        Err(e) => return AppError::InternalServerError(e.to_string()).into_response(),
+    };
+    let fingerprint = hasher.lock().unwrap().clone().finalize().to_vec();
+    cache.complete(
+        &key,
+        fingerprint,
+        CachedResponse {
+            status: parts.status,
+            content_type: parts.headers.get(header::CONTENT_TYPE).cloned(),
+            body: bytes.clone(),
+        },
+    );
+    Response::from_parts(parts, Body::from(bytes))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn cached(body: &'static str) -> CachedResponse {
+        CachedResponse {
+            status: StatusCode::OK,
+            content_type: None,
+            body: Bytes::from_static(body.as_bytes()),
+        }
+    }
+
+    #[test]
+    fn test_cache_lifecycle() {
+        let cache = IdempotencyCache::default();
+        assert!(matches!(cache.begin("a"), Lookup::New));
+        assert!(matches!(cache.begin("a"), Lookup::InFlight));
+
+        // A failed request frees the key for the retry
+        cache.abandon("a");
+        assert!(matches!(cache.begin("a"), Lookup::New));
+
+        cache.complete("a", vec![1], cached("first"));
+        cache.abandon("a");
+        match cache.begin("a") {
+            Lookup::Completed(fingerprint, response) => {
+                assert_eq!(fingerprint, vec![1]);
+                assert_eq!(response.body, "first");
+            }
+            _ => panic!("expected the completed response"),
+        }
+    }
+
+    #[test]
+    fn test_cache_is_bounded() {
+        let cache = IdempotencyCache::default();
+        for i in 0..MAX_ENTRIES + 10 {
+            let key = i.to_string();
+            assert!(matches!(cache.begin(&key), Lookup::New));
+            cache.complete(&key, Vec::new(), cached(""));
+        }
+        assert_eq!(cache.entries.lock().unwrap().len(), MAX_ENTRIES);
+        // The oldest keys were dropped
+        assert!(matches!(cache.begin("0"), Lookup::New));
+    }
+}
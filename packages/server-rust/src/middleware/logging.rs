@@ -1,17 +1,111 @@
-use axum::{extract::Request, middleware::Next, response::Response};
+use axum::{
+    extract::{FromRequestParts, Request},
+    http::{request::Parts, HeaderMap, HeaderValue},
+    middleware::Next,
+    response::Response,
+};
+use std::convert::Infallible;
+use std::fmt::Display;
 use std::time::Instant;
 
-pub async fn logging_middleware(req: Request, next: Next) -> Response {
+/// Header carrying the trace ID, echoed on every response
+const TRACE_ID_HEADER: &str = "x-trace-id";
+
+/// Length of generated trace IDs
+const TRACE_ID_LENGTH: usize = 16;
+
+/// Trace ID of the current request: taken from `X-Trace-ID`, `X-Request-ID`
+/// or a W3C `traceparent` header, or generated when the client sent none.
+/// Extract it in a handler to tag log lines with it.
+#[derive(Debug, Clone)]
+pub struct TraceId(pub String);
+
+impl TraceId {
+    fn from_headers(headers: &HeaderMap) -> Option<Self> {
+        let header = |name: &str| {
+            headers
+                .get(name)
+                .and_then(|v| v.to_str().ok())
+                .map(str::trim)
+                .filter(|v| !v.is_empty())
+        };
+        // W3C traceparent is "version-traceid-parentid-flags"
+        header(TRACE_ID_HEADER)
+            .or_else(|| header("x-request-id"))
+            .or_else(|| header("traceparent").and_then(|v| v.split('-').nth(1)))
+            .map(|id| TraceId(id.to_string()))
+    }
+
+    fn generate() -> Self {
+        TraceId(crate::utils::common::generate_nanoid(TRACE_ID_LENGTH))
+    }
+
+    pub fn as_str(&self) -> &str {
+        &self.0
+    }
+
+    /// Print a log line tagged with the trace ID, in the same format as the
+    /// request log.
+    pub fn log(&self, message: impl Display) {
+        println!("[{}] {}", self.0, message);
+    }
+}
+
+impl<S: Send + Sync> FromRequestParts<S> for TraceId {
+    type Rejection = Infallible;
+
+    async fn from_request_parts(parts: &mut Parts, _state: &S) -> Result<Self, Self::Rejection> {
+        // Set by `logging_middleware`; routers built without it get a fresh ID
+        Ok(parts
+            .extensions
+            .get::<TraceId>()
+            .cloned()
+            .or_else(|| TraceId::from_headers(&parts.headers))
+            .unwrap_or_else(TraceId::generate))
+    }
+}
+
+pub async fn logging_middleware(mut req: Request, next: Next) -> Response {
     let method = req.method().clone();
     let uri = req.uri().clone();
+    let trace_id = TraceId::from_headers(req.headers()).unwrap_or_else(TraceId::generate);
+    req.extensions_mut().insert(trace_id.clone());
     let start = Instant::now();
 
-    let response = next.run(req).await;
+    let mut response = next.run(req).await;
 
     let duration = start.elapsed();
     let status = response.status();
 
-    println!("{} {} {} {:?}", method, uri, status, duration);
+    trace_id.log(format_args!("{} {} {} {:?}", method, uri, status, duration));
 
+    if let Ok(value) = HeaderValue::from_str(trace_id.as_str()) {
+        response.headers_mut().insert(TRACE_ID_HEADER, value);
+    }
     response
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_trace_id_from_headers() {
+        let with = |name: &'static str, value: &'static str| {
+            let mut headers = HeaderMap::new();
+            headers.insert(name, HeaderValue::from_static(value));
+            TraceId::from_headers(&headers).map(|id| id.0)
+        };
+        assert_eq!(with("x-trace-id", "abc"), Some("abc".to_string()));
+        assert_eq!(with("x-request-id", " req-1 "), Some("req-1".to_string()));
+        assert_eq!(
+            with(
+                "traceparent",
+                "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+            ),
+            Some("4bf92f3577b34da6a3ce929d0e0e4736".to_string())
+        );
+        assert_eq!(with("x-trace-id", ""), None);
+        assert_eq!(TraceId::generate().0.len(), TRACE_ID_LENGTH);
+    }
+}
@@ -0,0 +1,264 @@
+//! Prometheus metrics served at `GET /metrics`.
+//!
+//! Requests are labeled with the matched route pattern (`/api/v1/process/{id}/logs`)
+//! rather than the raw path, so ids in paths cannot blow up the number of series.
+
+use crate::state::AppState;
+use axum::{
+    extract::{MatchedPath, Request, State},
+    middleware::Next,
+    response::Response,
+};
+use std::collections::BTreeMap;
+use std::fmt::Write;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+/// Upper bounds of the request duration histogram, in seconds
+const DURATION_BUCKETS: [f64; 11] = [
+    0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0,
+];
+
+/// Route label of requests that matched no route
+const UNMATCHED_ROUTE: &str = "unmatched";
+
+/// Method and route pattern
+type RouteKey = (String, String);
+
+#[derive(Default)]
+struct RouteStats {
+    in_flight: u64,
+    /// Completed requests by HTTP status
+    responses: BTreeMap<u16, u64>,
+    /// Requests per `DURATION_BUCKETS` entry, not cumulative
+    buckets: [u64; DURATION_BUCKETS.len()],
+    duration_sum: f64,
+    duration_count: u64,
+}
+
+#[derive(Default)]
+pub struct Metrics {
+    routes: Mutex<BTreeMap<RouteKey, RouteStats>>,
+    websocket_clients: AtomicUsize,
+}
+
+impl Metrics {
+    fn start(&self, key: &RouteKey) {
+        let mut routes = self.routes.lock().unwrap();
+        routes.entry(key.clone()).or_default().in_flight += 1;
+    }
+
+    fn finish(&self, key: &RouteKey, status: u16, elapsed: Duration) {
+        let mut routes = self.routes.lock().unwrap();
+        let stats = routes.entry(key.clone()).or_default();
+        *stats.responses.entry(status).or_default() += 1;
+        let secs = elapsed.as_secs_f64();
+        if let Some(bucket) = DURATION_BUCKETS.iter().position(|&le| secs <= le) {
+            stats.buckets[bucket] += 1;
+        }
+        stats.duration_sum += secs;
+        stats.duration_count += 1;
+    }
+
+    /// Count a WebSocket client until the returned guard is dropped.
+    pub fn track_websocket(self: &Arc<Self>) -> WebSocketClient {
+        self.websocket_clients.fetch_add(1, Ordering::Relaxed);
+        WebSocketClient(self.clone())
+    }
+
+    /// Everything recorded so far in the Prometheus text format, together
+    /// with the current process and session gauges.
+    pub fn render(&self, running_processes: usize, active_sessions: usize) -> String {
+        let routes = self.routes.lock().unwrap();
+        let mut out = String::new();
+
+        out.push_str("# HELP devbox_http_requests_total Completed HTTP requests.\n");
+        out.push_str("# TYPE devbox_http_requests_total counter\n");
+        for ((method, route), stats) in routes.iter() {
+            for (status, count) in &stats.responses {
+                let _ = writeln!(
+                    out,
+                    "devbox_http_requests_total{{method=\"{}\",route=\"{}\",status=\"{}\"}} {}",
+                    escape_label(method),
+                    escape_label(route),
+                    status,
+                    count
+                );
+            }
+        }
+
+        out.push_str("# HELP devbox_http_request_duration_seconds Time until the response headers were sent.\n");
+        out.push_str("# TYPE devbox_http_request_duration_seconds histogram\n");
+        for ((method, route), stats) in routes.iter() {
+            if stats.duration_count == 0 {
+                continue;
+            }
+            let labels = format!(
+                "method=\"{}\",route=\"{}\"",
+                escape_label(method),
+                escape_label(route)
+            );
+            let mut cumulative = 0;
+            for (le, count) in DURATION_BUCKETS.iter().zip(stats.buckets) {
+                cumulative += count;
+                let _ = writeln!(
+                    out,
+                    "devbox_http_request_duration_seconds_bucket{{{},le=\"{}\"}} {}",
+                    labels, le, cumulative
+                );
+            }
+            let _ = writeln!(
+                out,
+                "devbox_http_request_duration_seconds_bucket{{{},le=\"+Inf\"}} {}",
+                labels, stats.duration_count
+            );
+            let _ = writeln!(
+                out,
+                "devbox_http_request_duration_seconds_sum{{{}}} {}",
+                labels, stats.duration_sum
+            );
+            let _ = writeln!(
+                out,
+                "devbox_http_request_duration_seconds_count{{{}}} {}",
+                labels, stats.duration_count
+            );
+        }
+
+        out.push_str("# HELP devbox_http_requests_in_flight Requests being handled.\n");
+        out.push_str("# TYPE devbox_http_requests_in_flight gauge\n");
+        for ((method, route), stats) in routes.iter() {
+            let _ = writeln!(
+                out,
+                "devbox_http_requests_in_flight{{method=\"{}\",route=\"{}\"}} {}",
+                escape_label(method),
+                escape_label(route),
+                stats.in_flight
+            );
+        }
+
+        let gauges = [
+            (
+                "devbox_processes_running",
+                "Processes still running.",
+                running_processes,
+            ),
+            (
+                "devbox_sessions_active",
+                "Sessions not yet terminated.",
+                active_sessions,
+            ),
+            (
+                "devbox_websocket_clients",
+                "Connected WebSocket clients.",
+                self.websocket_clients.load(Ordering::Relaxed),
+            ),
+        ];
+        for (name, help, value) in gauges {
+            let _ = writeln!(out, "# HELP {} {}", name, help);
+            let _ = writeln!(out, "# TYPE {} gauge", name);
+            let _ = writeln!(out, "{} {}", name, value);
+        }
+        out
+    }
+}
+
+/// Connected WebSocket client, counted until dropped
+pub struct WebSocketClient(Arc<Metrics>);
+
+impl Drop for WebSocketClient {
+    fn drop(&mut self) {
+        self.0.websocket_clients.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+/// Leaves the in-flight gauge even when the request future is dropped
+/// (e.g. the client went away)
+struct InFlight<'a> {
+    metrics: &'a Metrics,
+    key: RouteKey,
+}
+
+impl Drop for InFlight<'_> {
+    fn drop(&mut self) {
+        let mut routes = self.metrics.routes.lock().unwrap();
+        if let Some(stats) = routes.get_mut(&self.key) {
+            stats.in_flight = stats.in_flight.saturating_sub(1);
+        }
+    }
+}
+
+/// Records every request. The duration ends when the response headers are
+/// ready, so streamed bodies (downloads, followed logs) are not included.
+pub async fn metrics_middleware(
+    State(state): State<Arc<AppState>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    let route = req
+        .extensions()
+        .get::<MatchedPath>()
+        .map(|path| path.as_str().to_string())
+        .unwrap_or_else(|| UNMATCHED_ROUTE.to_string());
+    let key = (req.method().to_string(), route);
+
+    state.metrics.start(&key);
+    let in_flight = InFlight {
+        metrics: &state.metrics,
+        key,
+    };
+    let start = Instant::now();
+    let response = next.run(req).await;
+    state
+        .metrics
+        .finish(&in_flight.key, response.status().as_u16(), start.elapsed());
+    response
+}
+
+/// Escape a label value for the text exposition format.
+fn escape_label(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_render() {
+        let metrics = Arc::new(Metrics::default());
+        let key = ("GET".to_string(), "/api/v1/process/{id}/logs".to_string());
+        metrics.start(&key);
+        metrics.finish(&key, 200, Duration::from_millis(30));
+        let client = metrics.track_websocket();
+
+        let text = metrics.render(2, 1);
+        assert!(text.contains(
+            "devbox_http_requests_total{method=\"GET\",route=\"/api/v1/process/{id}/logs\",status=\"200\"} 1\n"
+        ));
+        assert!(text.contains(
+            "devbox_http_request_duration_seconds_bucket{method=\"GET\",route=\"/api/v1/process/{id}/logs\",le=\"0.025\"} 0\n"
+        ));
+        assert!(text.contains(
+            "devbox_http_request_duration_seconds_bucket{method=\"GET\",route=\"/api/v1/process/{id}/logs\",le=\"0.05\"} 1\n"
+        ));
+        assert!(text.contains(
+            "devbox_http_requests_in_flight{method=\"GET\",route=\"/api/v1/process/{id}/logs\"} 1\n"
+        ));
+        assert!(text.contains("devbox_processes_running 2\n"));
+        assert!(text.contains("devbox_websocket_clients 1\n"));
+
+        drop(client);
+        assert!(metrics
+            .render(0, 0)
+            .contains("devbox_websocket_clients 0\n"));
+    }
+
+    #[test]
+    fn test_escape_label() {
+        assert_eq!(escape_label("a\"b\\c\nd"), "a\\\"b\\\\c\\nd");
+    }
+}
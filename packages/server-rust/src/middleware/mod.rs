@@ -1,2 +1,10 @@
 pub mod auth;
+pub mod body_limit;
+pub mod compression;
+pub mod cors;
+pub mod idempotency;
 pub mod logging;
+pub mod metrics;
+pub mod negotiate;
+pub mod rate_limit;
+pub mod read_only;
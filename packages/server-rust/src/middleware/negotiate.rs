@@ -0,0 +1,171 @@
+use crate::error::ErrorDetails;
+use crate::state::AppState;
+use axum::{
+    body::{to_bytes, Body},
+    extract::{Request, State},
+    http::header,
+    middleware::Next,
+    response::Response,
+};
+use std::sync::Arc;
+
+/// Re-renders error responses as plain text when the client prefers `text/plain`
+/// over JSON. Successful responses are passed through untouched.
+pub async fn error_format_middleware(req: Request, next: Next) -> Response {
+    let wants_text = req
+        .headers()
+        .get(header::ACCEPT)
+        .and_then(|v| v.to_str().ok())
+        .map(prefers_plain_text)
+        .unwrap_or(false);
+
+    let response = next.run(req).await;
+    if !wants_text {
+        return response;
+    }
+
+    let Some(details) = response.extensions().get::<ErrorDetails>().cloned() else {
+        return response;
+    };
+
+    let mut text = format!(
+        "status: {}\nmessage: {}\n",
+        details.status as u16, details.message
+    );
+    match &details.data {
+        serde_json::Value::Null => {}
+        serde_json::Value::Object(map) if map.is_empty() => {}
+        data => text.push_str(&format!("data: {}\n", data)),
+    }
+
+    // Keep headers such as Retry-After and WWW-Authenticate
+    let (mut parts, _) = response.into_parts();
+    parts.headers.insert(
+        header::CONTENT_TYPE,
+        header::HeaderValue::from_static("text/plain; charset=utf-8"),
+    );
+    parts.headers.remove(header::CONTENT_LENGTH);
+    Response::from_parts(parts, Body::from(text))
+}
+
+/// Strips the `status`/`message` envelope from successful JSON responses when
+/// the server runs with `RESPONSE_ENVELOPE=false` or the request carries
+/// `?envelope=false`. `?envelope=true` forces the envelope back on. Error
+/// responses always keep the envelope so clients can read the status code.
+pub async fn envelope_middleware(
+    State(state): State<Arc<AppState>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    let envelope = req
+        .uri()
+        .query()
+        .and_then(envelope_query_override)
+        .unwrap_or(state.config.response_envelope);
+
+    let response = next.run(req).await;
+    if envelope || response.extensions().get::<ErrorDetails>().is_some() {
+        return response;
+    }
+
+    let is_json = response
+        .headers()
+        .get(header::CONTENT_TYPE)
+        .and_then(|v| v.to_str().ok())
+        .map(|ct| ct.starts_with("application/json"))
+        .unwrap_or(false);
+    if !is_json {
+        return response;
+    }
+
+    let (mut parts, body) = response.into_parts();
+    let bytes = match to_bytes(body, usize::MAX).await {
+        Ok(b) => b,
+        Err(e) => {
+            println!("Failed to buffer response body: {}", e);
+            return Response::from_parts(parts, Body::empty());
+        }
+    };
+
+    let mut value: serde_json::Value = match serde_json::from_slice(&bytes) {
+        Ok(v) => v,
+        Err(_) => return Response::from_parts(parts, Body::from(bytes)),
+    };
+    let Some(map) = value.as_object_mut() else {
+        return Response::from_parts(parts, Body::from(bytes));
+    };
+    map.remove("status");
+    map.remove("message");
+
+    let raw = serde_json::to_vec(&value).unwrap_or_else(|_| bytes.to_vec());
+    parts.headers.remove(header::CONTENT_LENGTH);
+    Response::from_parts(parts, Body::from(raw))
+}
+
+/// Reads the `envelope` query parameter, if present and valid.
+fn envelope_query_override(query: &str) -> Option<bool> {
+    query
+        .split('&')
+        .map(|pair| pair.split_once('=').unwrap_or((pair, "")))
+        .find(|(key, _)| *key == "envelope")
+        .and_then(|(_, value)| match value {
+            "true" | "1" | "" => Some(true),
+            "false" | "0" => Some(false),
+            _ => None,
+        })
+}
+
+/// Returns true if the Accept header ranks `text/plain` above `application/json`.
+/// JSON stays the default when both are equally acceptable.
+fn prefers_plain_text(accept: &str) -> bool {
+    let mut text_q: f32 = 0.0;
+    let mut json_q: f32 = 0.0;
+
+    for item in accept.split(',') {
+        let mut parts = item.split(';');
+        let media = parts.next().unwrap_or("").trim().to_ascii_lowercase();
+        let q = parts
+            .filter_map(|p| p.trim().strip_prefix("q="))
+            .find_map(|v| v.trim().parse::<f32>().ok())
+            .unwrap_or(1.0);
+
+        match media.as_str() {
+            "text/plain" | "text/*" => text_q = text_q.max(q),
+            "application/json" | "application/*" => json_q = json_q.max(q),
+            "*/*" => {
+                text_q = text_q.max(q);
+                json_q = json_q.max(q);
+            }
+            _ => {}
+        }
+    }
+
+    text_q > json_q
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_prefers_plain_text() {
+        assert!(prefers_plain_text("text/plain"));
+        assert!(prefers_plain_text("text/plain, application/json;q=0.5"));
+        assert!(prefers_plain_text("text/*"));
+        assert!(!prefers_plain_text("application/json"));
+        assert!(!prefers_plain_text("*/*"));
+        assert!(!prefers_plain_text("text/plain, application/json"));
+        assert!(!prefers_plain_text("text/plain;q=0.2, application/json"));
+        assert!(!prefers_plain_text("text/html"));
+    }
+
+    #[test]
+    fn test_envelope_query_override() {
+        assert_eq!(envelope_query_override("envelope=false"), Some(false));
+        assert_eq!(envelope_query_override("path=.&envelope=0"), Some(false));
+        assert_eq!(envelope_query_override("envelope=true"), Some(true));
+        assert_eq!(envelope_query_override("envelope"), Some(true));
+        assert_eq!(envelope_query_override("path=."), None);
+        assert_eq!(envelope_query_override("envelope=maybe"), None);
+    }
+}
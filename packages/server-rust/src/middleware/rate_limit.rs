@@ -0,0 +1,145 @@
+//! Per-client request rate limiting (`RATE_LIMIT`), one token bucket per IP.
+
+use crate::error::AppError;
+use crate::state::AppState;
+use axum::{
+    extract::{ConnectInfo, Request, State},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use std::collections::HashMap;
+use std::net::{IpAddr, SocketAddr};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+/// Routes that are never rate limited, so probes keep working under load
+const RATE_LIMIT_EXEMPT_ROUTES: &[&str] = &[
+    "/health",
+    "/health/live",
+    "/health/ready",
+    "/healthz",
+    "/readyz",
+];
+
+/// Number of tracked clients above which idle (full) buckets are dropped
+const MAX_TRACKED_CLIENTS: usize = 10000;
+
+struct Bucket {
+    tokens: f64,
+    updated: Instant,
+}
+
+pub struct RateLimiter {
+    per_second: f64,
+    burst: f64,
+    trust_forwarded_for: bool,
+    buckets: Mutex<HashMap<IpAddr, Bucket>>,
+}
+
+impl RateLimiter {
+    pub fn new(per_second: f64, burst: u32, trust_forwarded_for: bool) -> Self {
+        Self {
+            per_second,
+            burst: burst.max(1) as f64,
+            trust_forwarded_for,
+            buckets: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Take a token for `client`, or return how long until one is available.
+    fn acquire(&self, client: IpAddr, now: Instant) -> Result<(), Duration> {
+        let mut buckets = self.buckets.lock().unwrap();
+        if buckets.len() >= MAX_TRACKED_CLIENTS && !buckets.contains_key(&client) {
+            buckets.retain(|_, bucket| self.refill(bucket, now) < self.burst);
+        }
+
+        let bucket = buckets.entry(client).or_insert(Bucket {
+            tokens: self.burst,
+            updated: now,
+        });
+        let tokens = self.refill(bucket, now);
+        bucket.updated = now;
+        if tokens >= 1.0 {
+            bucket.tokens = tokens - 1.0;
+            Ok(())
+        } else {
+            bucket.tokens = tokens;
+            Err(Duration::from_secs_f64((1.0 - tokens) / self.per_second))
+        }
+    }
+
+    /// Tokens in `bucket` at `now`
+    fn refill(&self, bucket: &Bucket, now: Instant) -> f64 {
+        let elapsed = now.saturating_duration_since(bucket.updated).as_secs_f64();
+        (bucket.tokens + elapsed * self.per_second).min(self.burst)
+    }
+
+    /// Client address: the first `X-Forwarded-For` entry when the server runs
+    /// behind a trusted proxy, otherwise the peer address.
+    fn client_ip(&self, req: &Request) -> Option<IpAddr> {
+        if self.trust_forwarded_for {
+            let forwarded = req
+                .headers()
+                .get("x-forwarded-for")
+                .and_then(|v| v.to_str().ok())
+                .and_then(|v| v.split(',').next())
+                .and_then(|v| v.trim().parse().ok());
+            if forwarded.is_some() {
+                return forwarded;
+            }
+        }
+        req.extensions()
+            .get::<ConnectInfo<SocketAddr>>()
+            .map(|ConnectInfo(addr)| addr.ip())
+    }
+}
+
+pub async fn rate_limit_middleware(
+    State(state): State<Arc<AppState>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    let Some(limiter) = &state.rate_limiter else {
+        return next.run(req).await;
+    };
+    if RATE_LIMIT_EXEMPT_ROUTES.contains(&req.uri().path()) {
+        return next.run(req).await;
+    }
+
+    if let Some(client) = limiter.client_ip(&req) {
+        if let Err(wait) = limiter.acquire(client, Instant::now()) {
+            return AppError::TooManyRequests(
+                "Rate limit exceeded".to_string(),
+                wait.as_secs_f64().ceil().max(1.0) as u64,
+            )
+            .into_response();
+        }
+    }
+
+    next.run(req).await
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_acquire() {
+        let limiter = RateLimiter::new(2.0, 3, false);
+        let client: IpAddr = "10.0.0.1".parse().unwrap();
+        let other: IpAddr = "10.0.0.2".parse().unwrap();
+        let start = Instant::now();
+
+        for _ in 0..3 {
+            assert!(limiter.acquire(client, start).is_ok());
+        }
+        let wait = limiter.acquire(client, start).unwrap_err();
+        assert_eq!(wait, Duration::from_millis(500));
+        assert!(limiter.acquire(other, start).is_ok());
+
+        // Two tokens per second refill
+        let later = start + Duration::from_millis(500);
+        assert!(limiter.acquire(client, later).is_ok());
+        assert!(limiter.acquire(client, later).is_err());
+    }
+}
@@ -0,0 +1,60 @@
+use crate::error::AppError;
+use crate::state::AppState;
+use axum::{
+    extract::{Request, State},
+    http::Method,
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use std::sync::Arc;
+
+/// Non-GET routes that do not modify the workspace and stay available in
+/// read-only mode. Everything else that is not GET/HEAD/OPTIONS is rejected,
+/// so new mutating endpoints are covered by default.
+const READ_ONLY_SAFE_ROUTES: &[&str] = &[
+    "/api/v1/files/batch-download",
+    "/api/v1/files/batch-download/estimate",
+    "/api/v1/files/search",
+    "/api/v1/files/find",
+    "/api/v1/files/grep",
+];
+
+/// Rejection of a mutating request, also used by WebSocket actions, which
+/// do not pass through this middleware.
+pub fn read_only_error() -> AppError {
+    AppError::Forbidden("Server is running in read-only mode".to_string())
+}
+
+pub async fn read_only_middleware(
+    State(state): State<Arc<AppState>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    if state.config.read_only && is_mutating(req.method(), req.uri().path()) {
+        return read_only_error().into_response();
+    }
+
+    next.run(req).await
+}
+
+fn is_mutating(method: &Method, path: &str) -> bool {
+    if *method == Method::GET || *method == Method::HEAD || *method == Method::OPTIONS {
+        return false;
+    }
+    !READ_ONLY_SAFE_ROUTES.contains(&path)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_is_mutating() {
+        assert!(!is_mutating(&Method::GET, "/api/v1/files/read"));
+        assert!(!is_mutating(&Method::POST, "/api/v1/files/search"));
+        assert!(!is_mutating(&Method::POST, "/api/v1/files/grep"));
+        assert!(is_mutating(&Method::POST, "/api/v1/files/write"));
+        assert!(is_mutating(&Method::POST, "/api/v1/process/exec"));
+        assert!(is_mutating(&Method::DELETE, "/api/v1/anything"));
+    }
+}
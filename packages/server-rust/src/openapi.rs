@@ -0,0 +1,432 @@
+//! OpenAPI description generated from the request and response types.
+//!
+//! The paths come from the routes the router registered and the schemas from
+//! the `JsonSchema` derives of the handler types, which honour the same serde
+//! attributes (`rename`, `default`, `skip_serializing_if`, ...) the handlers
+//! use, so field names and optionality cannot drift from what the server
+//! actually accepts. Doc comments on the fields become their descriptions.
+
+use crate::handlers::{file, process, session};
+use crate::router::RouteInfo;
+use schemars::{generate::SchemaSettings, JsonSchema, Schema, SchemaGenerator};
+use serde_json::{json, Map, Value};
+
+type SchemaFn = fn(&mut SchemaGenerator) -> Schema;
+
+/// Input and output types of a route. Routes without an entry are described
+/// by their path and method only.
+pub struct Operation {
+    pub method: &'static str,
+    pub path: &'static str,
+    /// JSON request body
+    body: Option<SchemaFn>,
+    /// Query string parameters
+    query: Option<SchemaFn>,
+    /// Fields of a successful response next to `status` and `message`
+    response: Option<SchemaFn>,
+}
+
+impl Operation {
+    fn new(method: &'static str, path: &'static str) -> Self {
+        Self {
+            method,
+            path,
+            body: None,
+            query: None,
+            response: None,
+        }
+    }
+
+    fn body<T: JsonSchema>(mut self) -> Self {
+        self.body = Some(SchemaGenerator::subschema_for::<T>);
+        self
+    }
+
+    /// Query parameters are listed one by one, so the struct is inlined
+    fn query<T: JsonSchema>(mut self) -> Self {
+        self.query = Some(T::json_schema);
+        self
+    }
+
+    fn response<T: JsonSchema>(mut self) -> Self {
+        self.response = Some(SchemaGenerator::subschema_for::<T>);
+        self
+    }
+}
+
+pub fn operations() -> Vec<Operation> {
+    use file::{batch, info, io, list, search, stale, trash, types, usage};
+
+    vec![
+        // File routes
+        Operation::new("GET", "/api/v1/files/list").query::<list::ListFilesParams>(),
+        Operation::new("GET", "/api/v1/files/read").query::<io::ReadFileParams>(),
+        Operation::new("GET", "/api/v1/files/download").query::<io::ReadFileParams>(),
+        Operation::new("POST", "/api/v1/files/delete")
+            .body::<io::DeleteFileRequest>()
+            .response::<io::DeleteFileResponse>(),
+        Operation::new("POST", "/api/v1/files/restore")
+            .body::<trash::RestoreRequest>()
+            .response::<trash::RestoreResponse>(),
+        Operation::new("POST", "/api/v1/files/write")
+            .body::<io::WriteFileRequest>()
+            .response::<types::WriteFileResponse>(),
+        Operation::new("POST", "/api/v1/files/patch")
+            .body::<io::PatchFileRequest>()
+            .response::<types::WriteFileResponse>(),
+        Operation::new("POST", "/api/v1/files/batch-download")
+            .body::<batch::DownloadFilesRequest>(),
+        Operation::new("POST", "/api/v1/files/batch-download/estimate")
+            .body::<batch::DownloadFilesRequest>(),
+        Operation::new("GET", "/api/v1/files/manifest").query::<batch::DownloadManifestParams>(),
+        Operation::new("POST", "/api/v1/files/move")
+            .body::<io::MoveFileRequest>()
+            .response::<types::FileOperationResponse>(),
+        Operation::new("POST", "/api/v1/files/batch-move")
+            .body::<io::BatchMoveRequest>()
+            .response::<io::BatchMoveResponse>(),
+        Operation::new("POST", "/api/v1/files/copy")
+            .body::<io::CopyFileRequest>()
+            .response::<io::CopyFileResponse>(),
+        Operation::new("POST", "/api/v1/files/rename")
+            .body::<io::RenameFileRequest>()
+            .response::<types::FileOperationResponse>(),
+        Operation::new("POST", "/api/v1/files/chmod")
+            .body::<file::perm::ChmodRequest>()
+            .response::<types::FileOperationResponse>(),
+        Operation::new("POST", "/api/v1/files/search")
+            .body::<search::SearchRequest>()
+            .response::<search::SearchResponse>(),
+        Operation::new("POST", "/api/v1/files/find")
+            .body::<search::FindRequest>()
+            .response::<search::FindResponse>(),
+        Operation::new("POST", "/api/v1/files/grep")
+            .body::<search::GrepRequest>()
+            .response::<search::GrepResponse>(),
+        Operation::new("POST", "/api/v1/files/replace")
+            .body::<search::ReplaceRequest>()
+            .response::<search::ReplaceResponse>(),
+        Operation::new("GET", "/api/v1/files/stale")
+            .query::<stale::StaleFilesParams>()
+            .response::<stale::StaleFilesResponse>(),
+        Operation::new("POST", "/api/v1/files/stale/delete")
+            .body::<stale::StaleFilesParams>()
+            .response::<stale::StaleFilesResponse>(),
+        Operation::new("GET", "/api/v1/files/stat").query::<info::FileInfoParams>(),
+        Operation::new("GET", "/api/v1/files/hash").query::<info::HashFileParams>(),
+        Operation::new("GET", "/api/v1/files/usage").query::<usage::DiskUsageParams>(),
+        // Process routes
+        Operation::new("POST", "/api/v1/process/exec")
+            .body::<process::ExecProcessRequest>()
+            .response::<process::ExecProcessResponse>(),
+        Operation::new("POST", "/api/v1/process/exec-sync")
+            .query::<process::SyncExecutionParams>()
+            .body::<process::SyncExecutionRequest>()
+            .response::<process::SyncExecutionResponse>(),
+        Operation::new("POST", "/api/v1/process/sync-stream")
+            .body::<process::SyncStreamExecutionRequest>(),
+        Operation::new("POST", "/api/v1/process/run-script")
+            .body::<process::RunScriptRequest>()
+            .response::<process::SyncExecutionResponse>(),
+        Operation::new("GET", "/api/v1/process/logs/stream")
+            .query::<process::MergedLogStreamParams>(),
+        Operation::new("GET", "/api/v1/process/status").query::<process::ProcessPidParams>(),
+        Operation::new("POST", "/api/v1/process/{id}/stdin")
+            .body::<process::ProcessStdinRequest>()
+            .response::<process::ProcessStdinResponse>(),
+        Operation::new("POST", "/api/v1/process/{id}/restart")
+            .response::<process::ExecProcessResponse>(),
+        Operation::new("GET", "/api/v1/process/{id}/logs/search")
+            .query::<process::LogSearchParams>(),
+        // Session routes
+        Operation::new("POST", "/api/v1/sessions/create")
+            .body::<session::CreateSessionRequest>()
+            .response::<session::CreateSessionResponse>(),
+        Operation::new("GET", "/api/v1/sessions/{id}/env")
+            .response::<session::SessionEnvResponse>(),
+        Operation::new("POST", "/api/v1/sessions/{id}/env")
+            .body::<session::UpdateSessionEnvRequest>()
+            .response::<session::SessionOperationResponse>(),
+        Operation::new("POST", "/api/v1/sessions/{id}/env/replace")
+            .body::<session::UpdateSessionEnvRequest>()
+            .response::<session::SessionOperationResponse>(),
+        Operation::new("POST", "/api/v1/sessions/{id}/exec")
+            .body::<session::SessionExecRequest>()
+            .response::<session::SessionExecResponse>(),
+        Operation::new("POST", "/api/v1/sessions/{id}/cd")
+            .body::<session::SessionCdRequest>()
+            .response::<session::SessionCdResponse>(),
+        Operation::new("POST", "/api/v1/sessions/{id}/signal")
+            .body::<session::SessionSignalRequest>()
+            .response::<session::SessionOperationResponse>(),
+        Operation::new("POST", "/api/v1/sessions/{id}/terminate")
+            .response::<session::SessionOperationResponse>(),
+    ]
+}
+
+/// Build the OpenAPI 3.1 document describing `routes`.
+pub fn document(routes: &[RouteInfo]) -> Value {
+    let mut settings = SchemaSettings::draft2020_12();
+    settings.definitions_path = "/components/schemas".into();
+    let mut generator = settings.into_generator();
+    let operations = operations();
+
+    let mut paths = Map::new();
+    // HEAD is answered by every GET route and needs no entry of its own
+    for route in routes.iter().filter(|route| route.method != "HEAD") {
+        let (path, path_params) = openapi_path(&route.path);
+        let mut parameters: Vec<Value> = path_params
+            .into_iter()
+            .map(|name| {
+                json!({
+                    "name": name,
+                    "in": "path",
+                    "required": true,
+                    "schema": { "type": "string" },
+                })
+            })
+            .collect();
+
+        let mut entry = Map::new();
+        let mut data = None;
+        let operation = operations
+            .iter()
+            .find(|op| op.method == route.method && op.path == route.path);
+        if let Some(op) = operation {
+            if let Some(query) = op.query {
+                parameters.extend(query_parameters(query(&mut generator).to_value()));
+            }
+            if let Some(body) = op.body {
+                entry.insert(
+                    "requestBody".to_string(),
+                    json!({
+                        "required": true,
+                        "content": {
+                            "application/json": { "schema": body(&mut generator).to_value() },
+                        },
+                    }),
+                );
+            }
+            data = op
+                .response
+                .map(|response| response(&mut generator).to_value());
+        }
+        if !parameters.is_empty() {
+            entry.insert("parameters".to_string(), Value::Array(parameters));
+        }
+        entry.insert("responses".to_string(), responses(data));
+
+        if let Value::Object(methods) = paths
+            .entry(path)
+            .or_insert_with(|| Value::Object(Map::new()))
+        {
+            methods.insert(route.method.to_lowercase(), Value::Object(entry));
+        }
+    }
+
+    let mut schemas = generator.definitions().clone();
+    schemas.insert(
+        "ApiResponse".to_string(),
+        json!({
+            "type": "object",
+            "properties": {
+                "status": {
+                    "type": "integer",
+                    "description": "0 on success, otherwise the error code",
+                },
+                "message": { "type": "string" },
+            },
+            "required": ["status"],
+        }),
+    );
+
+    json!({
+        "openapi": "3.1.0",
+        "info": {
+            "title": "DevBox SDK Server API",
+            "version": env!("CARGO_PKG_VERSION"),
+        },
+        "paths": paths,
+        "components": { "schemas": schemas },
+    })
+}
+
+/// Convert an axum path to OpenAPI syntax (`{*rest}` becomes `{rest}`) and
+/// return it with the names of its parameters.
+fn openapi_path(path: &str) -> (String, Vec<String>) {
+    let mut params = Vec::new();
+    let segments: Vec<String> = path
+        .split('/')
+        .map(|segment| match segment.strip_prefix('{') {
+            Some(param) => {
+                let name = param.trim_end_matches('}').trim_start_matches('*');
+                params.push(name.to_string());
+                format!("{{{}}}", name)
+            }
+            None => segment.to_string(),
+        })
+        .collect();
+    (segments.join("/"), params)
+}
+
+/// One query parameter per property of an inlined struct schema.
+fn query_parameters(schema: Value) -> Vec<Value> {
+    let required: Vec<&str> = schema["required"]
+        .as_array()
+        .map(|names| names.iter().filter_map(|name| name.as_str()).collect())
+        .unwrap_or_default();
+    let Some(properties) = schema["properties"].as_object() else {
+        return Vec::new();
+    };
+
+    properties
+        .iter()
+        .map(|(name, property)| {
+            let mut param = json!({
+                "name": name,
+                "in": "query",
+                "required": required.contains(&name.as_str()),
+                "schema": property,
+            });
+            if let Some(description) = property.get("description") {
+                param["description"] = description.clone();
+            }
+            param
+        })
+        .collect()
+}
+
+/// Success responses carry the route's fields next to the envelope; errors
+/// only the envelope. Routes without a known response type (streams, file
+/// downloads, listings) are left undescribed.
+fn responses(data: Option<Value>) -> Value {
+    let envelope = json!({ "$ref": "#/components/schemas/ApiResponse" });
+    let success = match data {
+        Some(data) => json!({
+            "description": "Success",
+            "content": {
+                "application/json": { "schema": { "allOf": [envelope, data] } },
+            },
+        }),
+        None => json!({ "description": "Success" }),
+    };
+    json!({
+        "200": success,
+        "default": {
+            "description": "Error",
+            "content": { "application/json": { "schema": envelope } },
+        },
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn route(method: &'static str, path: &str) -> RouteInfo {
+        RouteInfo {
+            path: path.to_string(),
+            method,
+        }
+    }
+
+    #[test]
+    fn test_request_schema_follows_serde_attributes() {
+        let doc = document(&[route("POST", "/api/v1/files/write")]);
+
+        let body = &doc["paths"]["/api/v1/files/write"]["post"]["requestBody"];
+        assert_eq!(
+            body["content"]["application/json"]["schema"]["$ref"],
+            "#/components/schemas/WriteFileRequest"
+        );
+
+        let schema = &doc["components"]["schemas"]["WriteFileRequest"];
+        let properties = schema["properties"].as_object().unwrap();
+        // Renamed fields appear under their wire names
+        assert!(properties.contains_key("expectedSha256"));
+        assert!(properties.contains_key("modTime"));
+        assert!(!properties.contains_key("mod_time"));
+        // Doc comments become descriptions
+        assert!(properties["append"]["description"]
+            .as_str()
+            .unwrap()
+            .contains("Append"));
+
+        let required: Vec<&str> = schema["required"]
+            .as_array()
+            .unwrap()
+            .iter()
+            .filter_map(|name| name.as_str())
+            .collect();
+        assert!(required.contains(&"path"));
+        assert!(required.contains(&"content"));
+        assert!(!required.contains(&"encoding"));
+        assert!(!required.contains(&"append"));
+    }
+
+    #[test]
+    fn test_query_and_path_parameters() {
+        let doc = document(&[
+            route("GET", "/api/v1/files/list"),
+            route("HEAD", "/api/v1/files/list"),
+            route("GET", "/api/v1/process/{id}/logs/search"),
+        ]);
+
+        let list = &doc["paths"]["/api/v1/files/list"];
+        assert!(list.get("head").is_none());
+        let names: Vec<&str> = list["get"]["parameters"]
+            .as_array()
+            .unwrap()
+            .iter()
+            .filter_map(|param| param["name"].as_str())
+            .collect();
+        assert!(names.contains(&"showHidden"));
+        assert!(names.contains(&"maxDepth"));
+
+        let params = doc["paths"]["/api/v1/process/{id}/logs/search"]["get"]["parameters"]
+            .as_array()
+            .unwrap();
+        assert!(params
+            .iter()
+            .any(|param| param["name"] == "id" && param["in"] == "path"));
+        assert!(params
+            .iter()
+            .any(|param| param["name"] == "q" && param["required"] == true));
+    }
+
+    #[test]
+    fn test_response_schema_extends_envelope() {
+        let doc = document(&[route("POST", "/api/v1/sessions/create")]);
+
+        let schema = &doc["paths"]["/api/v1/sessions/create"]["post"]["responses"]["200"]
+            ["content"]["application/json"]["schema"];
+        assert_eq!(
+            schema["allOf"][0]["$ref"],
+            "#/components/schemas/ApiResponse"
+        );
+        assert_eq!(
+            schema["allOf"][1]["$ref"],
+            "#/components/schemas/CreateSessionResponse"
+        );
+        assert!(
+            doc["components"]["schemas"]["CreateSessionResponse"]["properties"]
+                .get("sessionId")
+                .is_some()
+        );
+    }
+
+    #[test]
+    fn test_openapi_path() {
+        assert_eq!(
+            openapi_path("/api/v1/sessions/{id}/exec"),
+            (
+                "/api/v1/sessions/{id}/exec".to_string(),
+                vec!["id".to_string()]
+            )
+        );
+        assert_eq!(
+            openapi_path("/static/{*rest}"),
+            ("/static/{rest}".to_string(), vec!["rest".to_string()])
+        );
+    }
+}
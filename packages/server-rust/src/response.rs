@@ -1,3 +1,8 @@
+use axum::{
+    body::Body,
+    http::{header, HeaderMap},
+    response::{IntoResponse, Response},
+};
 use serde::{Serialize, Serializer};
 
 #[derive(Debug, Clone, Copy, PartialEq)]
@@ -11,7 +16,9 @@ pub enum Status {
     Forbidden = 1403,
     InvalidRequest = 1422,
     InternalError = 1500,
+    MethodNotAllowed = 1405,
     Conflict = 1409,
+    TooManyRequests = 1429,
     OperationError = 1600,
 }
 
@@ -50,3 +57,133 @@ impl<T> ApiResponse<T> {
         }
     }
 }
+
+pub const NDJSON_CONTENT_TYPE: &str = "application/x-ndjson";
+
+/// Returns true if the client asked for newline-delimited JSON.
+pub fn wants_ndjson(headers: &HeaderMap) -> bool {
+    headers
+        .get(header::ACCEPT)
+        .and_then(|v| v.to_str().ok())
+        .map(prefers_ndjson)
+        .unwrap_or(false)
+}
+
+/// Returns true if the Accept header names NDJSON as acceptable (q above 0)
+/// and ranks it no lower than JSON. Wildcards never select NDJSON.
+fn prefers_ndjson(accept: &str) -> bool {
+    let mut ndjson_q: f32 = 0.0;
+    let mut json_q: f32 = 0.0;
+
+    for item in accept.split(',') {
+        let mut parts = item.split(';');
+        let media = parts.next().unwrap_or("").trim().to_ascii_lowercase();
+        let q = parts
+            .filter_map(|p| p.trim().strip_prefix("q="))
+            .find_map(|v| v.trim().parse::<f32>().ok())
+            .unwrap_or(1.0);
+
+        match media.as_str() {
+            NDJSON_CONTENT_TYPE => ndjson_q = ndjson_q.max(q),
+            "application/json" => json_q = json_q.max(q),
+            _ => {}
+        }
+    }
+
+    ndjson_q > 0.0 && ndjson_q >= json_q
+}
+
+/// Streams `items` as newline-delimited JSON, one object per line.
+pub fn ndjson_response<T: Serialize>(items: Vec<T>) -> Response {
+    let lines = items.into_iter().filter_map(|item| {
+        serde_json::to_string(&item)
+            .ok()
+            .map(|line| Ok::<_, std::convert::Infallible>(format!("{}\n", line)))
+    });
+    let body = Body::from_stream(futures::stream::iter(lines));
+
+    ([(header::CONTENT_TYPE, NDJSON_CONTENT_TYPE)], body).into_response()
+}
+
+/// Returns true if the request's `If-None-Match` header matches `etag`
+/// (weak comparison, so `W/` prefixes are ignored).
+pub fn if_none_match(headers: &HeaderMap, etag: &str) -> bool {
+    let Some(value) = headers
+        .get(header::IF_NONE_MATCH)
+        .and_then(|v| v.to_str().ok())
+    else {
+        return false;
+    };
+    let strip = |tag: &str| tag.trim().trim_start_matches("W/").to_string();
+    let etag = strip(etag);
+    value
+        .split(',')
+        .any(|candidate| candidate.trim() == "*" || strip(candidate) == etag)
+}
+
+/// Returns true if the request's `If-Modified-Since` header holds a date no
+/// earlier than `modified`, compared in whole seconds like `Last-Modified`.
+/// Unparseable dates are ignored.
+pub fn not_modified_since(headers: &HeaderMap, modified: std::time::SystemTime) -> bool {
+    let Some(since) = headers
+        .get(header::IF_MODIFIED_SINCE)
+        .and_then(|v| v.to_str().ok())
+        .and_then(crate::utils::common::parse_http_date)
+    else {
+        return false;
+    };
+    let secs = |t: std::time::SystemTime| {
+        t.duration_since(std::time::UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0)
+    };
+    secs(modified) <= secs(since)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_if_none_match() {
+        let with = |value: &str| {
+            let mut headers = HeaderMap::new();
+            headers.insert(header::IF_NONE_MATCH, value.parse().unwrap());
+            headers
+        };
+        assert!(if_none_match(&with("\"abc\""), "\"abc\""));
+        assert!(if_none_match(&with("W/\"abc\""), "\"abc\""));
+        assert!(if_none_match(&with("\"x\", \"abc\""), "\"abc\""));
+        assert!(if_none_match(&with("*"), "\"abc\""));
+        assert!(!if_none_match(&with("\"abd\""), "\"abc\""));
+        assert!(!if_none_match(&HeaderMap::new(), "\"abc\""));
+    }
+
+    #[test]
+    fn test_not_modified_since() {
+        let mut headers = HeaderMap::new();
+        headers.insert(
+            header::IF_MODIFIED_SINCE,
+            "Sun, 06 Nov 1994 08:49:37 GMT".parse().unwrap(),
+        );
+        let at = |millis: u64| std::time::UNIX_EPOCH + std::time::Duration::from_millis(millis);
+        // Sub-second precision is lost in Last-Modified
+        assert!(not_modified_since(&headers, at(784111777_500)));
+        assert!(not_modified_since(&headers, at(784111000_000)));
+        assert!(!not_modified_since(&headers, at(784111778_000)));
+        assert!(!not_modified_since(&HeaderMap::new(), at(0)));
+    }
+
+    #[test]
+    fn test_prefers_ndjson() {
+        assert!(prefers_ndjson("application/x-ndjson"));
+        assert!(prefers_ndjson("application/json, application/x-ndjson"));
+        assert!(prefers_ndjson("Application/X-NDJSON;q=0.5"));
+        assert!(!prefers_ndjson("application/x-ndjson;q=0"));
+        assert!(!prefers_ndjson(
+            "application/x-ndjson;q=0.5, application/json"
+        ));
+        assert!(!prefers_ndjson("application/json"));
+        assert!(!prefers_ndjson("*/*"));
+    }
+}
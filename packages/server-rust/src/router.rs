@@ -1,77 +1,308 @@
 use crate::handlers::{file, health, port, process, session, websocket};
-use crate::middleware::{auth, logging};
+use crate::middleware::{
+    auth, body_limit, compression, cors, idempotency, logging, metrics, negotiate, rate_limit,
+    read_only,
+};
+use crate::response::ApiResponse;
 use crate::state::AppState;
 use axum::{
     extract::{FromRequest, Request},
+    handler::Handler,
     middleware,
     response::{IntoResponse, Response},
-    routing::{get, post},
-    Router,
+    routing::{get, post, MethodRouter},
+    Json, Router,
 };
+use serde::Serialize;
 use std::sync::Arc;
 
 pub fn create_router(state: AppState) -> Router {
     let state = Arc::new(state);
 
-    let api_routes = Router::new()
+    routes(&state)
+        .into_router("/api/v1/_routes", "/api/v1/_openapi.json")
+        .method_not_allowed_fallback(method_not_allowed)
+        .layer(middleware::from_fn_with_state(
+            state.clone(),
+            read_only::read_only_middleware,
+        ))
+        .layer(middleware::from_fn_with_state(
+            state.clone(),
+            body_limit::body_limit_middleware,
+        ))
+        .layer(middleware::from_fn_with_state(
+            state.clone(),
+            negotiate::envelope_middleware,
+        ))
+        .layer(middleware::from_fn_with_state(
+            state.clone(),
+            auth::auth_middleware,
+        ))
+        .layer(middleware::from_fn_with_state(
+            state.clone(),
+            rate_limit::rate_limit_middleware,
+        ))
+        // Outside auth and the rate limit so their rejections are rendered too
+        .layer(middleware::from_fn(negotiate::error_format_middleware))
+        .layer(middleware::from_fn(compression::gzip_middleware))
+        .layer(middleware::from_fn_with_state(
+            state.clone(),
+            cors::cors_middleware,
+        ))
+        .layer(middleware::from_fn_with_state(
+            state.clone(),
+            metrics::metrics_middleware,
+        ))
+        .layer(middleware::from_fn(logging::logging_middleware))
+        .with_state(state)
+}
+
+fn routes(state: &Arc<AppState>) -> RouteTable {
+    // Registration order does not matter: a literal segment always wins over a
+    // `{param}` capture, which wins over a `{*rest}` wildcard, so a catch-all
+    // can never shadow a specific route. Conflicting routes panic at startup.
+    // A known path requested with the wrong method gets 405 with an `Allow`
+    // header (added by axum); unknown paths stay a plain 404. GET routes also
+    // answer HEAD with the same headers and no body.
+    let api_routes = RouteTable::new()
         // File routes
-        .route("/files/list", get(file::list_files))
-        .route("/files/read", get(file::read_file))
-        .route("/files/download", get(file::read_file)) // Alias for read
-        .route("/files/delete", post(file::delete_file))
+        .get("/files/list", file::list_files)
+        .get("/files/read", file::read_file)
+        .get("/files/download", file::read_file) // Alias for read
+        .post("/files/delete", file::delete_file)
+        .get("/files/trash", file::list_trash)
+        .post("/files/restore", file::restore_from_trash)
         .route(
             "/files/write",
-            post(handle_write_file).layer(axum::extract::DefaultBodyLimit::disable()),
+            &["POST"],
+            post(handle_write_file)
+                .layer(axum::extract::DefaultBodyLimit::disable())
+                .layer(middleware::from_fn_with_state(
+                    state.clone(),
+                    idempotency::idempotency_middleware,
+                )),
         )
         .route(
             "/files/batch-upload",
-            post(file::batch_upload).layer(axum::extract::DefaultBodyLimit::disable()),
+            &["POST"],
+            post(file::batch_upload)
+                .layer(axum::extract::DefaultBodyLimit::disable())
+                .layer(middleware::from_fn_with_state(
+                    state.clone(),
+                    idempotency::idempotency_middleware,
+                )),
+        )
+        .post("/files/patch", file::patch_file)
+        .post("/files/batch-download", file::batch_download)
+        .post(
+            "/files/batch-download/estimate",
+            file::batch_download_estimate,
         )
-        .route("/files/batch-download", post(file::batch_download))
-        .route("/files/move", post(file::move_file))
-        .route("/files/rename", post(file::rename_file))
-        .route("/files/chmod", post(file::change_permissions))
-        .route("/files/search", post(file::search_files))
-        .route("/files/find", post(file::find_in_files))
-        .route("/files/replace", post(file::replace_in_files))
+        .get("/files/manifest", file::batch_download_manifest)
+        .post("/files/move", file::move_file)
+        .post("/files/batch-move", file::batch_move)
+        .post("/files/copy", file::copy_file)
+        .post("/files/rename", file::rename_file)
+        .post("/files/chmod", file::change_permissions)
+        .post("/files/search", file::search_files)
+        .post("/files/find", file::find_in_files)
+        .post("/files/grep", file::grep_files)
+        .post("/files/replace", file::replace_in_files)
+        .get("/files/stale", file::find_stale_files)
+        .post("/files/stale/delete", file::delete_stale_files)
+        .get("/files/stat", file::stat_file)
+        .get("/files/hash", file::hash_file)
+        .get("/files/usage", file::get_disk_usage)
         // Process routes
-        .route("/process/exec", post(process::exec_process))
-        .route("/process/exec-sync", post(process::exec_process_sync))
+        .post("/process/exec", process::exec_process)
+        .post("/process/exec-sync", process::exec_process_sync)
+        .post("/process/sync-stream", process::exec_process_sync_stream)
+        .post("/process/run-script", process::run_script)
+        .get("/process/list", process::list_processes)
+        .get("/process/logs/stream", process::stream_merged_logs)
+        .get("/process/status", process::get_process_status_by_pid)
+        .post("/process/kill", process::kill_process_by_pid)
+        .get("/process/{id}/status", process::get_process_status)
+        .post("/process/{id}/kill", process::kill_process)
+        .post("/process/{id}/stdin", process::write_process_stdin)
+        .post("/process/{id}/restart", process::restart_process)
+        .get("/process/{id}/logs", process::get_process_logs)
+        .get("/process/{id}/logs/search", process::search_process_logs)
+        // Session routes
+        .post("/sessions/create", session::create_session)
+        .get("/sessions", session::list_sessions)
+        .get("/sessions/{id}", session::get_session)
         .route(
-            "/process/sync-stream",
-            post(process::exec_process_sync_stream),
+            "/sessions/{id}/env",
+            &["GET", "HEAD", "POST"],
+            get(session::get_session_env).post(session::update_session_env),
         )
-        .route("/process/list", get(process::list_processes))
-        .route("/process/{id}/status", get(process::get_process_status))
-        .route("/process/{id}/kill", post(process::kill_process))
-        .route("/process/{id}/logs", get(process::get_process_logs))
-        // Session routes
-        .route("/sessions/create", post(session::create_session))
-        .route("/sessions", get(session::list_sessions))
-        .route("/sessions/{id}", get(session::get_session))
-        .route("/sessions/{id}/env", post(session::update_session_env))
-        .route("/sessions/{id}/exec", post(session::session_exec))
-        .route("/sessions/{id}/cd", post(session::session_cd))
-        .route("/sessions/{id}/terminate", post(session::terminate_session))
-        .route("/sessions/{id}/logs", get(session::get_session_logs))
+        .post("/sessions/{id}/env/replace", session::replace_session_env)
+        .post("/sessions/{id}/exec", session::session_exec)
+        .post("/sessions/{id}/cd", session::session_cd)
+        .post("/sessions/{id}/touch", session::touch_session)
+        .post("/sessions/{id}/terminate", session::terminate_session)
+        .post("/sessions/{id}/signal", session::signal_session)
+        .get("/sessions/{id}/logs", session::get_session_logs)
         // Port routes
-        .route("/ports", get(port::get_ports));
+        .get("/ports", port::get_ports)
+        // Upload routes above disable this again for their own limits
+        .map(|router| {
+            router
+                .layer(axum::extract::DefaultBodyLimit::max(
+                    state.config.max_body_size as usize,
+                ))
+                .method_not_allowed_fallback(method_not_allowed)
+        });
 
-    Router::new()
-        .route("/health", get(health::health_check))
-        .route("/health/ready", get(health::readiness_check))
-        .route("/ws", get(websocket::ws_handler))
+    RouteTable::new()
+        .get("/health", health::health_check)
+        .get("/health/ready", health::readiness_check)
+        // Conventional probe paths for orchestrators
+        .get("/healthz", health::health_check)
+        .get("/readyz", health::readyz)
+        .get("/metrics", health::metrics)
+        // The upgrade extractor rejects HEAD
+        .route("/ws", &["GET"], get(websocket::ws_handler))
         .nest("/api/v1", api_routes)
-        .layer(middleware::from_fn_with_state(
-            state.clone(),
-            auth::auth_middleware,
-        ))
-        .layer(middleware::from_fn(logging::logging_middleware))
-        .with_state(state)
+}
+
+#[derive(Clone, Debug, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+pub struct RouteInfo {
+    pub path: String,
+    pub method: &'static str,
+}
+
+#[derive(Serialize)]
+pub struct RoutesResponse {
+    routes: Vec<RouteInfo>,
+    count: usize,
+}
+
+/// Router that records every method and path it registers, since axum cannot
+/// list the routes of a built `Router`.
+struct RouteTable {
+    router: Router<Arc<AppState>>,
+    routes: Vec<RouteInfo>,
+}
+
+impl RouteTable {
+    fn new() -> Self {
+        Self {
+            router: Router::new(),
+            routes: Vec::new(),
+        }
+    }
+
+    fn get<H, T>(self, path: &str, handler: H) -> Self
+    where
+        H: Handler<T, Arc<AppState>>,
+        T: 'static,
+    {
+        self.route(path, &["GET", "HEAD"], get(handler))
+    }
+
+    fn post<H, T>(self, path: &str, handler: H) -> Self
+    where
+        H: Handler<T, Arc<AppState>>,
+        T: 'static,
+    {
+        self.route(path, &["POST"], post(handler))
+    }
+
+    /// Register a method router built by hand (layered or serving several
+    /// methods); `methods` must list what it serves.
+    fn route(
+        mut self,
+        path: &str,
+        methods: &[&'static str],
+        method_router: MethodRouter<Arc<AppState>>,
+    ) -> Self {
+        self.router = self.router.route(path, method_router);
+        self.routes.extend(methods.iter().map(|&method| RouteInfo {
+            path: path.to_string(),
+            method,
+        }));
+        self
+    }
+
+    fn nest(mut self, prefix: &str, table: RouteTable) -> Self {
+        self.router = self.router.nest(prefix, table.router);
+        self.routes
+            .extend(table.routes.into_iter().map(|route| RouteInfo {
+                path: format!("{}{}", prefix, route.path),
+                method: route.method,
+            }));
+        self
+    }
+
+    /// Apply layers or fallbacks to the routes registered so far.
+    fn map(mut self, f: impl FnOnce(Router<Arc<AppState>>) -> Router<Arc<AppState>>) -> Self {
+        self.router = f(self.router);
+        self
+    }
+
+    /// Finish the router, serving the recorded routes (sorted by path, then
+    /// method) at `listing_path` and the OpenAPI document generated for them
+    /// at `openapi_path`.
+    fn into_router(self, listing_path: &str, openapi_path: &str) -> Router<Arc<AppState>> {
+        let mut routes = self.routes;
+        for path in [listing_path, openapi_path] {
+            routes.extend(["GET", "HEAD"].map(|method| RouteInfo {
+                path: path.to_string(),
+                method,
+            }));
+        }
+        routes.sort();
+        // Built once: the routes and types cannot change while running
+        let document = axum::body::Bytes::from(crate::openapi::document(&routes).to_string());
+        let routes = Arc::new(routes);
+
+        self.router
+            .route(
+                listing_path,
+                get(move || {
+                    let routes = routes.to_vec();
+                    async move {
+                        Json(ApiResponse::success(RoutesResponse {
+                            count: routes.len(),
+                            routes,
+                        }))
+                    }
+                }),
+            )
+            .route(
+                openapi_path,
+                get(move || {
+                    let document = document.clone();
+                    async move {
+                        (
+                            [(axum::http::header::CONTENT_TYPE, "application/json")],
+                            document,
+                        )
+                    }
+                }),
+            )
+    }
+}
+
+/// The path is taken from `OriginalUri` since nested routes see it without
+/// the `/api/v1` prefix.
+async fn method_not_allowed(
+    method: axum::http::Method,
+    axum::extract::OriginalUri(uri): axum::extract::OriginalUri,
+) -> Response {
+    crate::error::AppError::MethodNotAllowed(format!(
+        "{} is not supported for {}",
+        method,
+        uri.path()
+    ))
+    .into_response()
 }
 
 async fn handle_write_file(
     state: axum::extract::State<Arc<AppState>>,
+    trace: logging::TraceId,
     req: Request,
 ) -> Result<Response, crate::error::AppError> {
     let content_type = req
@@ -85,7 +316,7 @@ async fn handle_write_file(
             .await
             .map_err(|e| crate::error::AppError::BadRequest(e.to_string()))?;
 
-        file::write_file_json(state, json_body)
+        file::write_file_json(state, trace, json_body)
             .await
             .map(|r| r.into_response())
     } else if content_type.starts_with("multipart/form-data") {
@@ -93,7 +324,7 @@ async fn handle_write_file(
             .await
             .map_err(|e| crate::error::AppError::BadRequest(e.to_string()))?;
 
-        file::write_file_multipart(state, multipart)
+        file::write_file_multipart(state, trace, multipart)
             .await
             .map(|r| r.into_response())
     } else {
@@ -109,8 +340,241 @@ async fn handle_write_file(
             .await
             .map_err(|e| crate::error::AppError::BadRequest(e.to_string()))?;
 
-        file::write_file_binary(state, query, body)
+        file::write_file_binary(state, trace, query, body)
             .await
             .map(|r| r.into_response())
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::net::SocketAddr;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+    const TOKEN: &str = "router-test-token";
+
+    fn test_config() -> crate::config::Config {
+        let mut config = crate::config::Config::load();
+        config.token = Some(TOKEN.to_string());
+        config
+    }
+
+    fn test_state() -> Arc<AppState> {
+        Arc::new(AppState::new(test_config()))
+    }
+
+    /// Serve `router` on a local port and send it one request, returning the
+    /// response head (status line and lowercase headers) and body.
+    async fn send(router: Router, method: &str, path: &str) -> (String, String) {
+        send_with_headers(router, method, path, "").await
+    }
+
+    /// `send` with extra header lines, each ending in `\r\n`.
+    async fn send_with_headers(
+        router: Router,
+        method: &str,
+        path: &str,
+        headers: &str,
+    ) -> (String, String) {
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move {
+            axum::serve(
+                listener,
+                router.into_make_service_with_connect_info::<SocketAddr>(),
+            )
+            .await
+        });
+
+        let mut stream = tokio::net::TcpStream::connect(addr).await.unwrap();
+        let request = format!(
+            "{} {} HTTP/1.1\r\nHost: localhost\r\nAuthorization: Bearer {}\r\n{}Connection: close\r\nContent-Length: 0\r\n\r\n",
+            method, path, TOKEN, headers
+        );
+        stream.write_all(request.as_bytes()).await.unwrap();
+        let mut response = Vec::new();
+        stream.read_to_end(&mut response).await.unwrap();
+
+        let response = String::from_utf8_lossy(&response).into_owned();
+        let (head, body) = response.split_once("\r\n\r\n").unwrap_or((&response, ""));
+        (head.to_lowercase(), body.to_string())
+    }
+
+    #[tokio::test]
+    async fn test_specific_route_beats_wildcard() {
+        let state = test_state();
+        let forward = RouteTable::new()
+            .get("/static/{*rest}", || async { "wildcard" })
+            .get("/static/special", || async { "specific" })
+            .get("/items/{id}", || async { "param" })
+            .get("/items/special", || async { "specific" });
+        let reverse = RouteTable::new()
+            .get("/items/special", || async { "specific" })
+            .get("/items/{id}", || async { "param" })
+            .get("/static/special", || async { "specific" })
+            .get("/static/{*rest}", || async { "wildcard" });
+
+        for table in [forward, reverse] {
+            let router = table
+                .into_router("/_routes", "/_openapi.json")
+                .with_state(state.clone());
+            for (path, expected) in [
+                ("/static/special", "specific"),
+                ("/static/other/file", "wildcard"),
+                ("/items/special", "specific"),
+                ("/items/42", "param"),
+            ] {
+                let (head, body) = send(router.clone(), "GET", path).await;
+                assert!(head.starts_with("http/1.1 200"), "{}: {}", path, head);
+                assert_eq!(body, expected, "{}", path);
+            }
+        }
+    }
+
+    #[test]
+    fn test_routes_are_documented() {
+        let state = Arc::new(AppState::new(crate::config::Config::load()));
+        let spec = include_str!("../docs/openapi.yaml");
+        let undocumented: Vec<_> = routes(&state)
+            .routes
+            .into_iter()
+            .filter(|route| !spec.contains(&format!("\n  {}:\n", route.path)))
+            .collect();
+        assert!(
+            undocumented.is_empty(),
+            "missing from docs/openapi.yaml: {:?}",
+            undocumented
+        );
+    }
+
+    #[test]
+    fn test_openapi_operations_are_routes() {
+        let state = Arc::new(AppState::new(crate::config::Config::load()));
+        let routes = routes(&state).routes;
+        let unknown: Vec<_> = crate::openapi::operations()
+            .into_iter()
+            .filter(|op| {
+                !routes
+                    .iter()
+                    .any(|route| route.method == op.method && route.path == op.path)
+            })
+            .map(|op| format!("{} {}", op.method, op.path))
+            .collect();
+        assert!(unknown.is_empty(), "not registered: {:?}", unknown);
+    }
+
+    #[tokio::test]
+    async fn test_wrong_method_and_unknown_path() {
+        let router = create_router(AppState::new(test_config()));
+
+        // Known paths answer other methods with 405 and list what they accept
+        for (method, path, allowed) in [
+            ("DELETE", "/api/v1/files/list", "get,head"),
+            ("GET", "/api/v1/files/write", "post"),
+            ("POST", "/health", "get,head"),
+        ] {
+            let (head, _) = send(router.clone(), method, path).await;
+            assert!(
+                head.starts_with("http/1.1 405"),
+                "{} {}: {}",
+                method,
+                path,
+                head
+            );
+            let allow = head
+                .lines()
+                .find_map(|line| line.strip_prefix("allow:"))
+                .map(|value| value.replace(' ', ""))
+                .unwrap_or_default();
+            assert_eq!(allow, allowed, "{} {}", method, path);
+        }
+
+        for path in ["/api/v1/files/nope", "/nope", "/api/v2/files/list"] {
+            let (head, _) = send(router.clone(), "GET", path).await;
+            assert!(head.starts_with("http/1.1 404"), "{}: {}", path, head);
+            assert!(!head.contains("\nallow:"), "{}: {}", path, head);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_route_listing_is_sorted_and_complete() {
+        let state = test_state();
+        let router = create_router(AppState::new(test_config()));
+
+        let (head, body) = send(router, "GET", "/api/v1/_routes").await;
+        assert!(head.starts_with("http/1.1 200"), "{}", head);
+        let listing: serde_json::Value = serde_json::from_str(&body).unwrap();
+        let listed: Vec<(String, String)> = listing["routes"]
+            .as_array()
+            .unwrap()
+            .iter()
+            .map(|route| {
+                (
+                    route["path"].as_str().unwrap().to_string(),
+                    route["method"].as_str().unwrap().to_string(),
+                )
+            })
+            .collect();
+        assert_eq!(listing["count"], listed.len());
+
+        let mut sorted = listed.clone();
+        sorted.sort();
+        assert_eq!(listed, sorted);
+
+        let mut expected: Vec<(String, String)> = routes(&state)
+            .routes
+            .into_iter()
+            .map(|route| (route.path, route.method.to_string()))
+            .collect();
+        for path in ["/api/v1/_routes", "/api/v1/_openapi.json"] {
+            for method in ["GET", "HEAD"] {
+                expected.push((path.to_string(), method.to_string()));
+            }
+        }
+        expected.sort();
+        assert_eq!(listed, expected);
+    }
+
+    #[tokio::test]
+    async fn test_head_matches_get_without_body() {
+        let router = create_router(AppState::new(test_config()));
+
+        let header = |head: &str, name: &str| {
+            head.lines()
+                .find_map(|line| line.strip_prefix(name))
+                .map(|value| value.trim().to_string())
+        };
+
+        let (get_head, get_body) = send(router.clone(), "GET", "/api/v1/_routes").await;
+        let (head, body) = send(router, "HEAD", "/api/v1/_routes").await;
+        assert!(head.starts_with("http/1.1 200"), "{}", head);
+        assert!(body.is_empty(), "{}", body);
+        assert_eq!(
+            header(&head, "content-type:"),
+            header(&get_head, "content-type:")
+        );
+        assert_eq!(
+            header(&head, "content-length:"),
+            Some(get_body.len().to_string())
+        );
+    }
+
+    #[tokio::test]
+    async fn test_rate_limited_error_as_plain_text() {
+        let mut config = test_config();
+        config.rate_limit = Some(0.01);
+        config.rate_limit_burst = 1;
+        let router = create_router(AppState::new(config));
+
+        let accept = "Accept: text/plain\r\n";
+        let (head, _) = send_with_headers(router.clone(), "GET", "/api/v1/_routes", accept).await;
+        assert!(head.starts_with("http/1.1 200"), "{}", head);
+
+        let (head, body) = send_with_headers(router, "GET", "/api/v1/_routes", accept).await;
+        assert!(head.starts_with("http/1.1 429"), "{}", head);
+        assert!(head.contains("\ncontent-type: text/plain"), "{}", head);
+        assert!(head.contains("\nretry-after:"), "{}", head);
+        assert!(body.starts_with("status: 1429\n"), "{}", body);
+    }
+}
@@ -1,15 +1,62 @@
 pub mod process;
 pub mod session;
+pub mod upload;
 
+use crate::error::AppError;
+use crate::handlers::file::types::{FileHash, FileInfo};
+use crate::handlers::file::usage::DiskUsageResponse;
+use crate::middleware::idempotency::IdempotencyCache;
+use crate::middleware::metrics::Metrics;
+use crate::middleware::rate_limit::RateLimiter;
+use crate::utils::path::{validate_path, DeniedPaths};
+use crate::utils::quota::{QuotaReservation, WorkspaceQuota};
+use crate::utils::singleflight::SingleFlight;
 use std::collections::HashMap;
+use std::path::PathBuf;
 use std::sync::Arc;
-use tokio::sync::RwLock;
+use std::time::Instant;
+use tokio::sync::{watch, Mutex, RwLock};
+
+/// In-flight stat and hash computations, keyed by resolved path
+pub struct FileReadFlights {
+    pub stat: SingleFlight<Result<FileInfo, AppError>>,
+    pub hash: SingleFlight<Result<FileHash, AppError>>,
+}
+
+impl Default for FileReadFlights {
+    fn default() -> Self {
+        FileReadFlights {
+            stat: SingleFlight::new(),
+            hash: SingleFlight::new(),
+        }
+    }
+}
 
 #[derive(Clone)]
 pub struct AppState {
     pub config: Arc<crate::config::Config>,
     pub processes: process::ProcessStore,
     pub sessions: session::SessionStore,
+    pub uploads: upload::UploadProgressStore,
+    pub audit: Arc<crate::audit::AuditLog>,
+    pub file_reads: Arc<FileReadFlights>,
+    /// Upload deduplication store, when `DEDUP` is enabled
+    pub dedup: Option<Arc<crate::utils::dedup::DedupStore>>,
+    /// Workspace paths excluded from file operations (`DENIED_PATHS`)
+    pub denied_paths: Arc<DeniedPaths>,
+    /// Per-client request limiter, when `RATE_LIMIT` is set
+    pub rate_limiter: Option<Arc<RateLimiter>>,
+    /// Workspace disk usage limit, when `WORKSPACE_QUOTA` is set
+    pub quota: Option<Arc<WorkspaceQuota>>,
+    /// Last workspace-wide `/files/usage` result and when it was measured
+    pub workspace_usage: Arc<Mutex<Option<(Instant, DiskUsageResponse)>>>,
+    /// Responses of completed uploads, replayed for retries with the same
+    /// `Idempotency-Key`
+    pub idempotency: Arc<IdempotencyCache>,
+    pub metrics: Arc<Metrics>,
+    /// Flipped to true when the server starts shutting down, so long-lived
+    /// handlers such as WebSockets can finish
+    pub shutdown: watch::Sender<bool>,
     pub port_monitor: Arc<crate::monitor::port::PortMonitor>,
     pub start_time: std::time::Instant,
 }
@@ -21,10 +68,41 @@ impl AppState {
             excluded_ports.push(addr.port());
         }
 
+        let audit = Arc::new(crate::audit::AuditLog::open(config.audit_log.as_deref()));
+        let dedup = config
+            .dedup
+            .then(|| Arc::new(crate::utils::dedup::DedupStore::new(&config)));
+        let denied_paths = Arc::new(DeniedPaths::new(
+            &config.workspace_path,
+            config.denied_paths.clone(),
+        ));
+        let rate_limiter = config.rate_limit.map(|per_second| {
+            Arc::new(RateLimiter::new(
+                per_second,
+                config.rate_limit_burst,
+                config.trust_forwarded_for,
+            ))
+        });
+
+        let quota = config
+            .workspace_quota
+            .map(|limit| Arc::new(WorkspaceQuota::new(&config.workspace_path, limit)));
+
         Self {
             config: Arc::new(config),
             processes: Arc::new(RwLock::new(HashMap::new())),
             sessions: Arc::new(RwLock::new(HashMap::new())),
+            uploads: Arc::new(RwLock::new(HashMap::new())),
+            audit,
+            file_reads: Arc::new(FileReadFlights::default()),
+            dedup,
+            denied_paths,
+            rate_limiter,
+            quota,
+            workspace_usage: Arc::new(Mutex::new(None)),
+            idempotency: Arc::new(IdempotencyCache::default()),
+            metrics: Arc::new(Metrics::default()),
+            shutdown: watch::channel(false).0,
             port_monitor: Arc::new(crate::monitor::port::PortMonitor::new(
                 std::time::Duration::from_millis(100),
                 excluded_ports,
@@ -32,4 +110,30 @@ impl AppState {
             start_time: std::time::Instant::now(),
         }
     }
+
+    /// Resolve a client-supplied file path against the workspace, rejecting
+    /// paths matched by `DENIED_PATHS`.
+    pub fn resolve_path(&self, user_path: &str) -> Result<PathBuf, AppError> {
+        let path = validate_path(&self.config.workspace_path, user_path)?;
+        self.denied_paths.check(&path)?;
+        Ok(path)
+    }
+
+    pub async fn running_process_count(&self) -> usize {
+        let processes = self.processes.read().await;
+        processes.values().filter(|p| p.status == "running").count()
+    }
+
+    pub async fn active_session_count(&self) -> usize {
+        let sessions = self.sessions.read().await;
+        sessions.values().filter(|s| s.status == "active").count()
+    }
+
+    /// Reserve `bytes` of workspace quota for a write; a no-op without a
+    /// quota.
+    pub async fn reserve_quota(&self, bytes: u64) -> Result<QuotaReservation, AppError> {
+        let mut reservation = QuotaReservation::new(self.quota.clone());
+        reservation.ensure(bytes).await?;
+        Ok(reservation)
+    }
 }
@@ -1,9 +1,11 @@
+use crate::handlers::process::{ExecProcessRequest, FailureReason};
 use serde::Serialize;
 use std::collections::{HashMap, VecDeque};
+use std::sync::atomic::AtomicU64;
 use std::sync::Arc;
 use std::time::SystemTime;
-use tokio::process::Child;
-use tokio::sync::{broadcast, RwLock};
+use tokio::process::{Child, ChildStdin};
+use tokio::sync::{broadcast, Mutex, RwLock};
 
 #[derive(Debug, Clone, Serialize)]
 #[serde(rename_all = "camelCase")]
@@ -15,6 +17,29 @@ pub struct ProcessStatus {
     pub start_time: String,
     pub end_time: Option<String>,
     pub exit_code: Option<i32>,
+    /// Why the process was stopped by the server, e.g. `timeout`
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub failure_reason: Option<FailureReason>,
+}
+
+/// Lifecycle notification for WebSocket subscribers of a process, e.g.
+/// `{"type":"process_exit","targetId":..,"exitCode":0,"status":"completed"}`
+#[derive(Debug, Clone, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub struct ProcessEvent {
+    #[serde(rename = "type")]
+    pub event_type: String,
+    pub target_id: String,
+    pub exit_code: Option<i32>,
+    pub status: String,
+    pub timestamp: i64,
+}
+
+/// Writable input of a running process, kept for `/process/{id}/stdin`
+pub enum ProcessStdin {
+    Pipe(ChildStdin),
+    /// Clone of the PTY master; EOF is signalled with Ctrl-D
+    Pty(tokio::fs::File),
 }
 
 pub struct ProcessInfo {
@@ -26,8 +51,17 @@ pub struct ProcessInfo {
     pub start_time: SystemTime,
     pub end_time: Option<SystemTime>,
     pub exit_code: Option<i32>,
+    pub failure_reason: Option<FailureReason>,
     pub logs: Arc<RwLock<VecDeque<String>>>, // In-memory logs
+    /// Sequence number of the first entry in `logs`. Bumped under the `logs`
+    /// write lock for every evicted line, so each line keeps its sequence.
+    pub log_start_sequence: AtomicU64,
     pub log_broadcast: broadcast::Sender<String>, // Real-time log broadcasting
+    /// Serialized `ProcessEvent`s, kept apart from the raw log lines
+    pub events: broadcast::Sender<String>,
+    pub stdin: Arc<Mutex<Option<ProcessStdin>>>,
+    /// Request the process was started with, used by restarts
+    pub request: ExecProcessRequest,
 }
 
 impl ProcessInfo {
@@ -37,6 +71,7 @@ impl ProcessInfo {
         command: String,
         child: Option<Child>,
         log_broadcast: broadcast::Sender<String>,
+        request: ExecProcessRequest,
     ) -> Self {
         Self {
             id,
@@ -47,8 +82,31 @@ impl ProcessInfo {
             start_time: SystemTime::now(),
             end_time: None,
             exit_code: None,
+            failure_reason: None,
             logs: Arc::new(RwLock::new(VecDeque::new())),
+            log_start_sequence: AtomicU64::new(0),
             log_broadcast,
+            events: broadcast::channel(16).0,
+            stdin: Arc::new(Mutex::new(None)),
+            request,
+        }
+    }
+
+    /// Send a `ProcessEvent` with the current status to subscribers.
+    pub fn broadcast_event(&self, event_type: &str) {
+        let event = ProcessEvent {
+            event_type: event_type.to_string(),
+            target_id: self.id.clone(),
+            exit_code: self.exit_code,
+            status: self.status.clone(),
+            timestamp: SystemTime::now()
+                .duration_since(SystemTime::UNIX_EPOCH)
+                .unwrap_or_default()
+                .as_secs() as i64,
+        };
+        if let Ok(msg) = serde_json::to_string(&event) {
+            // No receivers just means nobody is subscribed
+            let _ = self.events.send(msg);
         }
     }
 
@@ -72,6 +130,7 @@ impl ProcessInfo {
                 )
             }),
             exit_code: self.exit_code,
+            failure_reason: self.failure_reason,
         }
     }
 }
@@ -3,7 +3,7 @@ use std::collections::{HashMap, VecDeque};
 use std::sync::Arc;
 use std::time::SystemTime;
 use tokio::process::{Child, ChildStdin};
-use tokio::sync::{broadcast, RwLock};
+use tokio::sync::{broadcast, Mutex, RwLock};
 
 #[derive(Debug, Clone, Serialize)]
 #[serde(rename_all = "camelCase")]
@@ -15,6 +15,9 @@ pub struct SessionStatus {
     pub session_status: String, // "active", "terminated"
     pub created_at: String,     // RFC3339
     pub last_used_at: String,   // RFC3339
+    /// Why the session was terminated ("memory_limit", "lifetime_exceeded", "idle_timeout", "requested")
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub termination_reason: Option<String>,
 }
 
 pub struct SessionInfo {
@@ -30,6 +33,11 @@ pub struct SessionInfo {
     pub last_used_at: SystemTime,
     pub logs: Arc<RwLock<VecDeque<String>>>,
     pub log_broadcast: broadcast::Sender<String>,
+    pub termination_reason: Option<String>,
+    /// End-of-command markers printed for `session_exec`, kept out of the logs
+    pub exec_markers: broadcast::Sender<String>,
+    /// Serializes `session_exec` calls so their outputs do not interleave
+    pub exec_lock: Arc<Mutex<()>>,
 }
 
 pub struct SessionInitParams {
@@ -59,6 +67,9 @@ impl SessionInfo {
             last_used_at: now,
             logs: Arc::new(RwLock::new(VecDeque::new())),
             log_broadcast: params.log_broadcast,
+            termination_reason: None,
+            exec_markers: broadcast::channel(16).0,
+            exec_lock: Arc::new(Mutex::new(())),
         }
     }
 
@@ -82,6 +93,7 @@ impl SessionInfo {
             session_status: self.status.clone(),
             created_at: crate::utils::common::format_time(created_secs),
             last_used_at: crate::utils::common::format_time(last_used_secs),
+            termination_reason: self.termination_reason.clone(),
         }
     }
 }
@@ -102,6 +114,7 @@ mod tests {
             session_status: "active".to_string(),
             created_at: "2023-01-01T00:00:00Z".to_string(),
             last_used_at: "2023-01-01T00:00:00Z".to_string(),
+            termination_reason: None,
         };
 
         let json = serde_json::to_string(&status).unwrap();
@@ -0,0 +1,207 @@
+use serde::Serialize;
+use std::collections::HashMap;
+use std::sync::Arc;
+use tokio::sync::{broadcast, RwLock};
+
+/// Minimum number of bytes between two progress events for the same file
+const PROGRESS_INTERVAL: u64 = 1024 * 1024;
+
+#[derive(Debug, Clone, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub struct UploadProgressEvent {
+    #[serde(rename = "type")]
+    pub msg_type: String, // "upload_progress"
+    pub upload_id: String,
+    pub path: String,
+    pub bytes_written: u64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub total_bytes: Option<u64>,
+    pub done: bool,
+}
+
+/// Progress channel of a single upload ID.
+pub struct UploadChannel {
+    tx: broadcast::Sender<String>,
+    /// Number of upload requests currently reporting to this channel
+    reporters: usize,
+}
+
+impl UploadChannel {
+    fn new() -> Self {
+        Self {
+            tx: broadcast::channel(100).0,
+            reporters: 0,
+        }
+    }
+}
+
+/// Progress channels keyed by the client supplied upload ID.
+pub type UploadProgressStore = Arc<RwLock<HashMap<String, UploadChannel>>>;
+
+/// Subscribe to progress events of an upload. The channel is created on demand
+/// so clients can subscribe before the upload request is sent.
+pub async fn subscribe(
+    store: &UploadProgressStore,
+    upload_id: &str,
+) -> broadcast::Receiver<String> {
+    let mut uploads = store.write().await;
+    uploads
+        .entry(upload_id.to_string())
+        .or_insert_with(UploadChannel::new)
+        .tx
+        .subscribe()
+}
+
+/// Held by a websocket subscription for as long as it runs. Dropping it removes
+/// a channel that no upload is reporting to and nobody else listens on, so
+/// subscribing to IDs that are never uploaded doesn't leak entries.
+pub struct SubscriptionGuard {
+    store: UploadProgressStore,
+    upload_id: String,
+}
+
+impl SubscriptionGuard {
+    pub fn new(store: &UploadProgressStore, upload_id: &str) -> Self {
+        Self {
+            store: store.clone(),
+            upload_id: upload_id.to_string(),
+        }
+    }
+}
+
+impl Drop for SubscriptionGuard {
+    fn drop(&mut self) {
+        let store = self.store.clone();
+        let upload_id = std::mem::take(&mut self.upload_id);
+        // Runs after the subscription task is gone, so its receiver no
+        // longer counts
+        tokio::spawn(async move {
+            let mut uploads = store.write().await;
+            let unused = uploads
+                .get(&upload_id)
+                .is_some_and(|ch| ch.reporters == 0 && ch.tx.receiver_count() == 0);
+            if unused {
+                uploads.remove(&upload_id);
+            }
+        });
+    }
+}
+
+/// Reports write progress of a single upload request to websocket subscribers.
+pub struct ProgressReporter {
+    upload_id: String,
+    tx: broadcast::Sender<String>,
+    store: UploadProgressStore,
+    last_reported: u64,
+}
+
+impl ProgressReporter {
+    pub async fn new(store: &UploadProgressStore, upload_id: String) -> Self {
+        let tx = {
+            let mut uploads = store.write().await;
+            let channel = uploads
+                .entry(upload_id.clone())
+                .or_insert_with(UploadChannel::new);
+            channel.reporters += 1;
+            channel.tx.clone()
+        };
+        Self {
+            upload_id,
+            tx,
+            store: store.clone(),
+            last_reported: 0,
+        }
+    }
+
+    /// Report progress for `path`, throttled to one event per `PROGRESS_INTERVAL` bytes.
+    pub fn update(&mut self, path: &str, bytes_written: u64, total_bytes: Option<u64>) {
+        if bytes_written < self.last_reported + PROGRESS_INTERVAL {
+            return;
+        }
+        self.last_reported = bytes_written;
+        self.send(path, bytes_written, total_bytes, false);
+    }
+
+    /// Report that `path` has been written completely.
+    pub fn complete(&mut self, path: &str, bytes_written: u64) {
+        self.last_reported = 0;
+        self.send(path, bytes_written, Some(bytes_written), true);
+    }
+
+    fn send(&self, path: &str, bytes_written: u64, total_bytes: Option<u64>, done: bool) {
+        if self.tx.receiver_count() == 0 {
+            return;
+        }
+        let event = UploadProgressEvent {
+            msg_type: "upload_progress".to_string(),
+            upload_id: self.upload_id.clone(),
+            path: path.to_string(),
+            bytes_written,
+            total_bytes,
+            done,
+        };
+        if let Ok(msg) = serde_json::to_string(&event) {
+            let _ = self.tx.send(msg);
+        }
+    }
+}
+
+impl Drop for ProgressReporter {
+    /// Remove the progress channel once the last upload request reporting to it
+    /// is done, which ends all websocket subscriptions for it.
+    fn drop(&mut self) {
+        let store = self.store.clone();
+        let upload_id = std::mem::take(&mut self.upload_id);
+        tokio::spawn(async move {
+            let mut uploads = store.write().await;
+            if let Some(channel) = uploads.get_mut(&upload_id) {
+                channel.reporters = channel.reporters.saturating_sub(1);
+                if channel.reporters == 0 {
+                    uploads.remove(&upload_id);
+                }
+            }
+        });
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    async fn settle() {
+        for _ in 0..10 {
+            tokio::task::yield_now().await;
+        }
+    }
+
+    #[tokio::test]
+    async fn test_subscription_without_upload_is_removed() {
+        let store: UploadProgressStore = Arc::new(RwLock::new(HashMap::new()));
+
+        let rx = subscribe(&store, "never-uploaded").await;
+        let guard = SubscriptionGuard::new(&store, "never-uploaded");
+        assert!(store.read().await.contains_key("never-uploaded"));
+
+        drop(rx);
+        drop(guard);
+        settle().await;
+        assert!(store.read().await.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_subscription_keeps_active_upload() {
+        let store: UploadProgressStore = Arc::new(RwLock::new(HashMap::new()));
+
+        let reporter = ProgressReporter::new(&store, "up".to_string()).await;
+        let rx = subscribe(&store, "up").await;
+        drop(rx);
+        drop(SubscriptionGuard::new(&store, "up"));
+        settle().await;
+        // The upload is still running, later subscribers must get its channel
+        assert!(store.read().await.contains_key("up"));
+
+        drop(reporter);
+        settle().await;
+        assert!(store.read().await.is_empty());
+    }
+}
@@ -0,0 +1,131 @@
+//! TLS termination with optional client certificate authentication.
+//!
+//! When `TLS_CERT_FILE`/`TLS_KEY_FILE` are configured the server speaks HTTPS.
+//! Setting `CLIENT_CA_FILE` additionally requires every client to present a
+//! certificate signed by one of the CAs in that file (mutual TLS); handshakes
+//! without a valid client certificate are rejected before any request is read.
+
+use axum::serve::Listener;
+use std::net::SocketAddr;
+use std::path::Path;
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::net::{TcpListener, TcpStream};
+use tokio::sync::mpsc;
+use tokio_rustls::rustls::pki_types::pem::PemObject;
+use tokio_rustls::rustls::pki_types::{CertificateDer, PrivateKeyDer};
+use tokio_rustls::rustls::server::WebPkiClientVerifier;
+use tokio_rustls::rustls::{RootCertStore, ServerConfig};
+use tokio_rustls::server::TlsStream;
+use tokio_rustls::TlsAcceptor;
+
+/// Time a client gets to complete the TLS handshake
+const HANDSHAKE_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Builds the rustls server config from PEM files. With `client_ca` set,
+/// client certificates are required and verified against it.
+pub fn load_server_config(
+    cert_file: &Path,
+    key_file: &Path,
+    client_ca: Option<&Path>,
+) -> Result<Arc<ServerConfig>, String> {
+    let certs = CertificateDer::pem_file_iter(cert_file)
+        .and_then(|certs| certs.collect::<Result<Vec<_>, _>>())
+        .map_err(|e| format!("failed to read certificate {:?}: {}", cert_file, e))?;
+    let key = PrivateKeyDer::from_pem_file(key_file)
+        .map_err(|e| format!("failed to read private key {:?}: {}", key_file, e))?;
+
+    let builder = ServerConfig::builder();
+    let builder = match client_ca {
+        Some(ca_file) => {
+            let mut roots = RootCertStore::empty();
+            let ca_certs = CertificateDer::pem_file_iter(ca_file)
+                .and_then(|certs| certs.collect::<Result<Vec<_>, _>>())
+                .map_err(|e| format!("failed to read client CA {:?}: {}", ca_file, e))?;
+            for cert in ca_certs {
+                roots
+                    .add(cert)
+                    .map_err(|e| format!("invalid client CA {:?}: {}", ca_file, e))?;
+            }
+            let verifier = WebPkiClientVerifier::builder(Arc::new(roots))
+                .build()
+                .map_err(|e| format!("invalid client CA {:?}: {}", ca_file, e))?;
+            builder.with_client_cert_verifier(verifier)
+        }
+        None => builder.with_no_client_auth(),
+    };
+
+    let mut config = builder
+        .with_single_cert(certs, key)
+        .map_err(|e| format!("invalid certificate or key: {}", e))?;
+    config.alpn_protocols = vec![b"http/1.1".to_vec()];
+    Ok(Arc::new(config))
+}
+
+/// TCP listener that performs TLS handshakes before handing connections to
+/// axum. Handshakes run concurrently so a slow client cannot stall others;
+/// failed ones (including missing or untrusted client certificates) are
+/// logged and the connection is dropped.
+pub struct TlsListener {
+    local_addr: SocketAddr,
+    connections: mpsc::Receiver<(TlsStream<TcpStream>, SocketAddr)>,
+}
+
+impl TlsListener {
+    pub fn new(tcp: TcpListener, config: Arc<ServerConfig>) -> std::io::Result<Self> {
+        let local_addr = tcp.local_addr()?;
+        let acceptor = TlsAcceptor::from(config);
+        let (tx, connections) = mpsc::channel(64);
+
+        tokio::spawn(async move {
+            loop {
+                let (stream, addr) = match tcp.accept().await {
+                    Ok(conn) => conn,
+                    Err(e) => {
+                        println!("Failed to accept connection: {}", e);
+                        tokio::time::sleep(Duration::from_millis(100)).await;
+                        continue;
+                    }
+                };
+
+                let acceptor = acceptor.clone();
+                let tx = tx.clone();
+                tokio::spawn(async move {
+                    match tokio::time::timeout(HANDSHAKE_TIMEOUT, acceptor.accept(stream)).await {
+                        Ok(Ok(tls)) => {
+                            let _ = tx.send((tls, addr)).await;
+                        }
+                        Ok(Err(e)) => println!("TLS handshake with {} failed: {}", addr, e),
+                        Err(_) => println!("TLS handshake with {} timed out", addr),
+                    }
+                });
+
+                if tx.is_closed() {
+                    break;
+                }
+            }
+        });
+
+        Ok(Self {
+            local_addr,
+            connections,
+        })
+    }
+}
+
+impl Listener for TlsListener {
+    type Io = TlsStream<TcpStream>;
+    type Addr = SocketAddr;
+
+    async fn accept(&mut self) -> (Self::Io, Self::Addr) {
+        match self.connections.recv().await {
+            Some(conn) => conn,
+            // The accept task only exits once this receiver is gone
+            None => std::future::pending().await,
+        }
+    }
+
+    fn local_addr(&self) -> std::io::Result<Self::Addr> {
+        Ok(self.local_addr)
+    }
+}
@@ -0,0 +1,154 @@
+use crate::error::AppError;
+use crate::utils::common::sha256_file;
+use std::path::{Path, PathBuf};
+use tokio::fs;
+use tokio::io::AsyncWriteExt;
+
+/// A file that is written to a temporary location and moved into place on
+/// `commit`, so readers never observe a partially written destination.
+///
+/// Without a configured temp dir the temporary file lives next to the
+/// destination, which guarantees an atomic rename. With a temp dir on another
+/// filesystem the rename falls back to copying into the destination directory
+/// first. Uncommitted temporary files are removed on drop.
+pub struct AtomicFile {
+    pub file: fs::File,
+    staged: StagedFile,
+}
+
+/// The complete content of an `AtomicFile` after `close`, waiting for
+/// `commit`. It holds no open file handle, so a request can stage many files
+/// before committing any. The temporary file is removed on drop.
+pub struct StagedFile {
+    temp_path: PathBuf,
+    dest: PathBuf,
+    committed: bool,
+}
+
+impl AtomicFile {
+    pub async fn create(temp_dir: Option<&Path>, dest: &Path) -> Result<Self, AppError> {
+        let temp_path = match temp_dir {
+            Some(dir) => dir.join(format!(
+                "devbox-{}.tmp",
+                crate::utils::common::generate_id()
+            )),
+            None => sibling_temp_path(dest),
+        };
+        let file = fs::File::create(&temp_path).await?;
+
+        Ok(Self {
+            file,
+            staged: StagedFile {
+                temp_path,
+                dest: dest.to_path_buf(),
+                committed: false,
+            },
+        })
+    }
+
+    pub async fn commit(self) -> Result<(), AppError> {
+        self.close().await?.commit().await
+    }
+
+    /// Finish writing and release the file handle without committing.
+    pub async fn close(mut self) -> Result<StagedFile, AppError> {
+        self.file.flush().await?;
+        Ok(self.staged)
+    }
+}
+
+impl StagedFile {
+    pub async fn commit(mut self) -> Result<(), AppError> {
+        // Replacing an existing file keeps its mode rather than the temp file's
+        // umask default.
+        if let Ok(meta) = fs::metadata(&self.dest).await {
+            fs::set_permissions(&self.temp_path, meta.permissions()).await?;
+        }
+
+        match fs::rename(&self.temp_path, &self.dest).await {
+            Ok(()) => {}
+            Err(e) if e.raw_os_error() == Some(nix::errno::Errno::EXDEV as i32) => {
+                // Temp dir is on another filesystem: copy next to the destination,
+                // then rename so the final step stays atomic.
+                let staging = sibling_temp_path(&self.dest);
+                if let Err(e) = fs::copy(&self.temp_path, &staging).await {
+                    let _ = fs::remove_file(&staging).await;
+                    return Err(e.into());
+                }
+                if let Err(e) = fs::rename(&staging, &self.dest).await {
+                    let _ = fs::remove_file(&staging).await;
+                    return Err(e.into());
+                }
+                let _ = fs::remove_file(&self.temp_path).await;
+            }
+            Err(e) => return Err(e.into()),
+        }
+
+        self.committed = true;
+        Ok(())
+    }
+}
+
+impl AtomicFile {
+    /// Re-read what was written and compare its SHA-256 with `expected`
+    /// (hex, case-insensitive). On mismatch the destination is left untouched.
+    pub async fn verify_sha256(&mut self, expected: &str) -> Result<(), AppError> {
+        self.file.flush().await?;
+
+        let actual = sha256_file(&self.staged.temp_path).await?;
+        if !actual.eq_ignore_ascii_case(expected.trim()) {
+            return Err(AppError::BadRequest(format!(
+                "Checksum mismatch: expected {}, got {}",
+                expected, actual
+            )));
+        }
+        Ok(())
+    }
+}
+
+impl Drop for StagedFile {
+    fn drop(&mut self) {
+        if !self.committed {
+            let _ = std::fs::remove_file(&self.temp_path);
+        }
+    }
+}
+
+/// Hidden temporary path in the same directory as `dest`, so renaming it onto
+/// `dest` is atomic.
+pub fn sibling_temp_path(dest: &Path) -> PathBuf {
+    let name = dest
+        .file_name()
+        .map(|n| n.to_string_lossy().to_string())
+        .unwrap_or_default();
+    dest.with_file_name(format!(
+        ".{}.{}.tmp",
+        name,
+        crate::utils::common::generate_id()
+    ))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::os::unix::fs::PermissionsExt;
+
+    #[tokio::test]
+    async fn test_commit_preserves_mode() {
+        let dir = std::env::temp_dir().join(format!("atomic-mode-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let dest = dir.join("script.sh");
+        std::fs::write(&dest, "old").unwrap();
+        std::fs::set_permissions(&dest, std::fs::Permissions::from_mode(0o750)).unwrap();
+
+        let mut file = AtomicFile::create(None, &dest).await.unwrap();
+        file.file.write_all(b"new").await.unwrap();
+        file.commit().await.unwrap();
+
+        let meta = std::fs::metadata(&dest).unwrap();
+        assert_eq!(meta.permissions().mode() & 0o777, 0o750);
+        assert_eq!(std::fs::read_to_string(&dest).unwrap(), "new");
+
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+}
@@ -102,10 +102,340 @@ pub fn format_time(secs: u64) -> String {
     )
 }
 
+/// Parse an RFC 3339 timestamp such as "2024-01-01T12:00:00Z" or
+/// "2024-01-01T14:00:00.5+02:00". Returns `None` for anything malformed.
+pub fn parse_time(s: &str) -> Option<std::time::SystemTime> {
+    let s = s.trim();
+    let num = |range: std::ops::Range<usize>| -> Option<i64> {
+        let part = s.get(range)?;
+        if !part.bytes().all(|b| b.is_ascii_digit()) {
+            return None;
+        }
+        part.parse().ok()
+    };
+    let sep =
+        |idx: usize, allowed: &[u8]| s.as_bytes().get(idx).is_some_and(|b| allowed.contains(b));
+
+    if !(sep(4, b"-") && sep(7, b"-") && sep(10, b"Tt ") && sep(13, b":") && sep(16, b":")) {
+        return None;
+    }
+    let (year, month, day) = (num(0..4)?, num(5..7)?, num(8..10)?);
+    let (hour, minute, second) = (num(11..13)?, num(14..16)?, num(17..19)?);
+    if !(1..=12).contains(&month)
+        || !(1..=31).contains(&day)
+        || hour > 23
+        || minute > 59
+        || second > 60
+    {
+        return None;
+    }
+
+    let mut rest = &s[19..];
+    let mut nanos = 0u32;
+    if let Some(frac) = rest.strip_prefix('.') {
+        let digits = frac.bytes().take_while(|b| b.is_ascii_digit()).count();
+        if digits == 0 {
+            return None;
+        }
+        for (i, b) in frac.bytes().take(digits.min(9)).enumerate() {
+            nanos += (b - b'0') as u32 * 10u32.pow(8 - i as u32);
+        }
+        rest = &frac[digits..];
+    }
+    let offset = match rest {
+        "Z" | "z" => 0,
+        _ if rest.len() == 6 && rest.as_bytes()[3] == b':' => {
+            let sign = match rest.as_bytes()[0] {
+                b'+' => 1,
+                b'-' => -1,
+                _ => return None,
+            };
+            let (h, m) = (
+                rest.get(1..3)?.parse::<i64>().ok()?,
+                rest.get(4..6)?.parse::<i64>().ok()?,
+            );
+            sign * (h * 3600 + m * 60)
+        }
+        _ => return None,
+    };
+
+    // Days since the epoch for a proleptic Gregorian date (Howard Hinnant's algorithm)
+    let y = if month <= 2 { year - 1 } else { year };
+    let era = y.div_euclid(400);
+    let yoe = y - era * 400;
+    let doy = (153 * ((month + 9) % 12) + 2) / 5 + day - 1;
+    let doe = yoe * 365 + yoe / 4 - yoe / 100 + doy;
+    let days = era * 146097 + doe - 719468;
+
+    let secs = days * 86400 + hour * 3600 + minute * 60 + second - offset;
+    let since_epoch = std::time::Duration::new(secs.unsigned_abs(), 0);
+    let time = if secs >= 0 {
+        std::time::UNIX_EPOCH + since_epoch
+    } else {
+        std::time::UNIX_EPOCH - since_epoch
+    };
+    Some(time + std::time::Duration::from_nanos(nanos as u64))
+}
+
+const WEEKDAYS: [&str; 7] = ["Thu", "Fri", "Sat", "Sun", "Mon", "Tue", "Wed"];
+const MONTHS: [&str; 12] = [
+    "Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec",
+];
+
+/// Format an HTTP date (IMF-fixdate) such as "Sun, 06 Nov 1994 08:49:37 GMT",
+/// as used by `Last-Modified`.
+pub fn format_http_date(secs: u64) -> String {
+    // "YYYY-MM-DDTHH:MM:SSZ"
+    let iso = format_time(secs);
+    let month: usize = iso[5..7].parse().unwrap_or(1);
+    format!(
+        "{}, {} {} {} {} GMT",
+        WEEKDAYS[(secs / 86400 % 7) as usize],
+        &iso[8..10],
+        MONTHS[month - 1],
+        &iso[0..4],
+        &iso[11..19]
+    )
+}
+
+/// Parse an HTTP date in the IMF-fixdate format. The obsolete RFC 850 and
+/// asctime formats are not accepted.
+pub fn parse_http_date(s: &str) -> Option<std::time::SystemTime> {
+    let parts: Vec<&str> = s.split_whitespace().collect();
+    let [weekday, day, month, year, time, "GMT"] = parts[..] else {
+        return None;
+    };
+    if !weekday.ends_with(',') || day.len() != 2 {
+        return None;
+    }
+    let month = MONTHS.iter().position(|m| *m == month)? + 1;
+    parse_time(&format!("{}-{:02}-{}T{}Z", year, month, day, time))
+}
+
+/// Parse a simple duration such as "90s", "30m", "24h" or "7d".
+/// A bare number is interpreted as seconds.
+pub fn parse_duration(s: &str) -> Option<std::time::Duration> {
+    let s = s.trim();
+    let split = s.find(|c: char| !c.is_ascii_digit()).unwrap_or(s.len());
+    let (num, unit) = s.split_at(split);
+    let value: u64 = num.parse().ok()?;
+    let multiplier = match unit {
+        "" | "s" => 1,
+        "m" => 60,
+        "h" => 60 * 60,
+        "d" => 24 * 60 * 60,
+        _ => return None,
+    };
+    value
+        .checked_mul(multiplier)
+        .map(std::time::Duration::from_secs)
+}
+
+/// Digest algorithms supported for file checksums
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum HashAlgorithm {
+    Sha256,
+    Sha1,
+    Md5,
+    Crc32,
+}
+
+impl HashAlgorithm {
+    pub fn parse(name: &str) -> Option<Self> {
+        match name.to_ascii_lowercase().as_str() {
+            "sha256" => Some(HashAlgorithm::Sha256),
+            "sha1" => Some(HashAlgorithm::Sha1),
+            "md5" => Some(HashAlgorithm::Md5),
+            "crc32" => Some(HashAlgorithm::Crc32),
+            _ => None,
+        }
+    }
+
+    pub fn name(&self) -> &'static str {
+        match self {
+            HashAlgorithm::Sha256 => "sha256",
+            HashAlgorithm::Sha1 => "sha1",
+            HashAlgorithm::Md5 => "md5",
+            HashAlgorithm::Crc32 => "crc32",
+        }
+    }
+}
+
+enum Digester {
+    Sha256(sha2::Sha256),
+    Sha1(sha1::Sha1),
+    Md5(md5::Md5),
+    Crc32(crc32fast::Hasher),
+}
+
+impl Digester {
+    fn new(algorithm: HashAlgorithm) -> Self {
+        use sha2::Digest;
+        match algorithm {
+            HashAlgorithm::Sha256 => Digester::Sha256(sha2::Sha256::new()),
+            HashAlgorithm::Sha1 => Digester::Sha1(sha1::Sha1::new()),
+            HashAlgorithm::Md5 => Digester::Md5(md5::Md5::new()),
+            HashAlgorithm::Crc32 => Digester::Crc32(crc32fast::Hasher::new()),
+        }
+    }
+
+    fn update(&mut self, data: &[u8]) {
+        use sha2::Digest;
+        match self {
+            Digester::Sha256(h) => h.update(data),
+            Digester::Sha1(h) => h.update(data),
+            Digester::Md5(h) => h.update(data),
+            Digester::Crc32(h) => h.update(data),
+        }
+    }
+
+    fn finalize_hex(self) -> String {
+        use sha2::Digest;
+        let bytes = match self {
+            Digester::Sha256(h) => h.finalize().to_vec(),
+            Digester::Sha1(h) => h.finalize().to_vec(),
+            Digester::Md5(h) => h.finalize().to_vec(),
+            Digester::Crc32(h) => h.finalize().to_be_bytes().to_vec(),
+        };
+        bytes.iter().map(|b| format!("{:02x}", b)).collect()
+    }
+}
+
+/// Hex-encoded digest of the file at `path`, read in 64 KiB chunks.
+pub async fn digest_file(
+    path: &std::path::Path,
+    algorithm: HashAlgorithm,
+) -> std::io::Result<String> {
+    use tokio::io::AsyncReadExt;
+
+    let mut file = tokio::fs::File::open(path).await?;
+    let mut digester = Digester::new(algorithm);
+    let mut buf = vec![0u8; 64 * 1024];
+    loop {
+        let n = file.read(&mut buf).await?;
+        if n == 0 {
+            break;
+        }
+        digester.update(&buf[..n]);
+    }
+
+    Ok(digester.finalize_hex())
+}
+
+/// Hex-encoded SHA-256 of the file at `path`.
+pub async fn sha256_file(path: &std::path::Path) -> std::io::Result<String> {
+    digest_file(path, HashAlgorithm::Sha256).await
+}
+
+/// Remove ANSI escape sequences (colors, cursor movement, OSC titles) and
+/// carriage returns, leaving the plain text a terminal would display.
+pub fn strip_ansi(s: &str) -> String {
+    let mut out = String::with_capacity(s.len());
+    let mut chars = s.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '\x1b' => match chars.next() {
+                // CSI: parameters and intermediates up to a final byte in @..~
+                Some('[') => {
+                    for c in chars.by_ref() {
+                        if ('@'..='~').contains(&c) {
+                            break;
+                        }
+                    }
+                }
+                // OSC: terminated by BEL or ESC \
+                Some(']') => {
+                    while let Some(c) = chars.next() {
+                        if c == '\x07' {
+                            break;
+                        }
+                        if c == '\x1b' {
+                            chars.next_if_eq(&'\\');
+                            break;
+                        }
+                    }
+                }
+                _ => {}
+            },
+            '\r' => {}
+            _ => out.push(c),
+        }
+    }
+    out
+}
+
+/// Appended to a log line cut off at the line length limit
+pub const TRUNCATION_MARKER: &str = "...[truncated]";
+
+/// Read one line into `line`, keeping at most `max` bytes of it plus the
+/// newline; the rest of an overlong line is skipped rather than returned as
+/// further lines. Returns the bytes consumed (0 at EOF) and whether the line
+/// was cut.
+pub async fn read_line_limited<R: tokio::io::AsyncBufRead + Unpin>(
+    reader: &mut R,
+    line: &mut Vec<u8>,
+    max: usize,
+) -> std::io::Result<(usize, bool)> {
+    use tokio::io::AsyncBufReadExt;
+
+    let mut consumed = 0;
+    let mut truncated = false;
+    loop {
+        let buf = reader.fill_buf().await?;
+        if buf.is_empty() {
+            break;
+        }
+        let (chunk, done) = match buf.iter().position(|&b| b == b'\n') {
+            Some(i) => (&buf[..i], true),
+            None => (buf, false),
+        };
+        let room = max.saturating_sub(line.len());
+        truncated |= chunk.len() > room;
+        line.extend_from_slice(&chunk[..chunk.len().min(room)]);
+        let n = chunk.len() + done as usize;
+        reader.consume(n);
+        consumed += n;
+        if done {
+            line.push(b'\n');
+            break;
+        }
+    }
+    Ok((consumed, truncated))
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
 
+    #[tokio::test]
+    async fn test_read_line_limited() {
+        let mut reader: &[u8] = b"short\n0123456789abc\ntail";
+        let mut line = Vec::new();
+
+        assert_eq!(
+            read_line_limited(&mut reader, &mut line, 8).await.unwrap(),
+            (6, false)
+        );
+        assert_eq!(line, b"short\n");
+        line.clear();
+        assert_eq!(
+            read_line_limited(&mut reader, &mut line, 8).await.unwrap(),
+            (14, true)
+        );
+        assert_eq!(line, b"01234567\n");
+        line.clear();
+        assert_eq!(
+            read_line_limited(&mut reader, &mut line, 8).await.unwrap(),
+            (4, false)
+        );
+        assert_eq!(line, b"tail");
+        line.clear();
+        assert_eq!(
+            read_line_limited(&mut reader, &mut line, 8).await.unwrap(),
+            (0, false)
+        );
+    }
+
     #[test]
     fn test_generate_id_length() {
         let id = generate_id();
@@ -149,4 +479,88 @@ mod tests {
             }
         }
     }
+
+    #[test]
+    fn test_parse_duration() {
+        use std::time::Duration;
+        assert_eq!(parse_duration("90"), Some(Duration::from_secs(90)));
+        assert_eq!(parse_duration("90s"), Some(Duration::from_secs(90)));
+        assert_eq!(parse_duration("30m"), Some(Duration::from_secs(1800)));
+        assert_eq!(parse_duration("24h"), Some(Duration::from_secs(86400)));
+        assert_eq!(parse_duration("7d"), Some(Duration::from_secs(604800)));
+        assert_eq!(parse_duration(""), None);
+        assert_eq!(parse_duration("h"), None);
+        assert_eq!(parse_duration("10w"), None);
+    }
+
+    #[test]
+    fn test_strip_ansi() {
+        assert_eq!(strip_ansi("plain"), "plain");
+        assert_eq!(strip_ansi("\x1b[1;31merror\x1b[0m: x\r\n"), "error: x\n");
+        assert_eq!(strip_ansi("\x1b]0;title\x07done"), "done");
+        assert_eq!(strip_ansi("\x1b]8;;http://a\x1b\\link"), "link");
+        assert_eq!(strip_ansi("\x1b[2K\x1b[1Gprogress"), "progress");
+    }
+
+    #[test]
+    fn test_digest_algorithms() {
+        let cases = [
+            (
+                HashAlgorithm::Sha256,
+                "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+            ),
+            (
+                HashAlgorithm::Sha1,
+                "a9993e364706816aba3e25717850c26c9cd0d89d",
+            ),
+            (HashAlgorithm::Md5, "900150983cd24fb0d6963f7d28e17f72"),
+            (HashAlgorithm::Crc32, "352441c2"),
+        ];
+        for (algorithm, expected) in cases {
+            let mut digester = Digester::new(algorithm);
+            digester.update(b"ab");
+            digester.update(b"c");
+            assert_eq!(digester.finalize_hex(), expected, "{}", algorithm.name());
+            assert_eq!(HashAlgorithm::parse(algorithm.name()), Some(algorithm));
+        }
+        assert_eq!(HashAlgorithm::parse("SHA256"), Some(HashAlgorithm::Sha256));
+        assert_eq!(HashAlgorithm::parse("sha512"), None);
+    }
+
+    #[test]
+    fn test_parse_time() {
+        let at = |secs: u64| std::time::UNIX_EPOCH + std::time::Duration::from_secs(secs);
+        assert_eq!(parse_time("2024-01-01T12:00:00Z"), Some(at(1704110400)));
+        assert_eq!(parse_time(&format_time(1704110400)), Some(at(1704110400)));
+        assert_eq!(
+            parse_time("2024-01-01T14:00:00+02:00"),
+            Some(at(1704110400))
+        );
+        assert_eq!(parse_time("1970-01-01T00:00:00Z"), Some(at(0)));
+        assert_eq!(
+            parse_time("2024-02-29T00:00:00.25Z"),
+            Some(at(1709164800) + std::time::Duration::from_millis(250))
+        );
+        assert_eq!(parse_time("2024-01-01"), None);
+        assert_eq!(parse_time("2024-13-01T00:00:00Z"), None);
+        assert_eq!(parse_time("2024-01-01T00:00:00"), None);
+        assert_eq!(parse_time("2024-01-01T00:00:00+0200"), None);
+    }
+
+    #[test]
+    fn test_http_date() {
+        let at = |secs: u64| std::time::UNIX_EPOCH + std::time::Duration::from_secs(secs);
+        assert_eq!(format_http_date(784111777), "Sun, 06 Nov 1994 08:49:37 GMT");
+        assert_eq!(format_http_date(0), "Thu, 01 Jan 1970 00:00:00 GMT");
+        assert_eq!(
+            parse_http_date("Sun, 06 Nov 1994 08:49:37 GMT"),
+            Some(at(784111777))
+        );
+        assert_eq!(
+            parse_http_date(&format_http_date(1709164800)),
+            Some(at(1709164800))
+        );
+        assert_eq!(parse_http_date("Sunday, 06-Nov-94 08:49:37 GMT"), None);
+        assert_eq!(parse_http_date("Sun, 06 Nov 1994 08:49:37 PST"), None);
+    }
 }
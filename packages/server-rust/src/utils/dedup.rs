@@ -0,0 +1,198 @@
+//! Content-addressable deduplication of uploaded files.
+//!
+//! With `DEDUP` enabled every uploaded file is hashed once it has been written.
+//! The first copy of some content is hardlinked into the blob store under its
+//! SHA-256; later uploads of the same content are replaced by a hardlink to
+//! that blob. The link count doubles as the reference count: a blob whose only
+//! remaining link is the store entry itself is no longer referenced and is
+//! removed by `sweep`.
+//!
+//! The store lives outside the workspace, so listings, searches and stale-file
+//! cleanup never see it, but on the same filesystem, which hardlinks require.
+//!
+//! Hardlinked files share their data and their inode, so anything that
+//! modifies a file in place, including `chmod` and `chown`, must `detach` it
+//! first. Atomic writes replace the link and are safe.
+
+use crate::error::AppError;
+use crate::utils::atomic::sibling_temp_path;
+use crate::utils::common::sha256_file;
+use crate::utils::path::ensure_directory;
+use std::io::ErrorKind;
+use std::os::unix::fs::MetadataExt;
+use std::path::{Path, PathBuf};
+use tokio::fs;
+
+/// Default blob store directory name, next to the workspace
+pub const STORE_DIR: &str = ".devbox-dedup";
+
+/// How often unreferenced blobs left behind by overwrites are collected
+pub const SWEEP_INTERVAL: std::time::Duration = std::time::Duration::from_secs(600);
+
+pub struct DedupStore {
+    dir: PathBuf,
+}
+
+impl DedupStore {
+    pub fn new(config: &crate::config::Config) -> Self {
+        let dir =
+            config
+                .dedup_dir
+                .clone()
+                .unwrap_or_else(|| match config.workspace_path.parent() {
+                    Some(parent) => parent.join(STORE_DIR),
+                    None => std::env::temp_dir().join(STORE_DIR),
+                });
+        Self { dir }
+    }
+
+    /// Directory holding the blobs
+    pub fn dir(&self) -> &Path {
+        &self.dir
+    }
+
+    /// Replace `path` with a hardlink to the stored blob of identical content,
+    /// or store it as the first copy. Returns true when it was deduplicated.
+    pub async fn link(&self, path: &Path) -> Result<bool, AppError> {
+        let metadata = fs::metadata(path).await?;
+        if !metadata.is_file() || metadata.len() == 0 {
+            return Ok(false);
+        }
+
+        ensure_directory(&self.dir).await?;
+        let hash = sha256_file(path).await?;
+        let blob = self.dir.join(&hash);
+
+        match fs::hard_link(path, &blob).await {
+            Ok(()) => return Ok(false),
+            Err(e) if e.kind() == ErrorKind::AlreadyExists => {}
+            Err(e) => return Err(e.into()),
+        }
+
+        // The blob shares its data with every linked file, so an in-place write
+        // through one of them may have changed it since it was stored.
+        if sha256_file(&blob).await? != hash {
+            fs::remove_file(&blob).await?;
+            fs::hard_link(path, &blob).await?;
+            return Ok(false);
+        }
+
+        let staging = sibling_temp_path(path);
+        fs::hard_link(&blob, &staging).await?;
+        if let Err(e) = fs::rename(&staging, path).await {
+            let _ = fs::remove_file(&staging).await;
+            return Err(e.into());
+        }
+        Ok(true)
+    }
+
+    /// Give `path` its own copy of the data before it is modified in place, so
+    /// the change does not leak into other files sharing the same blob.
+    pub async fn detach(&self, path: &Path) -> Result<(), AppError> {
+        let metadata = match fs::metadata(path).await {
+            Ok(metadata) => metadata,
+            Err(e) if e.kind() == ErrorKind::NotFound => return Ok(()),
+            Err(e) => return Err(e.into()),
+        };
+        if !metadata.is_file() || metadata.nlink() <= 1 {
+            return Ok(());
+        }
+
+        let staging = sibling_temp_path(path);
+        if let Err(e) = fs::copy(path, &staging).await {
+            let _ = fs::remove_file(&staging).await;
+            return Err(e.into());
+        }
+        if let Err(e) = fs::rename(&staging, path).await {
+            let _ = fs::remove_file(&staging).await;
+            return Err(e.into());
+        }
+        Ok(())
+    }
+
+    /// Remove blobs that no file links to anymore.
+    pub async fn sweep(&self) {
+        let mut entries = match fs::read_dir(&self.dir).await {
+            Ok(entries) => entries,
+            Err(e) if e.kind() == ErrorKind::NotFound => return,
+            Err(e) => {
+                println!("Failed to read dedup store {:?}: {}", self.dir, e);
+                return;
+            }
+        };
+
+        while let Ok(Some(entry)) = entries.next_entry().await {
+            let Ok(metadata) = entry.metadata().await else {
+                continue;
+            };
+            if metadata.is_file() && metadata.nlink() <= 1 {
+                if let Err(e) = fs::remove_file(entry.path()).await {
+                    println!(
+                        "Failed to remove unreferenced blob {:?}: {}",
+                        entry.path(),
+                        e
+                    );
+                }
+            }
+        }
+    }
+}
+
+/// `DedupStore::detach` when dedup is enabled; call before modifying `path`
+/// in place.
+pub async fn detach(store: Option<&DedupStore>, path: &Path) -> Result<(), AppError> {
+    match store {
+        Some(store) => store.detach(path).await,
+        None => Ok(()),
+    }
+}
+
+/// Deduplicate a freshly written upload. Returns `None` when dedup is disabled;
+/// failures are logged and reported as not deduplicated since the upload
+/// itself already succeeded.
+pub async fn deduplicate(store: Option<&DedupStore>, path: &Path) -> Option<bool> {
+    let store = store?;
+    match store.link(path).await {
+        Ok(deduplicated) => Some(deduplicated),
+        Err(e) => {
+            println!("Failed to deduplicate {:?}: {}", path, e);
+            Some(false)
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::os::unix::fs::PermissionsExt;
+
+    #[tokio::test]
+    async fn test_detach_keeps_other_copies() {
+        let dir = std::env::temp_dir().join(format!("dedup-test-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("ws")).unwrap();
+        let store = DedupStore {
+            dir: dir.join("store"),
+        };
+        let (a, b) = (dir.join("ws/a"), dir.join("ws/b"));
+        std::fs::write(&a, b"same").unwrap();
+        std::fs::write(&b, b"same").unwrap();
+        std::fs::set_permissions(&a, std::fs::Permissions::from_mode(0o644)).unwrap();
+        assert!(!store.link(&a).await.unwrap());
+        assert!(store.link(&b).await.unwrap());
+
+        // chmod changes the shared inode unless the file is detached first
+        detach(Some(&store), &b).await.unwrap();
+        std::fs::set_permissions(&b, std::fs::Permissions::from_mode(0o600)).unwrap();
+        std::fs::write(&b, b"changed").unwrap();
+
+        let meta = std::fs::metadata(&a).unwrap();
+        assert_eq!(meta.permissions().mode() & 0o777, 0o644);
+        assert_eq!(std::fs::read(&a).unwrap(), b"same");
+        assert_eq!(std::fs::metadata(&b).unwrap().nlink(), 1);
+
+        // Missing files have nothing to detach
+        detach(Some(&store), &dir.join("ws/missing")).await.unwrap();
+
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+}
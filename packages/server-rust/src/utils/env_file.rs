@@ -0,0 +1,167 @@
+//! Parsing of dotenv-style environment files referenced by `envFile`.
+
+use crate::error::AppError;
+use crate::state::AppState;
+use crate::utils::path::workspace_relative_path;
+use std::collections::HashMap;
+
+/// Parse `KEY=VALUE` lines. Blank lines and `#` comments are skipped, an
+/// optional `export ` prefix is accepted, and values may be single quoted
+/// (literal), double quoted (with `\n`, `\t`, `\"` and `\\` escapes) or bare
+/// (trailing ` #` comments are stripped).
+pub fn parse_env_file(content: &str) -> Result<HashMap<String, String>, String> {
+    let mut env = HashMap::new();
+
+    for (idx, raw_line) in content.lines().enumerate() {
+        let line_no = idx + 1;
+        let line = raw_line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let line = line.strip_prefix("export ").unwrap_or(line);
+
+        let (key, value) = line
+            .split_once('=')
+            .ok_or_else(|| format!("line {}: expected KEY=VALUE", line_no))?;
+        let key = key.trim();
+        let valid_key = key
+            .chars()
+            .next()
+            .is_some_and(|c| c == '_' || c.is_ascii_alphabetic())
+            && key.chars().all(|c| c == '_' || c.is_ascii_alphanumeric());
+        if !valid_key {
+            return Err(format!("line {}: invalid variable name {:?}", line_no, key));
+        }
+
+        let value = value.trim();
+        let value = if let Some(rest) = value.strip_prefix('\'') {
+            let end = rest
+                .find('\'')
+                .ok_or_else(|| format!("line {}: unterminated single quote", line_no))?;
+            rest[..end].to_string()
+        } else if let Some(rest) = value.strip_prefix('"') {
+            let mut out = String::new();
+            let mut chars = rest.chars();
+            loop {
+                match chars.next() {
+                    None => return Err(format!("line {}: unterminated double quote", line_no)),
+                    Some('"') => break,
+                    Some('\\') => match chars.next() {
+                        Some('n') => out.push('\n'),
+                        Some('t') => out.push('\t'),
+                        Some('r') => out.push('\r'),
+                        Some(c) => out.push(c),
+                        None => return Err(format!("line {}: unterminated double quote", line_no)),
+                    },
+                    Some(c) => out.push(c),
+                }
+            }
+            out
+        } else {
+            match value.find(" #") {
+                Some(pos) => value[..pos].trim_end().to_string(),
+                None => value.to_string(),
+            }
+        };
+
+        env.insert(key.to_string(), value);
+    }
+
+    Ok(env)
+}
+
+/// Load `env_file` (which must lie inside the workspace and not be denied)
+/// and merge `env` over it, so explicitly passed variables win over the file.
+pub async fn merge_env_file(
+    state: &AppState,
+    env_file: Option<&str>,
+    env: Option<HashMap<String, String>>,
+) -> Result<Option<HashMap<String, String>>, AppError> {
+    let Some(env_file) = env_file else {
+        return Ok(env);
+    };
+
+    let path = state.resolve_path(env_file)?;
+    if workspace_relative_path(&state.config.workspace_path, &path).is_none() {
+        return Err(AppError::Forbidden(format!(
+            "envFile must be inside the workspace: {}",
+            env_file
+        )));
+    }
+
+    let content = tokio::fs::read_to_string(&path)
+        .await
+        .map_err(|e| match e.kind() {
+            std::io::ErrorKind::NotFound => {
+                AppError::NotFound(format!("envFile not found: {}", env_file))
+            }
+            _ => AppError::BadRequest(format!("Failed to read envFile {}: {}", env_file, e)),
+        })?;
+    let mut merged = parse_env_file(&content)
+        .map_err(|e| AppError::BadRequest(format!("Invalid envFile {}: {}", env_file, e)))?;
+    merged.extend(env.unwrap_or_default());
+    Ok(Some(merged))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_env_file() {
+        let content = r#"
+# comment
+PLAIN=value
+export EXPORTED=yes
+SPACED = padded  # trailing comment
+SINGLE='literal $HOME \n'
+DOUBLE="line\nbreak \"quoted\""
+EMPTY=
+HASH=a#b
+"#;
+        let env = parse_env_file(content).unwrap();
+        assert_eq!(env["PLAIN"], "value");
+        assert_eq!(env["EXPORTED"], "yes");
+        assert_eq!(env["SPACED"], "padded");
+        assert_eq!(env["SINGLE"], "literal $HOME \\n");
+        assert_eq!(env["DOUBLE"], "line\nbreak \"quoted\"");
+        assert_eq!(env["EMPTY"], "");
+        assert_eq!(env["HASH"], "a#b");
+        assert_eq!(env.len(), 7);
+    }
+
+    #[test]
+    fn test_parse_env_file_errors() {
+        assert!(parse_env_file("NO_EQUALS").is_err());
+        assert!(parse_env_file("1BAD=x").is_err());
+        assert!(parse_env_file("OPEN=\"unterminated").is_err());
+        assert!(parse_env_file("OPEN='unterminated").is_err());
+    }
+
+    #[tokio::test]
+    async fn test_merge_env_file_denied() {
+        let dir = std::env::temp_dir().join(format!("env-file-denied-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("secrets")).unwrap();
+        std::fs::write(dir.join(".env"), "A=1\nB=2\n").unwrap();
+        std::fs::write(dir.join("secrets/.env"), "TOKEN=x\n").unwrap();
+        let mut config = crate::config::Config::load();
+        config.workspace_path = dir.clone();
+        config.denied_paths = vec!["secrets".to_string()];
+        let state = AppState::new(config);
+
+        let env = HashMap::from([("B".to_string(), "3".to_string())]);
+        let merged = merge_env_file(&state, Some(".env"), Some(env))
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(merged["A"], "1");
+        assert_eq!(merged["B"], "3");
+
+        assert!(matches!(
+            merge_env_file(&state, Some("secrets/.env"), None).await,
+            Err(AppError::Forbidden(_))
+        ));
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -0,0 +1,78 @@
+//! Extension-based MIME type guessing.
+
+use std::path::Path;
+
+/// Best-effort MIME type from the file extension, `None` when unknown.
+pub fn mime_type(path: &Path) -> Option<&'static str> {
+    let ext = path.extension()?.to_str()?.to_ascii_lowercase();
+    Some(match ext.as_str() {
+        "png" => "image/png",
+        "jpg" | "jpeg" => "image/jpeg",
+        "gif" => "image/gif",
+        "webp" => "image/webp",
+        "bmp" => "image/bmp",
+        "ico" => "image/x-icon",
+        "svg" => "image/svg+xml",
+        "pdf" => "application/pdf",
+        "mp4" => "video/mp4",
+        "webm" => "video/webm",
+        "mp3" => "audio/mpeg",
+        "wav" => "audio/wav",
+        "ogg" => "audio/ogg",
+        "json" => "application/json",
+        "txt" | "md" | "log" | "csv" | "yaml" | "yml" | "toml" => "text/plain; charset=utf-8",
+        "html" | "htm" => "text/html; charset=utf-8",
+        "css" => "text/css; charset=utf-8",
+        "js" | "mjs" => "text/javascript; charset=utf-8",
+        "xml" => "application/xml",
+        "wasm" => "application/wasm",
+        "zip" => "application/zip",
+        "gz" | "tgz" => "application/gzip",
+        "tar" => "application/x-tar",
+        _ => return None,
+    })
+}
+
+/// MIME type for files browsers can preview inline. Anything that could run
+/// script in the server's origin (HTML, SVG, JavaScript) is excluded.
+pub fn preview_mime_type(path: &Path) -> Option<&'static str> {
+    let mime = mime_type(path)?;
+    let previewable = (mime.starts_with("image/") && mime != "image/svg+xml")
+        || mime.starts_with("video/")
+        || mime.starts_with("audio/")
+        || mime.starts_with("text/plain")
+        || mime == "application/pdf"
+        || mime == "application/json";
+    previewable.then_some(mime)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_mime_type() {
+        assert_eq!(mime_type(Path::new("a/photo.PNG")), Some("image/png"));
+        assert_eq!(
+            mime_type(Path::new("index.html")),
+            Some("text/html; charset=utf-8")
+        );
+        assert_eq!(mime_type(Path::new("Makefile")), None);
+        assert_eq!(mime_type(Path::new("data.bin")), None);
+    }
+
+    #[test]
+    fn test_preview_mime_type() {
+        assert_eq!(
+            preview_mime_type(Path::new("doc.pdf")),
+            Some("application/pdf")
+        );
+        assert_eq!(
+            preview_mime_type(Path::new("notes.md")),
+            Some("text/plain; charset=utf-8")
+        );
+        assert_eq!(preview_mime_type(Path::new("index.html")), None);
+        assert_eq!(preview_mime_type(Path::new("logo.svg")), None);
+        assert_eq!(preview_mime_type(Path::new("app.js")), None);
+    }
+}
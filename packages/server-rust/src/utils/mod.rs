@@ -1,2 +1,11 @@
+pub mod atomic;
 pub mod common;
+pub mod dedup;
+pub mod env_file;
+pub mod mime;
 pub mod path;
+pub mod pty;
+pub mod quota;
+pub mod range;
+pub mod singleflight;
+pub mod usage;
@@ -58,6 +58,120 @@ pub async fn ensure_directory(path: &Path) -> Result<(), AppError> {
     Ok(())
 }
 
+/// Message for a recursive walk that went deeper than the configured maximum depth.
+pub fn depth_exceeded_message(max_depth: usize, path: &Path) -> String {
+    format!(
+        "Maximum traversal depth ({}) exceeded at {}",
+        max_depth,
+        path.display()
+    )
+}
+
+/// Absolute form of `path`, resolving relative paths against the server's
+/// current directory (e.g. when the workspace itself is configured relative).
+pub fn absolute_path(path: &Path) -> PathBuf {
+    normalize_path(&std::path::absolute(path).unwrap_or_else(|_| path.to_path_buf()))
+}
+
+/// Path relative to the workspace, or `None` when `path` lies outside of it.
+pub fn workspace_relative_path(base_path: &Path, path: &Path) -> Option<String> {
+    absolute_path(path)
+        .strip_prefix(absolute_path(base_path))
+        .ok()
+        .map(|p| p.to_string_lossy().to_string())
+}
+
+/// Reject mutations of `path` when it lies under one of the configured
+/// read-only prefixes, or contains one (e.g. deleting a parent directory).
+pub fn ensure_writable(read_only_paths: &[PathBuf], path: &Path) -> Result<(), AppError> {
+    let path = absolute_path(path);
+    for prefix in read_only_paths {
+        let prefix = absolute_path(prefix);
+        if path.starts_with(&prefix) || prefix.starts_with(&path) {
+            return Err(AppError::Forbidden(format!(
+                "Path is read-only: {}",
+                path.display()
+            )));
+        }
+    }
+    Ok(())
+}
+
+/// Match `text` against a glob where `*` and `?` stay within one path
+/// component and `**` also crosses `/`.
+pub fn glob_match(pattern: &str, text: &str) -> bool {
+    fn matches(p: &[u8], t: &[u8]) -> bool {
+        match p {
+            [] => t.is_empty(),
+            [b'*', b'*', rest @ ..] => {
+                let rest = rest.strip_prefix(b"/").unwrap_or(rest);
+                (0..=t.len()).any(|i| matches(rest, &t[i..]))
+            }
+            [b'*', rest @ ..] => (0..=t.len())
+                .take_while(|&i| i == 0 || t[i - 1] != b'/')
+                .any(|i| matches(rest, &t[i..])),
+            [b'?', rest @ ..] => matches!(t, [c, ..] if *c != b'/') && matches(rest, &t[1..]),
+            [c, rest @ ..] => t.first() == Some(c) && matches(rest, &t[1..]),
+        }
+    }
+    matches(pattern.as_bytes(), text.as_bytes())
+}
+
+/// Workspace paths that no file operation may touch (`DENIED_PATHS`).
+///
+/// Patterns are globs matched against the workspace-relative path. A pattern
+/// without `/` matches any single component (`.git` denies `.git` at every
+/// level), one with `/` matches from the workspace root. Everything below a
+/// denied path is denied as well.
+#[derive(Debug, Clone, Default)]
+pub struct DeniedPaths {
+    workspace_path: PathBuf,
+    patterns: Vec<String>,
+}
+
+impl DeniedPaths {
+    pub fn new(workspace_path: &Path, patterns: Vec<String>) -> Self {
+        Self {
+            workspace_path: workspace_path.to_path_buf(),
+            patterns,
+        }
+    }
+
+    pub fn is_denied(&self, path: &Path) -> bool {
+        if self.patterns.is_empty() {
+            return false;
+        }
+        let Some(relative) = workspace_relative_path(&self.workspace_path, path) else {
+            return false;
+        };
+        let components: Vec<&str> = relative.split('/').filter(|c| !c.is_empty()).collect();
+        self.patterns.iter().any(|pattern| {
+            let pattern = pattern.trim_matches('/');
+            if pattern.contains('/') {
+                (1..=components.len()).any(|n| glob_match(pattern, &components[..n].join("/")))
+            } else {
+                components.iter().any(|c| glob_match(pattern, c))
+            }
+        })
+    }
+
+    /// Whether no patterns are configured, so nothing is denied
+    pub fn is_empty(&self) -> bool {
+        self.patterns.is_empty()
+    }
+
+    /// Forbid access to denied paths.
+    pub fn check(&self, path: &Path) -> Result<(), AppError> {
+        if self.is_denied(path) {
+            return Err(AppError::Forbidden(format!(
+                "Path is not permitted: {}",
+                absolute_path(path).display()
+            )));
+        }
+        Ok(())
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -118,4 +232,64 @@ mod tests {
         let res = validate_path(base, "../../etc/passwd").unwrap();
         assert_eq!(res, PathBuf::from("/etc/passwd"));
     }
+
+    #[test]
+    fn test_workspace_relative_path() {
+        let base = Path::new("/home/devbox/project");
+        assert_eq!(
+            workspace_relative_path(base, Path::new("/home/devbox/project/src/main.rs")),
+            Some("src/main.rs".to_string())
+        );
+        assert_eq!(
+            workspace_relative_path(base, Path::new("/etc/passwd")),
+            None
+        );
+    }
+
+    #[test]
+    fn test_ensure_writable() {
+        let read_only = vec![PathBuf::from("/home/devbox/project/cache")];
+        let check = |p: &str| ensure_writable(&read_only, Path::new(p)).is_ok();
+        assert!(check("/home/devbox/project/src/main.rs"));
+        assert!(check("/home/devbox/project/cache2/a"));
+        assert!(!check("/home/devbox/project/cache"));
+        assert!(!check("/home/devbox/project/cache/lib/a.js"));
+        // Parents of a read-only path cannot be deleted or moved either
+        assert!(!check("/home/devbox/project"));
+        assert!(ensure_writable(&[], Path::new("/home/devbox/project/cache")).is_ok());
+    }
+
+    #[test]
+    fn test_glob_match() {
+        assert!(glob_match(".git", ".git"));
+        assert!(!glob_match(".git", ".github"));
+        assert!(glob_match("*.pem", "server.pem"));
+        assert!(!glob_match("*.pem", "certs/server.pem"));
+        assert!(glob_match("secrets/*", "secrets/key"));
+        assert!(glob_match("**/id_?sa", "home/.ssh/id_rsa"));
+        assert!(glob_match("**/id_?sa", "id_dsa"));
+        assert!(glob_match("build/**", "build/a/b"));
+        assert!(!glob_match("?", "/"));
+    }
+
+    #[test]
+    fn test_denied_paths() {
+        let base = Path::new("/home/devbox/project");
+        let denied = DeniedPaths::new(base, vec![".git".to_string(), "config/*.key".to_string()]);
+        assert!(denied.is_denied(Path::new("/home/devbox/project/.git")));
+        assert!(denied.is_denied(Path::new("/home/devbox/project/.git/config")));
+        assert!(denied.is_denied(Path::new("/home/devbox/project/sub/.git/HEAD")));
+        assert!(denied.is_denied(Path::new("/home/devbox/project/config/app.key")));
+        assert!(!denied.is_denied(Path::new("/home/devbox/project/sub/config/app.key")));
+        assert!(!denied.is_denied(Path::new("/home/devbox/project/.github/ci.yml")));
+        assert!(!denied.is_denied(Path::new("/home/devbox/project")));
+        assert!(!denied.is_denied(Path::new("/etc/.git")));
+        assert!(denied
+            .check(Path::new("/home/devbox/project/src/main.rs"))
+            .is_ok());
+        assert!(matches!(
+            denied.check(Path::new("/home/devbox/project/.git")),
+            Err(AppError::Forbidden(_))
+        ));
+    }
 }
@@ -0,0 +1,46 @@
+//! Pseudo-terminal allocation for spawned commands.
+
+use nix::pty::{openpty, Winsize};
+use std::process::Stdio;
+use tokio::process::Command;
+
+/// Terminal size reported to commands running under a PTY
+const PTY_WINSIZE: Winsize = Winsize {
+    ws_row: 24,
+    ws_col: 120,
+    ws_xpixel: 0,
+    ws_ypixel: 0,
+};
+
+/// Connect `cmd`'s stdin, stdout and stderr to a new pseudo-terminal that
+/// becomes the child's controlling terminal, so tools keep colors and other
+/// TTY-only output. Returns the master side, which yields stdout and stderr
+/// interleaved. `TERM` defaults to `xterm-256color`; set env afterwards to
+/// override it.
+///
+/// Drop `cmd` once spawned: it holds the parent's copies of the slave, and
+/// reads from the master only end after every copy is closed.
+pub fn attach_pty(cmd: &mut Command) -> std::io::Result<tokio::fs::File> {
+    let pty =
+        openpty(&PTY_WINSIZE, None::<&nix::sys::termios::Termios>).map_err(std::io::Error::from)?;
+
+    cmd.stdin(Stdio::from(pty.slave.try_clone()?));
+    cmd.stdout(Stdio::from(pty.slave.try_clone()?));
+    cmd.stderr(Stdio::from(pty.slave));
+    cmd.env("TERM", "xterm-256color");
+
+    // SAFETY: in the forked child, setsid starts a new session and the
+    // TIOCSCTTY ioctl on fd 0 (already the pty slave) makes it the controlling
+    // terminal. Both are bare syscalls that need no allocation or locks.
+    unsafe {
+        cmd.pre_exec(|| {
+            nix::unistd::setsid().map_err(std::io::Error::from)?;
+            if nix::libc::ioctl(0, nix::libc::TIOCSCTTY, 0) == -1 {
+                return Err(std::io::Error::last_os_error());
+            }
+            Ok(())
+        });
+    }
+
+    Ok(tokio::fs::File::from_std(std::fs::File::from(pty.master)))
+}
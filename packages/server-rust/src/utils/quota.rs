@@ -0,0 +1,167 @@
+//! Workspace disk quota (`WORKSPACE_QUOTA`).
+//!
+//! Measuring the workspace means walking it, so the usage is cached for
+//! `USAGE_CACHE_TTL`. Writers reserve their bytes before writing them: the
+//! check and the reservation happen under one lock, so concurrent uploads
+//! cannot together overshoot the quota. Committed writes are added to the
+//! cached figure and unused reservations are released.
+
+use crate::error::AppError;
+use crate::utils::usage::{disk_usage, USAGE_CACHE_TTL};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::Instant;
+use tokio::sync::Mutex;
+
+pub struct WorkspaceQuota {
+    workspace_path: PathBuf,
+    limit: u64,
+    /// Last measured usage and when it was taken
+    usage: Mutex<Option<(Instant, u64)>>,
+    /// Bytes reserved by writes still in progress
+    reserved: AtomicU64,
+}
+
+impl WorkspaceQuota {
+    pub fn new(workspace_path: &Path, limit: u64) -> Self {
+        Self {
+            workspace_path: workspace_path.to_path_buf(),
+            limit,
+            usage: Mutex::new(None),
+            reserved: AtomicU64::new(0),
+        }
+    }
+
+    /// Reserve `bytes` for a write, or fail if the quota cannot hold them on
+    /// top of the current usage and the other reservations.
+    async fn reserve(&self, bytes: u64) -> Result<(), AppError> {
+        // Held across the scan so concurrent writers wait for one measurement,
+        // and across the check so two writers cannot claim the same space
+        let mut usage = self.usage.lock().await;
+        let used = match *usage {
+            Some((measured, used)) if measured.elapsed() < USAGE_CACHE_TTL => used,
+            _ => {
+                let path = self.workspace_path.clone();
+                let used =
+                    tokio::task::spawn_blocking(move || disk_usage(&path, 0, |_| false).bytes)
+                        .await
+                        .map_err(|e| AppError::InternalServerError(e.to_string()))?;
+                *usage = Some((Instant::now(), used));
+                used
+            }
+        };
+        let reserved = self.reserved.load(Ordering::SeqCst);
+        check_quota(
+            Some(self.limit.saturating_sub(used.saturating_add(reserved))),
+            bytes,
+        )?;
+        self.reserved.fetch_add(bytes, Ordering::SeqCst);
+        Ok(())
+    }
+
+    fn release(&self, bytes: u64) {
+        self.reserved.fetch_sub(bytes, Ordering::SeqCst);
+    }
+
+    /// Turn `written` of the `reserved` bytes into usage and release the rest.
+    async fn commit(&self, reserved: u64, written: u64) {
+        let mut usage = self.usage.lock().await;
+        if let Some((_, used)) = usage.as_mut() {
+            *used += written;
+        }
+        self.release(reserved);
+    }
+}
+
+/// Quota space held by one write. Whatever is still reserved when it is
+/// dropped without `commit`, e.g. because the write failed, is released.
+pub struct QuotaReservation {
+    quota: Option<Arc<WorkspaceQuota>>,
+    bytes: u64,
+}
+
+impl QuotaReservation {
+    pub fn new(quota: Option<Arc<WorkspaceQuota>>) -> Self {
+        Self { quota, bytes: 0 }
+    }
+
+    /// Grow the reservation to at least `total` bytes.
+    pub async fn ensure(&mut self, total: u64) -> Result<(), AppError> {
+        if total <= self.bytes {
+            return Ok(());
+        }
+        if let Some(quota) = &self.quota {
+            quota.reserve(total - self.bytes).await?;
+        }
+        self.bytes = total;
+        Ok(())
+    }
+
+    /// Count `written` bytes against the quota and release the reservation.
+    pub async fn commit(mut self, written: u64) {
+        if let Some(quota) = self.quota.take() {
+            quota.commit(self.bytes, written).await;
+        }
+    }
+}
+
+impl Drop for QuotaReservation {
+    fn drop(&mut self) {
+        if let Some(quota) = &self.quota {
+            quota.release(self.bytes);
+        }
+    }
+}
+
+/// Reject a write of `bytes` when more than `available` remain to be written.
+pub fn check_quota(available: Option<u64>, bytes: u64) -> Result<(), AppError> {
+    match available {
+        Some(available) if bytes > available => {
+            Err(AppError::Conflict("Workspace quota exceeded".to_string()))
+        }
+        _ => Ok(()),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_check_quota() {
+        assert!(check_quota(None, u64::MAX).is_ok());
+        assert!(check_quota(Some(10), 10).is_ok());
+        assert!(matches!(
+            check_quota(Some(10), 11),
+            Err(AppError::Conflict(_))
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_reservations_share_the_quota() {
+        let dir = std::env::temp_dir().join(format!("quota-test-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let quota = Arc::new(WorkspaceQuota::new(&dir, 100));
+
+        let mut first = QuotaReservation::new(Some(quota.clone()));
+        first.ensure(60).await.unwrap();
+        // A concurrent write cannot claim the space the first one holds
+        let mut second = QuotaReservation::new(Some(quota.clone()));
+        assert!(matches!(
+            second.ensure(60).await,
+            Err(AppError::Conflict(_))
+        ));
+
+        // Dropping a failed write hands its space back
+        drop(first);
+        second.ensure(60).await.unwrap();
+        second.commit(60).await;
+
+        let mut third = QuotaReservation::new(Some(quota.clone()));
+        assert!(third.ensure(60).await.is_err());
+        third.ensure(40).await.unwrap();
+
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+}
@@ -0,0 +1,135 @@
+//! Byte ranges for partial file reads (`Range` header or `offset`/`length`).
+
+/// Inclusive byte range within a file.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ByteRange {
+    pub start: u64,
+    pub end: u64,
+}
+
+impl ByteRange {
+    pub fn length(&self) -> u64 {
+        self.end - self.start + 1
+    }
+
+    /// `Content-Range` header value for a file of `size` bytes
+    pub fn content_range(&self, size: u64) -> String {
+        format!("bytes {}-{}/{}", self.start, self.end, size)
+    }
+}
+
+/// Parse a single-range `Range` header (`bytes=start-end`, `bytes=start-` or
+/// `bytes=-suffix`) against a file of `size` bytes. An end past the file is
+/// clamped; a range starting at or beyond the end is not satisfiable.
+pub fn parse_range_header(value: &str, size: u64) -> Result<ByteRange, String> {
+    let spec = value
+        .trim()
+        .strip_prefix("bytes=")
+        .ok_or_else(|| format!("Unsupported range unit in {:?} (expected bytes=)", value))?;
+    if spec.contains(',') {
+        return Err("Multiple ranges are not supported".to_string());
+    }
+    let (start, end) = spec
+        .split_once('-')
+        .ok_or_else(|| format!("Invalid range {:?}", value))?;
+    let parse = |s: &str| {
+        s.trim()
+            .parse::<u64>()
+            .map_err(|_| format!("Invalid range {:?}", value))
+    };
+
+    let (start, end) = match (start.trim().is_empty(), end.trim().is_empty()) {
+        // bytes=-N: the last N bytes
+        (true, false) => {
+            let suffix = parse(end)?;
+            if suffix == 0 {
+                return Err(format!("Range not satisfiable: {}", value));
+            }
+            (size.saturating_sub(suffix), size.saturating_sub(1))
+        }
+        (false, true) => (parse(start)?, size.saturating_sub(1)),
+        (false, false) => {
+            let (start, end) = (parse(start)?, parse(end)?);
+            if end < start {
+                return Err(format!("Invalid range {:?}: end is before start", value));
+            }
+            (start, end.min(size.saturating_sub(1)))
+        }
+        (true, true) => return Err(format!("Invalid range {:?}", value)),
+    };
+
+    if start >= size {
+        return Err(format!(
+            "Range not satisfiable: {} (file size {})",
+            value, size
+        ));
+    }
+    Ok(ByteRange { start, end })
+}
+
+/// Range for the `offset`/`length` query parameters. `length` defaults to the
+/// rest of the file and is clamped to it.
+pub fn range_from_offset(
+    offset: Option<u64>,
+    length: Option<u64>,
+    size: u64,
+) -> Result<ByteRange, String> {
+    let start = offset.unwrap_or(0);
+    if start >= size {
+        return Err(format!(
+            "Offset {} is beyond the end of the file (size {})",
+            start, size
+        ));
+    }
+    let end = match length {
+        Some(0) => return Err("Length must be greater than 0".to_string()),
+        Some(length) => start.saturating_add(length - 1).min(size - 1),
+        None => size - 1,
+    };
+    Ok(ByteRange { start, end })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn range(start: u64, end: u64) -> ByteRange {
+        ByteRange { start, end }
+    }
+
+    #[test]
+    fn test_parse_range_header() {
+        assert_eq!(parse_range_header("bytes=0-99", 1000), Ok(range(0, 99)));
+        assert_eq!(parse_range_header("bytes=900-", 1000), Ok(range(900, 999)));
+        assert_eq!(parse_range_header("bytes=-500", 1000), Ok(range(500, 999)));
+        assert_eq!(parse_range_header("bytes=-5000", 1000), Ok(range(0, 999)));
+        assert_eq!(
+            parse_range_header("bytes=990-2000", 1000),
+            Ok(range(990, 999))
+        );
+        assert_eq!(range(500, 999).length(), 500);
+        assert_eq!(range(500, 999).content_range(1000), "bytes 500-999/1000");
+    }
+
+    #[test]
+    fn test_parse_range_header_errors() {
+        assert!(parse_range_header("items=0-1", 1000).is_err());
+        assert!(parse_range_header("bytes=0-1,5-6", 1000).is_err());
+        assert!(parse_range_header("bytes=5-1", 1000).is_err());
+        assert!(parse_range_header("bytes=1000-", 1000).is_err());
+        assert!(parse_range_header("bytes=-0", 1000).is_err());
+        assert!(parse_range_header("bytes=-", 1000).is_err());
+        assert!(parse_range_header("bytes=a-b", 1000).is_err());
+        assert!(parse_range_header("bytes=-10", 0).is_err());
+    }
+
+    #[test]
+    fn test_range_from_offset() {
+        assert_eq!(range_from_offset(None, None, 10), Ok(range(0, 9)));
+        assert_eq!(range_from_offset(Some(4), None, 10), Ok(range(4, 9)));
+        assert_eq!(range_from_offset(Some(4), Some(3), 10), Ok(range(4, 6)));
+        assert_eq!(range_from_offset(Some(4), Some(100), 10), Ok(range(4, 9)));
+        assert!(range_from_offset(Some(10), None, 10).is_err());
+        assert!(range_from_offset(None, Some(0), 10).is_err());
+    }
+}
@@ -0,0 +1,92 @@
+//! Coalescing of identical concurrent operations.
+//!
+//! A `SingleFlight` keyed by e.g. a file path runs the first caller's future
+//! and hands its result to every caller that arrives while it is still in
+//! flight. Only use it for idempotent reads.
+
+use futures::future::{BoxFuture, FutureExt, Shared};
+use std::collections::HashMap;
+use std::future::Future;
+use std::sync::Mutex;
+
+pub struct SingleFlight<T: Clone> {
+    calls: Mutex<HashMap<String, Shared<BoxFuture<'static, T>>>>,
+}
+
+impl<T: Clone + Send + Sync + 'static> SingleFlight<T> {
+    pub fn new() -> Self {
+        SingleFlight {
+            calls: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Run `f` for `key`, or wait for an identical call that is already running.
+    pub async fn run<F, Fut>(&self, key: &str, f: F) -> T
+    where
+        F: FnOnce() -> Fut,
+        Fut: Future<Output = T> + Send + 'static,
+    {
+        let (call, _guard) = {
+            let mut calls = self.calls.lock().unwrap();
+            match calls.get(key) {
+                Some(call) => (call.clone(), None),
+                None => {
+                    let call = f().boxed().shared();
+                    calls.insert(key.to_string(), call.clone());
+                    let guard = FlightGuard {
+                        calls: &self.calls,
+                        key,
+                    };
+                    (call, Some(guard))
+                }
+            }
+        };
+
+        call.await
+    }
+}
+
+/// Removes the leader's entry once it finishes or is cancelled, so later
+/// callers start a fresh operation instead of reusing a stale result.
+struct FlightGuard<'a, T: Clone> {
+    calls: &'a Mutex<HashMap<String, Shared<BoxFuture<'static, T>>>>,
+    key: &'a str,
+}
+
+impl<T: Clone> Drop for FlightGuard<'_, T> {
+    fn drop(&mut self) {
+        if let Ok(mut calls) = self.calls.lock() {
+            calls.remove(self.key);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::sync::Arc;
+
+    #[tokio::test]
+    async fn test_concurrent_calls_share_result() {
+        let flight = SingleFlight::new();
+        let runs = Arc::new(AtomicUsize::new(0));
+
+        let call = || {
+            let runs = runs.clone();
+            flight.run("key", move || async move {
+                runs.fetch_add(1, Ordering::SeqCst);
+                tokio::task::yield_now().await;
+                42
+            })
+        };
+        let (a, b) = tokio::join!(call(), call());
+
+        assert_eq!((a, b), (42, 42));
+        assert_eq!(runs.load(Ordering::SeqCst), 1);
+
+        // Finished calls are forgotten
+        assert_eq!(call().await, 42);
+        assert_eq!(runs.load(Ordering::SeqCst), 2);
+    }
+}
@@ -0,0 +1,101 @@
+//! Disk usage of a directory tree, shared by the workspace quota and the
+//! `/files/usage` report.
+
+use std::cmp::Reverse;
+use std::collections::{BinaryHeap, HashSet};
+use std::os::unix::fs::MetadataExt;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+/// How long a measured workspace usage is reused
+pub const USAGE_CACHE_TTL: Duration = Duration::from_secs(5);
+
+#[derive(Default)]
+pub struct DiskUsage {
+    /// Allocated size, like `du`
+    pub bytes: u64,
+    pub files: u64,
+    pub directories: u64,
+    /// The largest files by apparent size, largest first
+    pub largest: Vec<(u64, PathBuf)>,
+}
+
+/// Walk `root` once, keeping the `top` largest files. Symlinks are not
+/// followed and hardlinked files (such as deduplicated uploads) count once
+/// towards `bytes`. Paths for which `skip` returns true are left out with
+/// everything below them, and entries that vanish or cannot be read during
+/// the walk are ignored.
+pub fn disk_usage(root: &Path, top: usize, skip: impl Fn(&Path) -> bool) -> DiskUsage {
+    let mut usage = DiskUsage::default();
+    let mut seen = HashSet::new();
+    let mut largest = BinaryHeap::new();
+    let mut stack = vec![root.to_path_buf()];
+    while let Some(dir) = stack.pop() {
+        let Ok(entries) = std::fs::read_dir(&dir) else {
+            continue;
+        };
+        for entry in entries.flatten() {
+            let path = entry.path();
+            if skip(&path) {
+                continue;
+            }
+            let Ok(metadata) = entry.metadata() else {
+                continue;
+            };
+
+            if metadata.is_dir() {
+                usage.directories += 1;
+                usage.bytes += metadata.blocks() * 512;
+                stack.push(path);
+                continue;
+            }
+            usage.files += 1;
+            if metadata.nlink() <= 1 || seen.insert((metadata.dev(), metadata.ino())) {
+                usage.bytes += metadata.blocks() * 512;
+            }
+            if top > 0 && metadata.is_file() {
+                largest.push(Reverse((metadata.len(), path)));
+                if largest.len() > top {
+                    largest.pop();
+                }
+            }
+        }
+    }
+
+    usage.largest = largest
+        .into_sorted_vec()
+        .into_iter()
+        .map(|Reverse(file)| file)
+        .collect();
+    usage
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_disk_usage() {
+        let dir = std::env::temp_dir().join(format!("usage-test-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("sub/skipped")).unwrap();
+        std::fs::write(dir.join("sub/a"), vec![1u8; 64 * 1024]).unwrap();
+        std::fs::write(dir.join("small"), b"hello").unwrap();
+        std::fs::write(dir.join("sub/skipped/c"), b"hidden").unwrap();
+        let skip = |p: &Path| p.ends_with("skipped");
+
+        let usage = disk_usage(&dir, 1, skip);
+        assert_eq!(usage.files, 2);
+        assert_eq!(usage.directories, 1);
+        assert!(usage.bytes >= 64 * 1024);
+        assert_eq!(usage.largest, vec![(64 * 1024, dir.join("sub/a"))]);
+
+        // A second link to the same data adds a file but no bytes
+        std::fs::hard_link(dir.join("sub/a"), dir.join("b")).unwrap();
+        let linked = disk_usage(&dir, 0, skip);
+        assert_eq!(linked.files, 3);
+        assert_eq!(linked.bytes, usage.bytes);
+        assert!(linked.largest.is_empty());
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}